@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/broker"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/registry"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/server"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/store"
+)
+
+// how long startup waits for redis to answer before giving up
+const redisConnectTimeout = 10 * time.Second
+
+func main() {
+	err := run()
+	if err != nil {
+		log.Println("error:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	cfg, err := server.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var b broker.Broker
+	var reg registry.Registry
+	if cfg.Broker == server.BrokerRedis || cfg.Broker == server.BrokerStreams {
+		rdb, err := broker.NewRedisClient(cfg.Redis)
+		if err != nil {
+			return fmt.Errorf("configuring redis: %w", err)
+		}
+		defer rdb.Close()
+
+		pingCtx, cancel := context.WithTimeout(ctx, redisConnectTimeout)
+		err = rdb.Ping(pingCtx).Err()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("connecting to redis: %w", err)
+		}
+		if cfg.Broker == server.BrokerStreams {
+			b = broker.NewStreamBroker(rdb, cfg.StreamGroup, int64(cfg.StreamMaxLen))
+		} else {
+			b = broker.NewRedisBroker(rdb)
+		}
+		cfg.Players = store.NewRedisPlayers(rdb, "player")
+		cfg.Leaderboard = store.NewRedisLeaderboard(rdb, "leaderboard")
+		cfg.Matches = store.NewRedisMatches(rdb, "matches", cfg.MatchHistory, cfg.MatchTTL)
+		// checkpoints need the registry to say which instance a room is on
+		if cfg.AdvertiseURL != "" {
+			reg = registry.NewRedisRegistry(rdb, "rooms", cfg.RegistryTTL)
+			cfg.Checkpoints = store.NewRedisCheckpoints(rdb, "checkpoint")
+		}
+	}
+
+	s := server.NewServer(cfg, b, reg)
+	err = s.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("running server: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/broker"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/server"
+)
+
+// setenv sets key to value until the test ends
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	setenv(t, "TICK", "never")
+	if err := run(); !errors.Is(err, server.ErrInvalidConfig) {
+		t.Fatalf("got %v, want ErrInvalidConfig", err)
+	}
+}
+
+func TestRunBadRedisURL(t *testing.T) {
+	setenv(t, "REDIS_URL", "http://redis.example")
+	if err := run(); !errors.Is(err, broker.ErrRedisConfig) {
+		t.Fatalf("got %v, want ErrRedisConfig", err)
+	}
+}
+
+func TestRunRedisDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	setenv(t, "REDIS_URL", "redis://"+addr)
+	err = run()
+	var oe *net.OpError
+	if !errors.As(err, &oe) {
+		t.Fatalf("got %v, want a network error", err)
+	}
+}
+
+func TestRunPortTaken(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	setenv(t, "LISTEN_ADDR", ln.Addr().String())
+	err = run()
+	var oe *net.OpError
+	if !errors.As(err, &oe) || oe.Op != "listen" {
+		t.Fatalf("got %v, want a listen error", err)
+	}
+}
@@ -3,8 +3,10 @@ module github.com/stevenwhitehead/multiplayer-backend
 go 1.16
 
 require (
-	github.com/go-redis/redis v6.15.9+incompatible // indirect
-	github.com/go-redis/redis/v8 v8.11.3 // indirect
+	github.com/alicebob/miniredis/v2 v2.30.5
+	github.com/go-redis/redis/v8 v8.11.3
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/websocket v1.4.2
+	github.com/vmihailenco/msgpack/v5 v5.3.4
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,22 @@
+package broker
+
+import (
+	"context"
+)
+
+// Broker fans input payloads out to every server instance subscribed to a
+// channel. A subscription's channel is closed when the subscription ends,
+// either because ctx was canceled or the underlying connection failed.
+type Broker interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	Subscribe(ctx context.Context, channel string) (<-chan []byte, error)
+	Close() error
+}
+
+// Dropper is a Broker that keeps something of a channel beyond its
+// subscriptions, such as a stream's consumer group, so that an instance
+// restarting picks up where it left off. Drop lets go of it once the channel
+// is no longer wanted, unless it has been subscribed to again meanwhile.
+type Dropper interface {
+	Drop(ctx context.Context, channel string) error
+}
@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ClusterOptions builds client options for the cluster that the nodes at
+// cfg.ClusterAddrs belong to. Like with sentinels, the url, when there is
+// one, only gives credentials and TLS settings; a cluster has no dbs.
+func ClusterOptions(cfg RedisConfig) (*redis.ClusterOptions, error) {
+	if len(cfg.ClusterAddrs) == 0 {
+		return nil, fmt.Errorf("%w: no cluster addresses are set", ErrRedisConfig)
+	}
+	if cfg.Connection != "" {
+		return nil, fmt.Errorf("%w: cluster addresses can't be combined with a redis connection document", ErrRedisConfig)
+	}
+	if cfg.SentinelMaster != "" {
+		return nil, fmt.Errorf("%w: cluster addresses can't be combined with sentinels", ErrRedisConfig)
+	}
+	opts := &redis.ClusterOptions{Addrs: cfg.ClusterAddrs}
+	if cfg.URL != "" {
+		u, err := redis.ParseURL(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%w: parsing redis url: %s", ErrRedisConfig, err)
+		}
+		if u.DB != 0 {
+			return nil, fmt.Errorf("%w: a cluster only has db 0, the url asks for %d", ErrRedisConfig, u.DB)
+		}
+		opts.Username = u.Username
+		opts.Password = u.Password
+		opts.TLSConfig = u.TLSConfig
+	}
+	return opts, nil
+}
+
+// RoomKey is the key or channel named prefix for room. The room goes in a
+// hash tag, so on a cluster everything kept about one room lands in the
+// same slot.
+func RoomKey(prefix, room string) string {
+	return prefix + ":{" + room + "}"
+}
@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// messages buffered per local subscriber before publishes start failing
+const localBufferSize = 256
+
+var errBrokerClosed = errors.New("broker closed")
+var errSubscriberFull = errors.New("subscriber buffer full")
+
+// LocalBroker is an in-process Broker for running without redis
+type LocalBroker struct {
+	mu     sync.Mutex
+	closed bool
+	subs   map[string]map[chan []byte]struct{}
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{
+		subs: map[string]map[chan []byte]struct{}{},
+	}
+}
+
+func (b *LocalBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errBrokerClosed
+	}
+	var err error
+	for sub := range b.subs[channel] {
+		select {
+		case sub <- payload:
+		default:
+			err = errSubscriberFull
+		}
+	}
+	return err
+}
+
+func (b *LocalBroker) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, errBrokerClosed
+	}
+	sub := make(chan []byte, localBufferSize)
+	if b.subs[channel] == nil {
+		b.subs[channel] = map[chan []byte]struct{}{}
+	}
+	b.subs[channel][sub] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		b.unsubscribe(channel, sub)
+	}()
+	return sub, nil
+}
+
+func (b *LocalBroker) unsubscribe(channel string, sub chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[channel][sub]; !ok {
+		return
+	}
+	delete(b.subs[channel], sub)
+	if len(b.subs[channel]) == 0 {
+		delete(b.subs, channel)
+	}
+	close(sub)
+}
+
+func (b *LocalBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for channel, subs := range b.subs {
+		for sub := range subs {
+			close(sub)
+		}
+		delete(b.subs, channel)
+	}
+	return nil
+}
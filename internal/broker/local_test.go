@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, sub <-chan []byte) string {
+	t.Helper()
+	select {
+	case payload := <-sub:
+		return string(payload)
+	case <-time.After(time.Second):
+		t.Fatal("nothing received")
+	}
+	return ""
+}
+
+func TestLocalBrokerFanOut(t *testing.T) {
+	b := NewLocalBroker()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first, err := b.Subscribe(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Subscribe(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := b.Subscribe(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(ctx, "a", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []<-chan []byte{first, second} {
+		if got := receive(t, sub); got != "hello" {
+			t.Fatalf("received %q", got)
+		}
+	}
+	select {
+	case payload := <-other:
+		t.Fatalf("%q received on another channel", payload)
+	default:
+	}
+}
+
+func TestLocalBrokerUnsubscribes(t *testing.T) {
+	b := NewLocalBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := b.Subscribe(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, ok := <-sub; ok {
+		t.Fatal("subscription still open after cancel")
+	}
+
+	sub, err = b.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if _, ok := <-sub; ok {
+		t.Fatal("subscription still open after close")
+	}
+	if err := b.Publish(context.Background(), "a", nil); err == nil {
+		t.Fatal("published on a closed broker")
+	}
+	if _, err := b.Subscribe(context.Background(), "a"); err == nil {
+		t.Fatal("subscribed on a closed broker")
+	}
+}
+
+func TestLocalBrokerFullSubscriber(t *testing.T) {
+	b := NewLocalBroker()
+	defer b.Close()
+	if _, err := b.Subscribe(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < localBufferSize; i++ {
+		if err := b.Publish(context.Background(), "a", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Publish(context.Background(), "a", nil); err != errSubscriberFull {
+		t.Fatalf("got %v, want errSubscriberFull", err)
+	}
+}
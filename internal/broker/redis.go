@@ -0,0 +1,239 @@
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrRedisConfig is wrapped by every error from RedisOptions
+var ErrRedisConfig = errors.New("bad redis config")
+
+type RedisConnection struct {
+	Rediss RedissStruct `json:"rediss"`
+}
+
+type RedissStruct struct {
+	Composed []string    `json:"composed"`
+	Cert     Certificate `json:"certificate"`
+}
+
+type Certificate struct {
+	CertificateBase64 string `json:"certificate_base64"`
+}
+
+// RedisConfig says how to reach redis
+type RedisConfig struct {
+	// JSON connection document in the DATABASES_FOR_REDIS_CONNECTION format
+	Connection string
+	// plain redis:// or rediss:// url, used when Connection is empty
+	URL string
+	// with a master name, redis is found by asking the sentinels at
+	// SentinelAddrs, and followed to wherever they fail it over to
+	SentinelMaster   string
+	SentinelAddrs    []string
+	SentinelPassword string
+	// with addresses, redis is a cluster and these are the nodes first asked
+	// about the rest of it
+	ClusterAddrs []string
+}
+
+// RedisOptions builds client options from the connection document, or from
+// the plain url when there is none.
+func RedisOptions(cfg RedisConfig) (*redis.Options, error) {
+	if cfg.Connection == "" {
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("%w: neither a redis connection nor a url is set", ErrRedisConfig)
+		}
+		opts, err := redis.ParseURL(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%w: parsing redis url: %s", ErrRedisConfig, err)
+		}
+		return opts, nil
+	}
+
+	var redisCon RedisConnection
+	err := json.Unmarshal([]byte(cfg.Connection), &redisCon)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing redis connection: %s", ErrRedisConfig, err)
+	}
+
+	composed := redisCon.Rediss.Composed
+	if len(composed) == 0 {
+		return nil, fmt.Errorf("%w: redis connection has no composed urls", ErrRedisConfig)
+	}
+
+	var certPool *x509.CertPool
+	if certBase64 := redisCon.Rediss.Cert.CertificateBase64; certBase64 != "" {
+		cert, err := base64.StdEncoding.DecodeString(certBase64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: decoding certificate: %s", ErrRedisConfig, err)
+		}
+		certPool = x509.NewCertPool()
+		certPool.AppendCertsFromPEM(cert)
+	}
+
+	endpoints := make([]*redis.Options, len(composed))
+	for i, url := range composed {
+		opts, err := redis.ParseURL(url)
+		if err != nil {
+			return nil, fmt.Errorf("%w: parsing endpoint %d: %s", ErrRedisConfig, i, err)
+		}
+		// only rediss:// urls get a TLS config, and the certificate is optional
+		if opts.TLSConfig != nil && certPool != nil {
+			opts.TLSConfig.RootCAs = certPool
+		}
+		endpoints[i] = opts
+	}
+
+	// credentials and db come from the first endpoint, the dialer picks
+	// whichever address is reachable
+	opts := endpoints[0]
+	d := &endpointDialer{endpoints: endpoints, current: -1}
+	opts.Dialer = d.dial
+	return opts, nil
+}
+
+// endpointDialer dials the composed endpoints in order, sticking with the last
+// one that worked and falling over to the next when it stops answering.
+type endpointDialer struct {
+	mu        sync.Mutex
+	endpoints []*redis.Options
+	current   int
+}
+
+func (d *endpointDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	start := d.current
+	d.mu.Unlock()
+	if start < 0 {
+		start = 0
+	}
+
+	var lastErr error
+	for i := 0; i < len(d.endpoints); i++ {
+		idx := (start + i) % len(d.endpoints)
+		opts := d.endpoints[idx]
+		conn, err := dialEndpoint(ctx, opts)
+		if err != nil {
+			log.Printf("redis endpoint %s unreachable: %s", opts.Addr, err)
+			lastErr = err
+			continue
+		}
+		d.mu.Lock()
+		if d.current != idx {
+			log.Println("using redis endpoint:", opts.Addr)
+			d.current = idx
+		}
+		d.mu.Unlock()
+		return conn, nil
+	}
+	return nil, fmt.Errorf("all redis endpoints unreachable: %w", lastErr)
+}
+
+func dialEndpoint(ctx context.Context, opts *redis.Options) (net.Conn, error) {
+	netDialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 5 * time.Minute,
+	}
+	if netDialer.Timeout == 0 {
+		netDialer.Timeout = 5 * time.Second
+	}
+	conn, err := netDialer.DialContext(ctx, opts.Network, opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.TLSConfig == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, opts.TLSConfig)
+	tlsConn.SetDeadline(time.Now().Add(netDialer.Timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// RedisClient is the part of the go-redis client RedisBroker uses. Any
+// redis.UniversalClient satisfies it, so a cluster client, a client pointed at
+// miniredis or a hand-rolled fake all work.
+type RedisClient interface {
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	Close() error
+}
+
+// RedisBroker is a Broker backed by redis pub/sub
+type RedisBroker struct {
+	rdb RedisClient
+}
+
+func NewRedisBroker(rdb RedisClient) *RedisBroker {
+	return &RedisBroker{rdb: rdb}
+}
+
+// Publish retries for a while when redis is failing over, rather than drop
+// the input
+func (b *RedisBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	return withFailover(ctx, func() error {
+		return b.rdb.Publish(ctx, channel, payload).Err()
+	})
+}
+
+func (b *RedisBroker) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	pubsub := b.rdb.Subscribe(ctx, channel)
+	// wait for the subscription to be confirmed so errors surface here
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	out := make(chan []byte)
+	done := make(chan struct{})
+	// ReceiveMessage doesn't return when ctx is canceled, closing the
+	// subscription (which also unsubscribes) is what unblocks it
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		pubsub.Close()
+	}()
+	go func() {
+		defer close(out)
+		defer close(done)
+		for {
+			msg, err := pubsub.ReceiveMessage(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("pubsub error:", err)
+				}
+				return
+			}
+			select {
+			case out <- []byte(msg.Payload):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Close closes the underlying redis client
+func (b *RedisBroker) Close() error {
+	return b.rdb.Close()
+}
@@ -0,0 +1,243 @@
+package broker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// connection is a DATABASES_FOR_REDIS_CONNECTION document for urls with
+// certificate cert, base64 encoded, if not empty
+func connection(t *testing.T, cert string, urls ...string) string {
+	t.Helper()
+	var c RedisConnection
+	c.Rediss.Composed = urls
+	c.Rediss.Cert.CertificateBase64 = cert
+	doc, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(doc)
+}
+
+// testCert is a self-signed certificate, PEM and base64 encoded
+func testCert(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func ping(t *testing.T, opts *redis.Options) error {
+	t.Helper()
+	rdb := redis.NewClient(opts)
+	defer rdb.Close()
+	return rdb.Ping(context.Background()).Err()
+}
+
+func TestRedisOptionsPlainURL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	opts, err := RedisOptions(RedisConfig{URL: "redis://" + mr.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig != nil {
+		t.Fatal("TLS config for a redis:// url")
+	}
+	if err := ping(t, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same goes for a connection document
+	opts, err = RedisOptions(RedisConfig{Connection: connection(t, "", "redis://"+mr.Addr())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig != nil {
+		t.Fatal("TLS config for a redis:// url")
+	}
+	if err := ping(t, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisOptionsTLS(t *testing.T) {
+	opts, err := RedisOptions(RedisConfig{Connection: connection(t, "", "rediss://user:pw@redis.example:6380/0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.RootCAs != nil {
+		t.Fatalf("TLS config %+v, want one with the system roots", opts.TLSConfig)
+	}
+
+	opts, err = RedisOptions(RedisConfig{Connection: connection(t, testCert(t), "rediss://user:pw@redis.example:6380/0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.RootCAs == nil {
+		t.Fatalf("TLS config %+v, want one trusting the certificate", opts.TLSConfig)
+	}
+}
+
+func TestRedisOptionsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  RedisConfig
+	}{
+		{"nothing", RedisConfig{}},
+		{"bad url", RedisConfig{URL: "http://redis.example"}},
+		{"bad document", RedisConfig{Connection: "{"}},
+		{"bad certificate", RedisConfig{Connection: connection(t, "not base64!", "rediss://redis.example:6380")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := RedisOptions(tt.cfg)
+			if !errors.Is(err, ErrRedisConfig) {
+				t.Fatalf("got %v, want ErrRedisConfig", err)
+			}
+		})
+	}
+}
+
+// unreachable is an address nothing listens on
+func unreachable(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestRedisEndpoints(t *testing.T) {
+	mr := miniredis.RunT(t)
+	tests := []struct {
+		name string
+		urls []string
+		ok   bool
+	}{
+		{"none", nil, false},
+		{"one", []string{"redis://" + mr.Addr()}, true},
+		{"first of several", []string{"redis://" + mr.Addr(), "redis://" + unreachable(t)}, true},
+		{"second of several", []string{"redis://" + unreachable(t), "redis://" + mr.Addr()}, true},
+		{"all unreachable", []string{"redis://" + unreachable(t), "redis://" + unreachable(t)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := RedisOptions(RedisConfig{Connection: connection(t, "", tt.urls...)})
+			if len(tt.urls) == 0 {
+				if !errors.Is(err, ErrRedisConfig) {
+					t.Fatalf("got %v, want ErrRedisConfig", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.MaxRetries = -1
+			if err := ping(t, opts); (err == nil) != tt.ok {
+				t.Fatalf("ping: %v", err)
+			}
+		})
+	}
+}
+
+func TestRedisEndpointFailover(t *testing.T) {
+	first := miniredis.RunT(t)
+	second := miniredis.RunT(t)
+	second.Set("on", "second")
+	opts, err := RedisOptions(RedisConfig{Connection: connection(t, "", "redis://"+first.Addr(), "redis://"+second.Addr())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb := redis.NewClient(opts)
+	defer rdb.Close()
+	ctx := context.Background()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	first.Close()
+	// the pooled connection to the first one is dead, a new one goes to
+	// the second
+	var on string
+	for i := 0; i < 3 && on == ""; i++ {
+		on, _ = rdb.Get(ctx, "on").Result()
+	}
+	if on != "second" {
+		t.Fatalf("got %q, want the second endpoint", on)
+	}
+}
+
+func TestRedisBrokerRoundTrip(t *testing.T) {
+	mr := miniredis.RunT(t)
+	b := NewRedisBroker(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := b.Subscribe(ctx, "inputs:{a}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"one", "two"} {
+		if err := b.Publish(context.Background(), "inputs:{a}", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// nothing crosses over from another room
+	if err := b.Publish(context.Background(), "inputs:{b}", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"one", "two"} {
+		if got := receive(t, sub); got != want {
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	}
+	cancel()
+	for payload := range sub {
+		t.Fatalf("%q received after canceling", payload)
+	}
+}
+
+func TestRedisBrokerSubscriptionLost(t *testing.T) {
+	mr := miniredis.RunT(t)
+	b := NewRedisBroker(redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1}))
+	defer b.Close()
+	sub, err := b.Subscribe(context.Background(), "inputs:{a}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.Close()
+	select {
+	case _, ok := <-sub:
+		if ok {
+			t.Fatal("received from a closed server")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription still open with redis gone")
+	}
+	if _, err := b.Subscribe(context.Background(), "inputs:{a}"); err == nil {
+		t.Fatal("subscribed with redis gone")
+	}
+}
@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// how long a publish keeps retrying while redis fails over, and how long
+	// it waits between its first tries
+	publishRetryWindow  = 5 * time.Second
+	minPublishRetryWait = 50 * time.Millisecond
+	maxPublishRetryWait = time.Second
+)
+
+// FailoverOptions builds client options for reaching the master named
+// cfg.SentinelMaster through the sentinels at cfg.SentinelAddrs. The url,
+// when there is one, gives the master's credentials, db and TLS settings;
+// its host is ignored.
+func FailoverOptions(cfg RedisConfig) (*redis.FailoverOptions, error) {
+	if cfg.SentinelMaster == "" {
+		return nil, fmt.Errorf("%w: no sentinel master name is set", ErrRedisConfig)
+	}
+	if len(cfg.SentinelAddrs) == 0 {
+		return nil, fmt.Errorf("%w: sentinel master %q has no sentinel addresses", ErrRedisConfig, cfg.SentinelMaster)
+	}
+	if cfg.Connection != "" {
+		return nil, fmt.Errorf("%w: sentinels can't be combined with a redis connection document", ErrRedisConfig)
+	}
+	if len(cfg.ClusterAddrs) > 0 {
+		return nil, fmt.Errorf("%w: sentinels can't be combined with cluster addresses", ErrRedisConfig)
+	}
+	opts := &redis.FailoverOptions{
+		MasterName:       cfg.SentinelMaster,
+		SentinelAddrs:    cfg.SentinelAddrs,
+		SentinelPassword: cfg.SentinelPassword,
+	}
+	if cfg.URL != "" {
+		u, err := redis.ParseURL(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%w: parsing redis url: %s", ErrRedisConfig, err)
+		}
+		opts.Username = u.Username
+		opts.Password = u.Password
+		opts.DB = u.DB
+		opts.TLSConfig = u.TLSConfig
+	}
+	return opts, nil
+}
+
+// NewRedisClient connects through the sentinels when a master name is
+// configured, to a cluster when there are cluster addresses and straight to
+// redis otherwise. Either way RedisBroker, StreamBroker and the stores can
+// use what it returns.
+func NewRedisClient(cfg RedisConfig) (redis.UniversalClient, error) {
+	if len(cfg.ClusterAddrs) > 0 {
+		opts, err := ClusterOptions(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClusterClient(opts), nil
+	}
+	if cfg.SentinelMaster != "" {
+		opts, err := FailoverOptions(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(opts), nil
+	}
+	opts, err := RedisOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(opts), nil
+}
+
+// failingOver reports whether err looks like redis going away or turning
+// into a replica for a while, rather than something trying again won't fix
+func failingOver(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, redis.ErrClosed) {
+		return false
+	}
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return true
+	}
+	msg := err.Error()
+	for _, prefix := range []string{"READONLY ", "MASTERDOWN ", "LOADING ", "TRYAGAIN "} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// withFailover runs publish until it succeeds, fails for another reason
+// than a failover, or publishRetryWindow or ctx runs out. A try that only
+// looked failed may have gone through, so a payload can arrive twice; the
+// seqs on inputs make that harmless.
+func withFailover(ctx context.Context, publish func() error) error {
+	deadline := time.Now().Add(publishRetryWindow)
+	wait := minPublishRetryWait
+	for {
+		err := publish()
+		if err == nil || !failingOver(err) || time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		wait *= 2
+		if wait > maxPublishRetryWait {
+			wait = maxPublishRetryWait
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// how long a stream read blocks waiting for entries, which is also how long a
+// canceled subscription can take to notice
+const streamBlock = time.Second
+
+// entries read from a stream at once
+const streamCount = 64
+
+// the field of a stream entry that holds the payload
+const streamField = "p"
+
+// StreamClient is the part of the go-redis client StreamBroker uses
+type StreamClient interface {
+	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd
+	XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd
+	XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd
+	XGroupDestroy(ctx context.Context, stream, group string) *redis.IntCmd
+	Close() error
+}
+
+// StreamBroker is a Broker backed by redis streams. Each channel is a stream
+// capped at about maxLen entries and every instance reads it with a consumer
+// group of its own, acking what it has handed on. Entries it was given but
+// never acked, because it went away or the connection dropped, are delivered
+// again the next time it subscribes, so the group has to stay the same across
+// restarts for them to be picked up. The group outlives its subscriptions,
+// so nothing published while an instance restarts is missed either; Drop
+// destroys it once the channel is done with.
+type StreamBroker struct {
+	rdb    StreamClient
+	group  string
+	maxLen int64
+
+	mu sync.Mutex
+	// live subscriptions by channel
+	subs map[string]int
+}
+
+func NewStreamBroker(rdb StreamClient, group string, maxLen int64) *StreamBroker {
+	return &StreamBroker{rdb: rdb, group: group, maxLen: maxLen, subs: map[string]int{}}
+}
+
+// Publish retries for a while when redis is failing over, like
+// RedisBroker.Publish
+func (b *StreamBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	return withFailover(ctx, func() error {
+		return b.rdb.XAdd(ctx, &redis.XAddArgs{
+			Stream: channel,
+			MaxLen: b.maxLen,
+			Approx: true,
+			Values: map[string]interface{}{streamField: payload},
+		}).Err()
+	})
+}
+
+func (b *StreamBroker) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	// held so the group can't be dropped between creating it and counting
+	// this subscription
+	b.mu.Lock()
+	// a new group starts at the end of the stream, an existing one wherever
+	// it left off
+	err := b.rdb.XGroupCreateMkStream(ctx, channel, b.group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		b.mu.Unlock()
+		return nil, err
+	}
+	b.subs[channel]++
+	b.mu.Unlock()
+
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		defer b.unsubscribe(channel)
+		// catch up on our own pending entries first, then read new ones
+		last := "0"
+		for ctx.Err() == nil {
+			args := &redis.XReadGroupArgs{
+				Group:    b.group,
+				Consumer: b.group,
+				Streams:  []string{channel, last},
+				Count:    streamCount,
+				Block:    streamBlock,
+			}
+			if last != ">" {
+				args.Block = -1
+			}
+			streams, err := b.rdb.XReadGroup(ctx, args).Result()
+			if errors.Is(err, redis.Nil) {
+				// nothing pending is left, or nothing new came in
+				last = ">"
+				continue
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("stream error:", err)
+				}
+				return
+			}
+			msgs := streams[0].Messages
+			if last != ">" {
+				if len(msgs) == 0 {
+					last = ">"
+					continue
+				}
+				last = msgs[len(msgs)-1].ID
+			}
+			for _, msg := range msgs {
+				// entries trimmed away while pending come back without values
+				if payload, ok := msg.Values[streamField].(string); ok {
+					select {
+					case out <- []byte(payload):
+					case <-ctx.Done():
+						return
+					}
+				}
+				// the entry was handed on, so it's acked even if ctx was
+				// canceled meanwhile. An ack that fails leaves it pending and
+				// it's delivered again on the next subscribe
+				err := b.rdb.XAck(context.Background(), channel, b.group, msg.ID).Err()
+				if err != nil {
+					log.Println("stream ack error:", err)
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// unsubscribe forgets a subscription to channel that ended. The group is
+// left for the next subscribe, or for Drop.
+func (b *StreamBroker) unsubscribe(channel string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[channel]--
+	if b.subs[channel] <= 0 {
+		delete(b.subs, channel)
+	}
+}
+
+// Drop destroys this instance's group on channel, pending entries and all,
+// unless it is subscribed to again
+func (b *StreamBroker) Drop(ctx context.Context, channel string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[channel] > 0 {
+		return nil
+	}
+	return b.rdb.XGroupDestroy(ctx, channel, b.group).Err()
+}
+
+// Close closes the underlying redis client
+func (b *StreamBroker) Close() error {
+	return b.rdb.Close()
+}
@@ -0,0 +1,247 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// streamBroker is a StreamBroker for group on mr, closed with the test
+func streamBroker(t *testing.T, mr *miniredis.Miniredis, group string, maxLen int64) *StreamBroker {
+	b := NewStreamBroker(redis.NewClient(&redis.Options{Addr: mr.Addr()}), group, maxLen)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// pending is how many entries of stream group was given and hasn't acked
+func pending(t *testing.T, rdb *redis.Client, stream, group string) int64 {
+	t.Helper()
+	p, err := rdb.XPending(context.Background(), stream, group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Count
+}
+
+func TestStreamBrokerRoundTrip(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, b := streamBroker(t, mr, "a", 100), streamBroker(t, mr, "b", 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	subA, err := a.Subscribe(ctx, "inputs:{a}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subB, err := b.Subscribe(ctx, "inputs:{a}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"one", "two"} {
+		if err := a.Publish(context.Background(), "inputs:{a}", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Publish(context.Background(), "inputs:{b}", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	// every instance gets everything on the channel, in order, and nothing
+	// from another
+	for _, sub := range []<-chan []byte{subA, subB} {
+		for _, want := range []string{"one", "two"} {
+			if got := receive(t, sub); got != want {
+				t.Fatalf("received %q, want %q", got, want)
+			}
+		}
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	eventually(t, func() bool { return pending(t, rdb, "inputs:{a}", "a") == 0 })
+
+	cancel()
+	for _, sub := range []<-chan []byte{subA, subB} {
+		select {
+		case payload, ok := <-sub:
+			if ok {
+				t.Fatalf("%q received after canceling", payload)
+			}
+		case <-time.After(2 * streamBlock):
+			t.Fatal("still subscribed after canceling")
+		}
+	}
+}
+
+func TestStreamBrokerRecoversPending(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	ctx := context.Background()
+	b := streamBroker(t, mr, "a", 100)
+	// an instance of group a read three entries and went away before
+	// acking them
+	if err := rdb.XGroupCreateMkStream(ctx, "inputs:{a}", "a", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"one", "two", "three"} {
+		if err := b.Publish(ctx, "inputs:{a}", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "a", Consumer: "a", Streams: []string{"inputs:{a}", ">"}, Block: -1}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(t, rdb, "inputs:{a}", "a"); n != 3 {
+		t.Fatalf("%d pending, want 3", n)
+	}
+	if err := b.Publish(ctx, "inputs:{a}", []byte("four")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next one to subscribe gets them first, then what is new
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub, err := b.Subscribe(subCtx, "inputs:{a}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"one", "two", "three", "four"} {
+		if got := receive(t, sub); got != want {
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	}
+	eventually(t, func() bool { return pending(t, rdb, "inputs:{a}", "a") == 0 })
+}
+
+func TestStreamBrokerMaxLen(t *testing.T) {
+	mr := miniredis.RunT(t)
+	b := streamBroker(t, mr, "a", 10)
+	for i := 0; i < 50; i++ {
+		if err := b.Publish(context.Background(), "inputs:{a}", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	// trimmed approximately, so maybe not to exactly 10
+	if n, err := rdb.XLen(context.Background(), "inputs:{a}").Result(); err != nil || n >= 50 {
+		t.Fatalf("%d entries kept, %v", n, err)
+	}
+}
+
+// eventually waits for done to return true
+func eventually(t *testing.T, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("gave up waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// groups is the consumer groups reading stream. The reply is read by hand, as
+// go-redis expects fewer fields per group than newer redis versions send.
+func groups(t *testing.T, rdb *redis.Client, stream string) []string {
+	t.Helper()
+	reply, err := rdb.Do(context.Background(), "XINFO", "GROUPS", stream).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	all, _ := reply.([]interface{})
+	for _, group := range all {
+		fields, _ := group.([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i] == "name" {
+				names = append(names, fmt.Sprint(fields[i+1]))
+			}
+		}
+	}
+	return names
+}
+
+func TestStreamBrokerDrop(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	a, b := streamBroker(t, mr, "a", 100), streamBroker(t, mr, "b", 100)
+	ctx := context.Background()
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub, err := a.Subscribe(subCtx, "inputs:{a}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe(subCtx, "inputs:{a}"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the group stays while it is subscribed to
+	if err := a.Drop(ctx, "inputs:{a}"); err != nil {
+		t.Fatal(err)
+	}
+	if got := groups(t, rdb, "inputs:{a}"); len(got) != 2 {
+		t.Fatalf("groups %v after dropping a subscribed channel", got)
+	}
+
+	// and outlives the subscription
+	cancel()
+	for range sub {
+	}
+	if got := groups(t, rdb, "inputs:{a}"); len(got) != 2 {
+		t.Fatalf("groups %v once a's subscription ended", got)
+	}
+
+	// until it is dropped, leaving b's
+	if err := a.Drop(ctx, "inputs:{a}"); err != nil {
+		t.Fatal(err)
+	}
+	if got := groups(t, rdb, "inputs:{a}"); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("groups %v after dropping a's, want only b's", got)
+	}
+}
+
+func TestStreamBrokerRestart(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	before := streamBroker(t, mr, "a", 100)
+	subCtx, shutdown := context.WithCancel(ctx)
+	sub, err := before.Subscribe(subCtx, "inputs:{a}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Publish(ctx, "inputs:{a}", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, sub); got != "one" {
+		t.Fatalf("received %q, want one", got)
+	}
+	shutdown()
+	for range sub {
+	}
+
+	// others keep publishing while the instance is down
+	other := streamBroker(t, mr, "b", 100)
+	for _, payload := range []string{"two", "three"} {
+		if err := other.Publish(ctx, "inputs:{a}", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after := streamBroker(t, mr, "a", 100)
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub, err = after.Subscribe(subCtx, "inputs:{a}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"two", "three"} {
+		if got := receive(t, sub); got != want {
+			t.Fatalf("received %q after restarting, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Package clock abstracts time so the game loop can be driven by hand in
+// tests.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real returns a Clock backed by the time package
+func Real() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
+
+// Manual is a Clock that only moves when told to
+type Manual struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+func NewManual(now time.Time) *Manual {
+	return &Manual{now: now}
+}
+
+func (m *Manual) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+func (m *Manual) NewTicker(d time.Duration) Ticker {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := &manualTicker{
+		c:      make(chan time.Time),
+		period: d,
+		next:   m.now.Add(d),
+		stop:   make(chan struct{}),
+	}
+	m.tickers = append(m.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every ticker whose period
+// elapsed along the way. Each tick is delivered before Advance returns, so
+// the receiver has picked it up by then.
+func (m *Manual) Advance(d time.Duration) {
+	m.mu.Lock()
+	end := m.now.Add(d)
+	m.mu.Unlock()
+
+	for {
+		m.mu.Lock()
+		var next *manualTicker
+		for _, t := range m.tickers {
+			if !t.stopped() && !t.next.After(end) && (next == nil || t.next.Before(next.next)) {
+				next = t
+			}
+		}
+		if next == nil {
+			m.now = end
+			m.mu.Unlock()
+			return
+		}
+		m.now = next.next
+		next.next = next.next.Add(next.period)
+		now := m.now
+		m.mu.Unlock()
+
+		select {
+		case next.c <- now:
+		case <-next.stop:
+		}
+	}
+}
+
+type manualTicker struct {
+	c        chan time.Time
+	period   time.Duration
+	next     time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTicker) Stop() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+func (t *manualTicker) stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
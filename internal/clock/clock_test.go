@@ -0,0 +1,97 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Unix(1600000000, 0)
+
+// collect receives from t until stop is closed and returns what it got
+func collect(t Ticker, stop chan struct{}) chan []time.Time {
+	got := make(chan []time.Time, 1)
+	go func() {
+		var ticks []time.Time
+		for {
+			select {
+			case now := <-t.C():
+				ticks = append(ticks, now)
+			case <-stop:
+				got <- ticks
+				return
+			}
+		}
+	}()
+	return got
+}
+
+func TestManualTicks(t *testing.T) {
+	m := NewManual(epoch)
+	ticker := m.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	stop := make(chan struct{})
+	got := collect(ticker, stop)
+
+	m.Advance(5 * time.Millisecond)
+	m.Advance(5 * time.Millisecond)
+	m.Advance(25 * time.Millisecond)
+	close(stop)
+	ticks := <-got
+	want := []time.Time{epoch.Add(10 * time.Millisecond), epoch.Add(20 * time.Millisecond), epoch.Add(30 * time.Millisecond)}
+	if len(ticks) != len(want) {
+		t.Fatalf("got %d ticks, want %d", len(ticks), len(want))
+	}
+	for i := range want {
+		if !ticks[i].Equal(want[i]) {
+			t.Fatalf("tick %d at %s, want %s", i, ticks[i], want[i])
+		}
+	}
+	if now := m.Now(); !now.Equal(epoch.Add(35 * time.Millisecond)) {
+		t.Fatalf("now %s", now)
+	}
+}
+
+func TestManualTickersInOrder(t *testing.T) {
+	m := NewManual(epoch)
+	fast := m.NewTicker(10 * time.Millisecond)
+	slow := m.NewTicker(25 * time.Millisecond)
+	order := make(chan string, 16)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-fast.C():
+				order <- "fast"
+			case <-slow.C():
+				order <- "slow"
+			case <-stop:
+				close(order)
+				return
+			}
+		}
+	}()
+	m.Advance(50 * time.Millisecond)
+	close(stop)
+	var got []string
+	for s := range order {
+		got = append(got, s)
+	}
+	want := []string{"fast", "fast", "slow", "fast", "fast", "fast", "slow"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestManualStoppedTicker(t *testing.T) {
+	m := NewManual(epoch)
+	ticker := m.NewTicker(10 * time.Millisecond)
+	ticker.Stop()
+	ticker.Stop()
+	// nobody receives from a stopped ticker, so this would block otherwise
+	m.Advance(time.Second)
+}
@@ -0,0 +1,111 @@
+// Package registry tracks which server instance hosts each room, so players
+// asking for the same room all end up on the same instance.
+package registry
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrNotOwner is returned when refreshing or releasing a room another
+// instance has claimed
+var ErrNotOwner = errors.New("room is claimed by another instance")
+
+// Registry maps room names to the address of the instance hosting them.
+// Claims expire unless refreshed, so rooms of a dead instance free up.
+type Registry interface {
+	// Claim takes room for addr unless another instance holds it, and
+	// returns the owner either way
+	Claim(ctx context.Context, room, addr string) (string, error)
+	// Refresh extends addr's claim on room
+	Refresh(ctx context.Context, room, addr string) error
+	// Release gives up addr's claim on room
+	Release(ctx context.Context, room, addr string) error
+}
+
+// extends the key only if addr still owns it
+var refreshScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// deletes the key only if addr still owns it
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisRegistry keeps one key per room under a prefix. A hash would need a
+// ttl per field, which redis doesn't have, so every claim is its own key.
+type RedisRegistry struct {
+	rdb    redis.Cmdable
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedisRegistry stores claims as prefix:{<room>}, each lasting ttl unless
+// refreshed
+func NewRedisRegistry(rdb redis.Cmdable, prefix string, ttl time.Duration) *RedisRegistry {
+	return &RedisRegistry{rdb: rdb, prefix: prefix, ttl: ttl}
+}
+
+// the room is hash tagged like the broker's room channels, to share their
+// slot on a cluster
+func (reg *RedisRegistry) key(room string) string {
+	return reg.prefix + ":{" + room + "}"
+}
+
+func (reg *RedisRegistry) Claim(ctx context.Context, room, addr string) (string, error) {
+	key := reg.key(room)
+	// the claim may expire between SETNX and GET, so try twice
+	for i := 0; i < 2; i++ {
+		ok, err := reg.rdb.SetNX(ctx, key, addr, reg.ttl).Result()
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return addr, nil
+		}
+		owner, err := reg.rdb.Get(ctx, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if owner == addr {
+			return addr, reg.Refresh(ctx, room, addr)
+		}
+		return owner, nil
+	}
+	return "", errors.New("room claim kept expiring")
+}
+
+func (reg *RedisRegistry) Refresh(ctx context.Context, room, addr string) error {
+	n, err := refreshScript.Run(ctx, reg.rdb, []string{reg.key(room)}, addr, reg.ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+func (reg *RedisRegistry) Release(ctx context.Context, room, addr string) error {
+	n, err := releaseScript.Run(ctx, reg.rdb, []string{reg.key(room)}, addr).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
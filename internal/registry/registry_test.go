@@ -0,0 +1,105 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func testRegistry(t *testing.T) (*RedisRegistry, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return NewRedisRegistry(rdb, "rooms", time.Second), mr
+}
+
+func TestClaim(t *testing.T) {
+	reg, mr := testRegistry(t)
+	ctx := context.Background()
+	for _, addr := range []string{"ws://a", "ws://b", "ws://a"} {
+		owner, err := reg.Claim(ctx, "alpha", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner != "ws://a" {
+			t.Fatalf("%s got owner %s, want ws://a", addr, owner)
+		}
+	}
+	if got, _ := mr.Get("rooms:{alpha}"); got != "ws://a" {
+		t.Fatalf("stored %q", got)
+	}
+	// other rooms are free
+	if owner, err := reg.Claim(ctx, "beta", "ws://b"); err != nil || owner != "ws://b" {
+		t.Fatalf("got %q, %v, want ws://b", owner, err)
+	}
+}
+
+func TestClaimExpires(t *testing.T) {
+	reg, mr := testRegistry(t)
+	ctx := context.Background()
+	if _, err := reg.Claim(ctx, "alpha", "ws://a"); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(600 * time.Millisecond)
+	if err := reg.Refresh(ctx, "alpha", "ws://a"); err != nil {
+		t.Fatal(err)
+	}
+	// refreshed, so still held past the first ttl
+	mr.FastForward(600 * time.Millisecond)
+	if owner, _ := reg.Claim(ctx, "alpha", "ws://b"); owner != "ws://a" {
+		t.Fatalf("owner %s after refreshing, want ws://a", owner)
+	}
+	mr.FastForward(time.Second)
+	if owner, _ := reg.Claim(ctx, "alpha", "ws://b"); owner != "ws://b" {
+		t.Fatalf("owner %s after expiring, want ws://b", owner)
+	}
+	if err := reg.Refresh(ctx, "alpha", "ws://a"); err != ErrNotOwner {
+		t.Fatalf("refreshing a lost claim: got %v, want ErrNotOwner", err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	reg, _ := testRegistry(t)
+	ctx := context.Background()
+	if _, err := reg.Claim(ctx, "alpha", "ws://a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Release(ctx, "alpha", "ws://b"); err != ErrNotOwner {
+		t.Fatalf("releasing another's claim: got %v, want ErrNotOwner", err)
+	}
+	if err := reg.Release(ctx, "alpha", "ws://a"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := reg.Claim(ctx, "alpha", "ws://b"); owner != "ws://b" {
+		t.Fatalf("owner %s after releasing, want ws://b", owner)
+	}
+}
+
+func TestConcurrentClaims(t *testing.T) {
+	reg, _ := testRegistry(t)
+	owners := make([]string, 20)
+	var wg sync.WaitGroup
+	for i := range owners {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			owner, err := reg.Claim(context.Background(), "alpha", fmt.Sprintf("ws://%d", i))
+			if err != nil {
+				t.Error(err)
+			}
+			owners[i] = owner
+		}(i)
+	}
+	wg.Wait()
+	for _, owner := range owners {
+		if owner != owners[0] {
+			t.Fatalf("owners %v, want one for everyone", owners)
+		}
+	}
+}
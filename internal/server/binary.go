@@ -0,0 +1,265 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// Binary snapshots are sent to clients connected with ?encoding=binary in
+// place of the snapshot message, as binary frames. Every other message stays
+// JSON. Fixed size integers are big endian, counts, seqs and times are
+// uvarints and positions are varints counting 10^-precision pixels:
+//
+//	byte     binaryKeyframe or binaryDelta
+//	uint32   last_input_seq of the receiving player, or 0
+//	byte     precision
+//	uvarint  seq, tick, server_time_ms, tick_ms
+//
+// A keyframe then has the world width and height as uvarints, a byte that is
+// 1 when the world wraps around, a count of obstacles each with x, y, width
+// and height as uvarints, then a count and that many players, each a uint16
+// index, the 16 byte player id, their color as red, green and blue bytes,
+// the length of their name as a uvarint and its utf-8 bytes, x and y, then
+// hp, 0 while dead, the ticks left of spawn protection and of a speed boost
+// and their facing in hundredths of a radian as uvarints, then a byte of
+// flags, binaryIt, binaryBot and their team, 0 without teams, shifted up by
+// binaryTeamShift. A delta has a count of removed players, each a uint16
+// index, then a count of added players laid out as in a keyframe, then a
+// count of changed players, each a uint16 index, x, y, hp, protection,
+// boost, facing and flags. Both then have a count of projectiles, each a
+// uvarint id, the uint16 index of its owner, and x, y and its velocity per
+// second along x and y in the same units as positions, then a count of
+// coins, each a uvarint id and x and y in whole pixels as uvarints, then a
+// count of power-ups laid out like coins with a kind byte after the id,
+// binaryPowerSpeed for speed, then a count of flags, each a team byte, x and
+// y in whole pixels as uvarints and one more than the index of their carrier
+// as a uvarint, 0 when nobody carries it.
+//
+// A player's own snapshots then end with their stamina as a uvarint, a byte
+// that is 1 while they are exhausted and their dash cooldown in ms as a
+// uvarint; spectators' end with the flags. Room metadata, scores and
+// the leaderboard are only in the JSON snapshots.
+//
+// Players keep their index until their removal has been sent, after which it
+// may be handed to a new player, so removals come first in a delta.
+const (
+	binaryKeyframe = 1
+	binaryDelta    = 2
+
+	// offset of last_input_seq
+	binaryAckAt = 1
+
+	binaryPowerSpeed = 1
+
+	// player flags
+	binaryIt        = 1 << 0
+	binaryBot       = 1 << 1
+	binaryTeamShift = 2
+)
+
+// assignIndex gives id a binary snapshot index if it hasn't one
+func (r *Room) assignIndex(id string) {
+	if _, ok := r.index[id]; ok {
+		return
+	}
+	if n := len(r.freeIndex); n > 0 {
+		r.index[id] = r.freeIndex[n-1]
+		r.freeIndex = r.freeIndex[:n-1]
+		return
+	}
+	r.index[id] = uint16(len(r.index))
+}
+
+// colorBytes is a #rrggbb color as its red, green and blue bytes
+func colorBytes(c string) []byte {
+	b, err := hex.DecodeString(strings.TrimPrefix(c, "#"))
+	if err != nil || len(b) != 3 {
+		return make([]byte, 3)
+	}
+	return b
+}
+
+// releaseIndex frees id's index once its removal is going out
+func (r *Room) releaseIndex(id string) {
+	if i, ok := r.index[id]; ok {
+		delete(r.index, id)
+		r.freeIndex = append(r.freeIndex, i)
+	}
+}
+
+// encodeBinary encodes s, whose players must all have an index, with no
+// last_input_seq
+func (r *Room) encodeBinary(s Snapshot) []byte {
+	b := make([]byte, binaryAckAt+4, 64)
+	b[0] = binaryDelta
+	if s.Keyframe {
+		b[0] = binaryKeyframe
+	}
+	b = append(b, byte(s.Precision))
+	b = appendUvarint(b, s.Seq)
+	b = appendUvarint(b, s.Tick)
+	b = appendUvarint(b, uint64(s.ServerTimeMS))
+	b = appendUvarint(b, uint64(s.TickMS))
+
+	if s.Keyframe {
+		b = appendUvarint(b, uint64(s.World.Width))
+		b = appendUvarint(b, uint64(s.World.Height))
+		wrap := byte(0)
+		if s.World.Wrap {
+			wrap = 1
+		}
+		b = append(b, wrap)
+		b = appendUvarint(b, uint64(len(s.World.Obstacles)))
+		for _, o := range s.World.Obstacles {
+			b = appendUvarint(b, uint64(o.X))
+			b = appendUvarint(b, uint64(o.Y))
+			b = appendUvarint(b, uint64(o.Width))
+			b = appendUvarint(b, uint64(o.Height))
+		}
+		b = appendUvarint(b, uint64(len(s.Players)))
+		for id, p := range s.Players {
+			b = r.appendAdded(b, id, p)
+		}
+		b = r.appendProjectiles(b, s.Projectiles)
+		b = appendCoins(b, s.Coins)
+		b = appendPowerUps(b, s.PowerUps)
+		return r.appendFlags(b, s.Flags)
+	}
+	b = appendUvarint(b, uint64(len(s.removed)))
+	for _, i := range s.removed {
+		b = appendUint16(b, i)
+	}
+	b = appendUvarint(b, uint64(len(s.Add)))
+	for id, p := range s.Add {
+		b = r.appendAdded(b, id, p)
+	}
+	b = appendUvarint(b, uint64(len(s.Update)))
+	for id, p := range s.Update {
+		b = appendUint16(b, r.index[id])
+		b = r.appendPosition(b, p)
+	}
+	b = r.appendProjectiles(b, s.Projectiles)
+	b = appendCoins(b, s.Coins)
+	b = appendPowerUps(b, s.PowerUps)
+	return r.appendFlags(b, s.Flags)
+}
+
+// appendProjectiles appends the projectile section, which owners are in by
+// index as projectiles go with their owner
+func (r *Room) appendProjectiles(b []byte, shots []sim.Projectile) []byte {
+	b = appendUvarint(b, uint64(len(shots)))
+	for _, pr := range shots {
+		b = appendUvarint(b, uint64(pr.ID))
+		b = appendUint16(b, r.index[pr.Owner])
+		b = appendVarint(b, r.settings.fixed(pr.X))
+		b = appendVarint(b, r.settings.fixed(pr.Y))
+		b = appendVarint(b, r.settings.fixed(pr.Vel.X))
+		b = appendVarint(b, r.settings.fixed(pr.Vel.Y))
+	}
+	return b
+}
+
+// appendCoins appends the coin section
+func appendCoins(b []byte, coins []sim.Coin) []byte {
+	b = appendUvarint(b, uint64(len(coins)))
+	for _, c := range coins {
+		b = appendUvarint(b, uint64(c.ID))
+		b = appendUvarint(b, uint64(c.X))
+		b = appendUvarint(b, uint64(c.Y))
+	}
+	return b
+}
+
+// appendPowerUps appends the power-up section
+func appendPowerUps(b []byte, powerUps []sim.PowerUp) []byte {
+	b = appendUvarint(b, uint64(len(powerUps)))
+	for _, pu := range powerUps {
+		b = appendUvarint(b, uint64(pu.ID))
+		b = append(b, binaryPowerSpeed)
+		b = appendUvarint(b, uint64(pu.X))
+		b = appendUvarint(b, uint64(pu.Y))
+	}
+	return b
+}
+
+// appendFlags appends the flag section, carriers by index
+func (r *Room) appendFlags(b []byte, flags []sim.Flag) []byte {
+	b = appendUvarint(b, uint64(len(flags)))
+	for _, f := range flags {
+		b = append(b, byte(f.Team))
+		b = appendUvarint(b, uint64(f.X))
+		b = appendUvarint(b, uint64(f.Y))
+		carrier := uint64(0)
+		if f.Carrier != "" {
+			carrier = uint64(r.index[f.Carrier]) + 1
+		}
+		b = appendUvarint(b, carrier)
+	}
+	return b
+}
+
+func (r *Room) appendAdded(b []byte, id string, p sim.Player) []byte {
+	b = appendUint16(b, r.index[id])
+	// ids are uuids, anything else goes out as zeros
+	u, _ := uuid.Parse(id)
+	b = append(b, u[:]...)
+	b = append(b, colorBytes(p.Color)...)
+	b = appendUvarint(b, uint64(len(p.Name)))
+	b = append(b, p.Name...)
+	return r.appendPosition(b, p)
+}
+
+// binaryWithSelf copies a binary snapshot with last_input_seq filled in and
+// the player's own state on the end
+func binaryWithSelf(b []byte, seq int, self *Self) []byte {
+	out := make([]byte, len(b), len(b)+16)
+	copy(out, b)
+	binary.BigEndian.PutUint32(out[binaryAckAt:], uint32(seq))
+	out = appendUvarint(out, uint64(self.Stamina))
+	exhausted := byte(0)
+	if self.Exhausted {
+		exhausted = 1
+	}
+	out = append(out, exhausted)
+	return appendUvarint(out, uint64(self.DashCooldownMS))
+}
+
+// appendPosition appends where p is, their health, which is 0 while they
+// are dead, the ticks they are still protected and boosted for, their
+// facing and their flags and team
+func (r *Room) appendPosition(b []byte, p sim.Player) []byte {
+	b = appendVarint(b, r.settings.fixed(p.X))
+	b = appendVarint(b, r.settings.fixed(p.Y))
+	b = appendUvarint(b, uint64(p.HP))
+	b = appendUvarint(b, uint64(p.Invulnerable))
+	b = appendUvarint(b, uint64(p.Boost))
+	b = appendUvarint(b, uint64(facingUnits(p.Facing)))
+	flags := byte(p.Team) << binaryTeamShift
+	if p.It {
+		flags |= binaryIt
+	}
+	if p.Bot {
+		flags |= binaryBot
+	}
+	return append(b, flags)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// binaryReader reads the fields of a binary snapshot in order, failing the
+// test if it runs out
+type binaryReader struct {
+	t *testing.T
+	b []byte
+}
+
+func (br *binaryReader) bytes(n int) []byte {
+	br.t.Helper()
+	if len(br.b) < n {
+		br.t.Fatalf("%d bytes left, want %d", len(br.b), n)
+	}
+	v := br.b[:n]
+	br.b = br.b[n:]
+	return v
+}
+
+func (br *binaryReader) byte() byte {
+	br.t.Helper()
+	return br.bytes(1)[0]
+}
+
+func (br *binaryReader) uint16() uint16 {
+	br.t.Helper()
+	return binary.BigEndian.Uint16(br.bytes(2))
+}
+
+func (br *binaryReader) uvarint() uint64 {
+	br.t.Helper()
+	v, n := binary.Uvarint(br.b)
+	if n <= 0 {
+		br.t.Fatal("bad uvarint")
+	}
+	br.b = br.b[n:]
+	return v
+}
+
+func (br *binaryReader) varint() int64 {
+	br.t.Helper()
+	v, n := binary.Varint(br.b)
+	if n <= 0 {
+		br.t.Fatal("bad varint")
+	}
+	br.b = br.b[n:]
+	return v
+}
+
+// binaryPlayer is a player as a binary snapshot has them
+type binaryPlayer struct {
+	ID, Color, Name            string
+	X, Y                       int64
+	HP, Protected, Boost, Face uint64
+	Flags                      byte
+}
+
+// binaryClient follows binary snapshots like a client would, keeping the
+// index table and the players
+type binaryClient struct {
+	byIndex map[uint16]string
+	players map[string]binaryPlayer
+
+	keyframe                bool
+	ack                     uint32
+	precision               byte
+	seq, tick, time, tickMS uint64
+	width, height           uint64
+	wrap                    bool
+	obstacles               [][4]uint64
+	projectiles             []sim.Projectile
+	coins                   []sim.Coin
+	powerUps                []sim.PowerUp
+	flags                   []sim.Flag
+	// the receiver's own state, from snapshots that end with it
+	stamina, dashCooldown uint64
+	exhausted             bool
+}
+
+func newBinaryClient() *binaryClient {
+	return &binaryClient{byIndex: map[uint16]string{}, players: map[string]binaryPlayer{}}
+}
+
+func (bc *binaryClient) position(br *binaryReader, p *binaryPlayer) {
+	p.X = br.varint()
+	p.Y = br.varint()
+	p.HP = br.uvarint()
+	p.Protected = br.uvarint()
+	p.Boost = br.uvarint()
+	p.Face = br.uvarint()
+	p.Flags = br.byte()
+}
+
+func (bc *binaryClient) added(br *binaryReader) {
+	i := br.uint16()
+	var p binaryPlayer
+	u, err := uuid.FromBytes(br.bytes(16))
+	if err != nil {
+		br.t.Fatal(err)
+	}
+	p.ID = u.String()
+	c := br.bytes(3)
+	p.Color = fmt.Sprintf("#%02x%02x%02x", c[0], c[1], c[2])
+	p.Name = string(br.bytes(int(br.uvarint())))
+	bc.position(br, &p)
+	bc.byIndex[i] = p.ID
+	bc.players[p.ID] = p
+}
+
+// apply decodes b into bc, with the receiver's own state on the end if self
+func (bc *binaryClient) apply(t *testing.T, b []byte, self bool) {
+	t.Helper()
+	br := &binaryReader{t: t, b: b}
+	switch kind := br.byte(); kind {
+	case binaryKeyframe:
+		bc.keyframe = true
+	case binaryDelta:
+		bc.keyframe = false
+	default:
+		t.Fatalf("snapshot kind %d", kind)
+	}
+	bc.ack = binary.BigEndian.Uint32(br.bytes(4))
+	bc.precision = br.byte()
+	bc.seq, bc.tick, bc.time, bc.tickMS = br.uvarint(), br.uvarint(), br.uvarint(), br.uvarint()
+	if bc.keyframe {
+		bc.width, bc.height = br.uvarint(), br.uvarint()
+		bc.wrap = br.byte() == 1
+		bc.obstacles = nil
+		for n := br.uvarint(); n > 0; n-- {
+			bc.obstacles = append(bc.obstacles, [4]uint64{br.uvarint(), br.uvarint(), br.uvarint(), br.uvarint()})
+		}
+		bc.byIndex = map[uint16]string{}
+		bc.players = map[string]binaryPlayer{}
+		for n := br.uvarint(); n > 0; n-- {
+			bc.added(br)
+		}
+	} else {
+		for n := br.uvarint(); n > 0; n-- {
+			i := br.uint16()
+			id, ok := bc.byIndex[i]
+			if !ok {
+				t.Fatalf("removing index %d, which nobody has", i)
+			}
+			delete(bc.players, id)
+			delete(bc.byIndex, i)
+		}
+		for n := br.uvarint(); n > 0; n-- {
+			bc.added(br)
+		}
+		for n := br.uvarint(); n > 0; n-- {
+			i := br.uint16()
+			id, ok := bc.byIndex[i]
+			if !ok {
+				t.Fatalf("updating index %d, which nobody has", i)
+			}
+			p := bc.players[id]
+			bc.position(br, &p)
+			bc.players[id] = p
+		}
+	}
+	bc.projectiles = nil
+	for n := br.uvarint(); n > 0; n-- {
+		pr := sim.Projectile{ID: uint32(br.uvarint())}
+		pr.Owner = bc.byIndex[br.uint16()]
+		pr.X, pr.Y = bc.float(br.varint()), bc.float(br.varint())
+		pr.Vel.X, pr.Vel.Y = bc.float(br.varint()), bc.float(br.varint())
+		bc.projectiles = append(bc.projectiles, pr)
+	}
+	bc.coins = nil
+	for n := br.uvarint(); n > 0; n-- {
+		bc.coins = append(bc.coins, sim.Coin{ID: uint32(br.uvarint()), X: int(br.uvarint()), Y: int(br.uvarint())})
+	}
+	bc.powerUps = nil
+	for n := br.uvarint(); n > 0; n-- {
+		pu := sim.PowerUp{ID: uint32(br.uvarint())}
+		if kind := br.byte(); kind != binaryPowerSpeed {
+			t.Fatalf("power-up kind %d", kind)
+		}
+		pu.Kind = sim.PowerSpeed
+		pu.X, pu.Y = int(br.uvarint()), int(br.uvarint())
+		bc.powerUps = append(bc.powerUps, pu)
+	}
+	bc.flags = nil
+	for n := br.uvarint(); n > 0; n-- {
+		f := sim.Flag{Team: int(br.byte()), X: int(br.uvarint()), Y: int(br.uvarint())}
+		if carrier := br.uvarint(); carrier > 0 {
+			f.Carrier = bc.byIndex[uint16(carrier-1)]
+		}
+		bc.flags = append(bc.flags, f)
+	}
+	if self {
+		bc.stamina = br.uvarint()
+		bc.exhausted = br.byte() == 1
+		bc.dashCooldown = br.uvarint()
+	}
+	if len(br.b) != 0 {
+		t.Fatalf("%d bytes left over", len(br.b))
+	}
+}
+
+func (bc *binaryClient) float(v int64) float64 {
+	return float64(v) / math.Pow10(int(bc.precision))
+}
+
+// wantBinary is how the players last sent by r look in binary
+func wantBinary(r *Room) map[string]binaryPlayer {
+	want := map[string]binaryPlayer{}
+	for id, p := range r.sent {
+		flags := byte(p.Team) << binaryTeamShift
+		if p.It {
+			flags |= binaryIt
+		}
+		if p.Bot {
+			flags |= binaryBot
+		}
+		want[id] = binaryPlayer{
+			ID: id, Color: p.Color, Name: p.Name,
+			X: r.settings.fixed(p.X), Y: r.settings.fixed(p.Y),
+			HP: uint64(p.HP), Protected: uint64(p.Invulnerable), Boost: uint64(p.Boost), Face: uint64(facingUnits(p.Facing)),
+			Flags: flags,
+		}
+	}
+	return want
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	r := benchRoom(t, 5)
+	r.settings.Precision = 1
+	r.srv.cfg.KeyframeInterval = 10
+	var ids []string
+	for id := range r.gamestate.Players {
+		ids = append(ids, id)
+	}
+	r.gamestate.Players[ids[1]].It = true
+	r.gamestate.Players[ids[2]].Team = 2
+	r.gamestate.Projectiles = []*sim.Projectile{{ID: 7, Owner: ids[0], X: 10.25, Y: 20, Vel: sim.Vector{X: -300, Y: 0.5}}}
+	r.gamestate.PowerUps = []*sim.PowerUp{{ID: 3, Kind: sim.PowerSpeed, X: 50, Y: 60}}
+	r.gamestate.Flags = []*sim.Flag{{Team: 1, X: 5, Y: 6, Carrier: ids[3]}, {Team: 2, X: 700, Y: 500}}
+
+	bc := newBinaryClient()
+	for i := 0; i < 25; i++ {
+		switch i {
+		case 3:
+			r.gamestate.Remove(ids[4])
+		case 4:
+			// takes the index freed by the removal
+			id := uuid.New().String()
+			r.gamestate.Join(id, r.settings.Rules(r.srv.cfg.Tick)).Name = "late"
+		}
+		r.gamestate.Players[ids[0]].X += 1.26
+		r.gamestate.Players[ids[1]].HP -= 3
+		r.gamestate.Projectiles[0].X += 7
+
+		s := r.snapshot()
+		bc.apply(t, r.encodeBinary(s), false)
+		if bc.keyframe != s.Keyframe || bc.seq != s.Seq || bc.tick != s.Tick || bc.time != uint64(s.ServerTimeMS) || bc.tickMS != uint64(s.TickMS) || int(bc.precision) != s.Precision {
+			t.Fatalf("tick %d: header %+v, want %+v", i, bc, s)
+		}
+		if s.Keyframe && (bc.width != uint64(s.World.Width) || bc.height != uint64(s.World.Height) || bc.wrap != s.World.Wrap || len(bc.obstacles) != len(s.World.Obstacles)) {
+			t.Fatalf("tick %d: world %dx%d, want %+v", i, bc.width, bc.height, s.World)
+		}
+		if want := wantBinary(r); !reflect.DeepEqual(bc.players, want) {
+			t.Fatalf("tick %d: players %+v, want %+v", i, bc.players, want)
+		}
+		if !reflect.DeepEqual(bc.projectiles, s.Projectiles) {
+			t.Fatalf("tick %d: projectiles %+v, want %+v", i, bc.projectiles, s.Projectiles)
+		}
+		if len(bc.coins) != len(s.Coins) || len(s.Coins) > 0 && !reflect.DeepEqual(bc.coins, s.Coins) {
+			t.Fatalf("tick %d: coins %+v, want %+v", i, bc.coins, s.Coins)
+		}
+		if !reflect.DeepEqual(bc.powerUps, s.PowerUps) || !reflect.DeepEqual(bc.flags, s.Flags) {
+			t.Fatalf("tick %d: power-ups %+v and flags %+v, want %+v and %+v", i, bc.powerUps, bc.flags, s.PowerUps, s.Flags)
+		}
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	other := ts.match(t, "/game", 1)[0]
+	bin := ts.connect(t, "/game?encoding=binary", nil)
+	// events stay JSON
+	bin.event(EventWelcome, &bin.welcome)
+	bc := newBinaryClient()
+	// binary reads up to the next binary snapshot
+	binary := func(self bool) {
+		for {
+			m := bin.next()
+			if m.typ == websocket.BinaryMessage {
+				bc.apply(t, m.data, self)
+				return
+			}
+			var env envelope
+			json.Unmarshal(m.data, &env)
+			if env.Type == MessageSnapshot {
+				t.Fatal("JSON snapshot to a binary client")
+			}
+		}
+	}
+	// the resync on joining has no state of the player's own
+	binary(false)
+	if !bc.keyframe {
+		t.Fatal("first snapshot not a keyframe")
+	}
+	for i := 1; i <= 5; i++ {
+		bin.send(MessageInput, InputMessage{Seq: i, Inputs: []string{"right"}})
+		bin.sync()
+		ts.tick(1)
+		binary(true)
+		other.snapshot()
+		if bc.ack != uint32(i) {
+			t.Fatalf("acked %d, want %d", bc.ack, i)
+		}
+		if len(bc.players) != len(other.players) {
+			t.Fatalf("binary has %d players, JSON %d", len(bc.players), len(other.players))
+		}
+		for id, want := range other.players {
+			p := bc.players[id]
+			if p.X != int64(want.X) || p.Y != int64(want.Y) || p.HP != uint64(want.HP) || p.Name != want.Name || p.Color != want.Color {
+				t.Fatalf("tick %d: binary %+v, JSON %+v", i, p, want)
+			}
+		}
+	}
+	if bc.stamina == 0 {
+		t.Fatal("no stamina in the player's own state")
+	}
+}
+
+// BenchmarkSnapshotEncoding compares the size and cost of a 50 player
+// keyframe in JSON and binary
+func BenchmarkSnapshotEncoding(b *testing.B) {
+	r := benchRoom(b, 50)
+	s := r.snapshot()
+	b.Run("json", func(b *testing.B) {
+		var n int
+		for i := 0; i < b.N; i++ {
+			n = len(encode(MessageSnapshot, s).msg)
+		}
+		b.ReportMetric(float64(n), "bytes")
+	})
+	b.Run("binary", func(b *testing.B) {
+		var n int
+		for i := 0; i < b.N; i++ {
+			n = len(r.encodeBinary(s))
+		}
+		b.ReportMetric(float64(n), "bytes")
+	})
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+const (
+	// the most bots a room may have, on top of MaxPlayers
+	maxBots = 32
+	// the longest a wandering bot keeps to one heading
+	botTurn = 2 * time.Second
+	// how near someone who is it may come before a bot runs from them
+	botFleeRange = 200
+)
+
+// bot is what a server controlled player remembers between ticks
+type bot struct {
+	// what it draws its wandering from
+	rand    *rand.Rand
+	heading sim.Vector
+	// ticks left before a wandering bot picks a new heading
+	turn int
+}
+
+// addBots puts n bots in the room, called bot, bot2 and so on. They are
+// players like any other, except that driveBots makes up their inputs and
+// they don't count towards MaxPlayers or need to be ready.
+func (r *Room) addBots(n int) {
+	rules := r.settings.Rules(r.srv.cfg.Tick)
+	for i := 0; i < n; i++ {
+		id := uuid.New().String()
+		p := r.gamestate.Join(id, rules)
+		p.Bot = true
+		p.Name = r.uniqueName("bot", id)
+		// seeded from the room, so a room seeded the same plays the same
+		r.bots[id] = &bot{rand: rand.New(rand.NewSource(r.srv.cfg.Seed(r.name) + int64(len(r.bots))))}
+	}
+}
+
+// removeBot takes bot id out of the room
+func (r *Room) removeBot(id string) {
+	name := r.gamestate.Players[id].Name
+	r.gamestate.Remove(id)
+	delete(r.bots, id)
+	r.storeCounts()
+	r.send(encode(MessageEvent, PlayerEvent{Kind: EventLeave, PlayerID: id, Name: name, Reason: LeaveKick}))
+}
+
+// humans is the number of players that aren't bots
+func (r *Room) humans() int {
+	return len(r.gamestate.Players) - len(r.bots)
+}
+
+// driveBots queues the inputs of every living bot for this tick, through
+// the same queue as everyone else's. A bot that is it chases the nearest
+// player and one that someone who is it comes near runs away; otherwise it
+// heads for the nearest coin, or wanders when there is none.
+func (r *Room) driveBots() {
+	if r.phase != PhasePlaying || r.paused > 0 || len(r.bots) == 0 {
+		return
+	}
+	// in id order, so the same world and seed always drive them the same way
+	ids := make([]string, 0, len(r.bots))
+	for id := range r.bots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		p, ok := r.gamestate.Players[id]
+		if !ok || p.Dead {
+			continue
+		}
+		move := r.steer(id, p, r.bots[id])
+		r.enqueueInputs([]sim.InputEvent{{PlayerID: id, Move: &move}})
+	}
+}
+
+// steer is the way bot id, which is p, moves this tick
+func (r *Room) steer(id string, p *sim.Player, b *bot) sim.Vector {
+	var it *sim.Player
+	nearest, nearestD := (*sim.Player)(nil), math.Inf(1)
+	for other, q := range r.gamestate.Players {
+		if other == id || q.Dead {
+			continue
+		}
+		if q.It {
+			it = q
+		}
+		if d := math.Hypot(q.X-p.X, q.Y-p.Y); d < nearestD {
+			nearest, nearestD = q, d
+		}
+	}
+	switch {
+	case p.It && nearest != nil:
+		return toward(p.X, p.Y, nearest.X, nearest.Y)
+	case it != nil && math.Hypot(it.X-p.X, it.Y-p.Y) < botFleeRange:
+		return toward(it.X, it.Y, p.X, p.Y)
+	}
+	coin, coinD := sim.Vector{}, math.Inf(1)
+	for _, c := range r.gamestate.Coins {
+		if d := math.Hypot(float64(c.X)-p.X, float64(c.Y)-p.Y); d < coinD {
+			coin, coinD = toward(p.X, p.Y, float64(c.X), float64(c.Y)), d
+		}
+	}
+	if len(r.gamestate.Coins) > 0 {
+		return coin
+	}
+	return r.wander(p, b)
+}
+
+// wander keeps b on its heading for a while, then picks a new one, turning
+// away from any edge p is about to walk into
+func (r *Room) wander(p *sim.Player, b *bot) sim.Vector {
+	if b.turn <= 0 {
+		a := b.rand.Float64() * 2 * math.Pi
+		b.heading = sim.Vector{X: math.Cos(a), Y: math.Sin(a)}
+		b.turn = 1 + b.rand.Intn(r.ticksOf(int(botTurn.Milliseconds())))
+	}
+	b.turn--
+	if !r.settings.Wrap {
+		margin := float64(2 * r.settings.PlayerRadius)
+		if p.X < margin && b.heading.X < 0 || p.X > float64(r.settings.WorldWidth)-margin && b.heading.X > 0 {
+			b.heading.X = -b.heading.X
+		}
+		if p.Y < margin && b.heading.Y < 0 || p.Y > float64(r.settings.WorldHeight)-margin && b.heading.Y > 0 {
+			b.heading.Y = -b.heading.Y
+		}
+	}
+	return b.heading
+}
+
+// toward is the unit vector from x, y to tx, ty, or nothing when they are
+// the same point
+func toward(x, y, tx, ty float64) sim.Vector {
+	dx, dy := tx-x, ty-y
+	l := math.Hypot(dx, dy)
+	if l == 0 {
+		return sim.Vector{}
+	}
+	return sim.Vector{X: dx / l, Y: dy / l}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// bots is the ids of the players c knows the server plays
+func (c *testClient) bots() []string {
+	var ids []string
+	for id, p := range c.players {
+		if p.Bot {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestBotsPlay(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	code := ts.createRoom(t, map[string]interface{}{"bots": 3})
+	c := ts.dial(t, "/game?code="+code)
+	c.play()
+	ts.tick(1)
+	c.until(func() bool { return len(c.bots()) == 3 })
+	if c.me().Bot {
+		t.Fatal("a human flagged as a bot")
+	}
+
+	start := map[string]sim.Player{}
+	for _, id := range c.bots() {
+		start[id] = c.players[id]
+	}
+	moved := map[string]bool{}
+	for i := 0; i < 500; i++ {
+		ts.tick(1)
+		c.snapshot()
+		for id := range start {
+			p, ok := c.players[id]
+			if !ok {
+				t.Fatalf("tick %d: bot %s gone", i, id)
+			}
+			if p.X < 0 || p.X > 800 || p.Y < 0 || p.Y > 600 {
+				t.Fatalf("tick %d: bot %s at %v,%v", i, id, p.X, p.Y)
+			}
+			moved[id] = moved[id] || p.X != start[id].X || p.Y != start[id].Y
+		}
+	}
+	if len(moved) != 3 {
+		t.Fatalf("moved %v, want all three", moved)
+	}
+	for id, ok := range moved {
+		if !ok {
+			t.Fatalf("bot %s never moved", id)
+		}
+	}
+	if n := ts.Counters().TickPanics; n != 0 {
+		t.Fatalf("%d ticks panicked", n)
+	}
+}
+
+func TestBotsDontCount(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	code := ts.createRoom(t, map[string]interface{}{"bots": 3, "max_players": 2})
+	a, b := ts.dial(t, "/game?code="+code), ts.dial(t, "/game?code="+code)
+	// and the match waits on the humans alone
+	a.send(MessageReady, nil)
+	b.send(MessageReady, nil)
+	a.phase(PhasePlaying)
+	ts.tick(1)
+	if s := a.snapshot(); s.Room.Players != 2 {
+		t.Fatalf("room has %d players, want the 2 humans", s.Room.Players)
+	}
+	c := ts.connect(t, "/game?code="+code, nil)
+	if code := c.closeCode(); code != CloseRoomFull {
+		t.Fatalf("closed with %d, want %d", code, CloseRoomFull)
+	}
+}
+
+func TestKickBot(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	code := ts.createRoom(t, map[string]interface{}{"bots": 2})
+	host := ts.dial(t, "/game?code="+code)
+	host.play()
+	ts.tick(1)
+	host.until(func() bool { return len(host.bots()) == 2 })
+	other := ts.dial(t, "/game?code="+code)
+	bot := host.bots()[0]
+
+	other.send(MessageKick, KickMessage{PlayerID: bot})
+	if e := other.errorMessage(); e.Code != ErrNotHost {
+		t.Fatalf("got %+v, want %s", e, ErrNotHost)
+	}
+	host.send(MessageKick, KickMessage{PlayerID: bot})
+	var ev PlayerEvent
+	host.event(EventLeave, &ev)
+	if ev.PlayerID != bot || ev.Reason != LeaveKick {
+		t.Fatalf("got %+v, want bot %s kicked", ev, bot)
+	}
+	ts.tick(1)
+	host.snapshot()
+	if _, ok := host.players[bot]; ok || len(host.bots()) != 1 {
+		t.Fatalf("bots %v after kicking %s", host.bots(), bot)
+	}
+}
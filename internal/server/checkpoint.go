@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+const (
+	// room checkpoints that may wait for the store before more are dropped
+	maxPendingCheckpoints = 256
+	// how long writing or reading one checkpoint may take
+	checkpointTimeout = 2 * time.Second
+)
+
+// checkpointSave is an encoded checkpoint of room to keep, or the room's
+// checkpoint to forget
+type checkpointSave struct {
+	room   string
+	data   []byte
+	forget bool
+}
+
+// roomCheckpoint is what a room is started again from: its world and how
+// far into the match it was
+type roomCheckpoint struct {
+	// room clock time of the tick it was taken at, in unix ms
+	At        int64          `json:"at"`
+	Playing   bool           `json:"playing,omitempty"`
+	StartedAt int64          `json:"started_at,omitempty"`
+	ElapsedMS int64          `json:"elapsed_ms,omitempty"`
+	Remaining int            `json:"remaining,omitempty"`
+	World     sim.Checkpoint `json:"world"`
+	// leaderboard accounts by player id, which unlike tokens are no secret
+	Accounts map[string]string `json:"accounts,omitempty"`
+}
+
+// checkpoint queues a checkpoint of the room every CheckpointTicks ticks
+func (r *Room) checkpoint() {
+	if r.srv.checkpoints == nil || r.ticks%uint64(r.srv.cfg.CheckpointTicks) != 0 {
+		return
+	}
+	r.saveCheckpoint()
+}
+
+// saveCheckpoint queues a checkpoint of a public room with players in it,
+// encoded as msgpack. Like player saves it never blocks, and the next one
+// makes up for one that is dropped.
+func (r *Room) saveCheckpoint() {
+	if r.srv.checkpoints == nil || r.code != "" || r.humans() == 0 || atomic.LoadInt32(&r.owned) == 0 {
+		return
+	}
+	// stamped with the tick the world is as of, or for a room that hasn't
+	// ticked yet, like one shutting down straight after a restore, now
+	at := r.tickAt
+	if r.ticks == 0 {
+		at = r.srv.cfg.Clock.Now().UnixNano() / int64(time.Millisecond)
+	}
+	data := pack(roomCheckpoint{
+		At:        at,
+		Playing:   r.phase == PhasePlaying,
+		StartedAt: r.startedAt,
+		ElapsedMS: r.elapsed.Milliseconds(),
+		Remaining: r.remaining,
+		World:     r.gamestate.Checkpoint(),
+		Accounts:  r.accounts,
+	})
+	if data == nil {
+		return
+	}
+	r.srv.queueCheckpoint(checkpointSave{room: r.name, data: data})
+}
+
+// forgetCheckpoint queues the room's checkpoint to be dropped once the room
+// has closed empty, so the next one starts afresh
+func (r *Room) forgetCheckpoint() {
+	if r.srv.checkpoints != nil && r.code == "" && atomic.LoadInt32(&r.owned) == 1 {
+		r.srv.queueCheckpoint(checkpointSave{room: r.name, forget: true})
+	}
+}
+
+func (s *Server) queueCheckpoint(save checkpointSave) {
+	select {
+	case s.checkpoints <- save:
+	default:
+		atomic.AddUint64(&s.counters.DroppedCheckpoints, 1)
+	}
+}
+
+// runCheckpoints writes queued checkpoints to the store until the queue is
+// closed
+func (s *Server) runCheckpoints() {
+	defer close(s.checkpointsDone)
+	for save := range s.checkpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), checkpointTimeout)
+		var err error
+		if save.forget {
+			err = s.cfg.Checkpoints.Forget(ctx, save.room)
+		} else {
+			err = s.cfg.Checkpoints.Save(ctx, save.room, save.data, s.cfg.CheckpointMaxAge)
+		}
+		cancel()
+		if err != nil {
+			log.Println("checkpoint save:", err)
+		}
+	}
+}
+
+// restoreCheckpoint starts a public room from its checkpoint when one was
+// taken less than CheckpointMaxAge ago, most likely by an instance that went
+// away. Nobody is connected yet, so every player comes back disconnected,
+// as if they had left when it was taken, and waits for their resume token.
+// Bots are driven by this room from here on.
+func (r *Room) restoreCheckpoint(ctx context.Context) {
+	if r.srv.checkpoints == nil || r.code != "" || !r.claim(ctx) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkpointTimeout)
+	data, ok, err := r.srv.cfg.Checkpoints.Load(ctx, r.name)
+	cancel()
+	if err != nil {
+		log.Println("checkpoint load:", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	var cp roomCheckpoint
+	if err := unpackInto(data, &cp); err != nil {
+		log.Println("checkpoint decode:", err)
+		return
+	}
+	age := r.srv.cfg.Clock.Now().Sub(time.Unix(0, cp.At*int64(time.Millisecond)))
+	if age > r.srv.cfg.CheckpointMaxAge {
+		log.Println("checkpoint of room", r.name, "is", age, "old, starting afresh")
+		return
+	}
+	if age < 0 {
+		age = 0
+	}
+
+	seed := r.srv.cfg.Seed(r.name)
+	r.gamestate = sim.NewWorld(seed)
+	r.gamestate.Restore(cp.World, r.settings.Rules(r.srv.cfg.Tick))
+	r.bots = map[string]*bot{}
+	for _, pc := range cp.World.Players {
+		if pc.Bot {
+			r.bots[pc.ID] = &bot{rand: rand.New(rand.NewSource(seed + int64(len(r.bots))))}
+			continue
+		}
+		r.disconnected[pc.ID] = absence{gone: age, reason: LeaveDisconnect}
+		if account, ok := cp.Accounts[pc.ID]; ok {
+			r.accounts[pc.ID] = account
+		}
+	}
+	if cp.Playing {
+		r.phase = PhasePlaying
+		r.elapsed = time.Duration(cp.ElapsedMS) * time.Millisecond
+		r.startedAt = cp.StartedAt
+		if r.startedAt == 0 {
+			// taken before start times were kept
+			r.startedAt = cp.At - cp.ElapsedMS
+		}
+		r.remaining = cp.Remaining
+		atomic.StoreInt32(&r.started, 1)
+	}
+	r.storeCounts()
+	log.Println("room", r.name, "restored from a checkpoint", age, "old with", len(r.disconnected), "players to come back")
+}
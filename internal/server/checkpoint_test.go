@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/store"
+)
+
+// checkpointLog is a checkpoint store that keeps every checkpoint saved and
+// never has one to load
+type checkpointLog struct {
+	mu    sync.Mutex
+	saved []roomCheckpoint
+	rooms []string
+}
+
+func (l *checkpointLog) Save(ctx context.Context, room string, data []byte, ttl time.Duration) error {
+	var cp roomCheckpoint
+	if err := unpackInto(data, &cp); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.saved = append(l.saved, cp)
+	l.rooms = append(l.rooms, room)
+	return nil
+}
+
+func (l *checkpointLog) Load(ctx context.Context, room string) ([]byte, bool, error) {
+	return nil, false, nil
+}
+
+func (l *checkpointLog) Forget(ctx context.Context, room string) error {
+	return nil
+}
+
+func (l *checkpointLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.saved)
+}
+
+// persistence is a player and a checkpoint store in mr for servers to share
+func persistence(t *testing.T) (*miniredis.Miniredis, func(*Config)) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	players, checkpoints := store.NewRedisPlayers(rdb, "player"), store.NewRedisCheckpoints(rdb, "checkpoint")
+	return mr, func(cfg *Config) {
+		cfg.Players = players
+		cfg.Checkpoints = checkpoints
+	}
+}
+
+func TestCheckpointCadence(t *testing.T) {
+	log := &checkpointLog{}
+	ts := startInstance(t, newFakeRegistry(), func(cfg *Config) {
+		cfg.Checkpoints = log
+		cfg.CheckpointTicks = 5
+	})
+	a := ts.match(t, "/game", 1)[0]
+	ts.tick(20)
+	eventually(t, "four checkpoints", func() bool { return log.len() >= 4 })
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for i, cp := range log.saved {
+		if log.rooms[i] != DefaultRoom || !cp.Playing || len(cp.World.Players) != 1 || cp.World.Players[0].ID != a.welcome.ID {
+			t.Fatalf("checkpoint %d of %s: %+v", i, log.rooms[i], cp)
+		}
+		if i == 0 {
+			continue
+		}
+		if gap := time.Duration(cp.At-log.saved[i-1].At) * time.Millisecond; gap != 5*ts.cfg.Tick {
+			t.Fatalf("checkpoint %d taken %s after the one before, want every 5 ticks", i, gap)
+		}
+	}
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	_, configure := persistence(t)
+	reg := newFakeRegistry()
+	first := startInstance(t, reg, configure)
+	clients := first.match(t, "/game", 2)
+	a, b := clients[0], clients[1]
+	a.input("right")
+	if !moves(first, b, a.welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	wasA, wasB := b.players[a.welcome.ID], b.players[b.welcome.ID]
+	// the instance goes away, checkpointing the room as it does
+	if err := first.stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := startInstance(t, reg, configure)
+	back := second.dial(t, "/game?token="+a.welcome.Token)
+	if back.welcome.ID != a.welcome.ID {
+		t.Fatalf("resumed as %s, want %s", back.welcome.ID, a.welcome.ID)
+	}
+	// b is back too, waiting for its own token
+	second.tick(1)
+	back.until(func() bool { return len(back.players) == 2 })
+	if p := back.players[b.welcome.ID]; p.X != wasB.X || p.Y != wasB.Y || p.Color != wasB.Color {
+		t.Fatalf("b restored as %+v, want %+v", p, wasB)
+	}
+	if p := back.me(); p.X != wasA.X || p.Y != wasA.Y || p.Color != wasA.Color || p.Name != wasA.Name {
+		t.Fatalf("restored as %+v, want %+v", p, wasA)
+	}
+	second.tick(1)
+	if s := back.snapshot(); s.Room.Phase != PhasePlaying || s.Room.ElapsedMS == 0 {
+		t.Fatalf("room %+v, want the match carrying on", s.Room)
+	}
+}
+
+func TestCheckpointStale(t *testing.T) {
+	_, configure := persistence(t)
+	reg := newFakeRegistry()
+	first := startInstance(t, reg, configure)
+	first.match(t, "/game", 2)
+	if err := first.stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := startInstance(t, reg, func(cfg *Config) {
+		configure(cfg)
+		cfg.CheckpointMaxAge = time.Second
+	})
+	second.clock.Advance(2 * time.Second)
+	c := second.dial(t, "/game")
+	second.tick(1)
+	if s := c.snapshot(); s.Room.Players != 1 || s.Room.Phase != PhaseLobby {
+		t.Fatalf("room %+v, want it started afresh", s.Room)
+	}
+}
+
+func TestNoCheckpointsWithoutRegistry(t *testing.T) {
+	mr, persist := persistence(t)
+	configure := func(cfg *Config) {
+		persist(cfg)
+		cfg.CheckpointTicks = 1
+	}
+	// nothing says which of them has the room, so both host it
+	first, second := startServer(t, nil, configure), startServer(t, nil, configure)
+	first.match(t, "/game", 2)
+	first.tick(5)
+	c := second.dial(t, "/game")
+	second.tick(1)
+	if s := c.snapshot(); s.Room.Players != 1 || s.Room.Phase != PhaseLobby {
+		t.Fatalf("room %+v, want it to start afresh beside the other", s.Room)
+	}
+	if err := first.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := checkpointKeys(mr); len(keys) != 0 {
+		t.Fatalf("checkpoints %v taken without a registry", keys)
+	}
+}
+
+// checkpointKeys is every checkpoint kept in mr
+func checkpointKeys(mr *miniredis.Miniredis) []string {
+	var keys []string
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "checkpoint") {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestCheckpointNeedsClaim(t *testing.T) {
+	mr, configure := persistence(t)
+	reg := newFakeRegistry()
+	first := startInstance(t, reg, configure)
+	first.match(t, "/game", 2)
+	if err := first.stop(); err != nil {
+		t.Fatal(err)
+	}
+	saved := checkpointKeys(mr)
+	if len(saved) != 1 {
+		t.Fatalf("checkpoints %v, want the room's", saved)
+	}
+
+	// an instance that couldn't claim the room hosts it without the
+	// checkpoint, and leaves it for the one that will
+	reg.mu.Lock()
+	reg.down = true
+	reg.mu.Unlock()
+	second := startInstance(t, reg, func(cfg *Config) {
+		configure(cfg)
+		cfg.ReconnectGrace = 0
+		cfg.EmptyRoomGrace = 0
+	})
+	c := second.dial(t, "/game")
+	second.tick(1)
+	if s := c.snapshot(); s.Room.Players != 1 || s.Room.Phase != PhaseLobby {
+		t.Fatalf("room %+v restored without the claim", s.Room)
+	}
+	c.conn.Close()
+	eventually(t, "the room to close", func() bool {
+		second.tick(1)
+		return len(second.listRooms()) == 0
+	})
+	if err := second.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := checkpointKeys(mr); !reflect.DeepEqual(got, saved) {
+		t.Fatalf("checkpoints %v, want %v as they were", got, saved)
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/store"
+)
+
+const (
+	// ticks a connection may fall behind before it is considered too slow
+	sendBufferTicks = 16
+	// frames one busy tick can queue for a connection: its snapshot, the
+	// tick's events, and the phase, countdown and player events of everyone
+	// coming and going
+	framesPerTick = 16
+	// outbound messages buffered per connection
+	sendBufferSize = sendBufferTicks * framesPerTick
+	writeWait      = 10 * time.Second
+	// a connection gets at most one resync keyframe this often
+	minResyncInterval = time.Second
+)
+
+// client is a single websocket connection. All writes to conn go through
+// writePump so nothing else may call conn.Write* directly.
+type client struct {
+	srv  *Server
+	room *Room
+	id   string
+	conn *websocket.Conn
+	send chan frame
+	// connections that only watch; asked for with ?mode=spectator, or set on
+	// join when a room makes late joiners wait
+	spectator bool
+	// join order within the room, used to pick the next host
+	joined uint64
+	// old clients that only understand bare snapshots, asked for with
+	// ?format=bare
+	// TODO drop after the next release
+	legacy bool
+	// EncodingJSON, EncodingBinary, EncodingMsgpack or EncodingProtobuf
+	encoding string
+	// protocol version negotiated on connecting
+	protocol int
+	// when this connection last asked for a resync, only touched by its
+	// read loop
+	lastResync time.Time
+	// smoothed round trip time of websocket pings in ns, kept atomically
+	rtt int64
+	// resume token given with ?token= to take over a disconnected player,
+	// then the token handed out for this connection's player
+	resume string
+	// what the player store had under the resume token, if anything,
+	// whether the token was rotated away, and whether the store had no
+	// record of it at all
+	saved   *store.Player
+	rotated bool
+	unknown bool
+	// color asked for with ?color=, given if no other player has it
+	color string
+	// name asked for with ?name=, then the one given on joining
+	name string
+
+	done      chan struct{}
+	closeOnce sync.Once
+	closeMsg  []byte
+
+	// closed once writePump has returned
+	exited chan struct{}
+}
+
+// newClient wraps conn; the id and room are assigned on join
+func newClient(srv *Server, conn *websocket.Conn) *client {
+	return &client{
+		srv:      srv,
+		conn:     conn,
+		encoding: EncodingJSON,
+		send:     make(chan frame, sendBufferSize),
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+}
+
+// frame is a queued websocket message, text or binary. A prepared frame is
+// shared by every connection getting the same message, so it is compressed
+// once for all of them rather than once per connection.
+type frame struct {
+	typ      int
+	data     []byte
+	prepared *websocket.PreparedMessage
+}
+
+// enqueue queues f for the writer without blocking. It returns false when
+// the buffer is full, meaning the client can't keep up.
+func (c *client) enqueue(f frame) bool {
+	select {
+	case c.send <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrorMessage is the data of an error message, sent to a client whose
+// message couldn't be handled
+type ErrorMessage struct {
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+func (c *client) sendError(code, detail string) {
+	c.deliver(encode(MessageError, ErrorMessage{Code: code, Detail: detail}))
+}
+
+// keepalive sets the initial read deadline and extends it on every pong. Pings
+// carry the time they were sent, so each pong is also a round trip sample.
+func (c *client) keepalive() {
+	c.conn.SetReadDeadline(time.Now().Add(c.srv.cfg.PongTimeout))
+	c.conn.SetPongHandler(func(data string) error {
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			c.sampleRTT(time.Duration(c.srv.cfg.Clock.Now().UnixNano() - sent))
+		}
+		return c.conn.SetReadDeadline(time.Now().Add(c.srv.cfg.PongTimeout))
+	})
+}
+
+// sampleRTT folds one round trip into the smoothed value, weighting it 1/8
+// like TCP does
+func (c *client) sampleRTT(d time.Duration) {
+	if d < 0 {
+		return
+	}
+	old := atomic.LoadInt64(&c.rtt)
+	if old == 0 {
+		atomic.StoreInt64(&c.rtt, int64(d))
+		return
+	}
+	atomic.StoreInt64(&c.rtt, old+(int64(d)-old)/8)
+}
+
+// latencyMS is the smoothed round trip time, zero before the first pong
+func (c *client) latencyMS() int {
+	return int(time.Duration(atomic.LoadInt64(&c.rtt)).Milliseconds())
+}
+
+func (c *client) writePump() {
+	ping := time.NewTicker(c.srv.cfg.PingInterval)
+	defer ping.Stop()
+	defer close(c.exited)
+	defer c.conn.Close()
+	for {
+		select {
+		case <-ping.C:
+			sent := strconv.FormatInt(c.srv.cfg.Clock.Now().UnixNano(), 10)
+			err := c.conn.WriteControl(websocket.PingMessage, []byte(sent), time.Now().Add(writeWait))
+			if err != nil {
+				log.Println("ping failed for player", c.id+":", err)
+				c.room.leave(c, LeaveDisconnect)
+				return
+			}
+		case f := <-c.send:
+			err := c.write(f)
+			if err != nil {
+				// drop the player right away rather than waiting for the
+				// read loop to notice the dead connection
+				log.Println("write failed for player", c.id+":", err)
+				c.room.leave(c, LeaveDisconnect)
+				return
+			}
+		case <-c.done:
+			// flush whatever is still queued so the close frame comes last
+			if c.flush() != nil {
+				return
+			}
+			c.conn.WriteControl(websocket.CloseMessage, c.closeMsg, time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+func (c *client) write(f frame) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if f.prepared != nil {
+		return c.conn.WritePreparedMessage(f.prepared)
+	}
+	return c.conn.WriteMessage(f.typ, f.data)
+}
+
+func (c *client) flush() error {
+	for {
+		select {
+		case f := <-c.send:
+			err := c.write(f)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
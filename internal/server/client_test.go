@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/clock"
+)
+
+// smallBuffers shrinks the kernel send buffer of every connection it
+// accepts, so a client that stops reading backs up into the server quickly
+type smallBuffers struct {
+	net.Listener
+}
+
+func (l smallBuffers) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetWriteBuffer(4096)
+	}
+	return conn, err
+}
+
+func TestSlowReaderIsDropped(t *testing.T) {
+	cfg := testConfig()
+	// big uncompressed snapshots of bots running around
+	cfg.CompressionLevel = 0
+	cfg.Bots = 20
+	ts := serve(t, NewServer(cfg, nil, nil), smallBuffers{listen(t)})
+	fast := ts.dial(t, "/game")
+	slow, _, err := (&websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetReadBuffer(4096)
+			}
+			return conn, err
+		},
+	}).Dial("ws://"+ts.addr+"/game", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	var joined PlayerEvent
+	for joined.PlayerID == "" || joined.PlayerID == fast.welcome.ID {
+		fast.event(EventJoin, &joined)
+	}
+	slow.WriteJSON(ClientMessage{Type: MessageReady})
+	fast.play()
+
+	// the slow client never reads, the fast one gets every snapshot
+	left := false
+	for i := 0; i < 10000 && !left; i++ {
+		ts.tick(1)
+		for {
+			env := fast.message()
+			if env.Type == MessageSnapshot {
+				break
+			}
+			var ev PlayerEvent
+			json.Unmarshal(env.Data, &ev)
+			if ev.Kind == EventLeave && ev.PlayerID == joined.PlayerID {
+				left = true
+			}
+		}
+	}
+	if !left {
+		t.Fatal("slow client never dropped")
+	}
+	ts.tick(1)
+	fast.snapshot()
+
+	// everything still queued comes ahead of the close, and there is a lot
+	// of it
+	slow.UnderlyingConn().(*net.TCPConn).SetReadBuffer(1 << 20)
+	for {
+		_, _, err := slow.ReadMessage()
+		var ce *websocket.CloseError
+		if errors.As(err, &ce) {
+			if ce.Code != CloseTooSlow || ce.Text != closeText[CloseTooSlow] {
+				t.Fatalf("closed with %d %q, want %d", ce.Code, ce.Text, CloseTooSlow)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBusyTickKeepsClient(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxPlayers = framesPerTick
+	s := NewServer(cfg, nil, nil)
+	r := newRoom(s, "a", cfg.RoomSettings())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-r.done
+	}()
+	r.start(ctx)
+	// no writer ever runs, so everything sent stays queued
+	c := newClient(s, nil)
+	if _, err := r.join(c); err != nil {
+		t.Fatal(err)
+	}
+	// a room filling up all at once, each join an event to c
+	for i := 1; i < framesPerTick; i++ {
+		if _, err := r.join(newClient(s, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.Clock.(*clock.Manual).Advance(cfg.Tick)
+	if len(c.send) <= framesPerTick/2 {
+		t.Fatalf("%d frames queued, want the joins and a snapshot", len(c.send))
+	}
+	select {
+	case <-c.done:
+		t.Fatal("dropped as too slow after one tick")
+	default:
+	}
+}
+
+func TestUnresponsiveClientTimesOut(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.PingInterval = 20 * time.Millisecond
+		cfg.PongTimeout = 200 * time.Millisecond
+		cfg.ReconnectGrace = 0
+	})
+	clients := ts.match(t, "/game", 2)
+	alive, dead := clients[0], clients[1]
+	// a connection that isn't read never answers pings
+	dead.conn.UnderlyingConn().(*net.TCPConn).CloseRead()
+	start := time.Now()
+	var ev PlayerEvent
+	alive.event(EventLeave, &ev)
+	if ev.PlayerID != dead.welcome.ID || ev.Reason != LeaveIdle {
+		t.Fatalf("got %+v, want %s leaving idle", ev, dead.welcome.ID)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("dropped after %s", took)
+	}
+	ts.tick(1)
+	alive.snapshot()
+	if _, ok := alive.players[dead.welcome.ID]; ok {
+		t.Fatal("idle player still in the snapshot")
+	}
+	// the live one answered every ping
+	time.Sleep(300 * time.Millisecond)
+	ts.tick(1)
+	alive.snapshot()
+}
+
+func TestSampleRTT(t *testing.T) {
+	c := &client{}
+	if c.latencyMS() != 0 {
+		t.Fatal("latency before any pong")
+	}
+	for _, tt := range []struct {
+		sample time.Duration
+		want   int
+	}{
+		// the first sample is taken as is
+		{80 * time.Millisecond, 80},
+		// then each moves it an eighth of the way
+		{160 * time.Millisecond, 90},
+		{90 * time.Millisecond, 90},
+		{10 * time.Millisecond, 80},
+		// a pong from before the ping is ignored
+		{-time.Second, 80},
+	} {
+		c.sampleRTT(tt.sample)
+		if got := c.latencyMS(); got != tt.want {
+			t.Fatalf("after %v: %dms, want %dms", tt.sample, got, tt.want)
+		}
+	}
+}
+
+func TestLatencyInSnapshots(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.PingInterval = 5 * time.Millisecond
+	})
+	conn, err := ts.open("/game", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the clock is fake, so answer every ping as if it were sent 80ms
+	// before it was. Ticks while a ping is out add a little more.
+	conn.SetPingHandler(func(data string) error {
+		sent, err := strconv.ParseInt(data, 10, 64)
+		if err != nil {
+			t.Errorf("ping %q doesn't carry its time", data)
+		}
+		pong := strconv.FormatInt(sent-int64(80*time.Millisecond), 10)
+		return conn.WriteControl(websocket.PongMessage, []byte(pong), time.Now().Add(time.Second))
+	})
+	c := newTestClient(t, conn)
+	c.event(EventWelcome, &c.welcome)
+	c.play()
+	eventually(t, "the latency to be measured", func() bool {
+		ts.tick(1)
+		c.snapshot()
+		return c.me().LatencyMS >= 80
+	})
+	// and it's in the JSON as latency_ms
+	for {
+		ts.tick(1)
+		var raw struct {
+			Keyframe bool                              `json:"keyframe"`
+			Players  map[string]map[string]interface{} `json:"players"`
+		}
+		c.decode(c.skipTo(MessageSnapshot, nil), &raw)
+		if !raw.Keyframe {
+			continue
+		}
+		if ms, ok := raw.Players[c.welcome.ID]["latency_ms"].(float64); !ok || ms < 80 || ms > 200 {
+			t.Fatalf("keyframe player %v, want latency_ms of about 80", raw.Players[c.welcome.ID])
+		}
+		break
+	}
+}
+
+func TestPing(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	c := ts.dial(t, "/game")
+	c.send(MessagePing, PingMessage{T: 1234})
+	var pong PongEvent
+	c.event(EventPong, &pong)
+	if want := ts.clock.Now().UnixNano() / int64(time.Millisecond); pong.T != 1234 || pong.ServerTimeMS != want {
+		t.Fatalf("got %+v, want t 1234 and server time %d", pong, want)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// close codes the server sends, each with the text in closeText. A client
+// closing on its own, or a read loop ending after it went away, gets a
+// normal closure instead.
+const (
+	// turned away because the room already has MaxPlayers players, or
+	// MaxSpectators spectators
+	CloseRoomFull = 4001
+	// kicked by the host
+	CloseKicked = 4002
+	// the resume token doesn't match a disconnected player in the room
+	CloseBadResumeToken = 4003
+	// the declared protocol version is outside MinProtocol..MaxProtocol
+	CloseUnsupportedProtocol = 4004
+	// the server is stopping; reconnecting may reach another instance
+	CloseShutdown = 4005
+	// nothing, pongs included, was read for PongTimeout
+	CloseIdle = 4006
+	// the connection's send buffer filled up
+	CloseTooSlow = 4007
+	// another connection took the player over with its resume token
+	CloseResumedElsewhere = 4008
+	// MaxStrikes malformed or refused messages
+	CloseTooManyStrikes = 4009
+	// the join code expired between the handshake and joining
+	CloseUnknownCode = 4010
+	// something went wrong on the server's side
+	CloseInternalError = 4011
+)
+
+var closeText = map[int]string{
+	websocket.CloseNormalClosure: "",
+	CloseRoomFull:                "room full",
+	CloseKicked:                  "kicked by host",
+	CloseBadResumeToken:          "unknown or expired resume token",
+	CloseUnsupportedProtocol:     "unsupported protocol",
+	CloseShutdown:                "server shutting down",
+	CloseIdle:                    "idle timeout",
+	CloseTooSlow:                 "client too slow",
+	CloseResumedElsewhere:        "resumed elsewhere",
+	CloseTooManyStrikes:          "too many bad messages",
+	CloseUnknownCode:             "unknown or expired join code",
+	CloseInternalError:           "internal error",
+}
+
+// closeCode is the close code for a connection whose join failed with err
+func closeCode(err error) int {
+	switch err {
+	case errRoomFull, errSpectatorsFull:
+		return CloseRoomFull
+	case errBadResumeToken:
+		return CloseBadResumeToken
+	case errServerStopped:
+		return CloseShutdown
+	case errUnknownCode:
+		return CloseUnknownCode
+	}
+	return CloseInternalError
+}
+
+func closeMessage(code int) []byte {
+	return websocket.FormatCloseMessage(code, closeText[code])
+}
+
+// close asks the writer to send a close frame with code and tear the
+// connection down. Only the first call has any effect.
+func (c *client) close(code int) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = closeMessage(code)
+		close(c.done)
+	})
+}
+
+// abort sends whatever is queued and a close frame with code on a connection
+// whose writer never started
+func (c *client) abort(code int) {
+	if c.flush() != nil {
+		return
+	}
+	c.conn.WriteControl(websocket.CloseMessage, closeMessage(code), time.Now().Add(writeWait))
+}
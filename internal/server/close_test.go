@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCloseCodes(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want int
+	}{
+		{errRoomFull, CloseRoomFull},
+		{errSpectatorsFull, CloseRoomFull},
+		{errBadResumeToken, CloseBadResumeToken},
+		{errServerStopped, CloseShutdown},
+		{errUnknownCode, CloseUnknownCode},
+		{errors.New("disk on fire"), CloseInternalError},
+	} {
+		if got := closeCode(tt.err); got != tt.want {
+			t.Errorf("closeCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+	for code, text := range closeText {
+		if code == 1000 {
+			continue
+		}
+		if code < 4000 || code > 4099 || text == "" {
+			t.Errorf("close code %d %q", code, text)
+		}
+	}
+}
+
+func TestCloseReasons(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		// closed returns a client the server closes
+		closed func(t *testing.T, ts *testServer) *testClient
+		want   int
+	}{
+		{"room full", func(cfg *Config) { cfg.MaxPlayers = 1 }, func(t *testing.T, ts *testServer) *testClient {
+			ts.dial(t, "/game")
+			return ts.connect(t, "/game", nil)
+		}, CloseRoomFull},
+		{"kicked", nil, func(t *testing.T, ts *testServer) *testClient {
+			host, other := ts.dial(t, "/game"), ts.dial(t, "/game")
+			host.send(MessageKick, KickMessage{PlayerID: other.welcome.ID})
+			return other
+		}, CloseKicked},
+		{"bad resume token", nil, func(t *testing.T, ts *testServer) *testClient {
+			return ts.connect(t, "/game?token=bogus", nil)
+		}, CloseBadResumeToken},
+		{"unsupported protocol", nil, func(t *testing.T, ts *testServer) *testClient {
+			return ts.connect(t, "/game?protocol=99", nil)
+		}, CloseUnsupportedProtocol},
+		{"shutdown", nil, func(t *testing.T, ts *testServer) *testClient {
+			c := ts.dial(t, "/game")
+			go ts.stop()
+			return c
+		}, CloseShutdown},
+		{"idle", func(cfg *Config) {
+			cfg.PingInterval = 20 * time.Millisecond
+			cfg.PongTimeout = 200 * time.Millisecond
+		}, func(t *testing.T, ts *testServer) *testClient {
+			conn, err := ts.open("/game", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// reads, but never answers a ping
+			conn.SetPingHandler(func(string) error { return nil })
+			return newTestClient(t, conn)
+		}, CloseIdle},
+		{"resumed elsewhere", nil, func(t *testing.T, ts *testServer) *testClient {
+			c := ts.dial(t, "/game")
+			ts.dial(t, "/game?token="+c.welcome.Token)
+			return c
+		}, CloseResumedElsewhere},
+		{"too many strikes", func(cfg *Config) { cfg.MaxStrikes = 1 }, func(t *testing.T, ts *testServer) *testClient {
+			c := ts.dial(t, "/game")
+			c.send("chat", "hi")
+			return c
+		}, CloseTooManyStrikes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := startServer(t, nil, tt.configure)
+			ce := tt.closed(t, ts).closeFrame()
+			if ce.Code != tt.want || ce.Text != closeText[tt.want] {
+				t.Fatalf("closed with %d %q, want %d %q", ce.Code, ce.Text, tt.want, closeText[tt.want])
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"compress/flate"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// countingConn counts the bytes read through it
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+// counting is a dialer that asks for compression or not and counts what it
+// reads into read
+func counting(compress bool, read *int64) *websocket.Dialer {
+	return &websocket.Dialer{
+		EnableCompression: compress,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{conn, read}, nil
+		},
+	}
+}
+
+func TestCompressedSnapshots(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	deflate := &websocket.Dialer{EnableCompression: true}
+	// two that compress share one prepared frame, the third gets raw frames
+	clients := []*testClient{
+		ts.connect(t, "/game", deflate),
+		ts.connect(t, "/game", deflate),
+		ts.connect(t, "/game", nil),
+	}
+	for _, c := range clients {
+		c.event(EventWelcome, &c.welcome)
+		c.send(MessageReady, nil)
+	}
+	for _, c := range clients {
+		c.phase(PhasePlaying)
+	}
+	for i := 0; i < 40; i++ {
+		ts.tick(1)
+		var want Snapshot
+		for j, c := range clients {
+			s := c.snapshot()
+			s.Self = nil
+			if j == 0 {
+				want = s
+			} else if !reflect.DeepEqual(s, want) {
+				t.Fatalf("tick %d: client %d got %+v, want %+v", i, j, s, want)
+			}
+		}
+	}
+	for _, c := range clients {
+		if len(c.players) != len(clients) || !reflect.DeepEqual(c.players, clients[0].players) {
+			t.Fatalf("players %v, want %v", c.players, clients[0].players)
+		}
+	}
+}
+
+func TestCompressionNegotiated(t *testing.T) {
+	for _, tt := range []struct {
+		level int
+		want  bool
+	}{
+		{flate.BestSpeed, true},
+		{flate.NoCompression, false},
+	} {
+		ts := startServer(t, nil, func(cfg *Config) {
+			cfg.CompressionLevel = tt.level
+		})
+		conn, resp, err := (&websocket.Dialer{EnableCompression: true}).Dial("ws://"+ts.addr+"/game", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		got := strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+		if got != tt.want {
+			t.Fatalf("level %d: compression negotiated %v, want %v", tt.level, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkSnapshotWire measures the bytes on the wire for a 50 player
+// keyframe, sent the way the server sends a room's snapshots, with and
+// without compression
+func BenchmarkSnapshotWire(b *testing.B) {
+	r := benchRoom(b, 50)
+	msg := encode(MessageSnapshot, r.snapshot()).msg
+	for _, compress := range []bool{false, true} {
+		name := "raw"
+		if compress {
+			name = "deflate"
+		}
+		b.Run(name, func(b *testing.B) {
+			upgrader := websocket.Upgrader{EnableCompression: compress}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ln.Close()
+			frames := make(chan *websocket.PreparedMessage)
+			go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				c.SetCompressionLevel(flate.BestSpeed)
+				for pm := range frames {
+					if err := c.WritePreparedMessage(pm); err != nil {
+						return
+					}
+				}
+			}))
+			var read int64
+			conn, _, err := counting(compress, &read).Dial("ws://"+ln.Addr().String(), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			start := atomic.LoadInt64(&read)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pm, err := websocket.NewPreparedMessage(websocket.TextMessage, msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				frames <- pm
+				if _, got, err := conn.ReadMessage(); err != nil || len(got) != len(msg) {
+					b.Fatalf("read %d bytes, %v", len(got), err)
+				}
+			}
+			b.StopTimer()
+			close(frames)
+			b.ReportMetric(float64(atomic.LoadInt64(&read)-start)/float64(b.N), "wire-bytes/op")
+			b.ReportMetric(float64(len(msg)), "json-bytes")
+		})
+	}
+}
@@ -0,0 +1,874 @@
+package server
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/broker"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/clock"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/store"
+)
+
+const (
+	BrokerLocal   = "local"
+	BrokerRedis   = "redis"
+	BrokerStreams = "streams"
+)
+
+// how inputs are encoded on the broker, which every instance sharing it must
+// agree on
+const (
+	InputJSON     = "json"
+	InputProtobuf = "protobuf"
+)
+
+// how the frames of a batched input message are applied
+const (
+	// one frame per tick, in order
+	BatchSequential = "sequential"
+	// every frame in the next tick, added up like inputs that arrive
+	// between two ticks
+	BatchCoalesce = "coalesce"
+)
+
+// where a room goes once a match has ended and the intermission is over
+const (
+	AfterMatchLobby   = "lobby"
+	AfterMatchRestart = "restart"
+)
+
+// what happens to players joining a room whose match has started
+const (
+	MidMatchSpawn    = "spawn"
+	MidMatchSpectate = "spectate"
+)
+
+// game modes a room can be played in
+const (
+	ModeFreeForAll = "ffa"
+	ModeTag        = "tag"
+	// capture the flag, always played in teams
+	ModeCTF = "ctf"
+	// king of the hill
+	ModeHill = "koth"
+)
+
+// modes are the simulation rules of each game mode
+var modes = map[string]sim.Mode{
+	ModeFreeForAll: sim.FreeForAll{},
+	ModeTag:        sim.Tag{},
+	ModeCTF:        sim.CaptureTheFlag{},
+	ModeHill:       sim.KingOfTheHill{},
+}
+
+// modeNames lists the game modes for error messages
+func modeNames() string {
+	names := make([]string, 0, len(modes))
+	for name := range modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return quoted(names)
+}
+
+// quoted joins names, each quoted, for error messages
+func quoted(names []string) string {
+	q := make([]string, len(names))
+	for i, name := range names {
+		q[i] = strconv.Quote(name)
+	}
+	return strings.Join(q, ", ")
+}
+
+// ErrInvalidConfig is wrapped by every error from LoadConfig and Validate
+var ErrInvalidConfig = errors.New("invalid config")
+
+// Config holds the tunables for a Server
+type Config struct {
+	ListenAddr string
+	Tick       time.Duration
+
+	WorldWidth  int
+	WorldHeight int
+	// whether the world wraps around at its edges instead of stopping
+	// players there
+	Wrap bool
+	// top speed in pixels per second, and how fast players speed up and
+	// slow down in pixels per second squared
+	PlayerSpeed  int
+	Acceleration int
+	Friction     int
+	// radius of a player in pixels for collisions, 0 turning them off
+	PlayerRadius int
+	// top speed while sprinting as a percent of PlayerSpeed, the stamina
+	// players sprint with, how much of it a second of sprinting uses and
+	// walking gives back, and how long running out stops them sprinting
+	SprintSpeed   int
+	Stamina       int
+	StaminaDrain  int
+	StaminaRegen  int
+	SprintLockout time.Duration
+	// how far a dash moves a player in pixels, 0 turning dashes off, and
+	// how long they wait to dash again
+	DashDistance int
+	DashCooldown time.Duration
+	// projectile speed in pixels per second, how long one flies and how
+	// long a player waits between shots
+	ProjectileSpeed int
+	ProjectileTTL   time.Duration
+	FireCooldown    time.Duration
+	// health players start with, what a hit takes off, and how long after
+	// being killed they respawn
+	MaxHP            int
+	ProjectileDamage int
+	RespawnDelay     time.Duration
+	// the impulse in pixels per second a hit knocks a player back with, the
+	// one two players bumping into each other get, 0 for none, and the
+	// percent of their acceleration players keep until it wears off
+	Knockback        int
+	BumpKnockback    int
+	KnockbackControl int
+	// how long players can't be hurt after joining and respawning, and
+	// whether firing a shot ends that early
+	SpawnProtection    time.Duration
+	ShotEndsProtection bool
+	// coins lying around at once, how near a player must come to collect
+	// one, what it is worth and how long until a collected one is replaced
+	Coins       int
+	CoinRadius  int
+	CoinPoints  int
+	CoinRespawn time.Duration
+	// power-ups lying around at most, how often one is put down when there
+	// is room and how long it stays, and the percent of top speed a speed
+	// power-up gives for BoostDuration
+	PowerUps        int
+	PowerUpInterval time.Duration
+	PowerUpTTL      time.Duration
+	SpeedBoost      int
+	BoostDuration   time.Duration
+	// ModeFreeForAll, ModeTag, ModeCTF or ModeHill, and in tag how long a
+	// player that passed on it can't be tagged back and how long being it
+	// costs a point
+	Mode        string
+	TagImmunity time.Duration
+	TagCost     time.Duration
+	// ticks of holding the zone that win king of the hill
+	HillScore int
+	// whether players are split into teams outside capture the flag, how
+	// many players a team may be ahead after a switch, and whether
+	// projectiles hurt teammates
+	Teams        bool
+	TeamDelta    int
+	FriendlyFire bool
+	// decimal places positions are sent with, 0 meaning whole pixels
+	PositionPrecision int
+	// json file of obstacles placed in every room, and what was loaded
+	// from it
+	MapFile   string
+	Obstacles []sim.Rect
+	Spawns    []sim.Point
+	Bases     []sim.Point
+	Hill      *sim.Circle
+	// a directory of named maps private rooms may pick from, what was
+	// loaded from it, and the one public rooms use instead of MapFile
+	MapDir string
+	Maps   map[string]Map
+	Map    string
+	// without spawn points, how far from other players new ones start
+	// when there is room
+	SpawnDistance int
+	MaxPlayers    int
+	// bots put in every room, which don't count towards MaxPlayers
+	Bots int
+	// spectators per room, on top of MaxPlayers
+	MaxSpectators int
+	// MidMatchSpawn or MidMatchSpectate
+	MidMatchJoin string
+	// a match needs MinPlayers ready players, then starts after Countdown,
+	// or straight away when Countdown is zero
+	MinPlayers int
+	Countdown  time.Duration
+	// how long a match lasts, 0 for as long as nobody wins, how long its
+	// results are shown for and AfterMatchLobby or AfterMatchRestart
+	MatchDuration time.Duration
+	Intermission  time.Duration
+	AfterMatch    string
+	// the score that wins a match, 0 for none, and whether the dead sit
+	// out the rest of it until one player or team is left alive
+	WinScore  int
+	LastAlive bool
+	// how long a host's pause lasts at most before the match goes on
+	PauseTimeout time.Duration
+
+	// BrokerLocal, BrokerRedis for redis pub/sub or BrokerStreams for redis
+	// streams
+	Broker string
+	Redis  broker.RedisConfig
+	// with BrokerStreams, about how many inputs each room's stream keeps and
+	// the consumer group this instance reads them with, which has to stay the
+	// same across restarts for un-acked inputs to be read again
+	StreamMaxLen int
+	StreamGroup  string
+	// prefix of the broker channels; each room publishes and subscribes
+	// only on Channel:{<room>}, hash tagged for redis cluster
+	Channel string
+	// InputJSON or InputProtobuf
+	InputFormat string
+
+	// websocket base url other instances redirect players to, like
+	// ws://10.0.0.5:8080; setting it with the redis or streams broker turns
+	// on the room registry. Claims last RegistryTTL unless refreshed.
+	AdvertiseURL string
+	RegistryTTL  time.Duration
+
+	// every KeyframeInterval-th snapshot carries every player, the ones in
+	// between only what changed
+	KeyframeInterval int
+	// how many of the top scoring players snapshots list
+	LeaderboardSize int
+
+	// maximum number of inputs buffered between ticks
+	MaxEventQueue int
+	// most frames one input message may carry, and with BatchSequential
+	// the most a player can have waiting for later ticks; beyond that the
+	// oldest are coalesced into the next tick
+	MaxInputBatch int
+	// BatchSequential or BatchCoalesce
+	InputBatching string
+	// warn once a single source has sent this many malformed payloads
+	MalformedWarnThreshold int
+	// client messages longer than this many bytes are refused, and a
+	// connection is closed after MaxStrikes messages that were malformed or
+	// refused
+	MaxMessageSize int
+	MaxStrikes     int
+	// the server stops after this many ticks in a row have panicked
+	MaxTickPanics int
+
+	// players per matchmade room, and how long the first of them waits
+	// before a match starts with whoever is queued
+	MatchSize    int
+	MatchMaxWait time.Duration
+
+	// how long a disconnected player is kept for their resume token, zero
+	// drops players as soon as they disconnect
+	ReconnectGrace time.Duration
+	// keeps players as they join and leave, and every PlayerSaveInterval
+	// while connected, for ReconnectGrace, so they can resume on any
+	// instance; nil keeps them on this one only
+	Players            store.Players
+	PlayerSaveInterval time.Duration
+	// all-time scores of players holding a resume token, per game mode;
+	// nil keeps none
+	Leaderboard store.Leaderboard
+	// keeps every CheckpointTicks ticks what each public room's world looks
+	// like, so a room started again within CheckpointMaxAge, on this
+	// instance or another, carries on from there. Only used with a room
+	// registry, so a room's checkpoint is only ever taken and restored by
+	// the instance holding its claim; nil or zero ticks keeps none
+	Checkpoints      store.Checkpoints
+	CheckpointTicks  int
+	CheckpointMaxAge time.Duration
+	// records of finished matches, the latest MatchHistory of each game
+	// mode for up to MatchTTL, zero meaning however long that is; nil
+	// keeps none
+	Matches      store.Matches
+	MatchHistory int
+	MatchTTL     time.Duration
+	// words that may not appear in player names, ignoring case
+	NameBlocklist []string
+
+	// how long a room is kept once its last player leaves, so a quick
+	// reconnect lands back in the same room
+	EmptyRoomGrace time.Duration
+	// how long a private room waits for its first player before its join
+	// code expires
+	PrivateRoomTTL time.Duration
+
+	// how long shutdown waits for clients to receive their close frames
+	DrainTimeout time.Duration
+
+	// a ping is sent every PingInterval and the connection is dropped if
+	// nothing (pongs included) has been read for PongTimeout
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// flate level for permessage-deflate, from -2 (huffman only) to 9; 0
+	// turns compression off so all frames go out raw
+	CompressionLevel int
+
+	// drives the tick loop, nil means real time
+	Clock clock.Clock
+	// seeds the random source of each room's world by its name, nil
+	// meaning from the time the room is made
+	Seed func(room string) int64
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:             ":8080",
+		Tick:                   24 * time.Millisecond,
+		WorldWidth:             800,
+		WorldHeight:            600,
+		PlayerSpeed:            40,
+		Acceleration:           400,
+		Friction:               400,
+		PlayerRadius:           10,
+		SpawnDistance:          60,
+		SprintSpeed:            160,
+		Stamina:                100,
+		StaminaDrain:           50,
+		StaminaRegen:           25,
+		SprintLockout:          time.Second,
+		DashDistance:           80,
+		DashCooldown:           2 * time.Second,
+		ProjectileSpeed:        400,
+		ProjectileTTL:          1500 * time.Millisecond,
+		FireCooldown:           250 * time.Millisecond,
+		MaxHP:                  100,
+		ProjectileDamage:       25,
+		Knockback:              200,
+		KnockbackControl:       25,
+		RespawnDelay:           3 * time.Second,
+		SpawnProtection:        2 * time.Second,
+		ShotEndsProtection:     true,
+		Coins:                  5,
+		CoinRadius:             16,
+		CoinPoints:             1,
+		CoinRespawn:            5 * time.Second,
+		PowerUps:               1,
+		PowerUpInterval:        15 * time.Second,
+		PowerUpTTL:             10 * time.Second,
+		SpeedBoost:             150,
+		BoostDuration:          5 * time.Second,
+		Mode:                   ModeFreeForAll,
+		TagImmunity:            time.Second,
+		TagCost:                time.Second,
+		HillScore:              1000,
+		TeamDelta:              1,
+		PositionPrecision:      0,
+		MaxPlayers:             64,
+		MaxSpectators:          32,
+		MidMatchJoin:           MidMatchSpawn,
+		MinPlayers:             1,
+		Countdown:              3 * time.Second,
+		MatchDuration:          5 * time.Minute,
+		Intermission:           10 * time.Second,
+		PauseTimeout:           time.Minute,
+		AfterMatch:             AfterMatchLobby,
+		Broker:                 BrokerLocal,
+		Channel:                "inputs",
+		StreamMaxLen:           10000,
+		InputFormat:            InputJSON,
+		RegistryTTL:            15 * time.Second,
+		KeyframeInterval:       30,
+		LeaderboardSize:        10,
+		MaxEventQueue:          1024,
+		MaxInputBatch:          16,
+		InputBatching:          BatchSequential,
+		MalformedWarnThreshold: 10,
+		MaxMessageSize:         4096,
+		MaxStrikes:             5,
+		MaxTickPanics:          10,
+		MatchSize:              2,
+		MatchMaxWait:           5 * time.Second,
+		ReconnectGrace:         10 * time.Second,
+		PlayerSaveInterval:     5 * time.Second,
+		CheckpointTicks:        125,
+		CheckpointMaxAge:       30 * time.Second,
+		MatchHistory:           100,
+		MatchTTL:               7 * 24 * time.Hour,
+		EmptyRoomGrace:         10 * time.Second,
+		PrivateRoomTTL:         5 * time.Minute,
+		DrainTimeout:           10 * time.Second,
+		PingInterval:           20 * time.Second,
+		PongTimeout:            30 * time.Second,
+		CompressionLevel:       flate.BestSpeed,
+	}
+}
+
+// LoadConfig applies environment overrides on top of DefaultConfig and
+// validates the result.
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" {
+		cfg.ListenAddr = addr
+	} else if port := os.Getenv("PORT"); port != "" {
+		cfg.ListenAddr = ":" + port
+	}
+
+	cfg.Redis.Connection = os.Getenv("DATABASES_FOR_REDIS_CONNECTION")
+	cfg.Redis.URL = os.Getenv("REDIS_URL")
+	cfg.Redis.SentinelMaster = os.Getenv("REDIS_SENTINEL_MASTER")
+	if v := os.Getenv("REDIS_SENTINEL_ADDRS"); v != "" {
+		cfg.Redis.SentinelAddrs = strings.Split(v, ",")
+	}
+	cfg.Redis.SentinelPassword = os.Getenv("REDIS_SENTINEL_PASSWORD")
+	if v := os.Getenv("REDIS_CLUSTER_ADDRS"); v != "" {
+		cfg.Redis.ClusterAddrs = strings.Split(v, ",")
+	}
+	if v := os.Getenv("REDIS_CHANNEL"); v != "" {
+		cfg.Channel = v
+	}
+	// redis is used whenever it is configured, unless BROKER says otherwise
+	if cfg.Redis.Connection != "" || cfg.Redis.URL != "" || cfg.Redis.SentinelMaster != "" || len(cfg.Redis.ClusterAddrs) > 0 {
+		cfg.Broker = BrokerRedis
+	}
+	if v := os.Getenv("BROKER"); v != "" {
+		cfg.Broker = v
+	}
+	cfg.StreamGroup, _ = os.Hostname()
+	if v := os.Getenv("REDIS_STREAM_GROUP"); v != "" {
+		cfg.StreamGroup = v
+	}
+	if v := os.Getenv("INPUT_FORMAT"); v != "" {
+		cfg.InputFormat = v
+	}
+	if v := os.Getenv("INPUT_BATCHING"); v != "" {
+		cfg.InputBatching = v
+	}
+	if v := os.Getenv("ADVERTISE_URL"); v != "" {
+		cfg.AdvertiseURL = v
+	}
+	if v := os.Getenv("NAME_BLOCKLIST"); v != "" {
+		cfg.NameBlocklist = strings.Split(v, ",")
+	}
+	if v := os.Getenv("MID_MATCH_JOIN"); v != "" {
+		cfg.MidMatchJoin = v
+	}
+	if v := os.Getenv("AFTER_MATCH"); v != "" {
+		cfg.AfterMatch = v
+	}
+	if v := os.Getenv("GAME_MODE"); v != "" {
+		cfg.Mode = v
+	}
+	if v := os.Getenv("SHOT_ENDS_PROTECTION"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, invalidf("SHOT_ENDS_PROTECTION %q is not a boolean", v)
+		}
+		cfg.ShotEndsProtection = b
+	}
+	if v := os.Getenv("WORLD_WRAP"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, invalidf("WORLD_WRAP %q is not a boolean", v)
+		}
+		cfg.Wrap = b
+	}
+	if v := os.Getenv("TEAMS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, invalidf("TEAMS %q is not a boolean", v)
+		}
+		cfg.Teams = b
+	}
+	if v := os.Getenv("FRIENDLY_FIRE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, invalidf("FRIENDLY_FIRE %q is not a boolean", v)
+		}
+		cfg.FriendlyFire = b
+	}
+	if v := os.Getenv("LAST_ALIVE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, invalidf("LAST_ALIVE %q is not a boolean", v)
+		}
+		cfg.LastAlive = b
+	}
+	if v := os.Getenv("MAP_FILE"); v != "" {
+		m, err := LoadMap(v)
+		if err != nil {
+			return cfg, invalidf("MAP_FILE %q: %s", v, err)
+		}
+		cfg.MapFile = v
+		cfg.Obstacles = m.Obstacles
+		cfg.Spawns = m.Spawns
+		cfg.Bases = m.Bases
+		cfg.Hill = m.Hill
+	}
+	if v := os.Getenv("MAP_DIR"); v != "" {
+		maps, err := LoadMaps(v)
+		if err != nil {
+			return cfg, invalidf("MAP_DIR %q: %s", v, err)
+		}
+		cfg.MapDir = v
+		cfg.Maps = maps
+	}
+	if v := os.Getenv("MAP"); v != "" {
+		cfg.Map = v
+	}
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"WORLD_WIDTH", &cfg.WorldWidth},
+		{"WORLD_HEIGHT", &cfg.WorldHeight},
+		{"PLAYER_SPEED", &cfg.PlayerSpeed},
+		{"ACCELERATION", &cfg.Acceleration},
+		{"FRICTION", &cfg.Friction},
+		{"PLAYER_RADIUS", &cfg.PlayerRadius},
+		{"SPRINT_SPEED", &cfg.SprintSpeed},
+		{"STAMINA", &cfg.Stamina},
+		{"STAMINA_DRAIN", &cfg.StaminaDrain},
+		{"STAMINA_REGEN", &cfg.StaminaRegen},
+		{"DASH_DISTANCE", &cfg.DashDistance},
+		{"SPAWN_DISTANCE", &cfg.SpawnDistance},
+		{"PROJECTILE_SPEED", &cfg.ProjectileSpeed},
+		{"MAX_HP", &cfg.MaxHP},
+		{"PROJECTILE_DAMAGE", &cfg.ProjectileDamage},
+		{"KNOCKBACK", &cfg.Knockback},
+		{"BUMP_KNOCKBACK", &cfg.BumpKnockback},
+		{"KNOCKBACK_CONTROL", &cfg.KnockbackControl},
+		{"COINS", &cfg.Coins},
+		{"COIN_RADIUS", &cfg.CoinRadius},
+		{"COIN_POINTS", &cfg.CoinPoints},
+		{"HILL_SCORE", &cfg.HillScore},
+		{"TEAM_DELTA", &cfg.TeamDelta},
+		{"POWER_UPS", &cfg.PowerUps},
+		{"SPEED_BOOST", &cfg.SpeedBoost},
+		{"POSITION_PRECISION", &cfg.PositionPrecision},
+		{"MAX_PLAYERS", &cfg.MaxPlayers},
+		{"MIN_PLAYERS", &cfg.MinPlayers},
+		{"MAX_SPECTATORS", &cfg.MaxSpectators},
+		{"BOTS", &cfg.Bots},
+		{"WIN_SCORE", &cfg.WinScore},
+		{"KEYFRAME_INTERVAL", &cfg.KeyframeInterval},
+		{"LEADERBOARD_SIZE", &cfg.LeaderboardSize},
+		{"MAX_EVENT_QUEUE", &cfg.MaxEventQueue},
+		{"MAX_INPUT_BATCH", &cfg.MaxInputBatch},
+		{"MALFORMED_WARN_THRESHOLD", &cfg.MalformedWarnThreshold},
+		{"MAX_MESSAGE_SIZE", &cfg.MaxMessageSize},
+		{"MAX_STRIKES", &cfg.MaxStrikes},
+		{"MAX_TICK_PANICS", &cfg.MaxTickPanics},
+		{"MATCH_SIZE", &cfg.MatchSize},
+		{"COMPRESSION_LEVEL", &cfg.CompressionLevel},
+		{"REDIS_STREAM_MAXLEN", &cfg.StreamMaxLen},
+		{"CHECKPOINT_TICKS", &cfg.CheckpointTicks},
+		{"MATCH_HISTORY", &cfg.MatchHistory},
+	}
+	for _, v := range ints {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return cfg, invalidf("%s %q is not an integer", v.name, s)
+		}
+		*v.dst = n
+	}
+
+	durations := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"TICK", &cfg.Tick},
+		{"COUNTDOWN", &cfg.Countdown},
+		{"MATCH_DURATION", &cfg.MatchDuration},
+		{"INTERMISSION", &cfg.Intermission},
+		{"PAUSE_TIMEOUT", &cfg.PauseTimeout},
+		{"SPRINT_LOCKOUT", &cfg.SprintLockout},
+		{"DASH_COOLDOWN", &cfg.DashCooldown},
+		{"PROJECTILE_TTL", &cfg.ProjectileTTL},
+		{"FIRE_COOLDOWN", &cfg.FireCooldown},
+		{"RESPAWN_DELAY", &cfg.RespawnDelay},
+		{"SPAWN_PROTECTION", &cfg.SpawnProtection},
+		{"COIN_RESPAWN", &cfg.CoinRespawn},
+		{"POWER_UP_INTERVAL", &cfg.PowerUpInterval},
+		{"POWER_UP_TTL", &cfg.PowerUpTTL},
+		{"BOOST_DURATION", &cfg.BoostDuration},
+		{"TAG_IMMUNITY", &cfg.TagImmunity},
+		{"TAG_COST", &cfg.TagCost},
+		{"MATCH_MAX_WAIT", &cfg.MatchMaxWait},
+		{"RECONNECT_GRACE", &cfg.ReconnectGrace},
+		{"PLAYER_SAVE_INTERVAL", &cfg.PlayerSaveInterval},
+		{"CHECKPOINT_MAX_AGE", &cfg.CheckpointMaxAge},
+		{"MATCH_TTL", &cfg.MatchTTL},
+		{"EMPTY_ROOM_GRACE", &cfg.EmptyRoomGrace},
+		{"PRIVATE_ROOM_TTL", &cfg.PrivateRoomTTL},
+		{"REGISTRY_TTL", &cfg.RegistryTTL},
+		{"DRAIN_TIMEOUT", &cfg.DrainTimeout},
+		{"PING_INTERVAL", &cfg.PingInterval},
+		{"PONG_TIMEOUT", &cfg.PongTimeout},
+	}
+	for _, v := range durations {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return cfg, invalidf("%s %q: %s", v.name, s, err)
+		}
+		*v.dst = d
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate reports the first setting that is out of range
+func (cfg Config) Validate() error {
+	if cfg.ListenAddr == "" {
+		return invalidf("listen address must not be empty")
+	}
+
+	positive := []struct {
+		name string
+		v    int64
+	}{
+		{"tick", int64(cfg.Tick)},
+		{"world width", int64(cfg.WorldWidth)},
+		{"world height", int64(cfg.WorldHeight)},
+		{"player speed", int64(cfg.PlayerSpeed)},
+		{"acceleration", int64(cfg.Acceleration)},
+		{"stamina", int64(cfg.Stamina)},
+		{"stamina drain", int64(cfg.StaminaDrain)},
+		{"projectile speed", int64(cfg.ProjectileSpeed)},
+		{"projectile ttl", int64(cfg.ProjectileTTL)},
+		{"max hp", int64(cfg.MaxHP)},
+		{"power up ttl", int64(cfg.PowerUpTTL)},
+		{"tag cost", int64(cfg.TagCost)},
+		{"hill score", int64(cfg.HillScore)},
+		{"team delta", int64(cfg.TeamDelta)},
+		{"max players", int64(cfg.MaxPlayers)},
+		{"min players", int64(cfg.MinPlayers)},
+		{"max spectators", int64(cfg.MaxSpectators)},
+		{"keyframe interval", int64(cfg.KeyframeInterval)},
+		{"leaderboard size", int64(cfg.LeaderboardSize)},
+		{"max event queue", int64(cfg.MaxEventQueue)},
+		{"max input batch", int64(cfg.MaxInputBatch)},
+		{"malformed warn threshold", int64(cfg.MalformedWarnThreshold)},
+		{"max message size", int64(cfg.MaxMessageSize)},
+		{"max strikes", int64(cfg.MaxStrikes)},
+		{"max tick panics", int64(cfg.MaxTickPanics)},
+		{"match size", int64(cfg.MatchSize)},
+		{"match max wait", int64(cfg.MatchMaxWait)},
+		{"empty room grace", int64(cfg.EmptyRoomGrace)},
+		{"private room ttl", int64(cfg.PrivateRoomTTL)},
+		{"checkpoint max age", int64(cfg.CheckpointMaxAge)},
+		{"match history", int64(cfg.MatchHistory)},
+		{"registry ttl", int64(cfg.RegistryTTL)},
+		{"drain timeout", int64(cfg.DrainTimeout)},
+		{"ping interval", int64(cfg.PingInterval)},
+		{"pong timeout", int64(cfg.PongTimeout)},
+	}
+	for _, p := range positive {
+		if p.v <= 0 {
+			return invalidf("%s must be positive, got %d", p.name, p.v)
+		}
+	}
+	if cfg.Bots < 0 || cfg.Bots > maxBots {
+		return invalidf("bots must be between 0 and %d, got %d", maxBots, cfg.Bots)
+	}
+	if cfg.WinScore < 0 || cfg.WinScore > maxWinScore {
+		return invalidf("win score must be between 0 and %d, got %d", maxWinScore, cfg.WinScore)
+	}
+	if cfg.MinPlayers > cfg.MaxPlayers {
+		return invalidf("min players (%d) must not exceed max players (%d)", cfg.MinPlayers, cfg.MaxPlayers)
+	}
+	if cfg.Friction < 0 {
+		return invalidf("friction must not be negative, got %d", cfg.Friction)
+	}
+	if cfg.PlayerRadius < 0 {
+		return invalidf("player radius must not be negative, got %d", cfg.PlayerRadius)
+	}
+	if cfg.SprintSpeed < 100 {
+		return invalidf("sprint speed must be at least 100 percent, got %d", cfg.SprintSpeed)
+	}
+	if cfg.StaminaRegen < 0 {
+		return invalidf("stamina regen must not be negative, got %d", cfg.StaminaRegen)
+	}
+	if cfg.SprintLockout < 0 {
+		return invalidf("sprint lockout must not be negative, got %s", cfg.SprintLockout)
+	}
+	if cfg.DashDistance < 0 {
+		return invalidf("dash distance must not be negative, got %d", cfg.DashDistance)
+	}
+	if cfg.DashCooldown < 0 {
+		return invalidf("dash cooldown must not be negative, got %s", cfg.DashCooldown)
+	}
+	if cfg.FireCooldown < 0 {
+		return invalidf("fire cooldown must not be negative, got %s", cfg.FireCooldown)
+	}
+	if cfg.ProjectileDamage < 0 {
+		return invalidf("projectile damage must not be negative, got %d", cfg.ProjectileDamage)
+	}
+	if cfg.Knockback < 0 {
+		return invalidf("knockback must not be negative, got %d", cfg.Knockback)
+	}
+	if cfg.BumpKnockback < 0 {
+		return invalidf("bump knockback must not be negative, got %d", cfg.BumpKnockback)
+	}
+	if cfg.KnockbackControl < 0 || cfg.KnockbackControl > 100 {
+		return invalidf("knockback control must be between 0 and 100 percent, got %d", cfg.KnockbackControl)
+	}
+	if cfg.RespawnDelay < 0 {
+		return invalidf("respawn delay must not be negative, got %s", cfg.RespawnDelay)
+	}
+	if cfg.SpawnProtection < 0 {
+		return invalidf("spawn protection must not be negative, got %s", cfg.SpawnProtection)
+	}
+	if cfg.Coins < 0 {
+		return invalidf("coins must not be negative, got %d", cfg.Coins)
+	}
+	if cfg.CoinRadius < 0 {
+		return invalidf("coin radius must not be negative, got %d", cfg.CoinRadius)
+	}
+	if cfg.CoinPoints < 0 {
+		return invalidf("coin points must not be negative, got %d", cfg.CoinPoints)
+	}
+	if cfg.CoinRespawn < 0 {
+		return invalidf("coin respawn must not be negative, got %s", cfg.CoinRespawn)
+	}
+	if cfg.PowerUps < 0 {
+		return invalidf("power ups must not be negative, got %d", cfg.PowerUps)
+	}
+	if cfg.PowerUpInterval < 0 {
+		return invalidf("power up interval must not be negative, got %s", cfg.PowerUpInterval)
+	}
+	if cfg.SpeedBoost < 100 {
+		return invalidf("speed boost must be at least 100 percent, got %d", cfg.SpeedBoost)
+	}
+	if cfg.BoostDuration < 0 {
+		return invalidf("boost duration must not be negative, got %s", cfg.BoostDuration)
+	}
+	if _, ok := modes[cfg.Mode]; !ok {
+		return invalidf("unknown game mode %q, want one of %s", cfg.Mode, modeNames())
+	}
+	if cfg.TagImmunity < 0 {
+		return invalidf("tag immunity must not be negative, got %s", cfg.TagImmunity)
+	}
+	if cfg.PositionPrecision < 0 || cfg.PositionPrecision > maxPrecision {
+		return invalidf("position precision must be between 0 and %d, got %d", maxPrecision, cfg.PositionPrecision)
+	}
+	if i := outside(cfg.Obstacles, cfg.WorldWidth, cfg.WorldHeight); i >= 0 {
+		return invalidf("obstacle %d of %s lies outside the %dx%d world", i, cfg.MapFile, cfg.WorldWidth, cfg.WorldHeight)
+	}
+	if i := outsidePoint(cfg.Spawns, cfg.WorldWidth, cfg.WorldHeight); i >= 0 {
+		return invalidf("spawn point %d of %s lies outside the %dx%d world", i, cfg.MapFile, cfg.WorldWidth, cfg.WorldHeight)
+	}
+	if i := outsidePoint(cfg.Bases, cfg.WorldWidth, cfg.WorldHeight); i >= 0 {
+		return invalidf("base %d of %s lies outside the %dx%d world", i, cfg.MapFile, cfg.WorldWidth, cfg.WorldHeight)
+	}
+	if outsideCircle(cfg.Hill, cfg.WorldWidth, cfg.WorldHeight) {
+		return invalidf("hill of %s lies outside the %dx%d world", cfg.MapFile, cfg.WorldWidth, cfg.WorldHeight)
+	}
+	for _, name := range cfg.mapNames() {
+		m := cfg.Maps[name]
+		if err := m.fits(m.size(cfg.WorldWidth, cfg.WorldHeight)); err != nil {
+			return invalidf("map %s of %s: %s", name, cfg.MapDir, err)
+		}
+	}
+	if cfg.Map != "" {
+		if _, ok := cfg.Maps[cfg.Map]; !ok {
+			return invalidf("unknown map %q, want one of %s", cfg.Map, quoted(cfg.mapNames()))
+		}
+		if cfg.MapFile != "" {
+			return invalidf("map %q and map file %s can't both be used", cfg.Map, cfg.MapFile)
+		}
+	}
+	if cfg.SpawnDistance < 0 {
+		return invalidf("spawn distance must not be negative, got %d", cfg.SpawnDistance)
+	}
+	if cfg.Countdown < 0 {
+		return invalidf("countdown must not be negative, got %s", cfg.Countdown)
+	}
+	if cfg.MatchDuration < 0 {
+		return invalidf("match duration must not be negative, got %s", cfg.MatchDuration)
+	}
+	if cfg.Intermission < 0 {
+		return invalidf("intermission must not be negative, got %s", cfg.Intermission)
+	}
+	if cfg.PauseTimeout <= 0 {
+		return invalidf("pause timeout must be positive, got %s", cfg.PauseTimeout)
+	}
+	if cfg.AfterMatch != AfterMatchLobby && cfg.AfterMatch != AfterMatchRestart {
+		return invalidf("unknown after match %q, want %q or %q", cfg.AfterMatch, AfterMatchLobby, AfterMatchRestart)
+	}
+	if cfg.ReconnectGrace < 0 {
+		return invalidf("reconnect grace must not be negative, got %s", cfg.ReconnectGrace)
+	}
+	if cfg.PlayerSaveInterval < 0 {
+		return invalidf("player save interval must not be negative, got %s", cfg.PlayerSaveInterval)
+	}
+	if cfg.CheckpointTicks < 0 {
+		return invalidf("checkpoint ticks must not be negative, got %d", cfg.CheckpointTicks)
+	}
+	if cfg.MatchTTL < 0 {
+		return invalidf("match ttl must not be negative, got %s", cfg.MatchTTL)
+	}
+	if cfg.MatchMaxWait >= httpWriteTimeout {
+		return invalidf("match max wait (%s) must be shorter than the http write timeout (%s)", cfg.MatchMaxWait, httpWriteTimeout)
+	}
+	if cfg.CompressionLevel < flate.HuffmanOnly || cfg.CompressionLevel > flate.BestCompression {
+		return invalidf("compression level must be between %d and %d, got %d", flate.HuffmanOnly, flate.BestCompression, cfg.CompressionLevel)
+	}
+	if cfg.PingInterval >= cfg.PongTimeout {
+		return invalidf("ping interval (%s) must be shorter than pong timeout (%s)", cfg.PingInterval, cfg.PongTimeout)
+	}
+
+	if cfg.MidMatchJoin != MidMatchSpawn && cfg.MidMatchJoin != MidMatchSpectate {
+		return invalidf("unknown mid-match join %q, want %q or %q", cfg.MidMatchJoin, MidMatchSpawn, MidMatchSpectate)
+	}
+
+	switch cfg.Broker {
+	case BrokerLocal:
+	case BrokerRedis, BrokerStreams:
+		if len(cfg.Redis.ClusterAddrs) > 0 {
+			if _, err := broker.ClusterOptions(cfg.Redis); err != nil {
+				return invalidf("%s", err)
+			}
+		} else if cfg.Redis.SentinelMaster != "" {
+			if _, err := broker.FailoverOptions(cfg.Redis); err != nil {
+				return invalidf("%s", err)
+			}
+		} else if cfg.Redis.Connection == "" && cfg.Redis.URL == "" {
+			return invalidf("%s broker needs DATABASES_FOR_REDIS_CONNECTION, REDIS_URL, REDIS_SENTINEL_MASTER or REDIS_CLUSTER_ADDRS", cfg.Broker)
+		}
+		if cfg.Channel == "" {
+			return invalidf("redis channel must not be empty")
+		}
+	default:
+		return invalidf("unknown broker %q, want %q, %q or %q", cfg.Broker, BrokerLocal, BrokerRedis, BrokerStreams)
+	}
+	if cfg.Broker == BrokerStreams {
+		if cfg.StreamMaxLen <= 0 {
+			return invalidf("stream maxlen must be positive, got %d", cfg.StreamMaxLen)
+		}
+		if cfg.StreamGroup == "" {
+			return invalidf("streams broker needs REDIS_STREAM_GROUP")
+		}
+	}
+	if cfg.InputFormat != InputJSON && cfg.InputFormat != InputProtobuf {
+		return invalidf("unknown input format %q, want %q or %q", cfg.InputFormat, InputJSON, InputProtobuf)
+	}
+	if cfg.InputBatching != BatchSequential && cfg.InputBatching != BatchCoalesce {
+		return invalidf("unknown input batching %q, want %q or %q", cfg.InputBatching, BatchSequential, BatchCoalesce)
+	}
+
+	if cfg.AdvertiseURL != "" {
+		if cfg.Broker != BrokerRedis && cfg.Broker != BrokerStreams {
+			return invalidf("advertise url needs the %s or %s broker to share the room registry", BrokerRedis, BrokerStreams)
+		}
+		if !strings.HasPrefix(cfg.AdvertiseURL, "ws://") && !strings.HasPrefix(cfg.AdvertiseURL, "wss://") {
+			return invalidf("advertise url %q must start with ws:// or wss://", cfg.AdvertiseURL)
+		}
+	}
+	return nil
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidConfig}, args...)...)
+}
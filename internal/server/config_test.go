@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setenv sets key to value until the test ends
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		name       string
+		addr, port string
+		want       string
+	}{
+		{"default", "", "", ":8080"},
+		{"port", "", "9000", ":9000"},
+		{"addr", "127.0.0.1:9001", "", "127.0.0.1:9001"},
+		{"addr over port", "127.0.0.1:9001", "9000", "127.0.0.1:9001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "LISTEN_ADDR", tt.addr)
+			setenv(t, "PORT", tt.port)
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ListenAddr != tt.want {
+				t.Fatalf("listening on %q, want %q", cfg.ListenAddr, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunPortTaken(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg := testConfig()
+	cfg.ListenAddr = ln.Addr().String()
+	err = NewServer(cfg, nil, nil).Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), ln.Addr().String()) {
+		t.Fatalf("got %v, want an error naming the address", err)
+	}
+}
+
+func TestBrokerMode(t *testing.T) {
+	tests := []struct {
+		name          string
+		url, override string
+		want          string
+	}{
+		{"no redis", "", "", BrokerLocal},
+		{"redis configured", "redis://redis.example:6379", "", BrokerRedis},
+		{"local over redis", "redis://redis.example:6379", BrokerLocal, BrokerLocal},
+		{"streams", "redis://redis.example:6379", BrokerStreams, BrokerStreams},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "REDIS_URL", tt.url)
+			setenv(t, "BROKER", tt.override)
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Broker != tt.want {
+				t.Fatalf("broker %q, want %q", cfg.Broker, tt.want)
+			}
+		})
+	}
+}
+
+func TestSentinelConfig(t *testing.T) {
+	setenv(t, "REDIS_SENTINEL_MASTER", "mymaster")
+	setenv(t, "REDIS_SENTINEL_ADDRS", "s1.example:26379,s2.example:26379")
+	setenv(t, "REDIS_SENTINEL_PASSWORD", "sentinel")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Broker != BrokerRedis || cfg.Redis.SentinelMaster != "mymaster" || len(cfg.Redis.SentinelAddrs) != 2 || cfg.Redis.SentinelPassword != "sentinel" {
+		t.Fatalf("broker %q with %+v", cfg.Broker, cfg.Redis)
+	}
+
+	// a master on its own can't be found
+	setenv(t, "REDIS_SENTINEL_ADDRS", "")
+	if _, err := LoadConfig(); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("got %v, want ErrInvalidConfig", err)
+	}
+}
+
+func TestAdvertiseBroker(t *testing.T) {
+	for _, tt := range []struct {
+		broker string
+		ok     bool
+	}{
+		{BrokerLocal, false},
+		{BrokerRedis, true},
+		{BrokerStreams, true},
+	} {
+		cfg := DefaultConfig()
+		cfg.Broker = tt.broker
+		cfg.Redis.URL = "redis://redis.example:6379"
+		cfg.StreamGroup = "a"
+		cfg.AdvertiseURL = "ws://10.0.0.5:8080"
+		// the registry lives in redis, whichever way inputs go through it
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("advertising with the %s broker: got %v", tt.broker, err)
+		}
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Tick != 24*time.Millisecond || cfg.WorldWidth != 800 || cfg.WorldHeight != 600 || cfg.MaxPlayers != 64 || cfg.Channel != "inputs" {
+		t.Fatalf("defaults: tick %s, world %dx%d, %d players, channel %q", cfg.Tick, cfg.WorldWidth, cfg.WorldHeight, cfg.MaxPlayers, cfg.Channel)
+	}
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	setenv(t, "TICK", "50ms")
+	setenv(t, "WORLD_WIDTH", "1024")
+	setenv(t, "WORLD_HEIGHT", "768")
+	setenv(t, "PLAYER_SPEED", "120")
+	setenv(t, "MAX_PLAYERS", "8")
+	setenv(t, "REDIS_CHANNEL", "game")
+	setenv(t, "WORLD_WRAP", "true")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Tick != 50*time.Millisecond || cfg.WorldWidth != 1024 || cfg.WorldHeight != 768 ||
+		cfg.PlayerSpeed != 120 || cfg.MaxPlayers != 8 || cfg.Channel != "game" || !cfg.Wrap {
+		t.Fatalf("overrides not applied: %+v", cfg)
+	}
+}
+
+func TestWinScoreBound(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.WinScore = maxWinScore
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("win score of %d: %v", maxWinScore, err)
+	}
+	cfg.WinScore = maxWinScore + 1
+	if err := cfg.Validate(); !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "win score") {
+		t.Fatalf("win score of %d: got %v, want ErrInvalidConfig", cfg.WinScore, err)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	tests := []struct {
+		key, value string
+		// what the error has to mention
+		want string
+	}{
+		{"TICK", "fast", "TICK"},
+		{"TICK", "0s", "tick must be positive"},
+		{"TICK", "-24ms", "tick must be positive"},
+		{"WORLD_WIDTH", "wide", "WORLD_WIDTH"},
+		{"WORLD_WIDTH", "0", "world width must be positive"},
+		{"WORLD_HEIGHT", "-600", "world height must be positive"},
+		{"PLAYER_SPEED", "0", "player speed must be positive"},
+		{"MIN_PLAYERS", "100", "min players (100) must not exceed max players (64)"},
+		{"WORLD_WRAP", "sometimes", "WORLD_WRAP"},
+		{"BROKER", "pigeon", "unknown broker"},
+		{"BROKER", BrokerRedis, "redis broker needs"},
+		{"INPUT_FORMAT", "xml", "unknown input format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			setenv(t, tt.key, tt.value)
+			_, err := LoadConfig()
+			if !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("got %v, want ErrInvalidConfig", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("%q doesn't mention %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,578 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/broker"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/clock"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// testEpoch is where the manual clock of every test server starts
+var testEpoch = time.Unix(1600000000, 0)
+
+// how long a test waits for a message before giving up
+const readTimeout = 5 * time.Second
+
+// testConfig is the default config with a manual clock, matches starting as
+// soon as everyone is ready, players reaching top speed in a tick and
+// stopping in the next and every room's world seeded alike
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Clock = clock.NewManual(testEpoch)
+	cfg.PlayerSpeed = 200
+	cfg.Acceleration = 20000
+	cfg.Friction = 20000
+	cfg.Countdown = 0
+	cfg.DrainTimeout = time.Second
+	cfg.Seed = func(string) int64 { return 1 }
+	return cfg
+}
+
+// testServer is a Server serving on a loopback port until the test ends
+type testServer struct {
+	*Server
+	// nil when the test put a real clock in the config
+	clock *clock.Manual
+	addr  string
+
+	cancel   context.CancelFunc
+	done     chan error
+	stopOnce sync.Once
+	err      error
+}
+
+// startServer serves testConfig, changed by configure if not nil, with b as
+// the broker
+func startServer(t *testing.T, b broker.Broker, configure func(*Config)) *testServer {
+	t.Helper()
+	cfg := testConfig()
+	if configure != nil {
+		configure(&cfg)
+	}
+	return serve(t, NewServer(cfg, b, nil), listen(t))
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+// serve runs s on ln and stops it when the test ends
+func serve(t *testing.T, s *Server, ln net.Listener) *testServer {
+	ts := &testServer{Server: s, addr: ln.Addr().String(), done: make(chan error, 1)}
+	ts.clock, _ = s.cfg.Clock.(*clock.Manual)
+	ctx, cancel := context.WithCancel(context.Background())
+	ts.cancel = cancel
+	go func() {
+		ts.done <- s.Serve(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		if err := ts.stop(); err != nil {
+			t.Error("serve:", err)
+		}
+	})
+	return ts
+}
+
+// stop shuts the server down and returns what Serve did. Later calls return
+// the same.
+func (ts *testServer) stop() error {
+	ts.stopOnce.Do(func() {
+		ts.cancel()
+		select {
+		case ts.err = <-ts.done:
+		case <-time.After(10 * time.Second):
+			ts.err = errors.New("shutdown hung")
+		}
+	})
+	return ts.err
+}
+
+// exited waits for Serve to return by itself and returns its error
+func (ts *testServer) exited(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-ts.done:
+		ts.stopOnce.Do(ts.cancel)
+		return err
+	case <-time.After(readTimeout):
+		t.Fatal("still serving")
+	}
+	return nil
+}
+
+// tick runs every room n ticks on
+func (ts *testServer) tick(n int) {
+	ts.clock.Advance(time.Duration(n) * ts.cfg.Tick)
+}
+
+// match dials n players into the room at path, readies them all up and
+// returns them once the match has started and each has seen everyone
+func (ts *testServer) match(t *testing.T, path string, n int) []*testClient {
+	t.Helper()
+	clients := make([]*testClient, n)
+	for i := range clients {
+		clients[i] = ts.dial(t, path)
+	}
+	for _, c := range clients {
+		c.send(MessageReady, nil)
+	}
+	for _, c := range clients {
+		c.phase(PhasePlaying)
+	}
+	ts.tick(1)
+	for _, c := range clients {
+		c.until(func() bool {
+			for _, other := range clients {
+				if _, ok := c.players[other.welcome.ID]; !ok {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	return clients
+}
+
+// request sends an http request for path, with body as JSON unless it is
+// nil, and returns the status and body of the response
+func (ts *testServer) request(t *testing.T, method, path string, body interface{}) (int, []byte) {
+	t.Helper()
+	var in bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&in).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, "http://"+ts.addr+path, &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, out
+}
+
+// get is a GET of path that must answer 200, decoded into v
+func (ts *testServer) get(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	status, body := ts.request(t, http.MethodGet, path, nil)
+	if status != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", path, status, body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("GET %s: %v in %s", path, err, body)
+	}
+}
+
+// createRoom creates a private room with settings, which may be nil, and
+// returns its join code
+func (ts *testServer) createRoom(t *testing.T, settings interface{}) string {
+	t.Helper()
+	status, body := ts.request(t, http.MethodPost, "/rooms", settings)
+	if status != http.StatusCreated {
+		t.Fatalf("POST /rooms: %d %s", status, body)
+	}
+	var created struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatalf("POST /rooms: %v in %s", err, body)
+	}
+	return created.Code
+}
+
+// eventually waits for done to return true, for things the server does in
+// the background
+func eventually(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(readTimeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("gave up waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// received is a message read off a test connection
+type received struct {
+	typ  int
+	data []byte
+}
+
+// envelope is a JSON server message with its data left to decode
+type envelope struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// testClient is a websocket connection read in the background, so the server
+// never finds it too slow unless the test asks for that
+type testClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+	in   chan received
+	// why reading stopped, once in is closed
+	err error
+	// whether messages go out as msgpack
+	msgpack bool
+	// what the welcome said, filled in by dial
+	welcome WelcomeEvent
+	// the players as of the last snapshot read, kept up to date from
+	// deltas like a real client would
+	players map[string]sim.Player
+	// the rest of the last events message read
+	batched []envelope
+}
+
+// dial connects to path, like /game?room=a, and waits for the welcome
+func (ts *testServer) dial(t *testing.T, path string) *testClient {
+	t.Helper()
+	c := ts.connect(t, path, nil)
+	c.event(EventWelcome, &c.welcome)
+	return c
+}
+
+// connect opens a websocket to path with dialer, the default one if nil,
+// without waiting for anything
+func (ts *testServer) connect(t *testing.T, path string, dialer *websocket.Dialer) *testClient {
+	t.Helper()
+	conn, err := ts.open(path, dialer)
+	if err != nil {
+		t.Fatal("dial", path+":", err)
+	}
+	return newTestClient(t, conn)
+}
+
+// open dials path, returning the error and response status of a refused
+// upgrade
+func (ts *testServer) open(path string, dialer *websocket.Dialer) (*websocket.Conn, error) {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, resp, err := dialer.Dial("ws://"+ts.addr+path, nil)
+	if err != nil && resp != nil {
+		return nil, &statusError{resp.StatusCode, err}
+	}
+	return conn, err
+}
+
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return http.StatusText(e.status) + ": " + e.err.Error()
+}
+
+// refused returns the status a dial of path was turned away with before the
+// upgrade
+func (ts *testServer) refused(t *testing.T, path string) int {
+	t.Helper()
+	conn, err := ts.open(path, nil)
+	var se *statusError
+	if !errors.As(err, &se) {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Fatalf("dial %s: got %v, want a refused upgrade", path, err)
+	}
+	return se.status
+}
+
+func newTestClient(t *testing.T, conn *websocket.Conn) *testClient {
+	c := &testClient{t: t, conn: conn, in: make(chan received, 1<<14), players: map[string]sim.Player{}}
+	go func() {
+		defer close(c.in)
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				c.err = err
+				return
+			}
+			c.in <- received{typ, data}
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+// next returns the next message, failing the test if none comes in time
+func (c *testClient) next() received {
+	c.t.Helper()
+	select {
+	case m, ok := <-c.in:
+		if !ok {
+			c.t.Fatal("connection closed:", c.err)
+		}
+		return m
+	case <-time.After(readTimeout):
+		c.t.Fatal("no message in", readTimeout)
+	}
+	return received{}
+}
+
+// message returns the next JSON message, taking an events message apart
+// into an event message for each of its events
+func (c *testClient) message() envelope {
+	c.t.Helper()
+	for len(c.batched) == 0 {
+		m := c.next()
+		var env envelope
+		if err := json.Unmarshal(m.data, &env); err != nil {
+			c.t.Fatalf("not a message: %v in %q", err, m.data)
+		}
+		if env.Type != MessageEvents {
+			return env
+		}
+		var events []json.RawMessage
+		c.decode(env.Data, &events)
+		if len(events) == 0 {
+			c.t.Fatalf("empty events message %s", env.Data)
+		}
+		for _, data := range events {
+			c.batched = append(c.batched, envelope{Type: MessageEvent, Data: data})
+		}
+	}
+	env := c.batched[0]
+	c.batched = c.batched[1:]
+	return env
+}
+
+// skipTo skips messages until one of type typ for which match, if not nil,
+// returns true
+func (c *testClient) skipTo(typ string, match func(json.RawMessage) bool) json.RawMessage {
+	c.t.Helper()
+	for {
+		env := c.message()
+		if env.Type == MessageSnapshot {
+			c.apply(env.Data)
+		}
+		if env.Type == typ && (match == nil || match(env.Data)) {
+			return env.Data
+		}
+	}
+}
+
+// event skips to the next event of kind and decodes it into v unless v is
+// nil
+func (c *testClient) event(kind string, v interface{}) {
+	c.t.Helper()
+	data := c.skipTo(MessageEvent, func(data json.RawMessage) bool {
+		var ev struct {
+			Kind string `json:"kind"`
+		}
+		return json.Unmarshal(data, &ev) == nil && ev.Kind == kind
+	})
+	c.decode(data, v)
+}
+
+// phase skips to the phase event announcing phase
+func (c *testClient) phase(phase string) PhaseEvent {
+	c.t.Helper()
+	var ev PhaseEvent
+	for ev.Phase != phase {
+		c.event(EventPhase, &ev)
+	}
+	return ev
+}
+
+// snapshot skips to the next snapshot
+func (c *testClient) snapshot() Snapshot {
+	c.t.Helper()
+	var s Snapshot
+	c.decode(c.skipTo(MessageSnapshot, nil), &s)
+	return s
+}
+
+// apply brings players up to date with a snapshot
+func (c *testClient) apply(data json.RawMessage) {
+	c.t.Helper()
+	var s Snapshot
+	c.decode(data, &s)
+	if s.Keyframe {
+		c.players = map[string]sim.Player{}
+		for id, p := range s.Players {
+			c.players[id] = p
+		}
+	}
+	for id, p := range s.Add {
+		c.players[id] = p
+	}
+	for id, p := range s.Update {
+		c.players[id] = p
+	}
+	for _, id := range s.Remove {
+		delete(c.players, id)
+	}
+}
+
+// until reads snapshots until done returns true
+func (c *testClient) until(done func() bool) {
+	c.t.Helper()
+	for !done() {
+		c.snapshot()
+	}
+}
+
+// me is the client's own player as of the last snapshot read
+func (c *testClient) me() sim.Player {
+	c.t.Helper()
+	p, ok := c.players[c.welcome.ID]
+	if !ok {
+		c.t.Fatal("not in the room")
+	}
+	return p
+}
+
+// joined reads snapshots until the client's own player is in them
+func (c *testClient) joined() {
+	c.t.Helper()
+	c.until(func() bool {
+		_, ok := c.players[c.welcome.ID]
+		return ok
+	})
+}
+
+// keyframe skips to the next keyframe
+func (c *testClient) keyframe() Snapshot {
+	c.t.Helper()
+	for {
+		if s := c.snapshot(); s.Keyframe {
+			return s
+		}
+	}
+}
+
+// errorMessage skips to the next error message
+func (c *testClient) errorMessage() ErrorMessage {
+	c.t.Helper()
+	var e ErrorMessage
+	c.decode(c.skipTo(MessageError, nil), &e)
+	return e
+}
+
+func (c *testClient) decode(data json.RawMessage, v interface{}) {
+	c.t.Helper()
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		c.t.Fatalf("decoding %s: %v", data, err)
+	}
+}
+
+// closeCode reads until the connection closes and returns the code it was
+// closed with
+func (c *testClient) closeCode() int {
+	c.t.Helper()
+	return c.closeFrame().Code
+}
+
+// closeFrame reads until the connection closes and returns the close frame
+// it was closed with
+func (c *testClient) closeFrame() *websocket.CloseError {
+	c.t.Helper()
+	timeout := time.After(readTimeout)
+	for {
+		select {
+		case _, ok := <-c.in:
+			if ok {
+				continue
+			}
+			var ce *websocket.CloseError
+			if !errors.As(c.err, &ce) {
+				c.t.Fatal("closed without a close frame:", c.err)
+			}
+			return ce
+		case <-timeout:
+			c.t.Fatal("not closed in", readTimeout)
+		}
+	}
+}
+
+// send writes a message of type typ carrying data, if not nil
+func (c *testClient) send(typ string, data interface{}) {
+	c.t.Helper()
+	msg := map[string]interface{}{"type": typ}
+	if data != nil {
+		msg["data"] = data
+	}
+	c.write(msg)
+}
+
+// write writes v as a JSON text message, or msgpack for a msgpack client
+func (c *testClient) write(v interface{}) {
+	c.t.Helper()
+	var err error
+	if c.msgpack {
+		err = c.conn.WriteMessage(websocket.BinaryMessage, pack(v))
+	} else {
+		err = c.conn.WriteJSON(v)
+	}
+	if err != nil {
+		c.t.Fatal("write:", err)
+	}
+}
+
+// input sends held inputs
+func (c *testClient) input(inputs ...string) {
+	c.t.Helper()
+	c.send(MessageInput, InputMessage{Inputs: inputs})
+}
+
+// play readies the client up and waits for the match to start
+func (c *testClient) play() {
+	c.t.Helper()
+	c.send(MessageReady, nil)
+	c.phase(PhasePlaying)
+}
+
+// sync waits until the server has read everything sent before it, skipping
+// whatever arrives in the meantime
+func (c *testClient) sync() {
+	c.t.Helper()
+	c.send(MessagePing, PingMessage{T: -1})
+	c.skipTo(MessageEvent, func(data json.RawMessage) bool {
+		var ev PongEvent
+		return json.Unmarshal(data, &ev) == nil && ev.Kind == EventPong && ev.T == -1
+	})
+}
+
+// drain throws away every message that has arrived so far
+func (c *testClient) drain() {
+	for {
+		select {
+		case _, ok := <-c.in:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
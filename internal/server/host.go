@@ -0,0 +1,64 @@
+package server
+
+type kickRequest struct {
+	from   *client
+	target string
+	reply  chan error
+}
+
+// kick asks the room to remove target on behalf of from, which has to be the
+// host
+func (r *Room) kick(from *client, target string) error {
+	req := kickRequest{from: from, target: target, reply: make(chan error, 1)}
+	select {
+	case r.kicks <- req:
+	case <-r.done:
+		return errRoomClosed
+	}
+	return <-req.reply
+}
+
+// applyKick runs on the room goroutine
+func (r *Room) applyKick(req kickRequest) error {
+	if r.clients[req.from.id] != req.from || req.from.id != r.host {
+		return &RouteError{ErrNotHost, "only the host can kick"}
+	}
+	if req.target == r.host {
+		return &RouteError{ErrBadKick, "the host can't kick themselves"}
+	}
+	if _, ok := r.bots[req.target]; ok {
+		r.removeBot(req.target)
+		return nil
+	}
+	c, ok := r.clients[req.target]
+	if !ok {
+		return &RouteError{ErrBadKick, "no such player"}
+	}
+	r.remove(c, LeaveKick)
+	r.forgetPlayer(c.resume)
+	c.close(CloseKicked)
+	r.checkStart()
+	return nil
+}
+
+// pickHost hands the host role to the longest connected player left, if the
+// host is gone
+func (r *Room) pickHost() {
+	// a disconnected host can't kick anyone, so it passes on straight away
+	if c, ok := r.clients[r.host]; ok && !c.spectator {
+		return
+	}
+	r.host = ""
+	var first *client
+	for id, c := range r.clients {
+		if _, playing := r.gamestate.Players[id]; !playing {
+			continue
+		}
+		if first == nil || c.joined < first.joined {
+			first = c
+		}
+	}
+	if first != nil {
+		r.host = first.id
+	}
+}
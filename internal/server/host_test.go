@@ -0,0 +1,82 @@
+package server
+
+import "testing"
+
+// host reads snapshots until one names a host and returns it
+func (c *testClient) host() string {
+	c.t.Helper()
+	for {
+		if s := c.snapshot(); s.Room.Host != "" {
+			return s.Room.Host
+		}
+	}
+}
+
+func TestKick(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 3)
+	host, other, target := clients[0], clients[1], clients[2]
+	ts.tick(1)
+	if id := other.host(); id != host.welcome.ID {
+		t.Fatalf("host %s, want the first to join %s", id, host.welcome.ID)
+	}
+
+	other.send(MessageKick, KickMessage{PlayerID: target.welcome.ID})
+	if e := other.errorMessage(); e.Code != ErrNotHost {
+		t.Fatalf("got %+v, want %s", e, ErrNotHost)
+	}
+	host.send(MessageKick, KickMessage{PlayerID: host.welcome.ID})
+	if e := host.errorMessage(); e.Code != ErrBadKick {
+		t.Fatalf("got %+v, want %s", e, ErrBadKick)
+	}
+	host.send(MessageKick, KickMessage{PlayerID: "nobody"})
+	if e := host.errorMessage(); e.Code != ErrBadKick {
+		t.Fatalf("got %+v, want %s", e, ErrBadKick)
+	}
+	other.sync()
+	ts.tick(1)
+	other.snapshot()
+	if _, ok := other.players[target.welcome.ID]; !ok {
+		t.Fatal("player removed by a refused kick")
+	}
+
+	host.send(MessageKick, KickMessage{PlayerID: target.welcome.ID})
+	if code := target.closeCode(); code != CloseKicked {
+		t.Fatalf("closed with %d, want %d", code, CloseKicked)
+	}
+	var ev PlayerEvent
+	other.event(EventLeave, &ev)
+	if ev.PlayerID != target.welcome.ID || ev.Reason != LeaveKick {
+		t.Fatalf("got %+v, want %s kicked", ev, target.welcome.ID)
+	}
+	ts.tick(1)
+	other.snapshot()
+	if _, ok := other.players[target.welcome.ID]; ok {
+		t.Fatal("kicked player still in the snapshot")
+	}
+}
+
+func TestHostMigrates(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 3)
+	host, next, last := clients[0], clients[1], clients[2]
+	ts.tick(1)
+	if id := next.host(); id != host.welcome.ID {
+		t.Fatalf("host %s, want %s", id, host.welcome.ID)
+	}
+
+	// within its reconnect grace too, the host passes on at once
+	host.conn.Close()
+	id := host.welcome.ID
+	for i := 0; i < 100 && id == host.welcome.ID; i++ {
+		ts.tick(1)
+		id = next.host()
+	}
+	if id != next.welcome.ID {
+		t.Fatalf("host %s, want the longest connected %s", id, next.welcome.ID)
+	}
+	next.send(MessageKick, KickMessage{PlayerID: last.welcome.ID})
+	if code := last.closeCode(); code != CloseKicked {
+		t.Fatalf("closed with %d, want the new host's kick", code)
+	}
+}
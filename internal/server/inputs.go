@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/broker"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+const (
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+)
+
+const maxLoggedPayload = 128
+
+// sources of malformed payloads counted at once. The source is whatever
+// player id a payload claims, so a flood of made-up ones starts the counts
+// over rather than growing them without bound.
+const maxMalformedSources = 1024
+
+// receiveInputs subscribes to the room's channel and feeds its event queue
+// until ctx is canceled. When the subscription fails it is re-established
+// with exponential backoff; the tick loop keeps running on local inputs in
+// the meantime.
+func (r *Room) receiveInputs(ctx context.Context) {
+	backoff := minReconnectBackoff
+	for {
+		msgs, err := r.srv.broker.Subscribe(ctx, r.channel)
+		if err != nil {
+			log.Println("subscribe error:", err)
+		} else {
+			for payload := range msgs {
+				backoff = minReconnectBackoff
+				r.handlePayload(payload)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		n := atomic.AddUint64(&r.srv.counters.PubsubReconnects, 1)
+		log.Printf("pubsub for room %s disconnected, reconnecting in %s (attempt %d)", r.name, backoff, n)
+		wait := r.srv.cfg.Clock.NewTicker(backoff)
+		select {
+		case <-wait.C():
+		case <-ctx.Done():
+			wait.Stop()
+			return
+		}
+		wait.Stop()
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// dropChannel lets the broker give up what it keeps of the room's channel
+// between subscriptions, once the room has closed empty. When the server
+// stops it is kept, so the next instance to host the room catches up.
+func (r *Room) dropChannel() {
+	d, ok := r.srv.broker.(broker.Dropper)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	if err := d.Drop(ctx, r.channel); err != nil {
+		log.Println("broker drop error for room", r.name+":", err)
+	}
+}
+
+// inputBatch is an input message as published on the broker: a single frame
+// in the fields of sim.InputEvent, the way instances sent it before batching,
+// or several in Frames, whose player ids are left out
+type inputBatch struct {
+	sim.InputEvent
+	Frames []sim.InputEvent `json:"frames,omitempty"`
+}
+
+// frames returns the frames of b, oldest first
+func (b inputBatch) frames() []sim.InputEvent {
+	if len(b.Frames) == 0 {
+		return []sim.InputEvent{b.InputEvent}
+	}
+	frames := make([]sim.InputEvent, len(b.Frames))
+	for i, f := range b.Frames {
+		f.PlayerID = b.PlayerID
+		frames[i] = f
+	}
+	return frames
+}
+
+// inputBatch checks an input message from player id and turns it into what
+// is published, with move and aim vectors clamped
+func (s *Server) inputBatch(id string, msg InputMessage) (inputBatch, error) {
+	if len(msg.Frames) == 0 {
+		if msg.Seq < 0 {
+			return inputBatch{}, &RouteError{ErrBadInput, "seq must not be negative"}
+		}
+		if badAim(msg.Aim) {
+			return inputBatch{}, &RouteError{ErrBadInput, "aim must be a finite angle"}
+		}
+		return inputBatch{InputEvent: sim.InputEvent{PlayerID: id, Seq: msg.Seq, Inputs: msg.Inputs, Move: clampMove(msg.Move), Shoot: clampMove(msg.Shoot), Aim: msg.Aim}}, nil
+	}
+	if msg.Seq != 0 || msg.Inputs != nil || msg.Move != nil || msg.Shoot != nil || msg.Aim != nil {
+		return inputBatch{}, &RouteError{ErrBadInput, "frames can't be sent along with seq, inputs, move, shoot or aim"}
+	}
+	if len(msg.Frames) > s.cfg.MaxInputBatch {
+		return inputBatch{}, &RouteError{ErrBatchSize, fmt.Sprintf("%d frames, at most %d allowed", len(msg.Frames), s.cfg.MaxInputBatch)}
+	}
+	b := inputBatch{InputEvent: sim.InputEvent{PlayerID: id}, Frames: make([]sim.InputEvent, len(msg.Frames))}
+	for i, f := range msg.Frames {
+		if f.Seq < 0 {
+			return inputBatch{}, &RouteError{ErrBadInput, "seq must not be negative"}
+		}
+		if badAim(f.Aim) {
+			return inputBatch{}, &RouteError{ErrBadInput, "aim must be a finite angle"}
+		}
+		b.Frames[i] = sim.InputEvent{Seq: f.Seq, T: f.T, Inputs: f.Inputs, Move: clampMove(f.Move), Shoot: clampMove(f.Shoot), Aim: f.Aim}
+	}
+	return b, nil
+}
+
+// badAim reports whether an aim angle can't be faced, which only happens
+// with encodings that carry NaN or infinities
+func badAim(a *float64) bool {
+	return a != nil && (math.IsNaN(*a) || math.IsInf(*a, 0))
+}
+
+func clampMove(v *sim.Vector) *sim.Vector {
+	if v == nil {
+		return nil
+	}
+	c := v.Clamp()
+	return &c
+}
+
+// handlePayload decodes a single message from the input channel and queues it
+func (r *Room) handlePayload(payload []byte) {
+	input, err := r.srv.decodeInput(payload)
+	if err != nil {
+		r.reportMalformed(payload, err)
+		return
+	}
+	if input.PlayerID == "" {
+		log.Println("dropping input without player id")
+		atomic.AddUint64(&r.srv.counters.UnknownPlayerInputs, 1)
+		return
+	}
+	r.enqueueInputs(input.frames())
+}
+
+// reportMalformed logs and counts a payload that failed to decode. The source
+// is the player id if one can still be recovered from the payload.
+func (r *Room) reportMalformed(payload []byte, err error) {
+	atomic.AddUint64(&r.srv.counters.MalformedInputs, 1)
+
+	source := "unknown"
+	var partial struct {
+		PlayerID string `json:"player_id"`
+	}
+	if json.Unmarshal(payload, &partial) == nil && partial.PlayerID != "" {
+		source = partial.PlayerID
+	}
+
+	logged := string(payload)
+	if len(logged) > maxLoggedPayload {
+		logged = logged[:maxLoggedPayload] + "..."
+	}
+	log.Printf("malformed input from %s: %s: %q", source, err, logged)
+
+	if _, ok := r.malformedBySource[source]; !ok && len(r.malformedBySource) >= maxMalformedSources {
+		r.malformedBySource = map[string]int{}
+	}
+	r.malformedBySource[source]++
+	if n := r.malformedBySource[source]; n%r.srv.cfg.MalformedWarnThreshold == 0 {
+		log.Printf("warning: %d malformed inputs from %s", n, source)
+	}
+}
@@ -0,0 +1,652 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/broker"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// fakeBroker is an in-process Broker that keeps everything published and
+// whose subscriptions the test can cut
+type fakeBroker struct {
+	mu   sync.Mutex
+	subs map[string]chan []byte
+	// Subscribe calls so far by channel
+	subscribes map[string]int
+	published  [][]byte
+	// what Publish fails with, if anything
+	publishErr error
+	// Subscribe calls left to fail
+	failSubscribe int
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{subs: map[string]chan []byte{}, subscribes: map[string]int{}}
+}
+
+func (b *fakeBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.publishErr != nil {
+		return b.publishErr
+	}
+	b.published = append(b.published, payload)
+	if sub, ok := b.subs[channel]; ok {
+		sub <- payload
+	}
+	return nil
+}
+
+func (b *fakeBroker) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribes[channel]++
+	if b.failSubscribe > 0 {
+		b.failSubscribe--
+		return nil, errors.New("redis is down")
+	}
+	sub := make(chan []byte, 256)
+	b.subs[channel] = sub
+	go func() {
+		<-ctx.Done()
+		b.cut(channel, sub)
+	}()
+	return sub, nil
+}
+
+// cut ends the subscription to channel if it is still sub
+func (b *fakeBroker) cut(channel string, sub chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[channel] == sub {
+		delete(b.subs, channel)
+		close(sub)
+	}
+}
+
+// drop ends the subscription to channel like a lost connection would
+func (b *fakeBroker) drop(channel string) {
+	b.mu.Lock()
+	sub := b.subs[channel]
+	b.mu.Unlock()
+	b.cut(channel, sub)
+}
+
+func (b *fakeBroker) subscribed(channel string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribes[channel]
+}
+
+// waitSubscribed ticks until channel has been subscribed to n times, as
+// resubscribing waits out a backoff on the room clock
+func waitSubscribed(t *testing.T, ts *testServer, b *fakeBroker, channel string, n int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		if b.subscribed(channel) >= n {
+			return
+		}
+		ts.tick(1)
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("subscribed %d times, want %d", b.subscribed(channel), n)
+}
+
+func (b *fakeBroker) Close() error {
+	return nil
+}
+
+// inputs returns every published payload decoded
+func (b *fakeBroker) inputs(t *testing.T) []inputBatch {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batches := make([]inputBatch, len(b.published))
+	for i, payload := range b.published {
+		if err := json.Unmarshal(payload, &batches[i]); err != nil {
+			t.Fatalf("published %q: %v", payload, err)
+		}
+	}
+	return batches
+}
+
+// inject publishes payload on channel as if another instance had
+func (b *fakeBroker) inject(channel string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub, ok := b.subs[channel]
+	if !ok {
+		return errors.New("not subscribed to " + channel)
+	}
+	sub <- payload
+	return nil
+}
+
+// moves ticks until c sees player id move away from where it is, as inputs
+// through a broker take a moment to arrive
+func moves(ts *testServer, c *testClient, id string) bool {
+	c.t.Helper()
+	start := c.players[id]
+	for i := 0; i < 100; i++ {
+		ts.tick(1)
+		c.snapshot()
+		if p := c.players[id]; p.X != start.X || p.Y != start.Y {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInputsCarryPlayerThroughBroker(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, nil)
+	clients := ts.match(t, "/game", 2)
+	a, other := clients[0], clients[1]
+	still := a.players[other.welcome.ID]
+
+	a.input("right")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	if p := a.players[other.welcome.ID]; p.X != still.X || p.Y != still.Y {
+		t.Fatal("the other player moved")
+	}
+	var inputs []sim.InputEvent
+	for _, batch := range b.inputs(t) {
+		inputs = append(inputs, batch.frames()...)
+	}
+	if len(inputs) != 1 || inputs[0].PlayerID != a.welcome.ID || len(inputs[0].Inputs) != 1 || inputs[0].Inputs[0] != "right" {
+		t.Fatalf("published %+v", inputs)
+	}
+}
+
+func TestInputsForUnknownPlayers(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, nil)
+	a := ts.match(t, "/game", 1)[0]
+
+	channel := broker.RoomKey(ts.cfg.Channel, DefaultRoom)
+	for _, payload := range []string{
+		`{"player_id":"left-already","seq":0,"inputs":["right"]}`,
+		`{"seq":0,"inputs":["right"]}`,
+	} {
+		if err := b.inject(channel, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.input("down")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	if n := ts.Counters().UnknownPlayerInputs; n != 2 {
+		t.Fatalf("%d unknown player inputs counted, want 2", n)
+	}
+}
+
+func TestResubscribesAfterDrop(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, nil)
+	a := ts.match(t, "/game", 1)[0]
+
+	channel := broker.RoomKey(ts.cfg.Channel, DefaultRoom)
+	b.drop(channel)
+	waitSubscribed(t, ts, b, channel, 2)
+	if n := ts.Counters().PubsubReconnects; n != 1 {
+		t.Fatalf("%d reconnects, want 1", n)
+	}
+	a.input("right")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("inputs lost after resubscribing")
+	}
+}
+
+func TestResubscribesAfterFailedSubscribe(t *testing.T) {
+	b := newFakeBroker()
+	b.failSubscribe = 2
+	ts := startServer(t, b, nil)
+	a := ts.match(t, "/game", 1)[0]
+
+	channel := broker.RoomKey(ts.cfg.Channel, DefaultRoom)
+	waitSubscribed(t, ts, b, channel, 3)
+	if n := ts.Counters().PubsubReconnects; n != 2 {
+		t.Fatalf("%d reconnects, want 2", n)
+	}
+	a.input("right")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("inputs lost after subscribing")
+	}
+}
+
+func TestInputsThroughLocalBroker(t *testing.T) {
+	ts := startServer(t, broker.NewLocalBroker(), nil)
+	clients := ts.match(t, "/game", 2)
+	a, other := clients[0], clients[1]
+	still := a.players[other.welcome.ID]
+
+	a.input("right")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	if p := a.players[other.welcome.ID]; p.X != still.X || p.Y != still.Y {
+		t.Fatal("the other player moved")
+	}
+}
+
+func TestLocalMode(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	ts := startServer(t, nil, nil)
+	a := ts.match(t, "/game", 1)[0]
+	// the server still logs, but out is done with
+	log.SetOutput(os.Stderr)
+	if !strings.Contains(out.String(), "broker mode: local") {
+		t.Fatalf("mode not logged:\n%s", out.String())
+	}
+	start := a.me()
+	// inputs go straight onto the queue, so the next tick applies them
+	a.input("right")
+	a.sync()
+	ts.tick(1)
+	a.snapshot()
+	if p := a.me(); p.X <= start.X || p.Y != start.Y {
+		t.Fatalf("moved from %v,%v to %v,%v", start.X, start.Y, p.X, p.Y)
+	}
+}
+
+func TestInputsThroughRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ts := startServer(t, broker.NewRedisBroker(redis.NewClient(&redis.Options{Addr: mr.Addr()})), nil)
+	clients := ts.match(t, "/game", 2)
+	a, other := clients[0], clients[1]
+	still := a.players[other.welcome.ID]
+
+	a.input("right")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	if p := a.players[other.welcome.ID]; p.X != still.X || p.Y != still.Y {
+		t.Fatal("the other player moved")
+	}
+	channel := broker.RoomKey(ts.cfg.Channel, DefaultRoom)
+	if n := mr.PubSubNumSub(channel)[channel]; n != 1 {
+		t.Fatalf("%d subscribers to %s, want 1", n, channel)
+	}
+}
+
+func TestInputsThroughStreams(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	ts := startServer(t, broker.NewStreamBroker(rdb, "a", 100), func(cfg *Config) {
+		cfg.ReconnectGrace = 0
+		cfg.EmptyRoomGrace = 2 * cfg.Tick
+	})
+	a := ts.match(t, "/game?room=a", 1)[0]
+	a.input("right")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	channel := broker.RoomKey(ts.cfg.Channel, "a")
+	// XINFO GROUPS is read raw, go-redis expects fewer fields than miniredis
+	// sends
+	groups := func() int {
+		reply, err := rdb.Do(context.Background(), "XINFO", "GROUPS", channel).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, _ := reply.([]interface{})
+		return len(all)
+	}
+	if n := groups(); n != 1 {
+		t.Fatalf("%d groups on %s, want 1", n, channel)
+	}
+
+	// the room closing takes its group along, and nothing is left pending
+	a.conn.Close()
+	eventually(t, "room a's group to be destroyed", func() bool {
+		ts.tick(1)
+		return groups() == 0
+	})
+}
+
+func TestStreamGroupOutlivesShutdown(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	ts := startServer(t, broker.NewStreamBroker(rdb, "a", 100), nil)
+	ts.match(t, "/game?room=a", 1)
+	ts.stop()
+	// the next instance of group a to host the room picks up from here
+	channel := broker.RoomKey(ts.cfg.Channel, "a")
+	reply, err := rdb.Do(context.Background(), "XINFO", "GROUPS", channel).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := reply.([]interface{}); len(all) != 1 {
+		t.Fatalf("%d groups on %s after shutting down, want 1", len(all), channel)
+	}
+}
+
+func TestInputsStayInTheirRoom(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, func(cfg *Config) {
+		cfg.ReconnectGrace = 0
+		cfg.EmptyRoomGrace = 2 * cfg.Tick
+	})
+	a := ts.match(t, "/game?room=a", 1)[0]
+	other := ts.match(t, "/game?room=b", 1)[0]
+	still := other.me()
+
+	// an input for b's player on a's channel goes nowhere
+	payload := `{"player_id":"` + other.welcome.ID + `","inputs":["right"]}`
+	if err := b.inject(broker.RoomKey(ts.cfg.Channel, "a"), []byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "room a to count the input", func() bool {
+		ts.tick(1)
+		return ts.Counters().UnknownPlayerInputs == 1
+	})
+	other.snapshot()
+	if p := other.me(); p.X != still.X || p.Y != still.Y {
+		t.Fatal("room b's player moved on room a's input")
+	}
+
+	// rooms coming and going leave the others' subscriptions alone
+	for i := 0; i < 5; i++ {
+		ts.dial(t, fmt.Sprintf("/game?room=c%d", i)).conn.Close()
+	}
+	eventually(t, "the extra rooms to close", func() bool {
+		ts.tick(1)
+		return len(ts.listRooms()) == 2
+	})
+	a.input("right")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("room a lost its inputs")
+	}
+	for _, room := range []string{"a", "b"} {
+		if n := b.subscribed(broker.RoomKey(ts.cfg.Channel, room)); n != 1 {
+			t.Fatalf("room %s subscribed %d times", room, n)
+		}
+	}
+}
+
+func TestMalformedPayloadsAreSkipped(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, nil)
+	a := ts.match(t, "/game", 1)[0]
+
+	channel := broker.RoomKey(ts.cfg.Channel, DefaultRoom)
+	payloads := []string{
+		`{"player_id":`,
+		``,
+		`not json at all`,
+		`{"player_id":42,"inputs":["right"]}`,
+		`{"player_id":"` + a.welcome.ID + `","inputs":"right"}`,
+		`{"player_id":"` + a.welcome.ID + `","seq":"one","inputs":["right"]}`,
+	}
+	for _, payload := range payloads {
+		if err := b.inject(channel, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.input("right")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("valid input after the bad ones didn't move the player")
+	}
+	if n := ts.Counters().MalformedInputs; n != uint64(len(payloads)) {
+		t.Fatalf("%d malformed inputs counted, want %d", n, len(payloads))
+	}
+}
+
+func TestMalformedWarningPerSource(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	cfg := testConfig()
+	cfg.MalformedWarnThreshold = 3
+	r := newRoom(NewServer(cfg, nil, nil), "a", cfg.RoomSettings())
+	for i := 0; i < 7; i++ {
+		r.handlePayload([]byte(`{"player_id":"spammer","inputs":5}`))
+	}
+	r.handlePayload([]byte(`{"player_id":"someone else","inputs":5}`))
+	if n := strings.Count(out.String(), "warning: "); n != 2 {
+		t.Fatalf("%d warnings, want 2 for 7 bad payloads from one source:\n%s", n, out.String())
+	}
+}
+
+func TestMalformedSourcesBounded(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	cfg := testConfig()
+	r := newRoom(NewServer(cfg, nil, nil), "a", cfg.RoomSettings())
+	for i := 0; i < 3*maxMalformedSources; i++ {
+		r.handlePayload([]byte(fmt.Sprintf(`{"player_id":"made up %d","inputs":5}`, i)))
+		if n := len(r.malformedBySource); n > maxMalformedSources {
+			t.Fatalf("%d sources counted", n)
+		}
+	}
+}
+
+// held is frames with no inputs held as nil, which protobuf can't tell
+// apart from empty
+func held(frames []sim.InputEvent) []sim.InputEvent {
+	for i := range frames {
+		if len(frames[i].Inputs) == 0 {
+			frames[i].Inputs = nil
+		}
+	}
+	return frames
+}
+
+func TestInputRoundTrip(t *testing.T) {
+	aim := 1.5
+	batches := []inputBatch{
+		{InputEvent: sim.InputEvent{PlayerID: "a", Inputs: []string{"up", "left"}}},
+		{InputEvent: sim.InputEvent{PlayerID: "a", Seq: 7, Inputs: []string{}, Move: &sim.Vector{X: 0.5, Y: -1}, Shoot: &sim.Vector{X: 1}, Aim: &aim}},
+		{InputEvent: sim.InputEvent{PlayerID: "a"}, Frames: []sim.InputEvent{
+			{Seq: 1, T: 100, Inputs: []string{"right"}},
+			{Seq: 2, T: 116, Inputs: []string{"right", "sprint"}},
+		}},
+	}
+	for _, format := range []string{InputJSON, InputProtobuf} {
+		t.Run(format, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.InputFormat = format
+			s := NewServer(cfg, nil, nil)
+			for _, batch := range batches {
+				payload, err := s.encodeInput(batch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if json.Valid(payload) != (format == InputJSON) {
+					t.Fatalf("%q isn't %s", payload, format)
+				}
+				got, err := s.decodeInput(payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(held(got.frames()), held(batch.frames())) {
+					t.Fatalf("%q came back as %+v, want %+v", payload, got.frames(), batch.frames())
+				}
+			}
+		})
+	}
+}
+
+func TestPublishFailuresCounted(t *testing.T) {
+	b := newFakeBroker()
+	b.publishErr = errors.New("redis is down")
+	ts := startServer(t, b, nil)
+	a := ts.match(t, "/game", 1)[0]
+	a.input("right")
+	a.input("left")
+	a.sync()
+	if n := ts.Counters().PublishFailures; n != 2 {
+		t.Fatalf("%d publish failures counted, want 2", n)
+	}
+}
+
+func TestLastInputSeqAcked(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 2)
+	a, other := clients[0], clients[1]
+	// 3 is dropped and arrives after 5
+	for _, tt := range []struct{ seq, ack int }{{1, 1}, {2, 2}, {4, 4}, {5, 5}, {3, 5}} {
+		a.send(MessageInput, InputMessage{Seq: tt.seq, Inputs: []string{"right"}})
+		a.sync()
+		ts.tick(1)
+		if s := a.snapshot(); s.LastInputSeq != tt.ack {
+			t.Fatalf("after seq %d acked %d, want %d", tt.seq, s.LastInputSeq, tt.ack)
+		}
+		// only the sender is told
+		if s := other.snapshot(); s.LastInputSeq != 0 {
+			t.Fatalf("another player's snapshot acks %d", s.LastInputSeq)
+		}
+	}
+}
+
+func TestInputBatchClampsMove(t *testing.T) {
+	s := &Server{}
+	for _, tt := range []struct {
+		move, want *sim.Vector
+	}{
+		{nil, nil},
+		{&sim.Vector{}, &sim.Vector{}},
+		{&sim.Vector{X: -0.7, Y: 0.3}, &sim.Vector{X: -0.7, Y: 0.3}},
+		{&sim.Vector{X: 3, Y: -2}, &sim.Vector{X: 1, Y: -1}},
+	} {
+		b, err := s.inputBatch("a", InputMessage{Move: tt.move})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(b.Move, tt.want) {
+			t.Fatalf("move %v became %v, want %v", tt.move, b.Move, tt.want)
+		}
+	}
+}
+
+func TestMixedInputStyles(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 3)
+	held, analog, wild := clients[0], clients[1], clients[2]
+	before := map[string]sim.Player{}
+	for id, p := range held.players {
+		before[id] = p
+	}
+	held.input("right")
+	analog.send(MessageInput, InputMessage{Move: &sim.Vector{X: -0.5}})
+	// clamped to a full step right
+	wild.send(MessageInput, InputMessage{Move: &sim.Vector{X: 40}})
+	for _, c := range clients {
+		c.sync()
+	}
+	ts.tick(1)
+	held.snapshot()
+	step := func(c *testClient) float64 {
+		return held.players[c.welcome.ID].X - before[c.welcome.ID].X
+	}
+	full := step(held)
+	if full <= 0 {
+		t.Fatalf("held right moved %v", full)
+	}
+	// positions are rounded to whole pixels
+	if d := step(analog); math.Abs(d+full/2) > 1 {
+		t.Fatalf("half left moved %v, want about %v", d, -full/2)
+	}
+	if d := step(wild); d != full {
+		t.Fatalf("out of range moved %v, want %v", d, full)
+	}
+}
+
+// batch is an input message of n frames holding right, seqs from 1
+func batch(n int) InputMessage {
+	msg := InputMessage{Frames: make([]InputFrame, n)}
+	for i := range msg.Frames {
+		msg.Frames[i] = InputFrame{Seq: i + 1, T: int64(16 * i), Inputs: []string{"right"}}
+	}
+	return msg
+}
+
+func TestBatchedInputs(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		// acks after each tick
+		acks []int
+	}{
+		{BatchSequential, []int{1, 2, 3, 4, 5, 5}},
+		{BatchCoalesce, []int{5, 5}},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			ts := startServer(t, nil, func(cfg *Config) { cfg.InputBatching = tt.policy })
+			c := ts.match(t, "/game", 1)[0]
+			c.send(MessageInput, batch(5))
+			c.sync()
+			x := c.me().X
+			for i, ack := range tt.acks {
+				ts.tick(1)
+				s := c.snapshot()
+				if s.LastInputSeq != ack {
+					t.Fatalf("tick %d: acked %d, want %d", i, s.LastInputSeq, ack)
+				}
+				// a frame of right moves the player, after the last it stops
+				moved := c.me().X > x
+				if want := i == 0 || tt.acks[i-1] != ack; moved != want {
+					t.Fatalf("tick %d: moved %v, want %v", i, moved, want)
+				}
+				x = c.me().X
+			}
+		})
+	}
+}
+
+func TestOversizedBatch(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	c := ts.match(t, "/game", 1)[0]
+	c.send(MessageInput, batch(ts.cfg.MaxInputBatch+1))
+	if e := c.errorMessage(); e.Code != ErrBatchSize {
+		t.Fatalf("got %+v, want %s", e, ErrBatchSize)
+	}
+	// nothing of it was applied
+	ts.tick(1)
+	if s := c.snapshot(); s.LastInputSeq != 0 {
+		t.Fatalf("acked %d", s.LastInputSeq)
+	}
+}
+
+func TestBatchPublishedWhole(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, nil)
+	c := ts.match(t, "/game", 1)[0]
+	c.send(MessageInput, batch(5))
+	c.sync()
+	batches := b.inputs(t)
+	if len(batches) != 1 {
+		t.Fatalf("published %d payloads, want one", len(batches))
+	}
+	frames := batches[0].frames()
+	if len(frames) != 5 {
+		t.Fatalf("published %+v, want 5 frames", frames)
+	}
+	for i, f := range frames {
+		if f.PlayerID != c.welcome.ID || f.Seq != i+1 || f.T != int64(16*i) {
+			t.Fatalf("frame %d is %+v", i, f)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/broker"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/clock"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/server"
+)
+
+// loopback is a broker that hands every payload straight back to the
+// channel's subscriber and remembers it
+type loopback struct {
+	mu        sync.Mutex
+	subs      map[string]chan []byte
+	published []string
+}
+
+var _ broker.Broker = (*loopback)(nil)
+
+func (b *loopback) Publish(ctx context.Context, channel string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, string(payload))
+	if sub, ok := b.subs[channel]; ok {
+		sub <- payload
+	}
+	return nil
+}
+
+func (b *loopback) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := make(chan []byte, 64)
+	b.subs[channel] = sub
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, channel)
+		close(sub)
+	}()
+	return sub, nil
+}
+
+func (b *loopback) Close() error {
+	return nil
+}
+
+func (b *loopback) sent(s string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, payload := range b.published {
+		if strings.Contains(payload, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServerFromOutside(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1600000000, 0))
+	cfg := server.DefaultConfig()
+	cfg.Clock = clk
+	cfg.Countdown = 0
+	b := &loopback{subs: map[string]chan []byte{}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.NewServer(cfg, b, nil).Serve(ctx, ln)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+ln.Addr().String()+"/game", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var welcome struct {
+		Type string              `json:"type"`
+		Data server.WelcomeEvent `json:"data"`
+	}
+	if err := conn.ReadJSON(&welcome); err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Type != server.MessageEvent || welcome.Data.Kind != server.EventWelcome || welcome.Data.ID == "" {
+		t.Fatalf("got %+v, want a welcome", welcome)
+	}
+	messages := make(chan string, 1024)
+	go func() {
+		defer close(messages)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- string(data)
+		}
+	}()
+
+	conn.WriteJSON(server.ClientMessage{Type: server.MessageReady})
+	conn.WriteJSON(map[string]interface{}{"type": server.MessageInput, "data": server.InputMessage{Inputs: []string{"right"}}})
+	for i := 0; i < 100 && !b.sent(welcome.Data.ID); i++ {
+		clk.Advance(cfg.Tick)
+		time.Sleep(time.Millisecond)
+	}
+	if !b.sent(`"right"`) {
+		t.Fatal("input never reached the broker")
+	}
+	clk.Advance(cfg.Tick)
+	for m := range messages {
+		if strings.Contains(m, `"type":"`+server.MessageSnapshot+`"`) {
+			return
+		}
+	}
+	t.Fatal("no snapshot")
+}
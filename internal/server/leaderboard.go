@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/store"
+)
+
+const (
+	// score batches that may wait for the leaderboard before more are
+	// dropped
+	maxPendingScores = 1024
+	// how long writing one batch or answering one lookup may take
+	leaderboardTimeout = 2 * time.Second
+	// players GET /leaderboard returns by default, and at most
+	defaultLeaderboardLimit = 10
+	maxLeaderboardLimit     = 100
+)
+
+// scoreBatch is everything a room's players scored in one tick
+type scoreBatch struct {
+	mode   string
+	points []store.Points
+}
+
+// LeaderboardEntry is a player's place on the all-time leaderboard
+type LeaderboardEntry struct {
+	Rank    int    `json:"rank"`
+	Account string `json:"account"`
+	Name    string `json:"name"`
+	Score   int64  `json:"score"`
+}
+
+// accountID is the leaderboard identity of a player first given token. It
+// is kept as the token is rotated, and unlike the token it can be shown to
+// everyone.
+func accountID(token string) string {
+	// not the bare digest, which names the token's key in the player store
+	sum := sha256.Sum256([]byte("account:" + token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// recordScores queues what the players holding a resume token scored this
+// tick for the leaderboard, as one batch. Bots have no token and don't
+// count, and neither do lost points, the leaderboard only goes up.
+func (r *Room) recordScores() {
+	if r.srv.scores == nil || len(r.gamestate.Scores) == 0 {
+		return
+	}
+	var points []store.Points
+	at := map[string]int{}
+	for _, sc := range r.gamestate.Scores {
+		account, ok := r.accounts[sc.PlayerID]
+		p := r.gamestate.Players[sc.PlayerID]
+		if !ok || p == nil || sc.Points <= 0 {
+			continue
+		}
+		if i, ok := at[account]; ok {
+			points[i].Points += sc.Points
+			continue
+		}
+		at[account] = len(points)
+		points = append(points, store.Points{Account: account, Name: p.Name, Points: sc.Points})
+	}
+	if len(points) == 0 {
+		return
+	}
+	select {
+	case r.srv.scores <- scoreBatch{mode: r.settings.Mode, points: points}:
+	default:
+		atomic.AddUint64(&r.srv.counters.DroppedScores, 1)
+	}
+}
+
+// runScores writes queued score batches to the leaderboard until the queue
+// is closed
+func (s *Server) runScores() {
+	defer close(s.scoresDone)
+	for batch := range s.scores {
+		ctx, cancel := context.WithTimeout(context.Background(), leaderboardTimeout)
+		err := s.cfg.Leaderboard.Add(ctx, batch.mode, batch.points)
+		cancel()
+		if err != nil {
+			log.Println("leaderboard write:", err)
+		}
+	}
+}
+
+// handleLeaderboard serves GET /leaderboard?mode=&limit=, the best ranked
+// players of a game mode, and GET /leaderboard/{account}, where one player
+// stands in it. The mode defaults to the configured one.
+func (s *Server) handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cfg.Leaderboard == nil {
+		http.Error(w, "there is no leaderboard", http.StatusNotFound)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = s.cfg.Mode
+	}
+	if _, ok := modes[mode]; !ok {
+		http.Error(w, "mode must be one of "+modeNames(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), leaderboardTimeout)
+	defer cancel()
+
+	account := strings.TrimPrefix(r.URL.Path, "/leaderboard")
+	if account != "" {
+		account = strings.TrimPrefix(account, "/")
+		if account == "" || strings.Contains(account, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		rank, ok, err := s.cfg.Leaderboard.Rank(ctx, mode, account)
+		if err != nil {
+			log.Println("leaderboard read:", err)
+			http.Error(w, "leaderboard unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			http.Error(w, "no such player", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(leaderboardEntry(rank))
+		return
+	}
+
+	limit := defaultLeaderboardLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLeaderboardLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxLeaderboardLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	ranks, err := s.cfg.Leaderboard.Top(ctx, mode, limit)
+	if err != nil {
+		log.Println("leaderboard read:", err)
+		http.Error(w, "leaderboard unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// ties come back from the store in no particular order
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if ranks[i].Rank != ranks[j].Rank {
+			return ranks[i].Rank < ranks[j].Rank
+		}
+		return ranks[i].Name < ranks[j].Name
+	})
+	entries := make([]LeaderboardEntry, len(ranks))
+	for i, rank := range ranks {
+		entries[i] = leaderboardEntry(rank)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func leaderboardEntry(r store.Rank) LeaderboardEntry {
+	return LeaderboardEntry{Rank: r.Rank, Account: r.Account, Name: r.Name, Score: r.Score}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/store"
+)
+
+func redisLeaderboard(t *testing.T) *store.RedisLeaderboard {
+	mr := miniredis.RunT(t)
+	return store.NewRedisLeaderboard(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "leaderboard")
+}
+
+func TestLeaderboardScoring(t *testing.T) {
+	board := redisLeaderboard(t)
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.Leaderboard = board
+		cfg.ProjectileDamage = cfg.MaxHP
+		cfg.SpawnProtection = 0
+	})
+	clients := ts.match(t, "/game", 2)
+	shooter, victim := clients[0], clients[1]
+	if shooter.welcome.Account == "" || shooter.welcome.Account == shooter.welcome.ID {
+		t.Fatalf("account %q, want one apart from the player id", shooter.welcome.Account)
+	}
+	shoot(ts, shooter, victim)
+	victim.event(EventDeath, nil)
+
+	ctx := context.Background()
+	eventually(t, "the kill to reach the leaderboard", func() bool {
+		r, ok, err := board.Rank(ctx, ModeFreeForAll, shooter.welcome.Account)
+		return err == nil && ok && r.Score == 1
+	})
+	var entry LeaderboardEntry
+	ts.get(t, "/leaderboard/"+shooter.welcome.Account, &entry)
+	if entry != (LeaderboardEntry{Rank: 1, Account: shooter.welcome.Account, Name: shooter.me().Name, Score: 1}) {
+		t.Fatalf("GET /leaderboard/%s: %+v", shooter.welcome.Account, entry)
+	}
+	if _, ok, _ := board.Rank(ctx, ModeFreeForAll, victim.welcome.Account); ok {
+		t.Fatal("the victim is on the leaderboard without scoring")
+	}
+}
+
+func TestLeaderboardRanking(t *testing.T) {
+	board := redisLeaderboard(t)
+	ts := startServer(t, nil, func(cfg *Config) { cfg.Leaderboard = board })
+	ctx := context.Background()
+	err := board.Add(ctx, ModeFreeForAll, []store.Points{
+		{Account: "a", Name: "Ann", Points: 5},
+		{Account: "b", Name: "Bob", Points: 9},
+		{Account: "c", Name: "Cat", Points: 5},
+		{Account: "d", Name: "Dan", Points: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// points add up, and the latest name sticks
+	if err := board.Add(ctx, ModeFreeForAll, []store.Points{{Account: "d", Name: "Dee", Points: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := board.Add(ctx, ModeTag, []store.Points{{Account: "e", Name: "Eve", Points: 100}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var top []LeaderboardEntry
+	ts.get(t, "/leaderboard?mode=ffa", &top)
+	want := []LeaderboardEntry{
+		{1, "b", "Bob", 9},
+		{2, "a", "Ann", 5},
+		{2, "c", "Cat", 5},
+		{2, "d", "Dee", 5},
+	}
+	if !reflect.DeepEqual(top, want) {
+		t.Fatalf("GET /leaderboard %+v, want %+v", top, want)
+	}
+	ts.get(t, "/leaderboard?mode=ffa&limit=2", &top)
+	// which of the tied ones makes the cut is up to the store
+	if len(top) != 2 || top[0] != want[0] || top[1].Rank != 2 || top[1].Score != 5 {
+		t.Fatalf("with a limit of 2 %+v", top)
+	}
+	ts.get(t, "/leaderboard?mode=tag", &top)
+	if len(top) != 1 || top[0].Account != "e" {
+		t.Fatalf("tag leaderboard %+v", top)
+	}
+
+	var entry LeaderboardEntry
+	ts.get(t, "/leaderboard/c?mode=ffa", &entry)
+	if entry != want[2] {
+		t.Fatalf("GET /leaderboard/c %+v, want %+v", entry, want[2])
+	}
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/leaderboard?limit=0", http.StatusBadRequest},
+		{"/leaderboard?limit=1000", http.StatusBadRequest},
+		{"/leaderboard?limit=ten", http.StatusBadRequest},
+		{"/leaderboard?mode=racing", http.StatusBadRequest},
+		{"/leaderboard/e?mode=ffa", http.StatusNotFound},
+		{"/leaderboard/a/b", http.StatusNotFound},
+	} {
+		if status, body := ts.request(t, http.MethodGet, tt.path, nil); status != tt.want {
+			t.Fatalf("GET %s: %d %s, want %d", tt.path, status, body, tt.want)
+		}
+	}
+}
+
+func TestNoLeaderboard(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	if status, _ := ts.request(t, http.MethodGet, "/leaderboard", nil); status != http.StatusNotFound {
+		t.Fatalf("GET /leaderboard: %d without a leaderboard, want 404", status)
+	}
+	if c := ts.dial(t, "/game"); c.welcome.Account != "" {
+		t.Fatalf("account %q without a leaderboard", c.welcome.Account)
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// room phases
+const (
+	// players are in the room but movement is ignored until all are ready
+	PhaseLobby = "lobby"
+	// everyone is ready and the match starts once the countdown runs out
+	PhaseCountdown = "countdown"
+	// the match is under way
+	PhasePlaying = "playing"
+	// the match is over and everyone stands still while the results are
+	// up, until the room starts a new round or goes back to the lobby
+	PhaseEnded = "ended"
+)
+
+// PhaseEvent tells clients which phase their room is in, who is host and, in
+// the lobby, who is ready. It is sent on joining and whenever any of them
+// changes.
+type PhaseEvent struct {
+	Kind  string   `json:"kind"`
+	Phase string   `json:"phase"`
+	Host  string   `json:"host"`
+	Ready []string `json:"ready"`
+}
+
+// WelcomeEvent is the first message on every connection. Players get a token
+// to resume with if their connection drops, a new one every time they do.
+type WelcomeEvent struct {
+	Kind      string `json:"kind"`
+	ID        string `json:"id"`
+	Spectator bool   `json:"spectator"`
+	Token     string `json:"token,omitempty"`
+	// who the player is on the leaderboard, left out without one
+	Account string `json:"account,omitempty"`
+	// the protocol version the connection speaks
+	Protocol int `json:"protocol"`
+}
+
+// CountdownEvent announces the whole seconds left before the match starts
+type CountdownEvent struct {
+	Kind    string `json:"kind"`
+	Seconds int    `json:"seconds"`
+}
+
+type readyChange struct {
+	c     *client
+	ready bool
+}
+
+// setReady marks c as ready or not ready to start the match
+func (r *Room) setReady(c *client, ready bool) {
+	select {
+	case r.readiness <- readyChange{c, ready}:
+	case <-r.done:
+	}
+}
+
+// applyReady runs on the room goroutine
+func (r *Room) applyReady(rc readyChange) {
+	if r.phase == PhasePlaying || r.phase == PhaseEnded || r.clients[rc.c.id] != rc.c || rc.c.spectator {
+		return
+	}
+	if r.ready[rc.c.id] == rc.ready {
+		return
+	}
+	if rc.ready {
+		r.ready[rc.c.id] = true
+	} else {
+		delete(r.ready, rc.c.id)
+	}
+	if !r.checkStart() {
+		r.sendPhase()
+	}
+}
+
+// checkStart starts the countdown once there are enough players and all of
+// them are ready, and calls it off when that stops being true. It reports
+// whether the phase changed.
+func (r *Room) checkStart() bool {
+	// bots are always ready
+	players := r.humans()
+	canStart := players > 0 && players >= r.srv.cfg.MinPlayers && len(r.ready) == players
+	switch {
+	case r.phase == PhaseLobby && canStart:
+		if r.srv.cfg.Countdown <= 0 {
+			r.play(r.srv.cfg.Clock.Now().UnixNano() / int64(time.Millisecond))
+			return true
+		}
+		r.phase = PhaseCountdown
+		r.countdown = r.srv.cfg.Countdown
+		r.sendPhase()
+		r.sendCountdown()
+		return true
+	case r.phase == PhaseCountdown && !canStart:
+		log.Println("countdown canceled in room", r.name)
+		r.phase = PhaseLobby
+		r.sendPhase()
+		return true
+	}
+	return false
+}
+
+// advanceCountdown runs the countdown down by one tick, announcing each whole
+// second and starting the match at zero
+func (r *Room) advanceCountdown() {
+	before := wholeSeconds(r.countdown)
+	r.countdown -= r.srv.cfg.Tick
+	if r.countdown <= 0 {
+		r.play(r.tickAt)
+		return
+	}
+	if wholeSeconds(r.countdown) != before {
+		r.sendCountdown()
+	}
+}
+
+// play starts the match at, in unix ms by the room clock
+func (r *Room) play(at int64) {
+	r.phase = PhasePlaying
+	r.startedAt = at
+	r.remaining = r.ticksOf(r.settings.MatchDurationMS)
+	r.ready = map[string]bool{}
+	atomic.StoreInt32(&r.started, 1)
+	log.Println("match started in room", r.name)
+	r.sendPhase()
+}
+
+// endMatch stops the match, won by winner, if anyone, for reason, and
+// sends everyone the results to look at during the intermission
+func (r *Room) endMatch(winner, reason string) {
+	switch {
+	case reason == EndTime:
+		log.Println("match ran out of time in room", r.name)
+	case winner == "":
+		log.Println("match drawn in room", r.name)
+	default:
+		log.Println("match won by", winner, "in room", r.name, "by", reason)
+	}
+	scores := r.gamestate.Leaderboard(len(r.gamestate.Players))
+	stats := r.stats()
+	r.send(encode(MessageEvent, MatchOverEvent{
+		Kind:       EventMatchOver,
+		Reason:     reason,
+		Winner:     winner,
+		Scores:     scores,
+		TeamScores: r.gamestate.TeamScores,
+		Stats:      stats,
+	}))
+	r.recordMatch(winner, reason, scores, stats)
+	r.phase = PhaseEnded
+	r.remaining = r.ticksOf(r.settings.IntermissionMS)
+	r.sendPhase()
+}
+
+// advanceIntermission runs the intermission down by one tick. At the end
+// the world starts over and the room either plays the next round straight
+// away or waits in the lobby for everyone to be ready again.
+func (r *Room) advanceIntermission() {
+	r.remaining--
+	if r.remaining > 0 {
+		return
+	}
+	r.gamestate.NewRound(r.settings.Rules(r.srv.cfg.Tick))
+	r.elapsed = 0
+	if r.settings.AfterMatch == AfterMatchRestart {
+		log.Println("new round in room", r.name)
+		r.play(r.tickAt)
+		return
+	}
+	r.phase = PhaseLobby
+	atomic.StoreInt32(&r.started, 0)
+	r.sendPhase()
+}
+
+// ticksOf is ms of room time in ticks, rounded up
+func (r *Room) ticksOf(ms int) int {
+	d := time.Duration(ms) * time.Millisecond
+	return int((d + r.srv.cfg.Tick - 1) / r.srv.cfg.Tick)
+}
+
+// wholeSeconds rounds d up to seconds, so 2.1s left shows as 3
+func wholeSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func (r *Room) sendCountdown() {
+	r.send(encode(MessageEvent, CountdownEvent{Kind: EventCountdown, Seconds: wholeSeconds(r.countdown)}))
+}
+
+func (r *Room) phaseEvent() outbound {
+	ready := make([]string, 0, len(r.ready))
+	for id := range r.ready {
+		ready = append(ready, id)
+	}
+	sort.Strings(ready)
+	return encode(MessageEvent, PhaseEvent{Kind: EventPhase, Phase: r.phase, Host: r.host, Ready: ready})
+}
+
+// sendPhase tells every connection the current phase
+func (r *Room) sendPhase() {
+	r.announcedHost = r.host
+	r.send(r.phaseEvent())
+}
+
+func (r *Room) welcomeEvent(c *client) outbound {
+	ev := WelcomeEvent{Kind: EventWelcome, ID: c.id, Spectator: c.spectator, Token: c.resume, Protocol: c.protocol}
+	if r.srv.cfg.Leaderboard != nil {
+		ev.Account = r.accounts[c.id]
+	}
+	return encode(MessageEvent, ev)
+}
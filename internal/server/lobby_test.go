@@ -0,0 +1,293 @@
+package server
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// readied skips to the phase event listing exactly ids as ready
+func readied(c *testClient, ids ...string) PhaseEvent {
+	c.t.Helper()
+	sort.Strings(ids)
+	for {
+		ev := c.phase(PhaseLobby)
+		if len(ev.Ready) == len(ids) && (len(ids) == 0 || reflect.DeepEqual(ev.Ready, ids)) {
+			return ev
+		}
+	}
+}
+
+func TestAllReadyStartsMatch(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	a, b := ts.dial(t, "/game"), ts.dial(t, "/game")
+	ts.tick(1)
+	a.joined()
+	start := a.me()
+	// nobody moves in the lobby
+	a.input("right")
+	a.sync()
+	ts.tick(3)
+	if s := a.snapshot(); s.Room.Phase != PhaseLobby {
+		t.Fatalf("phase %s, want %s", s.Room.Phase, PhaseLobby)
+	}
+	if p := a.me(); p.X != start.X || p.Y != start.Y {
+		t.Fatal("moved in the lobby")
+	}
+
+	a.send(MessageReady, nil)
+	readied(b, a.welcome.ID)
+	b.send(MessageReady, nil)
+	for _, c := range []*testClient{a, b} {
+		c.phase(PhasePlaying)
+	}
+	ts.tick(1)
+	if s := a.snapshot(); s.Room.Phase != PhasePlaying {
+		t.Fatalf("phase %s, want %s", s.Room.Phase, PhasePlaying)
+	}
+	a.input("right")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("didn't move once playing")
+	}
+}
+
+func TestUnreadyBeforeStart(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	a, b := ts.dial(t, "/game"), ts.dial(t, "/game")
+	a.send(MessageReady, nil)
+	readied(b, a.welcome.ID)
+	a.send(MessageReady, ReadyMessage{Ready: false})
+	readied(b)
+	b.send(MessageReady, nil)
+	readied(a, b.welcome.ID)
+	ts.tick(1)
+	if s := a.snapshot(); s.Room.Phase != PhaseLobby {
+		t.Fatalf("phase %s with one player not ready", s.Room.Phase)
+	}
+	a.send(MessageReady, nil)
+	b.phase(PhasePlaying)
+}
+
+func TestMidMatchJoin(t *testing.T) {
+	for _, tt := range []struct {
+		setting   string
+		spectator bool
+	}{
+		{MidMatchSpawn, false},
+		{MidMatchSpectate, true},
+	} {
+		t.Run(tt.setting, func(t *testing.T) {
+			ts := startServer(t, nil, func(cfg *Config) { cfg.MidMatchJoin = tt.setting })
+			first := ts.match(t, "/game", 1)[0]
+			late := ts.dial(t, "/game")
+			if late.welcome.Spectator != tt.spectator {
+				t.Fatalf("late joiner spectating: %v, want %v", late.welcome.Spectator, tt.spectator)
+			}
+			ts.tick(1)
+			first.snapshot()
+			if _, ok := first.players[late.welcome.ID]; ok == tt.spectator {
+				t.Fatalf("late joiner in the game: %v", ok)
+			}
+		})
+	}
+}
+
+func TestCountdown(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.MinPlayers = 2
+		cfg.Countdown = 3 * time.Second
+	})
+	a := ts.dial(t, "/game")
+	a.send(MessageReady, nil)
+	readied(a, a.welcome.ID)
+	// ready alone isn't enough
+	ts.tick(1)
+	if s := a.snapshot(); s.Room.Phase != PhaseLobby {
+		t.Fatalf("phase %s with one player", s.Room.Phase)
+	}
+
+	b := ts.dial(t, "/game")
+	b.send(MessageReady, nil)
+	a.phase(PhaseCountdown)
+	var counted []int
+	started := false
+	// reads up to the next snapshot, noting the countdown along the way
+	next := func() Snapshot {
+		for {
+			env := a.message()
+			if env.Type == MessageSnapshot {
+				a.apply(env.Data)
+				var s Snapshot
+				a.decode(env.Data, &s)
+				return s
+			}
+			var ev struct {
+				Kind    string `json:"kind"`
+				Seconds int    `json:"seconds"`
+				Phase   string `json:"phase"`
+			}
+			a.decode(env.Data, &ev)
+			switch {
+			case ev.Kind == EventCountdown:
+				counted = append(counted, ev.Seconds)
+			case ev.Kind == EventPhase && ev.Phase == PhasePlaying:
+				started = true
+			}
+		}
+	}
+	ticks := int(ts.cfg.Countdown / ts.cfg.Tick)
+	for i := 1; i < ticks; i++ {
+		ts.tick(1)
+		if s := next(); s.Room.Phase != PhaseCountdown || started {
+			t.Fatalf("phase %s after %d of %d ticks", s.Room.Phase, i, ticks)
+		}
+	}
+	ts.tick(1)
+	if s := next(); s.Room.Phase != PhasePlaying || !started {
+		t.Fatalf("phase %s once the countdown ran out", s.Room.Phase)
+	}
+	if !reflect.DeepEqual(counted, []int{3, 2, 1}) {
+		t.Fatalf("counted down %v, want 3, 2, 1", counted)
+	}
+}
+
+func TestCountdownCanceled(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.MinPlayers = 2
+		cfg.Countdown = 3 * time.Second
+		cfg.ReconnectGrace = 0
+	})
+	a, b := ts.dial(t, "/game"), ts.dial(t, "/game")
+	a.send(MessageReady, nil)
+	b.send(MessageReady, nil)
+	a.phase(PhaseCountdown)
+	ts.tick(10)
+	b.conn.Close()
+	a.phase(PhaseLobby)
+	// and stays there however long it waits
+	ts.tick(int(ts.cfg.Countdown/ts.cfg.Tick) + 1)
+	if s := a.snapshot(); s.Room.Phase != PhaseLobby {
+		t.Fatalf("phase %s after the countdown was called off", s.Room.Phase)
+	}
+
+	// a new player has to ready up for it to start again
+	c := ts.dial(t, "/game")
+	c.send(MessageReady, nil)
+	a.phase(PhaseCountdown)
+}
+
+func TestMatchTimer(t *testing.T) {
+	for _, after := range []string{AfterMatchLobby, AfterMatchRestart} {
+		t.Run(after, func(t *testing.T) {
+			ts := startServer(t, nil, func(cfg *Config) {
+				cfg.MatchDuration = 10 * cfg.Tick
+				cfg.Intermission = 4 * cfg.Tick
+				cfg.AfterMatch = after
+			})
+			c := ts.match(t, "/game", 1)[0]
+			tick := ts.cfg.Tick.Milliseconds()
+			// one tick of the match has gone by
+			for left := int64(9); left > 1; left-- {
+				c.input("right")
+				c.sync()
+				ts.tick(1)
+				if s := c.snapshot(); s.Room.RemainingMS != (left-1)*tick {
+					t.Fatalf("%d ms left, want %d", s.Room.RemainingMS, (left-1)*tick)
+				}
+			}
+			ts.tick(1)
+			var over MatchOverEvent
+			c.event(EventMatchOver, &over)
+			if over.Reason != EndTime || over.Winner != "" || len(over.Scores) != 1 || over.Scores[0].PlayerID != c.welcome.ID {
+				t.Fatalf("match over %+v", over)
+			}
+			c.phase(PhaseEnded)
+			at := c.snapshot()
+			if at.Room.Phase != PhaseEnded || at.Room.RemainingMS != 4*tick {
+				t.Fatalf("room %+v, want the intermission", at.Room)
+			}
+			frozen := c.me()
+
+			// joining now waits for the next round
+			late := ts.dial(t, "/game")
+			if late.welcome.Spectator {
+				t.Fatal("joined during the intermission as a spectator")
+			}
+			late.phase(PhaseEnded)
+			for i := 0; i < 3; i++ {
+				c.input("right")
+				c.sync()
+				ts.tick(1)
+				if s := c.snapshot(); s.Room.Phase != PhaseEnded || c.me().X != frozen.X || c.me().Y != frozen.Y {
+					t.Fatalf("room %+v with %+v, want nobody moving", s.Room, c.me())
+				}
+			}
+			c.input()
+			c.sync()
+			ts.tick(1)
+			// a new round plays its first tick straight away
+			want, elapsed, remaining := PhaseLobby, int64(0), int64(0)
+			if after == AfterMatchRestart {
+				want, elapsed, remaining = PhasePlaying, tick, 9*tick
+			}
+			for _, cl := range []*testClient{c, late} {
+				cl.phase(want)
+				s := cl.snapshot()
+				if s.Room.Phase != want || s.Room.ElapsedMS != elapsed || s.Room.RemainingMS != remaining || len(cl.players) != 2 {
+					t.Fatalf("room %+v with %v after the intermission", s.Room, cl.players)
+				}
+			}
+			// back where the round started, not where the last one ended
+			if p := c.players[c.welcome.ID]; p.X == frozen.X {
+				t.Fatalf("still at %v,%v after the round was reset", p.X, p.Y)
+			}
+		})
+	}
+}
+
+func TestWinConditions(t *testing.T) {
+	for _, tt := range []struct {
+		reason    string
+		configure func(*Config)
+	}{
+		{sim.EndScore, func(cfg *Config) { cfg.WinScore = 1 }},
+		{sim.EndLastAlive, func(cfg *Config) { cfg.LastAlive = true }},
+	} {
+		t.Run(tt.reason, func(t *testing.T) {
+			ts := startServer(t, nil, func(cfg *Config) {
+				cfg.ProjectileDamage = cfg.MaxHP
+				cfg.SpawnProtection = 0
+				cfg.Intermission = 3 * cfg.ProjectileTTL
+				cfg.AfterMatch = AfterMatchRestart
+				tt.configure(cfg)
+			})
+			clients := ts.match(t, "/game", 2)
+			shooter, victim := clients[0], clients[1]
+			shoot(ts, shooter, victim)
+			for _, c := range clients {
+				var over MatchOverEvent
+				c.event(EventMatchOver, &over)
+				if over.Reason != tt.reason || over.Winner != shooter.welcome.ID || len(over.Scores) != 2 || over.Scores[0].PlayerID != shooter.welcome.ID {
+					t.Fatalf("match over %+v, want %s winning by %s", over, shooter.welcome.ID, tt.reason)
+				}
+				c.phase(PhaseEnded)
+			}
+
+			// the next round starts everyone over, with nothing left flying
+			ts.tick(int(ts.cfg.Intermission / ts.cfg.Tick))
+			shooter.phase(PhasePlaying)
+			s := shooter.keyframe()
+			if len(s.Projectiles) != 0 || len(s.Players) != 2 {
+				t.Fatalf("new round keyframe %+v", s)
+			}
+			for id, p := range s.Players {
+				if p.Dead || p.Score != 0 || p.HP != ts.cfg.MaxHP {
+					t.Fatalf("%s starts the new round as %+v", id, p)
+				}
+			}
+		})
+	}
+}
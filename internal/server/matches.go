@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+const (
+	// match records that may wait for the store before more are dropped
+	maxPendingMatches = 256
+	// how long writing one record or answering one lookup may take
+	matchesTimeout = 2 * time.Second
+	// matches GET /matches returns by default, and at most
+	defaultMatchesLimit = 20
+	maxMatchesLimit     = 100
+)
+
+// MatchRecord is what is kept of a finished match
+type MatchRecord struct {
+	ID string `json:"id"`
+	// empty for a private room, whose join code is no one else's business
+	Room    string `json:"room,omitempty"`
+	Private bool   `json:"private,omitempty"`
+	Mode    string `json:"mode"`
+	Map     string `json:"map,omitempty"`
+	Reason  string `json:"reason"`
+	Winner  string `json:"winner,omitempty"`
+	// unix ms, by the room clock, and the time played in between, which
+	// leaves out any time the match was paused
+	StartedAtMS int64          `json:"started_at_ms"`
+	EndedAtMS   int64          `json:"ended_at_ms"`
+	DurationMS  int64          `json:"duration_ms"`
+	Standings   []sim.Standing `json:"standings"`
+	TeamScores  []int          `json:"team_scores,omitempty"`
+	Stats       []PlayerStats  `json:"stats"`
+}
+
+// recordMatch queues a record of the match that ended in this tick for the
+// match history. It never blocks, so the intermission starts on time however
+// slow the store is; a record that doesn't fit is dropped.
+func (r *Room) recordMatch(winner, reason string, standings []sim.Standing, stats []PlayerStats) {
+	if r.srv.matches == nil {
+		return
+	}
+	rec := MatchRecord{
+		ID:          uuid.New().String(),
+		Room:        r.name,
+		Mode:        r.settings.Mode,
+		Map:         r.settings.Map,
+		Reason:      reason,
+		Winner:      winner,
+		StartedAtMS: r.startedAt,
+		EndedAtMS:   r.tickAt,
+		DurationMS:  r.elapsed.Milliseconds(),
+		Standings:   standings,
+		TeamScores:  append([]int(nil), r.gamestate.TeamScores...),
+		Stats:       stats,
+	}
+	if r.code != "" {
+		rec.Room = ""
+		rec.Private = true
+	}
+	select {
+	case r.srv.matches <- rec:
+	default:
+		atomic.AddUint64(&r.srv.counters.DroppedMatches, 1)
+	}
+}
+
+// runMatches writes queued match records to the match history until the
+// queue is closed
+func (s *Server) runMatches() {
+	defer close(s.matchesDone)
+	for rec := range s.matches {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			log.Println("marshal error:", err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), matchesTimeout)
+		err = s.cfg.Matches.Add(ctx, rec.Mode, rec.ID, data)
+		cancel()
+		if err != nil {
+			log.Println("match history write:", err)
+		}
+	}
+}
+
+// handleMatches serves GET /matches?mode=&limit=, the latest matches of a
+// game mode, newest first, and GET /matches/{id}, one match. The mode
+// defaults to the configured one.
+func (s *Server) handleMatches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cfg.Matches == nil {
+		http.Error(w, "there is no match history", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), matchesTimeout)
+	defer cancel()
+
+	id := strings.TrimPrefix(r.URL.Path, "/matches")
+	if id != "" {
+		id = strings.TrimPrefix(id, "/")
+		if id == "" || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		data, ok, err := s.cfg.Matches.Get(ctx, id)
+		if err != nil {
+			log.Println("match history read:", err)
+			http.Error(w, "match history unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			http.Error(w, "no such match", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(data, '\n'))
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = s.cfg.Mode
+	}
+	if _, ok := modes[mode]; !ok {
+		http.Error(w, "mode must be one of "+modeNames(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultMatchesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxMatchesLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxMatchesLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	records, err := s.cfg.Matches.Recent(ctx, mode, limit)
+	if err != nil {
+		log.Println("match history read:", err)
+		http.Error(w, "match history unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// the records are already JSON
+	out := make([]json.RawMessage, len(records))
+	for i, data := range records {
+		out[i] = data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
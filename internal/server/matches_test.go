@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/store"
+)
+
+func redisMatches(t *testing.T, keep int, ttl time.Duration) (*miniredis.Miniredis, *store.RedisMatches) {
+	mr := miniredis.RunT(t)
+	return mr, store.NewRedisMatches(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "matches", keep, ttl)
+}
+
+// history is the match records GET path answers with once it has n of them
+func history(t *testing.T, ts *testServer, path string, n int) []MatchRecord {
+	t.Helper()
+	var records []MatchRecord
+	eventually(t, fmt.Sprintf("%d match records", n), func() bool {
+		ts.get(t, path, &records)
+		return len(records) == n
+	})
+	return records
+}
+
+func TestMatchRecorded(t *testing.T) {
+	_, matches := redisMatches(t, 10, 0)
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.Matches = matches
+		cfg.MatchDuration = 10 * cfg.Tick
+		cfg.Intermission = 2 * cfg.Tick
+		cfg.AfterMatch = AfterMatchRestart
+	})
+	clients := ts.match(t, "/game", 2)
+	ts.tick(10)
+	var over MatchOverEvent
+	clients[0].event(EventMatchOver, &over)
+
+	rec := history(t, ts, "/matches", 1)[0]
+	if rec.ID == "" || rec.Room != DefaultRoom || rec.Private || rec.Mode != ModeFreeForAll || rec.Reason != over.Reason || rec.Winner != over.Winner {
+		t.Fatalf("recorded %+v after %+v", rec, over)
+	}
+	if rec.DurationMS != (10*ts.cfg.Tick).Milliseconds() || rec.EndedAtMS-rec.StartedAtMS != rec.DurationMS {
+		t.Fatalf("lasted %dms from %d to %d, want 10 ticks", rec.DurationMS, rec.StartedAtMS, rec.EndedAtMS)
+	}
+	if !reflect.DeepEqual(rec.Standings, over.Scores) || !reflect.DeepEqual(rec.Stats, over.Stats) {
+		t.Fatalf("standings %+v and stats %+v, want the results %+v", rec.Standings, rec.Stats, over)
+	}
+	var one MatchRecord
+	ts.get(t, "/matches/"+rec.ID, &one)
+	if !reflect.DeepEqual(one, rec) {
+		t.Fatalf("GET /matches/%s: %+v, want %+v", rec.ID, one, rec)
+	}
+
+	// the next round goes on top
+	ts.tick(2)
+	clients[0].phase(PhasePlaying)
+	ts.tick(10)
+	clients[0].event(EventMatchOver, nil)
+	records := history(t, ts, "/matches?mode=ffa", 2)
+	if records[1].ID != rec.ID || records[0].StartedAtMS < rec.EndedAtMS {
+		t.Fatalf("history %+v, want the second match before %s", records, rec.ID)
+	}
+	// and only under its own mode
+	history(t, ts, "/matches?mode=tag", 0)
+}
+
+func TestMatchPausedRecorded(t *testing.T) {
+	_, matches := redisMatches(t, 10, 0)
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.Matches = matches
+		cfg.MatchDuration = 10 * cfg.Tick
+	})
+	clients := ts.match(t, "/game", 2)
+	host := clients[0]
+	ts.tick(3)
+	host.send(MessagePause, nil)
+	host.sync()
+	ts.tick(5)
+	host.send(MessageResume, nil)
+	host.sync()
+	ts.tick(7)
+	host.event(EventMatchOver, nil)
+
+	// the pause counts towards when it ended but not how long it lasted
+	rec := history(t, ts, "/matches", 1)[0]
+	played, paused := (10 * ts.cfg.Tick).Milliseconds(), (5 * ts.cfg.Tick).Milliseconds()
+	if rec.DurationMS != played || rec.EndedAtMS-rec.StartedAtMS != played+paused {
+		t.Fatalf("lasted %dms from %d to %d, want 10 ticks played over 15", rec.DurationMS, rec.StartedAtMS, rec.EndedAtMS)
+	}
+}
+
+func TestMatchHistoryRetention(t *testing.T) {
+	mr, matches := redisMatches(t, 3, time.Hour)
+	ts := startServer(t, nil, func(cfg *Config) { cfg.Matches = matches })
+	ctx := context.Background()
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprint(i)
+		if err := matches.Add(ctx, ModeFreeForAll, id, []byte(`{"id":"`+id+`","mode":"ffa"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := matches.Add(ctx, ModeTag, "tag", []byte(`{"id":"tag","mode":"tag"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the latest 3 of each mode, newest first, and the rest are gone
+	var ids []string
+	for _, rec := range history(t, ts, "/matches", 3) {
+		ids = append(ids, rec.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"5", "4", "3"}) {
+		t.Fatalf("history %v, want 5, 4 and 3", ids)
+	}
+	if mr.Exists("matches:match:1") || mr.Exists("matches:match:2") {
+		t.Fatalf("trimmed records still kept: %v", mr.Keys())
+	}
+	if records := history(t, ts, "/matches?limit=2", 2); records[0].ID != "5" || records[1].ID != "4" {
+		t.Fatalf("with a limit of 2 %+v", records)
+	}
+	if records := history(t, ts, "/matches?mode=tag", 1); records[0].ID != "tag" {
+		t.Fatalf("tag history %+v", records)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/matches/4", http.StatusOK},
+		{http.MethodGet, "/matches/1", http.StatusNotFound},
+		{http.MethodGet, "/matches/a/b", http.StatusNotFound},
+		{http.MethodGet, "/matches?limit=0", http.StatusBadRequest},
+		{http.MethodGet, "/matches?limit=1000", http.StatusBadRequest},
+		{http.MethodGet, "/matches?mode=racing", http.StatusBadRequest},
+		{http.MethodPost, "/matches", http.StatusMethodNotAllowed},
+	} {
+		if status, body := ts.request(t, tt.method, tt.path, nil); status != tt.want {
+			t.Fatalf("%s %s: %d %s, want %d", tt.method, tt.path, status, body, tt.want)
+		}
+	}
+
+	// and after the ttl nothing is left to show
+	mr.FastForward(time.Hour)
+	history(t, ts, "/matches", 0)
+	if status, _ := ts.request(t, http.MethodGet, "/matches/5", nil); status != http.StatusNotFound {
+		t.Fatalf("GET /matches/5: %d after the ttl, want 404", status)
+	}
+}
+
+func TestNoMatchHistory(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	if status, _ := ts.request(t, http.MethodGet, "/matches", nil); status != http.StatusNotFound {
+		t.Fatalf("GET /matches: %d without a match history, want 404", status)
+	}
+}
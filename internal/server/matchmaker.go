@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/clock"
+)
+
+// Matchmaker groups waiting players into rooms. The in-memory queue only
+// matches players on the same instance; a shared one could sit behind the
+// same interface.
+type Matchmaker interface {
+	// Wait queues the caller until a match forms and returns the join code
+	// of its room. Canceling ctx takes the caller out of the queue.
+	Wait(ctx context.Context) (string, error)
+}
+
+// match is the result handed to each player in a formed match
+type match struct {
+	code string
+	err  error
+}
+
+type ticket struct {
+	result chan match
+}
+
+// localMatchmaker starts a match as soon as size players are queued, or when
+// the longest waiting player has waited maxWait, with whoever is there.
+type localMatchmaker struct {
+	size    int
+	maxWait time.Duration
+	clock   clock.Clock
+	// starts the room for a formed match and returns its join code
+	newRoom func() (string, error)
+
+	lock    sync.Mutex
+	waiting []*ticket
+}
+
+func newLocalMatchmaker(size int, maxWait time.Duration, clk clock.Clock, newRoom func() (string, error)) *localMatchmaker {
+	return &localMatchmaker{
+		size:    size,
+		maxWait: maxWait,
+		clock:   clk,
+		newRoom: newRoom,
+	}
+}
+
+func (m *localMatchmaker) Wait(ctx context.Context) (string, error) {
+	t := &ticket{result: make(chan match, 1)}
+	var players []*ticket
+	m.lock.Lock()
+	m.waiting = append(m.waiting, t)
+	if len(m.waiting) >= m.size {
+		players = m.take()
+	}
+	m.lock.Unlock()
+	m.start(players)
+
+	timeout := m.clock.NewTicker(m.maxWait)
+	defer timeout.Stop()
+	select {
+	case res := <-t.result:
+		return res.code, res.err
+	case <-timeout.C():
+		// start with fewer players, unless a match formed meanwhile
+		var players []*ticket
+		m.lock.Lock()
+		if m.queued(t) {
+			players = m.take()
+		}
+		m.lock.Unlock()
+		m.start(players)
+		res := <-t.result
+		return res.code, res.err
+	case <-ctx.Done():
+		m.lock.Lock()
+		queued := m.queued(t)
+		m.drop(t)
+		m.lock.Unlock()
+		if queued {
+			return "", ctx.Err()
+		}
+		// t is already in a match, whose room counts on it
+		res := <-t.result
+		return res.code, res.err
+	}
+}
+
+// take takes up to size queued players, oldest first, out of the queue.
+// lock must be held.
+func (m *localMatchmaker) take() []*ticket {
+	n := len(m.waiting)
+	if n > m.size {
+		n = m.size
+	}
+	players := m.waiting[:n]
+	m.waiting = append([]*ticket{}, m.waiting[n:]...)
+	return players
+}
+
+// start puts players into a new room, if there are any. It is called
+// without the lock, so starting the room doesn't hold up the queue.
+func (m *localMatchmaker) start(players []*ticket) {
+	if len(players) == 0 {
+		return
+	}
+	code, err := m.newRoom()
+	for _, t := range players {
+		t.result <- match{code, err}
+	}
+}
+
+// queued reports whether t is still waiting. lock must be held.
+func (m *localMatchmaker) queued(t *ticket) bool {
+	for _, w := range m.waiting {
+		if w == t {
+			return true
+		}
+	}
+	return false
+}
+
+// drop takes t out of the queue if it is still there. lock must be held.
+func (m *localMatchmaker) drop(t *ticket) {
+	for i, w := range m.waiting {
+		if w == t {
+			m.waiting = append(m.waiting[:i], m.waiting[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/clock"
+)
+
+const maxWait = time.Minute
+
+// testMatchmaker is a matchmaker on a manual clock whose rooms are numbered
+// in the order they were made
+type testMatchmaker struct {
+	*localMatchmaker
+	clock *clock.Manual
+	mu    sync.Mutex
+	rooms int
+}
+
+func newTestMatchmaker(size int) *testMatchmaker {
+	tm := &testMatchmaker{clock: clock.NewManual(testEpoch)}
+	tm.localMatchmaker = newLocalMatchmaker(size, maxWait, tm.clock, func() (string, error) {
+		tm.mu.Lock()
+		defer tm.mu.Unlock()
+		tm.rooms++
+		return fmt.Sprint("room", tm.rooms), nil
+	})
+	return tm
+}
+
+func (tm *testMatchmaker) made() int {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.rooms
+}
+
+func (tm *testMatchmaker) queueLen() int {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	return len(tm.waiting)
+}
+
+type waitResult struct {
+	code string
+	err  error
+}
+
+// join queues a player on ctx and returns where its result will arrive,
+// once it is in the queue
+func (tm *testMatchmaker) join(t *testing.T, ctx context.Context) chan waitResult {
+	t.Helper()
+	before := tm.queueLen()
+	out := make(chan waitResult, 1)
+	go func() {
+		code, err := tm.Wait(ctx)
+		out <- waitResult{code, err}
+	}()
+	eventually(t, "the player to queue", func() bool {
+		n := tm.queueLen()
+		// joining may have completed a match and emptied the queue
+		return n > before || n == 0
+	})
+	return out
+}
+
+func result(t *testing.T, c chan waitResult) waitResult {
+	t.Helper()
+	select {
+	case r := <-c:
+		return r
+	case <-time.After(readTimeout):
+		t.Fatal("still waiting")
+	}
+	return waitResult{}
+}
+
+func TestMatchmakerStaggeredJoins(t *testing.T) {
+	tm := newTestMatchmaker(4)
+	var players []chan waitResult
+	for i := 0; i < 4; i++ {
+		if i > 0 {
+			// well within the first player's max wait in total
+			tm.clock.Advance(maxWait / 5)
+		}
+		players = append(players, tm.join(t, context.Background()))
+	}
+	for _, p := range players {
+		if r := result(t, p); r.err != nil || r.code != "room1" {
+			t.Fatalf("got %+v, want room1", r)
+		}
+	}
+	if n := tm.made(); n != 1 {
+		t.Fatalf("%d rooms made, want 1", n)
+	}
+}
+
+func TestMatchmakerMaxWait(t *testing.T) {
+	tm := newTestMatchmaker(4)
+	first := tm.join(t, context.Background())
+	second := tm.join(t, context.Background())
+	// their timers start just after they queue
+	eventually(t, "the wait to run out", func() bool {
+		tm.clock.Advance(maxWait)
+		return len(first) > 0
+	})
+	for _, p := range []chan waitResult{first, second} {
+		if r := result(t, p); r.err != nil || r.code != "room1" {
+			t.Fatalf("got %+v, want room1", r)
+		}
+	}
+	if n := tm.made(); n != 1 {
+		t.Fatalf("%d rooms made, want 1", n)
+	}
+}
+
+func TestMatchmakerLeaveQueue(t *testing.T) {
+	tm := newTestMatchmaker(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := tm.join(t, ctx)
+	cancel()
+	if r := result(t, gone); r.err != context.Canceled {
+		t.Fatalf("got %+v, want canceled", r)
+	}
+	if n := tm.queueLen(); n != 0 {
+		t.Fatalf("%d still queued", n)
+	}
+	a := tm.join(t, context.Background())
+	b := tm.join(t, context.Background())
+	for _, p := range []chan waitResult{a, b} {
+		if r := result(t, p); r.err != nil || r.code != "room1" {
+			t.Fatalf("got %+v, want room1", r)
+		}
+	}
+}
+
+func TestMatchmakerCancelAfterMatch(t *testing.T) {
+	clk := clock.NewManual(testEpoch)
+	making := make(chan struct{})
+	release := make(chan struct{})
+	m := newLocalMatchmaker(2, maxWait, clk, func() (string, error) {
+		close(making)
+		<-release
+		return "room1", nil
+	})
+	tm := &testMatchmaker{localMatchmaker: m, clock: clk}
+	ctx, cancel := context.WithCancel(context.Background())
+	first := tm.join(t, ctx)
+	second := tm.join(t, context.Background())
+	<-making
+	// the match formed, so hanging up now is too late to leave it
+	cancel()
+	close(release)
+	for _, p := range []chan waitResult{first, second} {
+		if r := result(t, p); r.err != nil || r.code != "room1" {
+			t.Fatalf("got %+v, want room1", r)
+		}
+	}
+}
+
+func TestMatchmakerConcurrentJoins(t *testing.T) {
+	tm := newTestMatchmaker(4)
+	const players = 40
+	codes := make(chan string, players)
+	var wg sync.WaitGroup
+	for i := 0; i < players; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, err := tm.Wait(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			codes <- code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	per := map[string]int{}
+	for code := range codes {
+		per[code]++
+	}
+	if len(per) != players/4 {
+		t.Fatalf("%d rooms, want %d", len(per), players/4)
+	}
+	for code, n := range per {
+		if n != 4 {
+			t.Fatalf("%d players in %s, want 4", n, code)
+		}
+	}
+}
+
+func TestMatchmakeEndpoint(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) { cfg.MatchSize = 2 })
+	codes := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			status, body := ts.request(t, http.MethodPost, "/matchmake", nil)
+			if status != http.StatusOK {
+				t.Errorf("POST /matchmake: %d %s", status, body)
+			}
+			var matched struct {
+				Code string `json:"code"`
+			}
+			json.Unmarshal(body, &matched)
+			codes <- matched.Code
+		}()
+	}
+	a, b := <-codes, <-codes
+	if a == "" || a != b {
+		t.Fatalf("matched into %q and %q", a, b)
+	}
+	ts.dial(t, "/game?code="+a)
+	ts.dial(t, "/game?code="+b)
+	if status, _ := ts.request(t, http.MethodGet, "/matchmake", nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /matchmake: %d", status)
+	}
+}
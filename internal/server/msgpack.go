@@ -0,0 +1,40 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// pack encodes v as msgpack with the same field names as the JSON messages
+func pack(v interface{}) []byte {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	// whole pixel positions go out as ints
+	enc.UseCompactFloats(true)
+	if err := enc.Encode(v); err != nil {
+		log.Println("marshal error:", err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// unpackInto decodes msgpack written by pack into v
+func unpackInto(raw []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(raw))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// unpack turns a msgpack client message into the JSON the router takes
+func unpack(raw []byte) ([]byte, error) {
+	var v interface{}
+	if err := msgpack.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
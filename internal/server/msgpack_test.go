@@ -0,0 +1,102 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// dialMsgpack connects to path with dialer and waits for the welcome. Every
+// msgpack frame is turned into JSON as it arrives, so the client reads like
+// any other; a JSON text frame fails the test. What it sends goes out as
+// msgpack.
+func (ts *testServer) dialMsgpack(t *testing.T, path string, dialer *websocket.Dialer) *testClient {
+	t.Helper()
+	conn, err := ts.open(path, dialer)
+	if err != nil {
+		t.Fatal("dial", path+":", err)
+	}
+	c := &testClient{t: t, conn: conn, in: make(chan received, 1<<14), players: map[string]sim.Player{}, msgpack: true}
+	go func() {
+		defer close(c.in)
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				c.err = err
+				return
+			}
+			if typ != websocket.BinaryMessage {
+				t.Errorf("text frame %s to a msgpack client", data)
+				continue
+			}
+			msg, err := unpack(data)
+			if err != nil {
+				t.Errorf("not msgpack: %v", err)
+				continue
+			}
+			c.in <- received{websocket.TextMessage, msg}
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	c.event(EventWelcome, &c.welcome)
+	return c
+}
+
+func TestMsgpackMixedRoom(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	plain := ts.dial(t, "/game")
+	negotiated := ts.dialMsgpack(t, "/game", &websocket.Dialer{Subprotocols: []string{MsgpackProtocol}})
+	if p := negotiated.conn.Subprotocol(); p != MsgpackProtocol {
+		t.Fatalf("subprotocol %q, want %q", p, MsgpackProtocol)
+	}
+	queried := ts.dialMsgpack(t, "/game?encoding=msgpack", nil)
+	clients := []*testClient{plain, negotiated, queried}
+	ts.tick(1)
+	for _, c := range clients {
+		c.send(MessageReady, nil)
+	}
+	for _, c := range clients {
+		c.phase(PhasePlaying)
+	}
+
+	ts.tick(1)
+	for _, c := range clients {
+		c.snapshot()
+	}
+	start := plain.players[negotiated.welcome.ID]
+
+	// inputs come in as msgpack too
+	negotiated.input("right")
+	negotiated.sync()
+	for i := 0; i < 5; i++ {
+		ts.tick(1)
+		var snapshots []Snapshot
+		for _, c := range clients {
+			snapshots = append(snapshots, c.snapshot())
+		}
+		for j, c := range clients[1:] {
+			s, want := snapshots[j+1], snapshots[0]
+			if s.Seq != want.Seq || s.Tick != want.Tick || !reflect.DeepEqual(s.Room, want.Room) || !reflect.DeepEqual(s.Coins, want.Coins) {
+				t.Fatalf("tick %d: msgpack %+v, JSON %+v", i, s, want)
+			}
+			if !reflect.DeepEqual(c.players, plain.players) {
+				t.Fatalf("tick %d: msgpack players %v, JSON %v", i, c.players, plain.players)
+			}
+			if s.Self == nil {
+				t.Fatalf("tick %d: no state of its own", i)
+			}
+		}
+	}
+	if p := plain.players[negotiated.welcome.ID]; p.X == start.X {
+		t.Fatal("msgpack player didn't move")
+	}
+	// a bad frame is reported in msgpack
+	if err := queried.conn.WriteMessage(websocket.BinaryMessage, []byte{0xc1}); err != nil {
+		t.Fatal(err)
+	}
+	if e := queried.errorMessage(); e.Code != ErrBadMessage {
+		t.Fatalf("got %+v, want %s", e, ErrBadMessage)
+	}
+}
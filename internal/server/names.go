@@ -0,0 +1,74 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNameLength is the most characters a player name may have
+const maxNameLength = 16
+
+// cleanName is a name asked for with ?name=, with unprintable characters
+// dropped and spaces trimmed, or "" when that leaves nothing, too much or
+// something containing a word from blocked
+func cleanName(name string, blocked []string) string {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, name))
+	if n := utf8.RuneCountInString(name); n < 1 || n > maxNameLength {
+		return ""
+	}
+	lower := strings.ToLower(name)
+	for _, word := range blocked {
+		if word != "" && strings.Contains(lower, strings.ToLower(word)) {
+			return ""
+		}
+	}
+	return name
+}
+
+// uniqueName is name, or one made from id like player-7f3a when it is "",
+// with a number on the end if anyone else in the room goes by it already
+func (r *Room) uniqueName(name, id string) string {
+	if name == "" {
+		short := id
+		if len(short) > 4 {
+			short = short[:4]
+		}
+		name = "player-" + short
+	}
+	if !r.nameTaken(name, id) {
+		return name
+	}
+	base := []rune(name)
+	for n := 2; ; n++ {
+		suffix := strconv.Itoa(n)
+		if len(base)+len(suffix) > maxNameLength {
+			base = base[:maxNameLength-len(suffix)]
+		}
+		if candidate := string(base) + suffix; !r.nameTaken(candidate, id) {
+			return candidate
+		}
+	}
+}
+
+// nameTaken reports whether a connection or a disconnected player other than
+// id goes by name, ignoring case
+func (r *Room) nameTaken(name, id string) bool {
+	for other, c := range r.clients {
+		if other != id && strings.EqualFold(c.name, name) {
+			return true
+		}
+	}
+	for other, p := range r.gamestate.Players {
+		if other != id && strings.EqualFold(p.Name, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCleanName(t *testing.T) {
+	blocked := []string{"darn", ""}
+	for name, want := range map[string]string{
+		"alice":                 "alice",
+		"  bob  ":               "bob",
+		"ca\x00rol\n":           "carol",
+		"\u200bdave":            "dave",
+		"zoë":                   "zoë",
+		"sixteen chars ok":      "sixteen chars ok",
+		"seventeen chars no":    "",
+		"":                      "",
+		"   ":                   "",
+		"\x01\x02":              "",
+		"DARNit":                "",
+		strings.Repeat("é", 16): strings.Repeat("é", 16),
+	} {
+		if got := cleanName(name, blocked); got != want {
+			t.Fatalf("cleanName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestPlayerNames(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) { cfg.NameBlocklist = []string{"darn"} })
+	watcher := ts.dial(t, "/game?name=watcher")
+	watcher.event(EventJoin, nil)
+	// names are told apart ignoring case, and the suffix keeps within the
+	// limit
+	for _, tt := range []struct{ name, want string }{
+		{"bob", "bob"},
+		{"BOB", "BOB2"},
+		{"bob", "bob3"},
+		{"sixteen chars ok", "sixteen chars ok"},
+		{"sixteen chars ok", "sixteen chars o2"},
+	} {
+		c := ts.dial(t, "/game?name="+url.QueryEscape(tt.name))
+		var ev PlayerEvent
+		watcher.event(EventJoin, &ev)
+		if ev.PlayerID != c.welcome.ID || ev.Name != tt.want {
+			t.Fatalf("%q joined as %+v, want %q", tt.name, ev, tt.want)
+		}
+	}
+	// anything unusable gets one made up from the id
+	for _, name := range []string{"", "   ", "darn it", "seventeen chars no"} {
+		c := ts.dial(t, "/game?name="+url.QueryEscape(name))
+		var ev PlayerEvent
+		watcher.event(EventJoin, &ev)
+		if want := "player-" + c.welcome.ID[:4]; ev.Name != want {
+			t.Fatalf("%q joined as %q, want %q", name, ev.Name, want)
+		}
+	}
+	ts.tick(1)
+	watcher.snapshot()
+	if p := watcher.players[watcher.welcome.ID]; p.Name != "watcher" {
+		t.Fatalf("snapshot name %q", p.Name)
+	}
+}
+
+func TestNameKeptOnResume(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game?name=alice", 2)
+	a, other := clients[0], clients[1]
+	a.conn.Close()
+	var ev PlayerEvent
+	other.event(EventDisconnected, &ev)
+	if ev.Name != "alice" {
+		t.Fatalf("disconnected %+v", ev)
+	}
+	// nobody takes it while they are gone
+	c := ts.dial(t, "/game?name=alice")
+	other.event(EventJoin, &ev)
+	if ev.PlayerID != c.welcome.ID || ev.Name != "alice3" {
+		t.Fatalf("joined as %+v, want alice3", ev)
+	}
+	back := ts.dial(t, "/game?name=someone&token="+a.welcome.Token)
+	other.event(EventResumed, &ev)
+	if ev.PlayerID != a.welcome.ID || ev.Name != "alice" {
+		t.Fatalf("resumed %+v, want alice", ev)
+	}
+	ts.tick(1)
+	back.keyframe()
+	if p := back.me(); p.Name != "alice" {
+		t.Fatalf("resumed as %q", p.Name)
+	}
+}
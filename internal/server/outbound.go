@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/gorilla/websocket"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// types of server message
+const (
+	MessageSnapshot = "snapshot"
+	MessageEvent    = "event"
+	MessageError    = "error"
+	// the game events of one tick together, see Events
+	MessageEvents = "events"
+)
+
+// event kinds, carried in the data of an event message
+const (
+	EventWelcome   = "welcome"
+	EventPhase     = "phase"
+	EventCountdown = "countdown"
+	// a player or spectator arrived, before they are first in a snapshot
+	EventJoin = "join"
+	// a player or spectator is gone, after they were last in a snapshot
+	EventLeave = "leave"
+	// a player's connection dropped and they are held for their resume
+	// token, still in snapshots
+	EventDisconnected = "disconnected"
+	EventResumed      = "resumed"
+	EventPong         = "pong"
+	EventTimeSync     = "time_sync"
+	// a player was killed, sent in the events of the tick it happened
+	EventDeath = "death"
+	// a player scored or collected a coin or power-up, sent in the events
+	// of the tick it happened
+	EventScore  = "score"
+	EventPickup = "pickup"
+	// a flag was brought home in capture the flag
+	EventCapture = "capture"
+	// the match is over, sent as the room enters PhaseEnded
+	EventMatchOver = "match_over"
+)
+
+// EndTime is the reason of a match that ran out of time, alongside the
+// sim End reasons
+const EndTime = "time"
+
+// reasons given with a leave event
+const (
+	LeaveDisconnect = "disconnect"
+	LeaveKick       = "kick"
+	// nothing was heard from the client for PongTimeout
+	LeaveIdle = "idle"
+)
+
+// ServerMessage is the envelope for everything the server sends
+type ServerMessage struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// PlayerEvent reports a player or spectator arriving or going
+type PlayerEvent struct {
+	Kind      string `json:"kind"`
+	PlayerID  string `json:"player_id"`
+	Name      string `json:"name"`
+	Spectator bool   `json:"spectator"`
+	// why they left, on leave and disconnected events
+	Reason string `json:"reason,omitempty"`
+}
+
+// DeathEvent names who killed whom
+type DeathEvent struct {
+	Kind   string `json:"kind"`
+	Killer string `json:"killer"`
+	Victim string `json:"victim"`
+}
+
+// PickupEvent names the coin or power-up a player collected
+type PickupEvent struct {
+	Kind     string `json:"kind"`
+	PlayerID string `json:"player_id"`
+	Coin     uint32 `json:"coin,omitempty"`
+	PowerUp  uint32 `json:"power_up,omitempty"`
+}
+
+// CaptureEvent names who captured a flag and for which team
+type CaptureEvent struct {
+	Kind     string `json:"kind"`
+	PlayerID string `json:"player_id"`
+	Team     int    `json:"team"`
+}
+
+// MatchOverEvent is how a match ended. Reason is one of the sim End
+// reasons or EndTime, and Winner a player id or, with teams, a team
+// number, left out when time ran out or nobody was left alive. Scores has
+// every player, best first, and Stats every player by id.
+type MatchOverEvent struct {
+	Kind       string         `json:"kind"`
+	Reason     string         `json:"reason"`
+	Winner     string         `json:"winner,omitempty"`
+	Scores     []sim.Standing `json:"scores"`
+	TeamScores []int          `json:"team_scores,omitempty"`
+	Stats      []PlayerStats  `json:"stats"`
+}
+
+// Events is the data of an events message: every death, pickup, capture
+// and score of a tick, in that order, so a busy tick costs each connection
+// one message rather than one per event
+type Events []interface{}
+
+// ScoreEvent is points a player just scored and their score now
+type ScoreEvent struct {
+	Kind     string `json:"kind"`
+	PlayerID string `json:"player_id"`
+	Points   int    `json:"points"`
+	Score    int    `json:"score"`
+}
+
+// encodings a client can pick with ?encoding=. Msgpack can also be asked
+// for with the MsgpackProtocol subprotocol.
+const (
+	EncodingJSON = "json"
+	// binary snapshots, everything else as JSON
+	EncodingBinary = "binary"
+	// every message both ways as msgpack
+	EncodingMsgpack = "msgpack"
+	// every message both ways as protobuf, see internal/proto
+	EncodingProtobuf = "protobuf"
+
+	MsgpackProtocol  = "game.msgpack"
+	ProtobufProtocol = "game.protobuf"
+)
+
+// PongEvent answers a ping with the client's timestamp and the server clock
+// in ms when the ping arrived
+type PongEvent struct {
+	Kind         string `json:"kind"`
+	T            int64  `json:"t"`
+	ServerTimeMS int64  `json:"server_time_ms"`
+}
+
+// TimeSyncEvent answers a time_sync message with the server clock in ms when
+// it arrived and when the answer was sent. A client sending a few of these
+// at connect gets its clock offset as ((receive - client_time) + (send -
+// now)) / 2 and the round trip as (now - client_time) - (send - receive).
+type TimeSyncEvent struct {
+	Kind            string `json:"kind"`
+	ClientTime      int64  `json:"client_time"`
+	ServerReceiveMS int64  `json:"server_receive_ms"`
+	ServerSendMS    int64  `json:"server_send_ms"`
+}
+
+// outbound is an encoded message ready for the writers. legacy is what
+// clients connected with ?format=bare get instead, nil meaning nothing,
+// binary what binary clients get, nil meaning msg, and packed and protobuf
+// what msgpack and protobuf clients get, encoded from value when nil.
+type outbound struct {
+	value    *ServerMessage
+	msg      []byte
+	legacy   []byte
+	binary   []byte
+	packed   []byte
+	protobuf []byte
+	// msg prepared for sending to many connections, if compression is on
+	prepared *websocket.PreparedMessage
+}
+
+// encode wraps data in an envelope of type typ
+func encode(typ string, data interface{}) outbound {
+	v := &ServerMessage{Type: typ, Data: data}
+	msg, err := json.Marshal(v)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return outbound{}
+	}
+	return outbound{value: v, msg: msg}
+}
+
+// deliver queues the form of o this connection understands. Like enqueue it
+// never blocks and returns false when the client can't keep up.
+func (c *client) deliver(o outbound) bool {
+	switch {
+	case c.encoding == EncodingBinary && o.binary != nil:
+		return c.enqueue(frame{typ: websocket.BinaryMessage, data: o.binary})
+	case c.encoding == EncodingMsgpack:
+		if o.packed == nil && o.value != nil {
+			o.packed = pack(o.value)
+		}
+		if o.packed == nil {
+			return true
+		}
+		return c.enqueue(frame{typ: websocket.BinaryMessage, data: o.packed})
+	case c.encoding == EncodingProtobuf:
+		if o.protobuf == nil && o.value != nil {
+			o.protobuf = marshalProto(o.value)
+		}
+		if o.protobuf == nil {
+			return true
+		}
+		return c.enqueue(frame{typ: websocket.BinaryMessage, data: o.protobuf})
+	}
+	if c.legacy {
+		if o.legacy == nil {
+			return true
+		}
+		return c.enqueue(frame{typ: websocket.TextMessage, data: o.legacy})
+	}
+	if o.msg == nil {
+		return true
+	}
+	return c.enqueue(frame{typ: websocket.TextMessage, data: o.msg, prepared: o.prepared})
+}
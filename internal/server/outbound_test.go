@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// strict decodes data into v, failing on fields v doesn't have
+func strict(t *testing.T, data json.RawMessage, v interface{}) {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+}
+
+func TestMessageKinds(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 2)
+	host, other := clients[0], clients[1]
+	kinds := map[string]int{}
+	seen := func(env envelope) envelope {
+		switch env.Type {
+		case MessageSnapshot, MessageEvent, MessageError:
+		default:
+			t.Fatalf("message of type %q", env.Type)
+		}
+		kinds[env.Type]++
+		return env
+	}
+
+	ts.tick(1)
+	for {
+		env := seen(host.message())
+		if env.Type == MessageSnapshot {
+			var s Snapshot
+			strict(t, env.Data, &s)
+			if s.Version != SnapshotVersion || s.Room.Phase != PhasePlaying {
+				t.Fatalf("snapshot %s", env.Data)
+			}
+			break
+		}
+	}
+
+	host.send("chat", "hi")
+	for {
+		env := seen(host.message())
+		if env.Type == MessageError {
+			var e ErrorMessage
+			strict(t, env.Data, &e)
+			if e.Code != ErrUnknownType || e.Detail == "" {
+				t.Fatalf("error %s", env.Data)
+			}
+			break
+		}
+	}
+
+	// a kick notice goes out as an event
+	host.send(MessageKick, KickMessage{PlayerID: other.welcome.ID})
+	for {
+		env := seen(host.message())
+		if env.Type != MessageEvent {
+			continue
+		}
+		var ev PlayerEvent
+		strict(t, env.Data, &ev)
+		if ev.Kind == EventLeave {
+			if ev.PlayerID != other.welcome.ID || ev.Reason != LeaveKick {
+				t.Fatalf("event %s", env.Data)
+			}
+			break
+		}
+	}
+	if kinds[MessageSnapshot] == 0 || kinds[MessageEvent] == 0 || kinds[MessageError] != 1 {
+		t.Fatalf("read %v", kinds)
+	}
+}
+
+func TestBareFormat(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	player := ts.match(t, "/game", 1)[0]
+	old := ts.connect(t, "/game?format=bare", nil)
+	// nothing but bare players maps, from the first message on
+	for i := 0; i < 3; i++ {
+		ts.tick(1)
+		var players map[string]sim.Player
+		strict(t, old.next().data, &players)
+		if _, ok := players[player.welcome.ID]; !ok {
+			t.Fatalf("got %v, want a players map with %s", players, player.welcome.ID)
+		}
+	}
+}
+
+func TestJoinLeaveOrdering(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.ReconnectGrace = 0
+	})
+	a := ts.match(t, "/game", 1)[0]
+	b := ts.dial(t, "/game")
+	joined, appeared, left := false, false, false
+	// reads a tick's worth of a's messages, checking b against the events
+	// seen so far
+	read := func() {
+		ts.tick(1)
+		for {
+			env := a.message()
+			switch env.Type {
+			case MessageEvent:
+				var ev PlayerEvent
+				json.Unmarshal(env.Data, &ev)
+				if ev.PlayerID != b.welcome.ID {
+					continue
+				}
+				switch ev.Kind {
+				case EventJoin:
+					if appeared {
+						t.Fatal("join after appearing in a snapshot")
+					}
+					joined = true
+				case EventLeave:
+					if !appeared {
+						t.Fatal("leave before ever appearing")
+					}
+					if ev.Reason != LeaveDisconnect {
+						t.Fatalf("left with %q, want %q", ev.Reason, LeaveDisconnect)
+					}
+					left = true
+				}
+			case MessageSnapshot:
+				a.apply(env.Data)
+				_, in := a.players[b.welcome.ID]
+				if in && !joined {
+					t.Fatal("in a snapshot before the join")
+				}
+				if in && left {
+					t.Fatal("in a snapshot after the leave")
+				}
+				appeared = appeared || in
+				return
+			}
+		}
+	}
+	for i := 0; i < 5; i++ {
+		read()
+	}
+	if !appeared {
+		t.Fatal("never appeared")
+	}
+	b.conn.Close()
+	for i := 0; i < 100 && !left; i++ {
+		read()
+	}
+	if !left {
+		t.Fatal("never left")
+	}
+	read()
+}
+
+func TestTimeSync(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, nil)
+	c := ts.dial(t, "/game")
+	var last int64
+	// a few rounds, as a client would at connect
+	rounds := func(when string) {
+		for i := int64(1); i <= 3; i++ {
+			c.send(MessageTimeSync, TimeSyncMessage{ClientTime: i})
+			var ev TimeSyncEvent
+			c.event(EventTimeSync, &ev)
+			now := ts.clock.Now().UnixNano() / int64(time.Millisecond)
+			if ev.ClientTime != i || ev.ServerReceiveMS != now || ev.ServerSendMS < ev.ServerReceiveMS || ev.ServerReceiveMS < last {
+				t.Fatalf("%s: got %+v at %d after %d", when, ev, now, last)
+			}
+			last = ev.ServerSendMS
+			ts.tick(1)
+		}
+	}
+	rounds("in the lobby")
+	c.play()
+	rounds("in the match")
+	if inputs := b.inputs(t); len(inputs) != 0 {
+		t.Fatalf("published %+v", inputs)
+	}
+}
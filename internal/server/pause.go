@@ -0,0 +1,55 @@
+package server
+
+import "log"
+
+type pauseRequest struct {
+	from *client
+	// false to resume
+	pause bool
+	reply chan error
+}
+
+// setPaused asks the room to pause or resume the match on behalf of from,
+// which has to be the host
+func (r *Room) setPaused(from *client, pause bool) error {
+	req := pauseRequest{from: from, pause: pause, reply: make(chan error, 1)}
+	select {
+	case r.pauses <- req:
+	case <-r.done:
+		return errRoomClosed
+	}
+	return <-req.reply
+}
+
+// applyPause runs on the room goroutine. A pause lasts until the host
+// resumes or PauseTimeout runs out, whichever comes first, so a host that
+// walks away can't hold the room up for good.
+func (r *Room) applyPause(req pauseRequest) error {
+	if r.clients[req.from.id] != req.from || req.from.id != r.host {
+		return &RouteError{ErrNotHost, "only the host can pause"}
+	}
+	switch {
+	case req.pause && r.phase != PhasePlaying:
+		return &RouteError{ErrBadPause, "there is no match to pause"}
+	case req.pause && r.paused > 0:
+		return &RouteError{ErrBadPause, "already paused"}
+	case !req.pause && r.paused == 0:
+		return &RouteError{ErrBadPause, "not paused"}
+	}
+	if req.pause {
+		r.paused = r.ticksOf(int(r.srv.cfg.PauseTimeout.Milliseconds()))
+		log.Println("match paused in room", r.name)
+	} else {
+		r.paused = 0
+		log.Println("match resumed in room", r.name)
+	}
+	return nil
+}
+
+// advancePause runs a pause down by one tick
+func (r *Room) advancePause() {
+	r.paused--
+	if r.paused == 0 {
+		log.Println("pause ran out in room", r.name)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import "testing"
+
+func TestPause(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.MatchDuration = 100 * cfg.Tick
+		cfg.PauseTimeout = 10 * cfg.Tick
+	})
+	clients := ts.match(t, "/game", 2)
+	host, other := clients[0], clients[1]
+	ts.tick(1)
+	if id := other.host(); id != host.welcome.ID {
+		t.Fatalf("host %s, want %s", id, host.welcome.ID)
+	}
+
+	other.send(MessagePause, nil)
+	if e := other.errorMessage(); e.Code != ErrNotHost {
+		t.Fatalf("got %+v, want %s", e, ErrNotHost)
+	}
+	host.send(MessageResume, nil)
+	if e := host.errorMessage(); e.Code != ErrBadPause {
+		t.Fatalf("got %+v, want %s", e, ErrBadPause)
+	}
+
+	host.send(MessagePause, nil)
+	host.sync()
+	host.send(MessagePause, nil)
+	if e := host.errorMessage(); e.Code != ErrBadPause {
+		t.Fatalf("got %+v, want %s", e, ErrBadPause)
+	}
+	ts.tick(1)
+	before := other.snapshot()
+	at := other.me()
+	if !before.Room.Paused {
+		t.Fatal("snapshot not flagged paused")
+	}
+	// inputs still arrive but nobody moves and the clock stands still
+	for i := 0; i < 5; i++ {
+		other.input("right")
+		other.sync()
+		ts.tick(1)
+		s := other.snapshot()
+		if !s.Room.Paused || s.Room.ElapsedMS != before.Room.ElapsedMS || s.Room.RemainingMS != before.Room.RemainingMS {
+			t.Fatalf("tick %d: room %+v, want it as it was at %+v", i, s.Room, before.Room)
+		}
+		if me := other.me(); me.X != at.X || me.Y != at.Y {
+			t.Fatalf("tick %d: moved to %v,%v while paused", i, me.X, me.Y)
+		}
+	}
+
+	host.send(MessageResume, nil)
+	host.sync()
+	other.input("right")
+	other.sync()
+	ts.tick(1)
+	s := other.snapshot()
+	if s.Room.Paused || s.Room.RemainingMS >= before.Room.RemainingMS {
+		t.Fatalf("room %+v after resuming", s.Room)
+	}
+	if other.me().X <= at.X {
+		t.Fatal("didn't move after resuming")
+	}
+}
+
+func TestPauseRunsOut(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.PauseTimeout = 10 * cfg.Tick
+	})
+	host := ts.match(t, "/game", 1)[0]
+	host.send(MessagePause, nil)
+	host.sync()
+	for i := 1; i < 10; i++ {
+		ts.tick(1)
+		if s := host.snapshot(); !s.Room.Paused {
+			t.Fatalf("resumed %d ticks in, before the timeout", i)
+		}
+	}
+	ts.tick(1)
+	if s := host.snapshot(); s.Room.Paused {
+		t.Fatal("still paused after the timeout")
+	}
+	// and with no match there is nothing to pause
+	ts = startServer(t, nil, nil)
+	c := ts.dial(t, "/game")
+	c.send(MessagePause, nil)
+	if e := c.errorMessage(); e.Code != ErrBadPause {
+		t.Fatalf("got %+v, want %s", e, ErrBadPause)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/store"
+)
+
+const (
+	// player saves that may wait for the store before more are dropped
+	maxPendingSaves = 1024
+	// how long one save may take
+	saveTimeout = 2 * time.Second
+)
+
+// playerSave is a player to keep under their resume token, in place of old
+// when it is set, or to forget
+type playerSave struct {
+	token  string
+	old    string
+	player store.Player
+	forget bool
+}
+
+// savePlayer queues the player id behind token to be kept in the store for
+// ReconnectGrace. It never blocks, so a slow store can't stall the tick; a
+// save that doesn't fit is dropped and the next one catches up.
+func (r *Room) savePlayer(token, id string) {
+	r.replacePlayer("", token, id)
+}
+
+// replacePlayer is savePlayer for a token rotated from old, which the store
+// is told about too
+func (r *Room) replacePlayer(old, token, id string) {
+	p, ok := r.gamestate.Players[id]
+	if r.srv.saves == nil || !ok || r.srv.cfg.ReconnectGrace <= 0 {
+		return
+	}
+	r.srv.queueSave(playerSave{token: token, old: old, player: store.Player{
+		ID:      id,
+		Room:    r.name,
+		Account: r.accounts[id],
+		Name:    p.Name,
+		Color:   p.Color,
+		X:       p.X,
+		Y:       p.Y,
+		Score:   p.Score,
+	}})
+}
+
+// forgetPlayer queues token to be dropped from the store, so a kicked
+// player can't come back elsewhere
+func (r *Room) forgetPlayer(token string) {
+	if r.srv.saves != nil {
+		r.srv.queueSave(playerSave{token: token, forget: true})
+	}
+}
+
+// saveConnected saves every connected player every PlayerSaveInterval, so
+// one whose instance goes away without a word can still resume elsewhere.
+// Disconnected ones were saved as they left and are left alone, in case
+// they have resumed on another instance since.
+func (r *Room) saveConnected() {
+	every := r.ticksOf(int(r.srv.cfg.PlayerSaveInterval.Milliseconds()))
+	if r.srv.saves == nil || every == 0 || r.ticks%uint64(every) != 0 {
+		return
+	}
+	for token, id := range r.resumeTokens {
+		if _, connected := r.clients[id]; connected {
+			r.savePlayer(token, id)
+		}
+	}
+}
+
+func (s *Server) queueSave(save playerSave) {
+	select {
+	case s.saves <- save:
+	default:
+		atomic.AddUint64(&s.counters.DroppedSaves, 1)
+	}
+}
+
+// runSaves writes queued saves to the store until the queue is closed
+func (s *Server) runSaves() {
+	defer close(s.savesDone)
+	for save := range s.saves {
+		ctx, cancel := context.WithTimeout(context.Background(), saveTimeout)
+		var err error
+		if save.forget {
+			err = s.cfg.Players.Forget(ctx, save.token)
+		} else if save.old != "" {
+			err = s.cfg.Players.Rotate(ctx, save.old, save.token, save.player, s.cfg.ReconnectGrace)
+		} else {
+			err = s.cfg.Players.Save(ctx, save.token, save.player, s.cfg.ReconnectGrace)
+		}
+		cancel()
+		if err != nil {
+			log.Println("player save:", err)
+		}
+	}
+}
+
+// restore brings back a player whose token this room doesn't know from
+// what was last saved of them, maybe by another instance, handing them
+// token in its place. A token the store has no record of, never saved or
+// saved too long ago, is turned away. One saved for another room, or that
+// couldn't be looked up, joins as a new player, and one the room was
+// restored with from a checkpoint takes up where the checkpoint left them.
+func (r *Room) restore(c *client, token string) error {
+	saved := c.saved
+	if r.srv.cfg.Players == nil || c.rotated || c.unknown {
+		return errBadResumeToken
+	}
+	if saved == nil || saved.Room != r.name {
+		c.resume = ""
+		return r.admit(c)
+	}
+	if r.adoptable(saved.ID) {
+		return r.adopt(c, token)
+	}
+	if r.humans() >= r.settings.MaxPlayers {
+		return errRoomFull
+	}
+	// a player that is still here has resumed since with a token of its
+	// own, this one was rotated away and its forget hasn't landed yet
+	if _, here := r.gamestate.Players[saved.ID]; here || r.clients[saved.ID] != nil {
+		return errBadResumeToken
+	}
+	c.id = saved.ID
+	c.spectator = false
+	c.name = r.uniqueName(saved.Name, c.id)
+	r.accounts[c.id] = saved.Account
+	if saved.Account == "" {
+		r.accounts[c.id] = accountID(c.resume)
+	}
+	rules := r.settings.Rules(r.srv.cfg.Tick)
+	p := r.gamestate.Join(c.id, rules)
+	p.Name = c.name
+	// the room may be on a map where that spot is now inside a wall
+	if x, y := saved.X, saved.Y; !math.IsNaN(x) && !math.IsNaN(y) && rules.Free(x, y) {
+		p.X, p.Y = x, y
+	}
+	p.Score = saved.Score
+	if saved.Color != "" {
+		r.gamestate.Paint(c.id, saved.Color)
+	}
+	r.rotateToken(c, token)
+	log.Println("player", c.id, "restored in room", r.name)
+	r.attach(c)
+	r.sendPlayerEvent(EventJoin, c, "")
+	return nil
+}
+
+// adoptable reports whether id is a player brought back from a checkpoint
+// and still waiting for whoever holds their token. This room never gave out
+// a token for them, so the store is what vouches for one.
+func (r *Room) adoptable(id string) bool {
+	if _, gone := r.disconnected[id]; !gone {
+		return false
+	}
+	for _, owner := range r.resumeTokens {
+		if owner == id {
+			return false
+		}
+	}
+	return true
+}
+
+// adopt reattaches c to the checkpointed player it was saved as, as it is
+// in the room rather than as it was saved
+func (r *Room) adopt(c *client, token string) error {
+	delete(r.disconnected, c.saved.ID)
+	c.id = c.saved.ID
+	c.spectator = false
+	c.name = r.gamestate.Players[c.id].Name
+	if _, ok := r.accounts[c.id]; !ok {
+		r.accounts[c.id] = c.saved.Account
+		if c.saved.Account == "" {
+			r.accounts[c.id] = accountID(c.resume)
+		}
+	}
+	r.rotateToken(c, token)
+	log.Println("player", c.id, "resumed in room", r.name, "from a checkpoint")
+	r.attach(c)
+	r.sendPlayerEvent(EventResumed, c, "")
+	return nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/store"
+)
+
+// sharedPlayers is a player store in miniredis for servers to share
+func sharedPlayers(t *testing.T) (*miniredis.Miniredis, *store.RedisPlayers) {
+	mr := miniredis.RunT(t)
+	return mr, store.NewRedisPlayers(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "player")
+}
+
+func TestRestoreOnAnotherServer(t *testing.T) {
+	_, players := sharedPlayers(t)
+	configure := func(cfg *Config) { cfg.Players = players }
+	first, second := startServer(t, nil, configure), startServer(t, nil, configure)
+
+	a := first.match(t, "/game", 1)[0]
+	a.input("right")
+	if !moves(first, a, a.welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	was := a.me()
+	a.conn.Close()
+	// saved as they left, from the background; snapshots round positions
+	ctx := context.Background()
+	eventually(t, "the player to be saved", func() bool {
+		p, ok, err := players.Load(ctx, a.welcome.Token)
+		return err == nil && ok && math.Abs(p.X-was.X) <= 0.5 && math.Abs(p.Y-was.Y) <= 0.5
+	})
+
+	back := second.dial(t, "/game?token="+a.welcome.Token)
+	if back.welcome.ID != a.welcome.ID || back.welcome.Token == "" || back.welcome.Token == a.welcome.Token {
+		t.Fatalf("welcomed as %+v, want %s with a new token", back.welcome, a.welcome.ID)
+	}
+	back.play()
+	second.tick(1)
+	back.joined()
+	if p := back.me(); p.X != was.X || p.Y != was.Y || p.Color != was.Color || p.Name != was.Name {
+		t.Fatalf("restored as %+v, want %+v", p, was)
+	}
+}
+
+func TestRestoreScore(t *testing.T) {
+	_, players := sharedPlayers(t)
+	ts := startServer(t, nil, func(cfg *Config) { cfg.Players = players })
+	saved := store.Player{ID: "away", Room: DefaultRoom, Name: "Away", Color: "#e6194b", X: 123, Y: 234, Score: 7}
+	if err := players.Save(context.Background(), "0123456789abcdef", saved, ts.cfg.ReconnectGrace); err != nil {
+		t.Fatal(err)
+	}
+	c := ts.dial(t, "/game?token=0123456789abcdef")
+	c.play()
+	ts.tick(1)
+	c.joined()
+	if p := c.me(); c.welcome.ID != "away" || p.X != 123 || p.Y != 234 || p.Score != 7 || p.Color != saved.Color || p.Name != "Away" {
+		t.Fatalf("restored as %s %+v, want %+v", c.welcome.ID, p, saved)
+	}
+}
+
+func TestRestoreAfterTTL(t *testing.T) {
+	mr, players := sharedPlayers(t)
+	configure := func(cfg *Config) { cfg.Players = players }
+	first, second := startServer(t, nil, configure), startServer(t, nil, configure)
+
+	a := first.match(t, "/game", 1)[0]
+	// moved away from where the join save left them, so the save made as
+	// they leave can be told apart; fast forwarding before it lands would
+	// leave it a fresh ttl
+	a.input("right")
+	if !moves(first, a, a.welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	was := a.me()
+	a.conn.Close()
+	ctx := context.Background()
+	eventually(t, "the player to be saved as they left", func() bool {
+		p, ok, err := players.Load(ctx, a.welcome.Token)
+		return err == nil && ok && math.Abs(p.X-was.X) <= 0.5 && math.Abs(p.Y-was.Y) <= 0.5
+	})
+	mr.FastForward(first.cfg.ReconnectGrace)
+	if _, ok, _ := players.Load(ctx, a.welcome.Token); ok {
+		t.Fatal("still saved after the grace")
+	}
+
+	// the token is no good any more
+	if code := second.connect(t, "/game?token="+a.welcome.Token, nil).closeCode(); code != CloseBadResumeToken {
+		t.Fatalf("closed with %d, want %d", code, CloseBadResumeToken)
+	}
+}
+
+func TestMadeUpTokenRejected(t *testing.T) {
+	_, players := sharedPlayers(t)
+	ts := startServer(t, nil, func(cfg *Config) { cfg.Players = players })
+	if code := ts.connect(t, "/game?token=0123456789abcdef", nil).closeCode(); code != CloseBadResumeToken {
+		t.Fatalf("closed with %d, want %d", code, CloseBadResumeToken)
+	}
+}
+
+func TestSessionSavedAtJoin(t *testing.T) {
+	mr, players := sharedPlayers(t)
+	ts := startServer(t, nil, func(cfg *Config) { cfg.Players = players })
+	a := ts.dial(t, "/game")
+	// good elsewhere while still connected here, in case this instance dies
+	eventually(t, "the player to be saved", func() bool {
+		p, ok, err := players.Load(context.Background(), a.welcome.Token)
+		return err == nil && ok && p.ID == a.welcome.ID && p.Room == DefaultRoom
+	})
+	// and kept under a digest, not the token itself
+	for _, key := range mr.Keys() {
+		if strings.Contains(key, a.welcome.Token) {
+			t.Fatalf("key %q holds the token", key)
+		}
+		fields, _ := mr.HKeys(key)
+		for _, f := range fields {
+			if v := mr.HGet(key, f); strings.Contains(v, a.welcome.Token) {
+				t.Fatalf("%s of %q holds the token", f, key)
+			}
+		}
+	}
+}
+
+func TestRotatedTokenRejected(t *testing.T) {
+	_, players := sharedPlayers(t)
+	configure := func(cfg *Config) { cfg.Players = players }
+	first, second := startServer(t, nil, configure), startServer(t, nil, configure)
+
+	a := first.match(t, "/game", 1)[0]
+	a.conn.Close()
+	ctx := context.Background()
+	eventually(t, "the player to be saved", func() bool {
+		_, ok, err := players.Load(ctx, a.welcome.Token)
+		return err == nil && ok
+	})
+	back := second.dial(t, "/game?token="+a.welcome.Token)
+	if back.welcome.ID != a.welcome.ID {
+		t.Fatalf("resumed as %s, want %s", back.welcome.ID, a.welcome.ID)
+	}
+	eventually(t, "the token to be rotated", func() bool {
+		_, ok, err := players.Load(ctx, back.welcome.Token)
+		_, _, old := players.Load(ctx, a.welcome.Token)
+		return err == nil && ok && errors.Is(old, store.ErrRotated)
+	})
+
+	// the old token is spent everywhere, the first instance included even
+	// though it still holds the player under it
+	for name, ts := range map[string]*testServer{"first": first, "second": second} {
+		if code := ts.connect(t, "/game?token="+a.welcome.Token, nil).closeCode(); code != CloseBadResumeToken {
+			t.Fatalf("%s: closed with %d, want %d", name, code, CloseBadResumeToken)
+		}
+	}
+}
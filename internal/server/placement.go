@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/registry"
+)
+
+// how long placement calls to the registry may take
+const registryTimeout = 2 * time.Second
+
+// redirectElsewhere claims the public room name for this instance, or if
+// another instance already hosts it, points the client there with a 307 and
+// a JSON body carrying the websocket url. It reports whether it redirected.
+// Without a registry, or when the registry can't be reached, the room is
+// simply hosted here.
+func (s *Server) redirectElsewhere(w http.ResponseWriter, r *http.Request, name string) bool {
+	if s.registry == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), registryTimeout)
+	defer cancel()
+	owner, err := s.registry.Claim(ctx, name, s.cfg.AdvertiseURL)
+	if err != nil {
+		log.Println("registry claim failed, hosting room locally:", err)
+		return false
+	}
+	if owner == s.cfg.AdvertiseURL {
+		return false
+	}
+
+	target := owner + r.URL.Path + "?" + r.URL.RawQuery
+	w.Header().Set("Location", target)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTemporaryRedirect)
+	json.NewEncoder(w).Encode(struct {
+		Redirect string `json:"redirect"`
+	}{target})
+	return true
+}
+
+// releaseUnhosted gives up the claim on a room this instance took for a
+// request that then failed, unless the room is hosted here by now and its
+// heartbeat is looking after the claim
+func (s *Server) releaseUnhosted(name string) {
+	if s.registry == nil {
+		return
+	}
+	s.roomsLock.Lock()
+	_, hosted := s.rooms[name]
+	s.roomsLock.Unlock()
+	if hosted {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	err := s.registry.Release(ctx, name, s.cfg.AdvertiseURL)
+	if err != nil && err != registry.ErrNotOwner {
+		log.Println("registry release error for room", name+":", err)
+	}
+}
+
+// claim makes sure this instance holds the room's registry claim as the
+// room starts, reporting whether it does. Another instance hosting the room
+// too, because the registry was down when it was asked for, keeps its claim.
+func (r *Room) claim(ctx context.Context) bool {
+	addr := r.srv.cfg.AdvertiseURL
+	callCtx, cancel := context.WithTimeout(ctx, registryTimeout)
+	owner, err := r.srv.registry.Claim(callCtx, r.name, addr)
+	cancel()
+	if err != nil {
+		log.Println("registry claim failed for room", r.name+":", err)
+		return false
+	}
+	r.setOwned(owner == addr)
+	return owner == addr
+}
+
+func (r *Room) setOwned(owned bool) {
+	var v int32
+	if owned {
+		v = 1
+	}
+	atomic.StoreInt32(&r.owned, v)
+}
+
+// heartbeat keeps the room's registry claim alive until ctx is done, then
+// releases it
+func (r *Room) heartbeat(ctx context.Context) {
+	reg := r.srv.registry
+	addr := r.srv.cfg.AdvertiseURL
+	ticker := r.srv.cfg.Clock.NewTicker(r.srv.cfg.RegistryTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			callCtx, cancel := context.WithTimeout(ctx, registryTimeout)
+			err := reg.Refresh(callCtx, r.name, addr)
+			cancel()
+			if err == registry.ErrNotOwner {
+				// a claim that lapsed while redis was unreachable may have
+				// been taken; try to win it back, new players follow the
+				// registry either way
+				log.Println("lost registry claim on room", r.name)
+				callCtx, cancel = context.WithTimeout(ctx, registryTimeout)
+				var owner string
+				owner, err = reg.Claim(callCtx, r.name, addr)
+				cancel()
+				if err == nil {
+					r.setOwned(owner == addr)
+				}
+			} else if err == nil {
+				r.setOwned(true)
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Println("registry refresh error for room", r.name+":", err)
+			}
+		case <-ctx.Done():
+			callCtx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+			err := reg.Release(callCtx, r.name, addr)
+			cancel()
+			if err != nil && err != registry.ErrNotOwner {
+				log.Println("registry release error for room", r.name+":", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/registry"
+)
+
+// fakeRegistry keeps claims in memory, shared by every server given it
+type fakeRegistry struct {
+	mu       sync.Mutex
+	owners   map[string]string
+	refresh  int
+	released []string
+	// every call fails while set
+	down bool
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{owners: map[string]string{}}
+}
+
+var errRegistryDown = errors.New("registry down")
+
+func (f *fakeRegistry) Claim(ctx context.Context, room, addr string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return "", errRegistryDown
+	}
+	if owner, ok := f.owners[room]; ok {
+		return owner, nil
+	}
+	f.owners[room] = addr
+	return addr, nil
+}
+
+func (f *fakeRegistry) Refresh(ctx context.Context, room, addr string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errRegistryDown
+	}
+	if f.owners[room] != addr {
+		return registry.ErrNotOwner
+	}
+	f.refresh++
+	return nil
+}
+
+func (f *fakeRegistry) Release(ctx context.Context, room, addr string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errRegistryDown
+	}
+	if f.owners[room] != addr {
+		return registry.ErrNotOwner
+	}
+	delete(f.owners, room)
+	f.released = append(f.released, room)
+	return nil
+}
+
+// startInstance serves testConfig with reg as the registry, advertising its
+// own address
+func startInstance(t *testing.T, reg registry.Registry, configure func(*Config)) *testServer {
+	t.Helper()
+	ln := listen(t)
+	cfg := testConfig()
+	cfg.AdvertiseURL = "ws://" + ln.Addr().String()
+	if configure != nil {
+		configure(&cfg)
+	}
+	return serve(t, NewServer(cfg, nil, reg), ln)
+}
+
+// redirect GETs path without following redirects and returns the status and
+// the redirect in the body
+func (ts *testServer) redirect(t *testing.T, path string) (int, string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get("http://" + ts.addr + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Redirect string `json:"redirect"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if loc := resp.Header.Get("Location"); loc != body.Redirect {
+		t.Fatalf("Location %q, body %q", loc, body.Redirect)
+	}
+	return resp.StatusCode, body.Redirect
+}
+
+func TestRedirectToOwner(t *testing.T) {
+	reg := newFakeRegistry()
+	a := startInstance(t, reg, nil)
+	b := startInstance(t, reg, nil)
+	host := a.dial(t, "/game?room=alpha")
+
+	status, target := b.redirect(t, "/game?room=alpha&name=bob")
+	if status != http.StatusTemporaryRedirect {
+		t.Fatalf("status %d, want %d", status, http.StatusTemporaryRedirect)
+	}
+	if want := a.cfg.AdvertiseURL + "/game?room=alpha&name=bob"; target != want {
+		t.Fatalf("redirected to %s, want %s", target, want)
+	}
+	// following it lands in the same room
+	follower := a.dial(t, strings.TrimPrefix(target, a.cfg.AdvertiseURL))
+	var ev PlayerEvent
+	for ev.PlayerID != follower.welcome.ID {
+		host.event(EventJoin, &ev)
+	}
+	// rooms nobody else holds stay where they are asked for
+	if status, _ := a.redirect(t, "/game?room=gamma"); status == http.StatusTemporaryRedirect {
+		t.Fatal("redirected for an unclaimed room")
+	}
+}
+
+func TestRefusedRequestLeavesRoomUnclaimed(t *testing.T) {
+	reg := newFakeRegistry()
+	ts := startInstance(t, reg, nil)
+	for _, path := range []string{
+		"/game?room=alpha&mode=referee",
+		"/game?room=alpha&color=red",
+		"/game?room=alpha&encoding=xml",
+	} {
+		if status := ts.refused(t, path); status != http.StatusBadRequest {
+			t.Fatalf("%s: status %d, want %d", path, status, http.StatusBadRequest)
+		}
+	}
+	// a plain GET is a valid request until the upgrade fails
+	if status, _ := ts.request(t, http.MethodGet, "/game?room=alpha", nil); status != http.StatusBadRequest {
+		t.Fatalf("status %d for a GET, want %d", status, http.StatusBadRequest)
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if owner, ok := reg.owners["alpha"]; ok {
+		t.Fatalf("alpha claimed by %s for a refused request", owner)
+	}
+}
+
+func TestRegistryDownHostsLocally(t *testing.T) {
+	reg := newFakeRegistry()
+	reg.down = true
+	ts := startInstance(t, reg, nil)
+	ts.dial(t, "/game?room=alpha")
+	if rooms := ts.listRooms(); len(rooms) != 1 || rooms[0].Name != "alpha" {
+		t.Fatalf("rooms %+v, want alpha hosted here", rooms)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	reg := newFakeRegistry()
+	ts := startInstance(t, reg, func(cfg *Config) {
+		cfg.RegistryTTL = 3 * cfg.Tick
+		cfg.ReconnectGrace = 0
+		cfg.EmptyRoomGrace = 0
+	})
+	c := ts.dial(t, "/game?room=alpha")
+	eventually(t, "the claim to be refreshed", func() bool {
+		ts.tick(1)
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		return reg.refresh > 0
+	})
+	// a claim lost in the meantime is taken back
+	reg.mu.Lock()
+	delete(reg.owners, "alpha")
+	reg.mu.Unlock()
+	eventually(t, "the claim to be won back", func() bool {
+		ts.tick(1)
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		return reg.owners["alpha"] == ts.cfg.AdvertiseURL
+	})
+
+	c.conn.Close()
+	eventually(t, "the claim to be released", func() bool {
+		ts.tick(1)
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		return len(reg.released) == 1 && reg.released[0] == "alpha"
+	})
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	pb "github.com/stevenwhitehead/multiplayer-backend/internal/proto"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+	"google.golang.org/protobuf/proto"
+)
+
+var errEmptyMessage = errors.New("empty message")
+
+// marshalProto encodes a server message for a protobuf client
+func marshalProto(m *ServerMessage) []byte {
+	msg, err := serverMessageToProto(m)
+	if err == nil {
+		var b []byte
+		b, err = proto.Marshal(msg)
+		if err == nil {
+			return b
+		}
+	}
+	log.Println("marshal error:", err)
+	return nil
+}
+
+func serverMessageToProto(m *ServerMessage) (*pb.ServerMessage, error) {
+	switch d := m.Data.(type) {
+	case Snapshot:
+		return &pb.ServerMessage{Data: &pb.ServerMessage_Snapshot{Snapshot: snapshotToProto(d)}}, nil
+	case ErrorMessage:
+		return &pb.ServerMessage{Data: &pb.ServerMessage_Error{Error: &pb.Error{Code: d.Code, Detail: d.Detail}}}, nil
+	case Events:
+		events := &pb.Events{}
+		for _, e := range d {
+			ev, err := eventToProto(e)
+			if err != nil {
+				return nil, err
+			}
+			events.Events = append(events.Events, ev)
+		}
+		return &pb.ServerMessage{Data: &pb.ServerMessage_Events{Events: events}}, nil
+	}
+	ev, err := eventToProto(m.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ServerMessage{Data: &pb.ServerMessage_Event{Event: ev}}, nil
+}
+
+func eventToProto(data interface{}) (*pb.Event, error) {
+	ev := &pb.Event{}
+	switch d := data.(type) {
+	case WelcomeEvent:
+		ev.Event = &pb.Event_Welcome{Welcome: &pb.WelcomeEvent{Id: d.ID, Spectator: d.Spectator, Token: d.Token, Protocol: int32(d.Protocol), Account: d.Account}}
+	case PhaseEvent:
+		ev.Event = &pb.Event_Phase{Phase: &pb.PhaseEvent{Phase: d.Phase, Host: d.Host, Ready: d.Ready}}
+	case CountdownEvent:
+		ev.Event = &pb.Event_Countdown{Countdown: &pb.CountdownEvent{Seconds: int32(d.Seconds)}}
+	case PlayerEvent:
+		ev.Event = &pb.Event_Player{Player: &pb.PlayerEvent{Kind: d.Kind, PlayerId: d.PlayerID, Name: d.Name, Spectator: d.Spectator, Reason: d.Reason}}
+	case PongEvent:
+		ev.Event = &pb.Event_Pong{Pong: &pb.PongEvent{T: d.T, ServerTimeMs: d.ServerTimeMS}}
+	case DeathEvent:
+		ev.Event = &pb.Event_Death{Death: &pb.DeathEvent{Killer: d.Killer, Victim: d.Victim}}
+	case PickupEvent:
+		ev.Event = &pb.Event_Pickup{Pickup: &pb.PickupEvent{PlayerId: d.PlayerID, Coin: d.Coin, PowerUp: d.PowerUp}}
+	case CaptureEvent:
+		ev.Event = &pb.Event_Capture{Capture: &pb.CaptureEvent{PlayerId: d.PlayerID, Team: int32(d.Team)}}
+	case MatchOverEvent:
+		ev.Event = &pb.Event_MatchOver{MatchOver: &pb.MatchOverEvent{
+			Reason:     d.Reason,
+			Winner:     d.Winner,
+			Scores:     leaderboardToProto(d.Scores),
+			TeamScores: int32s(d.TeamScores),
+			Stats:      statsToProto(d.Stats),
+		}}
+	case ScoreEvent:
+		ev.Event = &pb.Event_Score{Score: &pb.ScoreEvent{PlayerId: d.PlayerID, Points: int32(d.Points), Score: int32(d.Score)}}
+	case TimeSyncEvent:
+		ev.Event = &pb.Event_TimeSync{TimeSync: &pb.TimeSyncEvent{
+			ClientTime:      d.ClientTime,
+			ServerReceiveMs: d.ServerReceiveMS,
+			ServerSendMs:    d.ServerSendMS,
+		}}
+	default:
+		return nil, fmt.Errorf("no protobuf message for %T", data)
+	}
+	return ev, nil
+}
+
+func snapshotToProto(s Snapshot) *pb.Snapshot {
+	return &pb.Snapshot{
+		Version:      int32(s.Version),
+		Seq:          s.Seq,
+		Tick:         s.Tick,
+		ServerTimeMs: s.ServerTimeMS,
+		TickMs:       s.TickMS,
+		Precision:    int32(s.Precision),
+		Keyframe:     s.Keyframe,
+		Room: &pb.RoomState{
+			Name:        s.Room.Name,
+			Mode:        s.Room.Mode,
+			Phase:       s.Room.Phase,
+			Players:     int32(s.Room.Players),
+			Spectators:  int32(s.Room.Spectators),
+			Host:        s.Room.Host,
+			ElapsedMs:   s.Room.ElapsedMS,
+			TeamScores:  int32s(s.Room.TeamScores),
+			Hill:        hillToProto(s.Room.Hill),
+			RemainingMs: s.Room.RemainingMS,
+			Paused:      s.Room.Paused,
+		},
+		World:        worldToProto(s.World),
+		Players:      playersToProto(s.Players, s.Precision),
+		Add:          playersToProto(s.Add, s.Precision),
+		Update:       playersToProto(s.Update, s.Precision),
+		Remove:       s.Remove,
+		Projectiles:  projectilesToProto(s.Projectiles, s.Precision),
+		Leaderboard:  leaderboardToProto(s.Leaderboard),
+		Coins:        coinsToProto(s.Coins),
+		PowerUps:     powerUpsToProto(s.PowerUps),
+		Flags:        flagsToProto(s.Flags),
+		LastInputSeq: int64(s.LastInputSeq),
+		Self:         selfToProto(s.Self),
+	}
+}
+
+func projectilesToProto(shots []sim.Projectile, precision int) []*pb.Projectile {
+	if len(shots) == 0 {
+		return nil
+	}
+	rs := RoomSettings{Precision: precision}
+	out := make([]*pb.Projectile, len(shots))
+	for i, pr := range shots {
+		out[i] = &pb.Projectile{
+			Id:    pr.ID,
+			Owner: pr.Owner,
+			X:     int32(rs.fixed(pr.X)),
+			Y:     int32(rs.fixed(pr.Y)),
+			Vx:    int32(rs.fixed(pr.Vel.X)),
+			Vy:    int32(rs.fixed(pr.Vel.Y)),
+		}
+	}
+	return out
+}
+
+func coinsToProto(coins []sim.Coin) []*pb.Coin {
+	if len(coins) == 0 {
+		return nil
+	}
+	out := make([]*pb.Coin, len(coins))
+	for i, c := range coins {
+		out[i] = &pb.Coin{Id: c.ID, X: int32(c.X), Y: int32(c.Y)}
+	}
+	return out
+}
+
+func powerUpsToProto(powerUps []sim.PowerUp) []*pb.PowerUp {
+	if len(powerUps) == 0 {
+		return nil
+	}
+	out := make([]*pb.PowerUp, len(powerUps))
+	for i, pu := range powerUps {
+		out[i] = &pb.PowerUp{Id: pu.ID, Kind: pu.Kind, X: int32(pu.X), Y: int32(pu.Y)}
+	}
+	return out
+}
+
+func flagsToProto(flags []sim.Flag) []*pb.Flag {
+	if len(flags) == 0 {
+		return nil
+	}
+	out := make([]*pb.Flag, len(flags))
+	for i, f := range flags {
+		out[i] = &pb.Flag{Team: int32(f.Team), X: int32(f.X), Y: int32(f.Y), Carrier: f.Carrier}
+	}
+	return out
+}
+
+func hillToProto(h *Hill) *pb.Hill {
+	if h == nil {
+		return nil
+	}
+	ph := &pb.Hill{
+		X:         int32(h.X),
+		Y:         int32(h.Y),
+		Radius:    int32(h.Radius),
+		Holder:    h.Holder,
+		Contested: h.Contested,
+		Progress:  make(map[string]int32, len(h.Progress)),
+		Score:     int32(h.Score),
+	}
+	for k, v := range h.Progress {
+		ph.Progress[k] = int32(v)
+	}
+	return ph
+}
+
+func int32s(vs []int) []int32 {
+	if len(vs) == 0 {
+		return nil
+	}
+	out := make([]int32, len(vs))
+	for i, v := range vs {
+		out[i] = int32(v)
+	}
+	return out
+}
+
+func leaderboardToProto(board []sim.Standing) []*pb.Standing {
+	if len(board) == 0 {
+		return nil
+	}
+	out := make([]*pb.Standing, len(board))
+	for i, st := range board {
+		out[i] = &pb.Standing{PlayerId: st.PlayerID, Score: int32(st.Score)}
+	}
+	return out
+}
+
+func statsToProto(stats []PlayerStats) []*pb.PlayerStats {
+	if len(stats) == 0 {
+		return nil
+	}
+	out := make([]*pb.PlayerStats, len(stats))
+	for i, st := range stats {
+		out[i] = &pb.PlayerStats{
+			PlayerId: st.PlayerID,
+			Name:     st.Name,
+			Distance: int32(st.Distance),
+			Inputs:   int32(st.Inputs),
+			Kills:    int32(st.Kills),
+			Deaths:   int32(st.Deaths),
+			Coins:    int32(st.Coins),
+			ItMs:     st.ItMS,
+		}
+	}
+	return out
+}
+
+func selfToProto(s *Self) *pb.Self {
+	if s == nil {
+		return nil
+	}
+	return &pb.Self{Stamina: int32(s.Stamina), Exhausted: s.Exhausted, DashCooldownMs: s.DashCooldownMS}
+}
+
+func worldToProto(w *World) *pb.World {
+	if w == nil {
+		return nil
+	}
+	pw := &pb.World{Width: int32(w.Width), Height: int32(w.Height), Wrap: w.Wrap}
+	for _, o := range w.Obstacles {
+		pw.Obstacles = append(pw.Obstacles, &pb.Rect{
+			X:      int32(o.X),
+			Y:      int32(o.Y),
+			Width:  int32(o.Width),
+			Height: int32(o.Height),
+		})
+	}
+	return pw
+}
+
+// playersToProto lists players by id, so the same players always encode the
+// same way. Positions go out as counts of 10^-precision pixels.
+func playersToProto(players map[string]sim.Player, precision int) []*pb.PlayerState {
+	if len(players) == 0 {
+		return nil
+	}
+	rs := RoomSettings{Precision: precision}
+	out := make([]*pb.PlayerState, 0, len(players))
+	for id, p := range players {
+		out = append(out, &pb.PlayerState{
+			Id:           id,
+			X:            int32(rs.fixed(p.X)),
+			Y:            int32(rs.fixed(p.Y)),
+			LatencyMs:    int32(p.LatencyMS),
+			Hp:           int32(p.HP),
+			Dead:         p.Dead,
+			Invulnerable: int32(p.Invulnerable),
+			Score:        int32(p.Score),
+			Boost:        int32(p.Boost),
+			It:           p.It,
+			Team:         int32(p.Team),
+			Color:        p.Color,
+			Name:         p.Name,
+			Facing:       int32(facingUnits(p.Facing)),
+			Bot:          p.Bot,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out
+}
+
+// clientMessageFromProto turns a protobuf client message into the JSON the
+// router takes
+func clientMessageFromProto(raw []byte) ([]byte, error) {
+	var m pb.ClientMessage
+	if err := proto.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	var msg ClientMessage
+	var data interface{}
+	switch d := m.Data.(type) {
+	case *pb.ClientMessage_Input:
+		msg.Type = MessageInput
+		in := InputMessage{Seq: int(d.Input.Seq), Inputs: d.Input.Inputs, Move: vectorFromProto(d.Input.Move), Shoot: vectorFromProto(d.Input.Shoot), Aim: d.Input.Aim}
+		for _, f := range d.Input.Frames {
+			in.Frames = append(in.Frames, InputFrame{Seq: int(f.Seq), T: f.T, Inputs: f.Inputs, Move: vectorFromProto(f.Move), Shoot: vectorFromProto(f.Shoot), Aim: f.Aim})
+		}
+		data = in
+	case *pb.ClientMessage_Ready:
+		msg.Type = MessageReady
+		if d.Ready.Ready != nil {
+			data = ReadyMessage{Ready: *d.Ready.Ready}
+		}
+	case *pb.ClientMessage_Kick:
+		msg.Type = MessageKick
+		data = KickMessage{PlayerID: d.Kick.PlayerId}
+	case *pb.ClientMessage_Resync:
+		msg.Type = MessageResync
+	case *pb.ClientMessage_Ping:
+		msg.Type = MessagePing
+		data = PingMessage{T: d.Ping.T}
+	case *pb.ClientMessage_TimeSync:
+		msg.Type = MessageTimeSync
+		data = TimeSyncMessage{ClientTime: d.TimeSync.ClientTime}
+	case *pb.ClientMessage_SwitchTeam:
+		msg.Type = MessageSwitchTeam
+	case *pb.ClientMessage_Pause:
+		msg.Type = MessagePause
+	case *pb.ClientMessage_Resume:
+		msg.Type = MessageResume
+	default:
+		return nil, errEmptyMessage
+	}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		msg.Data = b
+	}
+	return json.Marshal(msg)
+}
+
+func inputToProto(b inputBatch) *pb.InputEvent {
+	e := b.InputEvent
+	m := &pb.InputEvent{PlayerId: e.PlayerID, Seq: int64(e.Seq), T: e.T, Inputs: e.Inputs, Move: vectorToProto(e.Move), Shoot: vectorToProto(e.Shoot), Aim: e.Aim}
+	for _, f := range b.Frames {
+		m.Frames = append(m.Frames, &pb.InputFrame{Seq: int64(f.Seq), T: f.T, Inputs: f.Inputs, Move: vectorToProto(f.Move), Shoot: vectorToProto(f.Shoot), Aim: f.Aim})
+	}
+	return m
+}
+
+func inputFromProto(m *pb.InputEvent) inputBatch {
+	b := inputBatch{InputEvent: sim.InputEvent{PlayerID: m.PlayerId, Seq: int(m.Seq), T: m.T, Inputs: m.Inputs, Move: vectorFromProto(m.Move), Shoot: vectorFromProto(m.Shoot), Aim: m.Aim}}
+	for _, f := range m.Frames {
+		b.Frames = append(b.Frames, sim.InputEvent{Seq: int(f.Seq), T: f.T, Inputs: f.Inputs, Move: vectorFromProto(f.Move), Shoot: vectorFromProto(f.Shoot), Aim: f.Aim})
+	}
+	return b
+}
+
+func vectorToProto(v *sim.Vector) *pb.Vector {
+	if v == nil {
+		return nil
+	}
+	return &pb.Vector{X: v.X, Y: v.Y}
+}
+
+func vectorFromProto(v *pb.Vector) *sim.Vector {
+	if v == nil {
+		return nil
+	}
+	return &sim.Vector{X: v.X, Y: v.Y}
+}
+
+// encodeInput encodes an input for the broker in the configured format
+func (s *Server) encodeInput(input inputBatch) ([]byte, error) {
+	if s.cfg.InputFormat == InputProtobuf {
+		return proto.Marshal(inputToProto(input))
+	}
+	return json.Marshal(input)
+}
+
+// decodeInput is the reverse of encodeInput
+func (s *Server) decodeInput(payload []byte) (inputBatch, error) {
+	if s.cfg.InputFormat == InputProtobuf {
+		var m pb.InputEvent
+		if err := proto.Unmarshal(payload, &m); err != nil {
+			return inputBatch{}, err
+		}
+		return inputFromProto(&m), nil
+	}
+	var input inputBatch
+	err := json.Unmarshal(payload, &input)
+	return input, err
+}
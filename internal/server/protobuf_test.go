@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	pb "github.com/stevenwhitehead/multiplayer-backend/internal/proto"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSnapshotToProto(t *testing.T) {
+	s := Snapshot{
+		Version:  SnapshotVersion,
+		Seq:      9,
+		Tick:     12,
+		TickMS:   24,
+		Keyframe: true,
+		// positions in tenths of a pixel
+		Precision: 1,
+		Room:      RoomState{Name: "alpha", Phase: PhasePlaying, Players: 2, Host: "b"},
+		World:     &World{Width: 800, Height: 600, Obstacles: []sim.Rect{{X: 1, Y: 2, Width: 3, Height: 4}}},
+		Players: map[string]sim.Player{
+			"b": {X: 10.5, Y: -2.25, HP: 80, Name: "bee", Color: "#00ff00", Team: 2},
+			"a": {X: 1, Y: 2, HP: 100, Name: "ay", It: true},
+		},
+		Remove:       []string{"c"},
+		Projectiles:  []sim.Projectile{{ID: 3, Owner: "a", X: 5, Y: 6, Vel: sim.Vector{X: 100}}},
+		Coins:        []sim.Coin{{ID: 1, X: 7, Y: 8}},
+		LastInputSeq: 4,
+		Self:         &Self{Stamina: 50},
+	}
+	m := snapshotToProto(s)
+	if m.Seq != 9 || m.Tick != 12 || m.TickMs != 24 || !m.Keyframe || m.Precision != 1 || m.LastInputSeq != 4 || m.Self.GetStamina() != 50 {
+		t.Fatalf("header %v", m)
+	}
+	if m.Room.GetName() != "alpha" || m.Room.GetPlayers() != 2 || m.Room.GetHost() != "b" {
+		t.Fatalf("room %v", m.Room)
+	}
+	if w := m.World; w.GetWidth() != 800 || len(w.GetObstacles()) != 1 || w.Obstacles[0].GetHeight() != 4 {
+		t.Fatalf("world %v", w)
+	}
+	// sorted by id, positions in fixed point
+	if len(m.Players) != 2 || m.Players[0].Id != "a" || m.Players[1].Id != "b" {
+		t.Fatalf("players %v", m.Players)
+	}
+	if b := m.Players[1]; b.X != 105 || b.Y != -23 || b.Hp != 80 || b.Name != "bee" || b.Team != 2 {
+		t.Fatalf("player b %v", b)
+	}
+	if a := m.Players[0]; !a.It || a.X != 10 || a.Y != 20 {
+		t.Fatalf("player a %v", a)
+	}
+	if len(m.Remove) != 1 || len(m.Projectiles) != 1 || m.Projectiles[0].GetOwner() != "a" || len(m.Coins) != 1 {
+		t.Fatalf("removed %v, projectiles %v, coins %v", m.Remove, m.Projectiles, m.Coins)
+	}
+	// deltas leave out what they don't have
+	if d := snapshotToProto(Snapshot{Update: map[string]sim.Player{"a": {}}}); d.World != nil || d.Players != nil || len(d.Update) != 1 {
+		t.Fatalf("delta %v", d)
+	}
+}
+
+func TestServerMessageToProto(t *testing.T) {
+	tests := []struct {
+		data  interface{}
+		check func(*pb.ServerMessage) bool
+	}{
+		{Snapshot{Seq: 1}, func(m *pb.ServerMessage) bool { return m.GetSnapshot().GetSeq() == 1 }},
+		{ErrorMessage{Code: ErrBadKick, Detail: "no"}, func(m *pb.ServerMessage) bool { return m.GetError().GetCode() == ErrBadKick }},
+		{WelcomeEvent{Kind: EventWelcome, ID: "a", Token: "t"}, func(m *pb.ServerMessage) bool {
+			return m.GetEvent().GetWelcome().GetId() == "a" && m.GetEvent().GetWelcome().GetToken() == "t"
+		}},
+		{PlayerEvent{Kind: EventLeave, PlayerID: "a", Reason: LeaveKick}, func(m *pb.ServerMessage) bool {
+			p := m.GetEvent().GetPlayer()
+			return p.GetKind() == EventLeave && p.GetReason() == LeaveKick
+		}},
+		{PhaseEvent{Kind: EventPhase, Phase: PhasePlaying}, func(m *pb.ServerMessage) bool { return m.GetEvent().GetPhase().GetPhase() == PhasePlaying }},
+		{CountdownEvent{Kind: EventCountdown, Seconds: 3}, func(m *pb.ServerMessage) bool { return m.GetEvent().GetCountdown().GetSeconds() == 3 }},
+		{PongEvent{Kind: EventPong, T: 5}, func(m *pb.ServerMessage) bool { return m.GetEvent().GetPong().GetT() == 5 }},
+		{Events{DeathEvent{Kind: EventDeath, Victim: "a"}, ScoreEvent{Kind: EventScore, PlayerID: "b", Points: 1}}, func(m *pb.ServerMessage) bool {
+			e := m.GetEvents().GetEvents()
+			return len(e) == 2 && e[0].GetDeath().GetVictim() == "a" && e[1].GetScore().GetPoints() == 1
+		}},
+	}
+	for _, tt := range tests {
+		m, err := serverMessageToProto(&ServerMessage{Data: tt.data})
+		if err != nil {
+			t.Fatalf("%T: %v", tt.data, err)
+		}
+		// and it survives the wire
+		b, err := proto.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got pb.ServerMessage
+		if err := proto.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !tt.check(&got) {
+			t.Fatalf("%+v became %v", tt.data, &got)
+		}
+	}
+	if _, err := serverMessageToProto(&ServerMessage{Data: "text"}); err == nil {
+		t.Fatal("converted a string")
+	}
+	if _, err := serverMessageToProto(&ServerMessage{Data: Events{"text"}}); err == nil {
+		t.Fatal("converted a string in events")
+	}
+}
+
+func TestClientMessageFromProto(t *testing.T) {
+	no := false
+	tests := []struct {
+		msg  *pb.ClientMessage
+		want string
+	}{
+		{&pb.ClientMessage{Data: &pb.ClientMessage_Input{Input: &pb.InputMessage{Seq: 2, Inputs: []string{"up"}, Move: &pb.Vector{X: 1}}}},
+			`{"type":"input","data":{"seq":2,"inputs":["up"],"move":{"x":1,"y":0}}}`},
+		{&pb.ClientMessage{Data: &pb.ClientMessage_Ready{Ready: &pb.ReadyMessage{}}}, `{"type":"ready"}`},
+		{&pb.ClientMessage{Data: &pb.ClientMessage_Ready{Ready: &pb.ReadyMessage{Ready: &no}}}, `{"type":"ready","data":{"ready":false}}`},
+		{&pb.ClientMessage{Data: &pb.ClientMessage_Kick{Kick: &pb.KickMessage{PlayerId: "a"}}}, `{"type":"kick","data":{"player_id":"a"}}`},
+		{&pb.ClientMessage{Data: &pb.ClientMessage_Ping{Ping: &pb.PingMessage{T: 7}}}, `{"type":"ping","data":{"t":7}}`},
+		{&pb.ClientMessage{Data: &pb.ClientMessage_Resync{Resync: &pb.ResyncMessage{}}}, `{"type":"resync"}`},
+	}
+	for _, tt := range tests {
+		raw, err := proto.Marshal(tt.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := clientMessageFromProto(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotV, wantV interface{}
+		json.Unmarshal(got, &gotV)
+		json.Unmarshal([]byte(tt.want), &wantV)
+		if string(mustJSON(t, gotV)) != string(mustJSON(t, wantV)) {
+			t.Fatalf("got %s, want %s", got, tt.want)
+		}
+	}
+	if _, err := clientMessageFromProto(nil); err != errEmptyMessage {
+		t.Fatalf("empty message: got %v, want errEmptyMessage", err)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestProtobufClient(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	conn, err := ts.open("/game", &websocket.Dialer{Subprotocols: []string{ProtobufProtocol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, conn)
+	// next is the next protobuf message
+	next := func() *pb.ServerMessage {
+		m := c.next()
+		if m.typ != websocket.BinaryMessage {
+			t.Fatalf("text frame %s to a protobuf client", m.data)
+		}
+		var msg pb.ServerMessage
+		if err := proto.Unmarshal(m.data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return &msg
+	}
+	send := func(msg *pb.ClientMessage) {
+		b, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := next().GetEvent().GetWelcome().GetId()
+	if id == "" {
+		t.Fatal("no welcome")
+	}
+	send(&pb.ClientMessage{Data: &pb.ClientMessage_Ready{Ready: &pb.ReadyMessage{}}})
+	for next().GetEvent().GetPhase().GetPhase() != PhasePlaying {
+	}
+	ts.tick(1)
+	for {
+		if s := next().GetSnapshot(); s != nil && len(s.Players)+len(s.Add) > 0 {
+			if s.Room.GetPhase() != PhasePlaying {
+				t.Fatalf("snapshot %v", s)
+			}
+			break
+		}
+	}
+	send(&pb.ClientMessage{Data: &pb.ClientMessage_Kick{Kick: &pb.KickMessage{PlayerId: "nobody"}}})
+	for {
+		if e := next().GetError(); e != nil {
+			if e.Code != ErrBadKick {
+				t.Fatalf("error %v, want %s", e, ErrBadKick)
+			}
+			return
+		}
+	}
+}
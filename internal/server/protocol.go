@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// protocol versions this server speaks, declared by clients with
+// ?protocol=. Clients that don't declare one are taken to speak version 1.
+// TODO require a version once version 1 clients are gone
+const (
+	MinProtocol = 1
+	MaxProtocol = 2
+)
+
+// ErrUnsupportedProtocol is the error code sent before closing with
+// CloseUnsupportedProtocol
+const ErrUnsupportedProtocol = "unsupported_protocol"
+
+// negotiateProtocol returns the version a client declared, or false if it is
+// not one this server speaks
+func negotiateProtocol(declared string) (int, bool) {
+	if declared == "" {
+		return MinProtocol, true
+	}
+	v, err := strconv.Atoi(declared)
+	if err != nil || v < MinProtocol || v > MaxProtocol {
+		return 0, false
+	}
+	return v, true
+}
+
+func unsupportedProtocol(declared string) string {
+	return fmt.Sprintf("protocol %q is not supported, this server speaks versions %d to %d", declared, MinProtocol, MaxProtocol)
+}
+
+// reject sends an error and closes a connection that never joined a room,
+// before its writer has started
+func (c *client) reject(closeCode int, errCode, detail string) {
+	c.sendError(errCode, detail)
+	c.abort(closeCode)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	tests := []struct {
+		declared string
+		want     int
+		ok       bool
+	}{
+		{"", 1, true},
+		{"1", 1, true},
+		{"2", 2, true},
+		{"0", 0, false},
+		{"3", 0, false},
+		{"two", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := negotiateProtocol(tt.declared)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("negotiateProtocol(%q) = %d, %v, want %d, %v", tt.declared, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestProtocolHandshake(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/game?protocol=2", 2},
+		// older but still spoken
+		{"/game?protocol=1", 1},
+		// no version is version 1 for now
+		{"/game", 1},
+	} {
+		c := ts.dial(t, tt.path)
+		if c.welcome.Protocol != tt.want {
+			t.Fatalf("%s: welcomed with protocol %d, want %d", tt.path, c.welcome.Protocol, tt.want)
+		}
+	}
+
+	c := ts.connect(t, "/game?protocol=3", nil)
+	e := c.errorMessage()
+	if e.Code != ErrUnsupportedProtocol || !strings.Contains(e.Detail, "1 to 2") {
+		t.Fatalf("got %+v, want %s naming versions 1 to 2", e, ErrUnsupportedProtocol)
+	}
+	if code := c.closeCode(); code != CloseUnsupportedProtocol {
+		t.Fatalf("closed with %d, want %d", code, CloseUnsupportedProtocol)
+	}
+	var rooms []RoomInfo
+	ts.get(t, "/rooms", &rooms)
+	if len(rooms) != 1 || rooms[0].Players != 3 {
+		t.Fatalf("rooms %+v, want the three that spoke a supported version", rooms)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var errBadResumeToken = errors.New("unknown or expired resume token")
+
+func newResumeToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("generating resume token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// disconnect handles a connection going away. A player is kept in place for
+// ReconnectGrace so a new connection can take it over with its resume token.
+func (r *Room) disconnect(c *client, reason string) {
+	if r.clients[c.id] != c {
+		return
+	}
+	if _, playing := r.gamestate.Players[c.id]; !playing || r.srv.cfg.ReconnectGrace <= 0 {
+		r.remove(c, reason)
+		return
+	}
+	delete(r.clients, c.id)
+	r.disconnected[c.id] = absence{reason: reason}
+	r.savePlayer(c.resume, c.id)
+	r.pickHost()
+	r.storeCounts()
+	r.sendPlayerEvent(EventDisconnected, c, reason)
+}
+
+// playerOf returns the player holding token. Every token is compared in
+// constant time, so how long a guess takes says nothing about how close it
+// was.
+func (r *Room) playerOf(token string) (string, bool) {
+	id, found := "", false
+	for t, owner := range r.resumeTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			id, found = owner, true
+		}
+	}
+	return id, found
+}
+
+// rotateToken hands c token in place of the one it resumed with, which is
+// good for one resume only and dropped here and in the player store
+func (r *Room) rotateToken(c *client, token string) {
+	delete(r.resumeTokens, c.resume)
+	r.resumeTokens[token] = c.id
+	r.replacePlayer(c.resume, token, c.id)
+	c.resume = token
+}
+
+// resume reattaches c to the disconnected player its token belongs to, or
+// with a player store restores them from it. Either way c gets a new token.
+func (r *Room) resume(c *client) error {
+	token, err := newResumeToken()
+	if err != nil {
+		return err
+	}
+	id, ok := r.playerOf(c.resume)
+	if !ok {
+		return r.restore(c, token)
+	}
+	// the token was rotated away on another instance, which has the player
+	// now. A token the store doesn't have is still good here: its save is
+	// queued, and may even have been dropped.
+	if c.rotated {
+		return errBadResumeToken
+	}
+	if _, gone := r.disconnected[id]; !gone {
+		// the old connection hasn't been noticed dropping yet
+		old, ok := r.clients[id]
+		if !ok {
+			return errBadResumeToken
+		}
+		delete(r.clients, id)
+		old.close(CloseResumedElsewhere)
+	}
+	delete(r.disconnected, id)
+	c.id = id
+	c.spectator = false
+	c.name = r.gamestate.Players[id].Name
+	r.rotateToken(c, token)
+	log.Println("player", id, "resumed in room", r.name)
+	r.attach(c)
+	r.sendPlayerEvent(EventResumed, c, "")
+	return nil
+}
+
+// expireDisconnected drops players that have been gone longer than
+// ReconnectGrace. It runs every tick.
+func (r *Room) expireDisconnected() {
+	for id, a := range r.disconnected {
+		a.gone += r.srv.cfg.Tick
+		if a.gone < r.srv.cfg.ReconnectGrace {
+			r.disconnected[id] = a
+			continue
+		}
+		log.Println("player", id, "did not come back to room", r.name)
+		name := r.gamestate.Players[id].Name
+		r.dropPlayer(id)
+		r.send(encode(MessageEvent, PlayerEvent{Kind: EventLeave, PlayerID: id, Name: name, Reason: a.reason}))
+		r.pickHost()
+		r.storeCounts()
+		r.checkStart()
+	}
+}
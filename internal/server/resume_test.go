@@ -0,0 +1,83 @@
+package server
+
+import "testing"
+
+func TestResume(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 2)
+	a, other := clients[0], clients[1]
+	a.input("right")
+	if !moves(ts, other, a.welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	was := other.players[a.welcome.ID]
+
+	a.conn.Close()
+	var ev PlayerEvent
+	other.event(EventDisconnected, &ev)
+	if ev.PlayerID != a.welcome.ID {
+		t.Fatalf("got %+v, want %s disconnecting", ev, a.welcome.ID)
+	}
+	// kept in place while gone
+	ts.tick(3)
+	other.snapshot()
+	if p, ok := other.players[a.welcome.ID]; !ok || p.X != was.X || p.Y != was.Y {
+		t.Fatalf("disconnected player at %+v, want kept at %v,%v", p, was.X, was.Y)
+	}
+
+	back := ts.dial(t, "/game?token="+a.welcome.Token)
+	if back.welcome.ID != a.welcome.ID {
+		t.Fatalf("resumed as %s, want %s", back.welcome.ID, a.welcome.ID)
+	}
+	if back.welcome.Token == "" || back.welcome.Token == a.welcome.Token {
+		t.Fatalf("token %q after resuming, want a new one", back.welcome.Token)
+	}
+	other.event(EventResumed, &ev)
+	if ev.PlayerID != a.welcome.ID {
+		t.Fatalf("got %+v, want %s resuming", ev, a.welcome.ID)
+	}
+	ts.tick(1)
+	back.keyframe()
+	if p := back.me(); p.X != was.X || p.Y != was.Y {
+		t.Fatalf("resumed at %v,%v, want %v,%v", p.X, p.Y, was.X, was.Y)
+	}
+
+	// a token is good for one resume
+	if code := ts.connect(t, "/game?token="+a.welcome.Token, nil).closeCode(); code != CloseBadResumeToken {
+		t.Fatalf("closed with %d, want %d", code, CloseBadResumeToken)
+	}
+}
+
+func TestResumeAfterExpiry(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.ReconnectGrace = 3 * cfg.Tick
+	})
+	clients := ts.match(t, "/game", 2)
+	a, other := clients[0], clients[1]
+	a.conn.Close()
+	other.event(EventDisconnected, nil)
+	for i := 0; i < 3; i++ {
+		ts.tick(1)
+	}
+	var ev PlayerEvent
+	other.event(EventLeave, &ev)
+	if ev.PlayerID != a.welcome.ID {
+		t.Fatalf("got %+v, want %s leaving", ev, a.welcome.ID)
+	}
+	ts.tick(1)
+	other.snapshot()
+	if _, ok := other.players[a.welcome.ID]; ok {
+		t.Fatal("expired player still in the snapshot")
+	}
+	if code := ts.connect(t, "/game?token="+a.welcome.Token, nil).closeCode(); code != CloseBadResumeToken {
+		t.Fatalf("closed with %d, want %d", code, CloseBadResumeToken)
+	}
+}
+
+func TestResumeBogusToken(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	ts.match(t, "/game", 1)
+	if code := ts.connect(t, "/game?token=0123456789abcdef", nil).closeCode(); code != CloseBadResumeToken {
+		t.Fatalf("closed with %d, want %d", code, CloseBadResumeToken)
+	}
+}
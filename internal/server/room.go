@@ -0,0 +1,686 @@
+package server
+
+import (
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/broker"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+var errServerStopped = errors.New("server shutting down")
+var errRoomClosed = errors.New("room closed")
+var errUnknownCode = errors.New("unknown or expired join code")
+var errRoomFull = errors.New("room full")
+var errSpectatorsFull = errors.New("no spectator slots left")
+
+// ErrTickPanics is returned by Serve when a room's tick keeps panicking
+var ErrTickPanics = errors.New("too many consecutive tick panics")
+
+// DefaultRoom is joined when /game is given no room
+const DefaultRoom = "lobby"
+
+// room names double as part of the broker channel, so keep them tame
+var roomNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// join codes avoid characters that are easy to misread
+const (
+	joinCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	joinCodeLength   = 6
+)
+
+// newJoinCode returns a random private room code like "XYZ123"
+func newJoinCode() (string, error) {
+	b := make([]byte, joinCodeLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("generating join code: %w", err)
+	}
+	for i := range b {
+		b[i] = joinCodeAlphabet[int(b[i])%len(joinCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+// ValidRoomName reports whether name may be used as a room name: 1 to 32
+// letters, digits, dashes or underscores.
+func ValidRoomName(name string) bool {
+	return roomNamePattern.MatchString(name)
+}
+
+type departure struct {
+	c *client
+	// LeaveDisconnect or LeaveIdle
+	reason string
+}
+
+// absence is how long and why a disconnected player has been gone
+type absence struct {
+	gone   time.Duration
+	reason string
+}
+
+type registration struct {
+	c *client
+	// nil once c has joined, errRoomFull or errSpectatorsFull if there was no
+	// room
+	reply chan error
+}
+
+// Room is one match with its own players, event queue and tick loop. Joins,
+// leaves, ticks and broadcasts all happen on the room goroutine, so the
+// connection set and game state need no lock. A public room is created when
+// its first player joins, a private one up front. Either is torn down, ticker
+// and subscription included, once it has been empty for too long.
+type Room struct {
+	srv  *Server
+	name string
+	// private rooms are left out of the room list and joined by this code
+	code string
+	// broker channel carrying this room's inputs
+	channel  string
+	settings RoomSettings
+
+	register   chan registration
+	unregister chan departure
+	readiness  chan readyChange
+	resyncs    chan *client
+	kicks      chan kickRequest
+	switches   chan teamSwitch
+	pauses     chan pauseRequest
+	// GET /rooms/{room}/stats waiting for an answer
+	statsRequests chan chan []PlayerStats
+	// closed once run has returned and the subscription has stopped
+	done chan struct{}
+
+	// every connection gets snapshots, only players have an entry in
+	// gamestate
+	clients   map[string]*client
+	gamestate *sim.World
+	// the players driven by the server
+	bots  map[string]*bot
+	phase string
+	// simulation ticks run so far and the room clock time, in ms, the
+	// latest one started
+	ticks  uint64
+	tickAt int64
+	// seq, tick and time of the last snapshot and positions as of it, which
+	// deltas are taken against
+	seq      uint64
+	sentTick uint64
+	sentAt   int64
+	sent     map[string]sim.Player
+	// projectiles, coins, power-ups, flags and leaderboard as of the last
+	// snapshot, for keyframes sent in between
+	shots    []sim.Projectile
+	coins    []sim.Coin
+	powerUps []sim.PowerUp
+	flags    []sim.Flag
+	board    []sim.Standing
+	// binary snapshot indices of the players in sent, and indices free to
+	// hand out again
+	index     map[string]uint16
+	freeIndex []uint16
+	// the first player to join; it passes to the longest connected player
+	// when they leave. announcedHost is the host clients were last told of.
+	host          string
+	announcedHost string
+	// counts joins so the longest connected player can be found
+	joins uint64
+	// players ready to leave the lobby
+	ready map[string]bool
+	// resume tokens to player ids, and how long and why each player whose
+	// connection dropped has been gone
+	resumeTokens map[string]string
+	disconnected map[string]absence
+	// leaderboard accounts of the players given resume tokens by id, which
+	// stay the same as their tokens are rotated
+	accounts map[string]string
+	// time left before the match starts while in PhaseCountdown, and time
+	// played since
+	countdown time.Duration
+	elapsed   time.Duration
+	// room clock time, in ms, the match entered PhasePlaying
+	startedAt int64
+	// ticks left of the match while in PhasePlaying, 0 without a limit, and
+	// of the intermission in PhaseEnded
+	remaining int
+	// ticks left before a paused match goes on by itself, 0 unless paused
+	paused int
+	// player and spectator counts and whether the match has started, kept
+	// atomically so the room list can read them
+	players    int32
+	spectators int32
+	started    int32
+	// whether this instance holds the room's registry claim, which it needs
+	// to checkpoint the room; kept atomically as the heartbeat may lose it
+	owned int32
+
+	// the queue is filled from the broker subscription, so it has its own lock
+	eventLock  sync.Mutex
+	eventQueue []sim.InputEvent
+	// batched frames per player waiting for later ticks, with
+	// BatchSequential; also guarded by eventLock
+	backlog map[string][]sim.InputEvent
+
+	// malformed payload counts per source, only touched by receiveInputs
+	malformedBySource map[string]int
+}
+
+func newRoom(srv *Server, name string, settings RoomSettings) *Room {
+	r := &Room{
+		srv:               srv,
+		name:              name,
+		channel:           broker.RoomKey(srv.cfg.Channel, name),
+		settings:          settings,
+		register:          make(chan registration),
+		unregister:        make(chan departure),
+		readiness:         make(chan readyChange),
+		resyncs:           make(chan *client),
+		kicks:             make(chan kickRequest),
+		switches:          make(chan teamSwitch),
+		pauses:            make(chan pauseRequest),
+		statsRequests:     make(chan chan []PlayerStats),
+		done:              make(chan struct{}),
+		clients:           map[string]*client{},
+		gamestate:         sim.NewWorld(srv.cfg.Seed(name)),
+		bots:              map[string]*bot{},
+		sent:              map[string]sim.Player{},
+		index:             map[string]uint16{},
+		phase:             PhaseLobby,
+		ready:             map[string]bool{},
+		resumeTokens:      map[string]string{},
+		accounts:          map[string]string{},
+		disconnected:      map[string]absence{},
+		eventQueue:        []sim.InputEvent{},
+		backlog:           map[string][]sim.InputEvent{},
+		malformedBySource: map[string]int{},
+	}
+	r.addBots(settings.Bots)
+	return r
+}
+
+// RoomInfo describes a room in the room list
+type RoomInfo struct {
+	Name       string `json:"name"`
+	Players    int    `json:"players"`
+	Max        int    `json:"max"`
+	Spectators int    `json:"spectators"`
+	// false while the room is still in the lobby
+	Started  bool         `json:"started"`
+	Settings RoomSettings `json:"settings"`
+}
+
+func (r *Room) info() RoomInfo {
+	return RoomInfo{
+		Name:       r.name,
+		Players:    int(atomic.LoadInt32(&r.players)),
+		Spectators: int(atomic.LoadInt32(&r.spectators)),
+		Max:        r.settings.MaxPlayers,
+		Started:    atomic.LoadInt32(&r.started) == 1,
+		Settings:   r.settings,
+	}
+}
+
+// newPrivateRoom creates a room joined by code. Its channel can't collide
+// with a public room since room names have no colons.
+func newPrivateRoom(srv *Server, code string, settings RoomSettings) *Room {
+	r := newRoom(srv, code, settings)
+	r.code = code
+	r.channel = broker.RoomKey(srv.cfg.Channel+":private", code)
+	return r
+}
+
+// start runs the room's tick loop, its input subscription when there is a
+// broker and its registry heartbeat when there is a registry, until ctx is
+// canceled or the room empties.
+func (r *Room) start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	subDone := make(chan struct{})
+	if r.srv.broker != nil {
+		go func() {
+			defer close(subDone)
+			r.receiveInputs(ctx)
+		}()
+	} else {
+		close(subDone)
+	}
+	// private rooms are only reachable by code on this instance, so only
+	// public ones are registered
+	heartbeatDone := make(chan struct{})
+	if r.srv.registry != nil && r.code == "" {
+		go func() {
+			defer close(heartbeatDone)
+			r.heartbeat(ctx)
+		}()
+	} else {
+		close(heartbeatDone)
+	}
+	go func() {
+		defer close(r.done)
+		emptied := r.run(ctx)
+		cancel()
+		<-subDone
+		<-heartbeatDone
+		if emptied {
+			r.dropChannel()
+		}
+	}()
+}
+
+// join hands a new connection to the room and returns the id of the player
+// created for it. It fails once the room has closed or when it is full.
+func (r *Room) join(c *client) (string, error) {
+	reg := registration{c: c, reply: make(chan error, 1)}
+	select {
+	case r.register <- reg:
+	case <-r.done:
+		return "", errRoomClosed
+	}
+	err := <-reg.reply
+	if err != nil {
+		return "", err
+	}
+	return c.id, nil
+}
+
+// leave removes the connection and its player. It is safe to call more than
+// once and after the room has closed.
+func (r *Room) leave(c *client, reason string) {
+	select {
+	case r.unregister <- departure{c, reason}:
+	case <-r.done:
+	}
+}
+
+// run is the room's loop. It reports whether it ended because the room
+// closed empty, rather than the server stopping or failing.
+func (r *Room) run(ctx context.Context) bool {
+	ticker := r.srv.cfg.Clock.NewTicker(r.srv.cfg.Tick)
+	defer ticker.Stop()
+	consecutivePanics := 0
+	// a private room starts out empty and is given PrivateRoomTTL for its
+	// first player, after that any room gets EmptyRoomGrace
+	emptyFor := time.Duration(0)
+	emptyLimit := r.srv.cfg.PrivateRoomTTL
+	r.restoreCheckpoint(ctx)
+	for {
+		select {
+		case reg := <-r.register:
+			err := r.admit(reg.c)
+			reg.reply <- err
+			if err != nil {
+				continue
+			}
+			emptyFor = 0
+			emptyLimit = r.srv.cfg.EmptyRoomGrace
+			// a new player isn't ready yet, which calls off a countdown
+			r.checkStart()
+		case d := <-r.unregister:
+			r.disconnect(d.c, d.reason)
+			// the last player not yet ready may just have left, or the
+			// room may be short of players now
+			r.checkStart()
+		case rc := <-r.readiness:
+			r.applyReady(rc)
+		case c := <-r.resyncs:
+			if r.clients[c.id] == c && !c.deliver(r.resync()) {
+				r.dropSlow([]*client{c})
+			}
+		case req := <-r.kicks:
+			req.reply <- r.applyKick(req)
+		case req := <-r.switches:
+			req.reply <- r.applySwitch(req)
+		case req := <-r.pauses:
+			req.reply <- r.applyPause(req)
+		case reply := <-r.statsRequests:
+			reply <- r.stats()
+		case now := <-ticker.C():
+			r.expireDisconnected()
+			if len(r.clients) == 0 {
+				emptyFor += r.srv.cfg.Tick
+				if emptyFor >= emptyLimit {
+					r.srv.closeRoom(r)
+					r.forgetCheckpoint()
+					return true
+				}
+				continue
+			}
+			if r.safeTick(now) {
+				consecutivePanics = 0
+				continue
+			}
+			consecutivePanics++
+			if consecutivePanics >= r.srv.cfg.MaxTickPanics {
+				// the room stops ticking but keeps its clients so shutdown
+				// can still say goodbye to them
+				r.srv.fail(fmt.Errorf("room %s: %w", r.name, ErrTickPanics))
+				return false
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// admit adds c to the room, as a new player, a spectator or, when it carries
+// a resume token, back into the player it had before
+func (r *Room) admit(c *client) error {
+	if c.resume != "" {
+		return r.resume(c)
+	}
+	// late joiners may have to watch until the match is over
+	spectate := c.spectator ||
+		r.phase == PhasePlaying && r.settings.MidMatchJoin == MidMatchSpectate
+	// joins are serialized here, so the checks can't race
+	if spectate && r.spectatorCount() >= r.srv.cfg.MaxSpectators {
+		return errSpectatorsFull
+	}
+	if !spectate && r.humans() >= r.settings.MaxPlayers {
+		return errRoomFull
+	}
+	c.id = uuid.New().String()
+	c.spectator = spectate
+	c.name = r.uniqueName(cleanName(c.name, r.srv.cfg.NameBlocklist), c.id)
+	if !spectate {
+		token, err := newResumeToken()
+		if err != nil {
+			return err
+		}
+		r.resumeTokens[token] = c.id
+		r.accounts[c.id] = accountID(token)
+		c.resume = token
+		r.gamestate.Join(c.id, r.settings.Rules(r.srv.cfg.Tick)).Name = c.name
+		if c.color != "" {
+			r.gamestate.Paint(c.id, c.color)
+		}
+		// so the token is good on any instance from the start
+		r.savePlayer(token, c.id)
+	}
+	r.attach(c)
+	r.sendPlayerEvent(EventJoin, c, "")
+	return nil
+}
+
+// attach adds an admitted connection to the broadcast set
+func (r *Room) attach(c *client) {
+	c.room = r
+	r.joins++
+	c.joined = r.joins
+	r.clients[c.id] = c
+	r.pickHost()
+	r.storeCounts()
+	c.deliver(r.welcomeEvent(c))
+	c.deliver(r.phaseEvent())
+	c.deliver(r.resync())
+}
+
+// remove drops a connection and, for a player, the player too
+func (r *Room) remove(c *client, reason string) {
+	if r.clients[c.id] == c {
+		delete(r.clients, c.id)
+		r.dropPlayer(c.id)
+		r.pickHost()
+		r.storeCounts()
+		r.sendPlayerEvent(EventLeave, c, reason)
+	}
+}
+
+func (r *Room) dropPlayer(id string) {
+	r.gamestate.Remove(id)
+	delete(r.ready, id)
+	delete(r.disconnected, id)
+	delete(r.accounts, id)
+	for token, owner := range r.resumeTokens {
+		if owner == id {
+			delete(r.resumeTokens, token)
+		}
+	}
+}
+
+// spectatorCount is the number of connections without a player. Players
+// other than bots are either connected or disconnected and waiting to
+// resume.
+func (r *Room) spectatorCount() int {
+	return len(r.clients) - (r.humans() - len(r.disconnected))
+}
+
+func (r *Room) storeCounts() {
+	atomic.StoreInt32(&r.players, int32(r.humans()))
+	atomic.StoreInt32(&r.spectators, int32(r.spectatorCount()))
+}
+
+// tick applies queued inputs, moves every player and broadcasts the result.
+// Until the match starts, and while it is paused, inputs are thrown away and
+// nobody moves. now is when the ticker fired, which the clock may well have
+// moved on from by the time the tick runs.
+func (r *Room) tick(now time.Time) {
+	r.saveConnected()
+	r.driveBots()
+	r.eventLock.Lock()
+	events := r.eventQueue
+	r.eventQueue = []sim.InputEvent{}
+	for id, frames := range r.backlog {
+		events = append(events, frames[0])
+		if len(frames) == 1 {
+			delete(r.backlog, id)
+		} else {
+			r.backlog[id] = frames[1:]
+		}
+	}
+	r.eventLock.Unlock()
+
+	r.ticks++
+	r.tickAt = now.UnixNano() / int64(time.Millisecond)
+	r.checkpoint()
+
+	switch r.phase {
+	case PhaseCountdown:
+		r.advanceCountdown()
+	case PhaseEnded:
+		r.advanceIntermission()
+	}
+	if r.paused > 0 {
+		// the match clock stands still too
+		r.advancePause()
+	} else if r.phase == PhasePlaying {
+		r.elapsed += r.srv.cfg.Tick
+		for _, input := range events {
+			// the player may have left while the input was in flight
+			if _, ok := r.gamestate.Players[input.PlayerID]; !ok {
+				atomic.AddUint64(&r.srv.counters.UnknownPlayerInputs, 1)
+			}
+		}
+		r.gamestate = sim.Step(r.gamestate, events, r.settings.Rules(r.srv.cfg.Tick))
+		r.recordScores()
+		r.sendEvents()
+		if reason := r.gamestate.Ended; reason != "" {
+			r.endMatch(r.gamestate.Winner, reason)
+		} else if r.remaining > 0 {
+			r.remaining--
+			if r.remaining == 0 {
+				r.endMatch("", EndTime)
+			}
+		}
+	}
+	for id, c := range r.clients {
+		if p, ok := r.gamestate.Players[id]; ok {
+			p.LatencyMS = c.latencyMS()
+		}
+	}
+	// the host may have changed since the last tick, including while
+	// dropping a slow client mid-broadcast
+	if r.host != r.announcedHost {
+		r.sendPhase()
+	}
+
+	// dispatch only queues onto each writer, so it should stay well under a
+	// tick however many clients there are or however slow their sockets
+	start := r.srv.cfg.Clock.Now()
+	r.broadcast()
+	if took := r.srv.cfg.Clock.Now().Sub(start); took > r.srv.cfg.Tick {
+		atomic.AddUint64(&r.srv.counters.SlowBroadcasts, 1)
+		log.Printf("broadcast to %d clients in room %s took %s, longer than a tick", len(r.clients), r.name, took)
+	}
+}
+
+// safeTick runs a single tick, recovering from any panic so one bad tick
+// doesn't kill the simulation. It reports whether the tick completed.
+func (r *Room) safeTick(now time.Time) (ok bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			atomic.AddUint64(&r.srv.counters.TickPanics, 1)
+			log.Printf("panic in tick for room %s: %v\n%s", r.name, rec, debug.Stack())
+			ok = false
+		}
+	}()
+	r.tick(now)
+	return true
+}
+
+// send queues o for every connection. Nothing here blocks, so a slow client
+// can't stall the tick; it is dropped instead.
+func (r *Room) send(o outbound) {
+	o = r.pack(o)
+	var slow []*client
+	for _, c := range r.clients {
+		if !c.deliver(o) {
+			slow = append(slow, c)
+		}
+	}
+	r.dropSlow(slow)
+}
+
+// pack fills in o's msgpack and protobuf forms if any connection needs them,
+// so each is only encoded once, and prepares msg when compression is on
+func (r *Room) pack(o outbound) outbound {
+	return r.packFor(o, false)
+}
+
+// packFor is pack for a snapshot when snapshot is set. Players each get
+// their own version of one and binary clients its binary form, so msg only
+// goes out as it is to spectators.
+func (r *Room) packFor(o outbound, snapshot bool) outbound {
+	if o.value == nil {
+		return o
+	}
+	// preparing compresses msg up front, which only pays off when it goes
+	// out unchanged more than once
+	shared := 0
+	for id, c := range r.clients {
+		_, playing := r.gamestate.Players[id]
+		switch {
+		case c.legacy || c.encoding == EncodingMsgpack || c.encoding == EncodingProtobuf:
+		case snapshot && (playing || c.encoding == EncodingBinary):
+		default:
+			shared++
+		}
+	}
+	if r.srv.cfg.CompressionLevel != flate.NoCompression && shared > 1 {
+		prepared, err := websocket.NewPreparedMessage(websocket.TextMessage, o.msg)
+		if err != nil {
+			log.Println("prepare error:", err)
+		}
+		o.prepared = prepared
+	}
+	for _, c := range r.clients {
+		switch {
+		case c.encoding == EncodingMsgpack && o.packed == nil:
+			o.packed = pack(o.value)
+		case c.encoding == EncodingProtobuf && o.protobuf == nil:
+			o.protobuf = marshalProto(o.value)
+		}
+	}
+	return o
+}
+
+func (r *Room) dropSlow(slow []*client) {
+	for _, c := range slow {
+		log.Println("send buffer full, dropping player:", c.id)
+		r.remove(c, LeaveDisconnect)
+		c.close(CloseTooSlow)
+	}
+}
+
+// sendEvents sends what happened in the last step as one events message,
+// if anything did
+func (r *Room) sendEvents() {
+	var events Events
+	for _, d := range r.gamestate.Deaths {
+		events = append(events, DeathEvent{Kind: EventDeath, Killer: d.Killer, Victim: d.Victim})
+	}
+	for _, pu := range r.gamestate.Pickups {
+		events = append(events, PickupEvent{Kind: EventPickup, PlayerID: pu.PlayerID, Coin: pu.Coin, PowerUp: pu.PowerUp})
+	}
+	for _, c := range r.gamestate.Captures {
+		events = append(events, CaptureEvent{Kind: EventCapture, PlayerID: c.PlayerID, Team: c.Team})
+	}
+	for _, sc := range r.gamestate.Scores {
+		events = append(events, ScoreEvent{Kind: EventScore, PlayerID: sc.PlayerID, Points: sc.Points, Score: sc.Score})
+	}
+	if len(events) > 0 {
+		r.send(encode(MessageEvents, events))
+	}
+}
+
+func (r *Room) sendPlayerEvent(kind string, c *client, reason string) {
+	r.send(encode(MessageEvent, PlayerEvent{Kind: kind, PlayerID: c.id, Name: c.name, Spectator: c.spectator, Reason: reason}))
+}
+
+// enqueueInputs adds the frames of one input message, all from the same
+// player and oldest first. With BatchSequential a batch goes into the
+// player's backlog to be applied a frame per tick, and so does anything sent
+// while the backlog is draining to keep the order. The backlog never holds
+// more than MaxInputBatch frames; older ones go into the next tick.
+func (r *Room) enqueueInputs(frames []sim.InputEvent) {
+	r.eventLock.Lock()
+	defer r.eventLock.Unlock()
+
+	id := frames[0].PlayerID
+	if r.srv.cfg.InputBatching == BatchSequential && (len(frames) > 1 || len(r.backlog[id]) > 0) {
+		backlog := append(r.backlog[id], frames...)
+		if over := len(backlog) - r.srv.cfg.MaxInputBatch; over > 0 {
+			for _, input := range backlog[:over] {
+				r.queueInput(input)
+			}
+			backlog = backlog[over:]
+		}
+		r.backlog[id] = backlog
+		return
+	}
+	for _, input := range frames {
+		r.queueInput(input)
+	}
+}
+
+// queueInput adds an input for the next tick. Once the queue is full the
+// newest input replaces any queued one from the same player, and failing that
+// the oldest queued input is dropped. The caller holds eventLock.
+func (r *Room) queueInput(input sim.InputEvent) {
+	if len(r.eventQueue) < r.srv.cfg.MaxEventQueue {
+		r.eventQueue = append(r.eventQueue, input)
+		return
+	}
+
+	atomic.AddUint64(&r.srv.counters.DroppedInputs, 1)
+	for i := len(r.eventQueue) - 1; i >= 0; i-- {
+		if r.eventQueue[i].PlayerID == input.PlayerID {
+			r.eventQueue[i] = input
+			return
+		}
+	}
+	log.Println("event queue full, dropping oldest input in room", r.name)
+	copy(r.eventQueue, r.eventQueue[1:])
+	r.eventQueue[len(r.eventQueue)-1] = input
+}
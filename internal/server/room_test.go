@@ -0,0 +1,729 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/broker"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/clock"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// ticking runs the server's rooms tick after tick until the returned func is
+// called, a millisecond apart so the writers keep up
+func ticking(ts *testServer) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				ts.tick(1)
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	stop := ticking(ts)
+	defer stop()
+	t.Run("clients", func(t *testing.T) {
+		for i := 0; i < 8; i++ {
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				t.Parallel()
+				c := ts.dial(t, "/game")
+				c.send(MessageReady, nil)
+				for j := 0; j < 10; j++ {
+					c.input("right")
+				}
+				c.joined()
+				c.snapshot()
+				c.conn.Close()
+			})
+		}
+	})
+	// the room is still ticking
+	c := ts.dial(t, "/game")
+	c.snapshot()
+	c.snapshot()
+}
+
+func TestJoinLeaveHammer(t *testing.T) {
+	cfg := testConfig()
+	cfg.ReconnectGrace = 0
+	cfg.MaxPlayers = 1000
+	cfg.MaxSpectators = 1000
+	cfg.EmptyRoomGrace = time.Hour
+	s := NewServer(cfg, nil, nil)
+	r := newRoom(s, "a", cfg.RoomSettings())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-r.done
+	}()
+	r.start(ctx)
+	stop := make(chan struct{})
+	ticked := make(chan struct{})
+	go func() {
+		defer close(ticked)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				cfg.Clock.(*clock.Manual).Advance(cfg.Tick)
+			}
+		}
+	}()
+
+	var ids sync.Map
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				c := newClient(s, nil)
+				c.spectator = j%4 == 0
+				id, err := r.join(c)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, dup := ids.LoadOrStore(id, true); dup {
+					t.Errorf("id %s handed out twice", id)
+				}
+				r.leave(c, LeaveDisconnect)
+				// leaving twice is harmless
+				r.leave(c, LeaveDisconnect)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	<-ticked
+
+	// a last round trip through the room so every leave has been handled
+	c := newClient(s, nil)
+	if _, err := r.join(c); err != nil {
+		t.Fatal(err)
+	}
+	r.leave(c, LeaveDisconnect)
+	r.join(newClient(s, nil))
+	if n := atomic.LoadInt32(&r.players); n != 1 {
+		t.Fatalf("%d players left, want 1", n)
+	}
+	if n := atomic.LoadInt32(&r.spectators); n != 0 {
+		t.Fatalf("%d spectators left, want 0", n)
+	}
+}
+
+func TestManualTicks(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) { cfg.PositionPrecision = 2 })
+	a := ts.match(t, "/game", 1)[0]
+	start := a.me()
+	// two inputs in one tick add up to a diagonal
+	a.input("right")
+	a.input("down")
+	a.sync()
+	ts.tick(1)
+	a.snapshot()
+	step := float64(ts.cfg.PlayerSpeed) * ts.cfg.Tick.Seconds() * math.Sqrt2 / 2
+	p := a.me()
+	if math.Abs(p.X-start.X-step) > 0.01 || math.Abs(p.Y-start.Y-step) > 0.01 {
+		t.Fatalf("moved from %v,%v to %v,%v, want %v along each axis", start.X, start.Y, p.X, p.Y, step)
+	}
+	// nothing held in the next tick, so the player stops
+	ts.tick(1)
+	a.snapshot()
+	if q := a.me(); q.X != p.X || q.Y != p.Y {
+		t.Fatalf("moved on to %v,%v without input", q.X, q.Y)
+	}
+}
+
+func TestAbruptCloseMidGame(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 3)
+	gone := clients[0]
+	gone.conn.UnderlyingConn().Close()
+
+	for _, c := range clients[1:] {
+		var ev PlayerEvent
+		c.event(EventDisconnected, &ev)
+		if ev.PlayerID != gone.welcome.ID {
+			t.Fatalf("%s disconnected, want %s", ev.PlayerID, gone.welcome.ID)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		ts.tick(1)
+		for _, c := range clients[1:] {
+			c.snapshot()
+		}
+	}
+}
+
+func TestEventQueueBounded(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxEventQueue = 8
+	s := NewServer(cfg, nil, nil)
+	r := newRoom(s, "a", cfg.RoomSettings())
+	const sent = 5000
+	for i := 1; i <= sent; i++ {
+		r.enqueueInputs([]sim.InputEvent{{PlayerID: fmt.Sprint(i % 3), Seq: i}})
+	}
+	if len(r.eventQueue) != cfg.MaxEventQueue {
+		t.Fatalf("%d inputs queued, want %d", len(r.eventQueue), cfg.MaxEventQueue)
+	}
+	if n := s.Counters().DroppedInputs; n != sent-uint64(cfg.MaxEventQueue) {
+		t.Fatalf("%d inputs dropped, want %d", n, sent-cfg.MaxEventQueue)
+	}
+	latest := map[string]int{}
+	for _, input := range r.eventQueue {
+		if input.Seq > latest[input.PlayerID] {
+			latest[input.PlayerID] = input.Seq
+		}
+	}
+	want := map[string]int{"0": sent - 2, "1": sent - 1, "2": sent}
+	if !reflect.DeepEqual(latest, want) {
+		t.Fatalf("latest queued inputs %v, want %v", latest, want)
+	}
+}
+
+// poisoned is a mode that panics once a player faces an angle of poison,
+// facing them back the other way first unless forever is set
+type poisoned struct {
+	forever bool
+}
+
+const poison = 3.0
+
+func (m poisoned) Step(w *sim.World, rules sim.Rules) {
+	for _, p := range w.Players {
+		if p.Facing == poison {
+			if !m.forever {
+				p.Facing = 0
+			}
+			panic("poisoned")
+		}
+	}
+}
+
+// withMode makes mode available to rooms as name until the test ends
+func withMode(t *testing.T, name string, mode sim.Mode) {
+	modes[name] = mode
+	t.Cleanup(func() { delete(modes, name) })
+}
+
+func TestTickPanicRecovered(t *testing.T) {
+	withMode(t, "poisoned", poisoned{})
+	ts := startServer(t, nil, func(cfg *Config) { cfg.Mode = "poisoned" })
+	a := ts.match(t, "/game", 1)[0]
+	aim := poison
+	a.send(MessageInput, InputMessage{Aim: &aim})
+	a.sync()
+	ts.tick(1)
+	eventually(t, "the tick to panic", func() bool { return ts.Counters().TickPanics == 1 })
+	a.input("right")
+	if !moves(ts, a, a.welcome.ID) {
+		t.Fatal("room stopped after the panic")
+	}
+}
+
+func TestTooManyTickPanics(t *testing.T) {
+	withMode(t, "poisoned", poisoned{forever: true})
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.Mode = "poisoned"
+		cfg.MaxTickPanics = 3
+	})
+	a := ts.match(t, "/game", 1)[0]
+	aim := poison
+	a.send(MessageInput, InputMessage{Aim: &aim})
+	a.sync()
+	ts.tick(3)
+	if err := ts.exited(t); !errors.Is(err, ErrTickPanics) {
+		t.Fatalf("serve returned %v, want ErrTickPanics", err)
+	}
+	if code := a.closeCode(); code != CloseShutdown {
+		t.Fatalf("closed with %d, want %d", code, CloseShutdown)
+	}
+}
+
+func TestRoomsTickIndependently(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, nil)
+	inA := ts.match(t, "/game?room=a", 2)
+	inB := ts.match(t, "/game?room=b", 1)[0]
+	for _, room := range []string{"a", "b"} {
+		if n := b.subscribed(broker.RoomKey(ts.cfg.Channel, room)); n != 1 {
+			t.Fatalf("room %s subscribed %d times, want 1", room, n)
+		}
+	}
+	if len(inB.players) != 1 {
+		t.Fatalf("room b sees %d players, want only its own", len(inB.players))
+	}
+	still := inB.me()
+
+	inA[0].input("right")
+	if !moves(ts, inA[0], inA[0].welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	before := inB.snapshot().Seq
+	ts.tick(1)
+	// room b kept ticking too
+	if seq := inB.snapshot().Seq; seq <= before {
+		t.Fatalf("room b at seq %d after %d", seq, before)
+	}
+	if p := inB.me(); p.X != still.X || p.Y != still.Y {
+		t.Fatal("room b's player moved")
+	}
+	for _, c := range inA {
+		if len(c.players) != 2 {
+			t.Fatalf("room a sees %d players, want 2", len(c.players))
+		}
+		if _, ok := c.players[inB.welcome.ID]; ok {
+			t.Fatal("room a sees room b's player")
+		}
+	}
+}
+
+func TestEmptyRoomTornDown(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, func(cfg *Config) {
+		cfg.ReconnectGrace = 0
+		cfg.EmptyRoomGrace = 3 * cfg.Tick
+	})
+	stays := ts.match(t, "/game?room=a", 1)[0]
+	leaves := ts.match(t, "/game?room=b", 1)[0]
+	leaves.conn.Close()
+	channel := broker.RoomKey(ts.cfg.Channel, "b")
+	eventually(t, "room b to close", func() bool {
+		ts.tick(1)
+		for _, info := range ts.listRooms() {
+			if info.Name == "b" {
+				return false
+			}
+		}
+		return true
+	})
+	eventually(t, "room b's subscription to end", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		_, ok := b.subs[channel]
+		return !ok
+	})
+	ts.tick(1)
+	stays.snapshot()
+
+	// coming back makes a new room
+	back := ts.match(t, "/game?room=b", 1)[0]
+	if n := b.subscribed(channel); n != 2 {
+		t.Fatalf("room b subscribed %d times, want 2", n)
+	}
+	if len(back.players) != 1 {
+		t.Fatalf("%d players in the new room", len(back.players))
+	}
+}
+
+func TestRoomParam(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	if name := ts.dial(t, "/game").snapshot().Room.Name; name != DefaultRoom {
+		t.Fatalf("joined %q without a room, want %q", name, DefaultRoom)
+	}
+	if name := ts.dial(t, "/game?room=Team_a-1").snapshot().Room.Name; name != "Team_a-1" {
+		t.Fatalf("joined %q, want Team_a-1", name)
+	}
+	for _, room := range []string{strings.Repeat("a", 33), "a:b", "a%20b", "caf%C3%A9", "a%7Bb%7D"} {
+		if status := ts.refused(t, "/game?room="+room); status != http.StatusBadRequest {
+			t.Fatalf("room %q refused with %d, want %d", room, status, http.StatusBadRequest)
+		}
+	}
+	if !ValidRoomName(strings.Repeat("a", 32)) || ValidRoomName("") {
+		t.Fatal("room names must be 1 to 32 characters")
+	}
+}
+
+func TestConcurrentRoomsIsolated(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	stop := ticking(ts)
+	defer stop()
+	ids := map[string][]string{}
+	var mu sync.Mutex
+	t.Run("rooms", func(t *testing.T) {
+		for _, room := range []string{"a", "b"} {
+			for i := 0; i < 3; i++ {
+				room := room
+				t.Run(room, func(t *testing.T) {
+					t.Parallel()
+					c := ts.dial(t, "/game?room="+room)
+					mu.Lock()
+					ids[room] = append(ids[room], c.welcome.ID)
+					mu.Unlock()
+					c.send(MessageReady, nil)
+					for j := 0; j < 50; j++ {
+						c.input("right")
+						c.snapshot()
+						mu.Lock()
+						for other, theirs := range ids {
+							if other == room {
+								continue
+							}
+							for _, id := range theirs {
+								if _, ok := c.players[id]; ok {
+									mu.Unlock()
+									t.Fatalf("player in room %s sees %s from room %s", room, id, other)
+								}
+							}
+						}
+						mu.Unlock()
+					}
+				})
+			}
+		}
+	})
+}
+
+func TestMaxPlayersUnderConcurrentJoins(t *testing.T) {
+	const max = 4
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.MaxPlayers = max
+		cfg.ReconnectGrace = 0
+	})
+	clients := make([]*testClient, max+5)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := ts.open("/game", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			clients[i] = newTestClient(t, conn)
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	var in []*testClient
+	full := 0
+	for _, c := range clients {
+		select {
+		case m, ok := <-c.in:
+			if ok {
+				var env envelope
+				json.Unmarshal(m.data, &env)
+				var ev WelcomeEvent
+				json.Unmarshal(env.Data, &ev)
+				if ev.Kind != EventWelcome {
+					t.Fatalf("first message %s", m.data)
+				}
+				in = append(in, c)
+				continue
+			}
+			var ce *websocket.CloseError
+			if !errors.As(c.err, &ce) || ce.Code != CloseRoomFull {
+				t.Fatalf("closed with %v, want %d", c.err, CloseRoomFull)
+			}
+			full++
+		case <-time.After(readTimeout):
+			t.Fatal("neither welcomed nor turned away")
+		}
+	}
+	if len(in) != max || full != 5 {
+		t.Fatalf("%d joined and %d turned away, want %d and 5", len(in), full, max)
+	}
+	var rooms []RoomInfo
+	ts.get(t, "/rooms", &rooms)
+	if len(rooms) != 1 || rooms[0].Players != max {
+		t.Fatalf("rooms %+v, want one with %d players", rooms, max)
+	}
+
+	// a place opens up once someone leaves
+	in[0].conn.Close()
+	eventually(t, "the player to leave", func() bool {
+		ts.get(t, "/rooms", &rooms)
+		return rooms[0].Players == max-1
+	})
+	ts.dial(t, "/game")
+}
+
+func TestQuickReturnReusesRoom(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, func(cfg *Config) {
+		cfg.ReconnectGrace = 0
+		cfg.EmptyRoomGrace = 10 * cfg.Tick
+	})
+	channel := broker.RoomKey(ts.cfg.Channel, "a")
+	c := ts.dial(t, "/game?room=a")
+	c.conn.Close()
+	eventually(t, "the player to leave", func() bool {
+		return len(ts.listRooms()) == 1 && ts.listRooms()[0].Players == 0
+	})
+	ts.tick(5)
+	ts.dial(t, "/game?room=a").snapshot()
+	if n := b.subscribed(channel); n != 1 {
+		t.Fatalf("subscribed %d times, want the room kept within its grace", n)
+	}
+}
+
+func TestAbandonedRoomsReclaimed(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, func(cfg *Config) {
+		cfg.ReconnectGrace = 0
+		cfg.EmptyRoomGrace = 2 * cfg.Tick
+	})
+	// the server's own goroutines, with one room running
+	ts.dial(t, "/game?room=first").conn.Close()
+	eventually(t, "the first room to close", func() bool {
+		ts.tick(1)
+		return len(ts.listRooms()) == 0
+	})
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		c := ts.dial(t, fmt.Sprintf("/game?room=r%d", i))
+		c.conn.Close()
+	}
+	eventually(t, "every room to close", func() bool {
+		ts.tick(1)
+		return len(ts.listRooms()) == 0
+	})
+	// a room is unlisted before its subscription is torn down
+	eventually(t, "every subscription to close", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.subs) == 0
+	})
+	eventually(t, "the rooms' goroutines to exit", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
+
+func TestConfiguredWorld(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.WorldWidth, cfg.WorldHeight = 200, 200
+	})
+	c := ts.dial(t, "/game")
+	// the size comes with the first keyframe
+	if s := c.snapshot(); !s.Keyframe || s.World == nil || s.World.Width != 200 || s.World.Height != 200 {
+		t.Fatalf("first snapshot %+v, want a keyframe of a 200x200 world", s)
+	}
+	c.play()
+	for i := 0; i < 100; i++ {
+		c.input("right", "down")
+		c.sync()
+		ts.tick(1)
+		c.snapshot()
+	}
+	if p := c.me(); p.X != 200 || p.Y != 200 {
+		t.Fatalf("at %v,%v, want the corner at 200,200", p.X, p.Y)
+	}
+}
+
+func TestWrappedWorld(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	code := ts.createRoom(t, map[string]interface{}{"wrap": true, "world_width": 200, "world_height": 200})
+	c := ts.dial(t, "/game?code="+code)
+	if s := c.snapshot(); !s.Keyframe || s.World == nil || !s.World.Wrap {
+		t.Fatalf("first snapshot %+v, want a keyframe of a wrapping world", s)
+	}
+	if s := ts.dial(t, "/game").snapshot(); s.World == nil || s.World.Wrap {
+		t.Fatalf("first snapshot %+v, want a keyframe of a world with edges", s)
+	}
+	c.play()
+	wrapped := false
+	last := math.Inf(-1)
+	for i := 0; i < 100; i++ {
+		c.input("right")
+		c.sync()
+		ts.tick(1)
+		c.snapshot()
+		x := c.me().X
+		if x < 0 || x >= 200 {
+			t.Fatalf("at %v in a world 200 wide", x)
+		}
+		wrapped = wrapped || x < last
+		last = x
+	}
+	if !wrapped {
+		t.Fatal("never came back in on the left")
+	}
+}
+
+// shoot has from fire at where at stands, and ticks for as long as the shot
+// can fly
+func shoot(ts *testServer, from, at *testClient) {
+	from.t.Helper()
+	a, b := from.me(), from.players[at.welcome.ID]
+	from.send(MessageInput, InputMessage{Shoot: &sim.Vector{X: b.X - a.X, Y: b.Y - a.Y}})
+	from.sync()
+	ts.tick(int(ts.cfg.ProjectileTTL / ts.cfg.Tick))
+}
+
+func TestDeathEvent(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.ProjectileDamage = cfg.MaxHP
+		cfg.SpawnProtection = 0
+	})
+	clients := ts.match(t, "/game", 2)
+	shooter, victim := clients[0], clients[1]
+	shoot(ts, shooter, victim)
+	for _, c := range clients {
+		var ev DeathEvent
+		c.event(EventDeath, &ev)
+		if ev.Killer != shooter.welcome.ID || ev.Victim != victim.welcome.ID {
+			t.Fatalf("got %+v, want %s killing %s", ev, shooter.welcome.ID, victim.welcome.ID)
+		}
+	}
+}
+
+func TestJoinersSpawnApart(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	c := ts.match(t, "/game", 10)[0]
+	// less a pixel, as positions are sent rounded
+	min := float64(ts.cfg.SpawnDistance) - 1
+	for ia, a := range c.players {
+		for ib, b := range c.players {
+			if ia < ib && math.Hypot(a.X-b.X, a.Y-b.Y) < min {
+				t.Fatalf("%s at %v,%v and %s at %v,%v", ia, a.X, a.Y, ib, b.X, b.Y)
+			}
+		}
+	}
+}
+
+func TestScoreEvent(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.ProjectileDamage = cfg.MaxHP
+		cfg.SpawnProtection = 0
+		// the kill is the only way to score
+		cfg.Coins = 0
+	})
+	clients := ts.match(t, "/game", 2)
+	shooter, victim := clients[0], clients[1]
+	shoot(ts, shooter, victim)
+	var ev ScoreEvent
+	victim.event(EventScore, &ev)
+	if ev.PlayerID != shooter.welcome.ID || ev.Points != 1 || ev.Score != 1 {
+		t.Fatalf("got %+v, want a point for %s", ev, shooter.welcome.ID)
+	}
+	// and the leaderboard has them on top
+	ts.tick(1)
+	if s := victim.snapshot(); len(s.Leaderboard) != 2 || s.Leaderboard[0] != (sim.Standing{PlayerID: shooter.welcome.ID, Score: 1}) {
+		t.Fatalf("leaderboard %+v", s.Leaderboard)
+	}
+}
+
+func TestEventsBatched(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.ProjectileDamage = cfg.MaxHP
+		cfg.SpawnProtection = 0
+		cfg.Coins = 0
+	})
+	clients := ts.match(t, "/game", 2)
+	shooter, victim := clients[0], clients[1]
+	shoot(ts, shooter, victim)
+	// read around message, which takes events messages apart
+	for {
+		var env envelope
+		victim.decode(victim.next().data, &env)
+		var events []struct {
+			Kind string `json:"kind"`
+		}
+		switch env.Type {
+		case MessageEvent:
+			var ev struct {
+				Kind string `json:"kind"`
+			}
+			if victim.decode(env.Data, &ev); ev.Kind == EventDeath || ev.Kind == EventScore {
+				t.Fatalf("%s sent on its own", env.Data)
+			}
+			continue
+		case MessageEvents:
+			victim.decode(env.Data, &events)
+		default:
+			continue
+		}
+		if len(events) != 2 || events[0].Kind != EventDeath || events[1].Kind != EventScore {
+			t.Fatalf("got %s, want the death and then the score", env.Data)
+		}
+		return
+	}
+}
+
+func TestHillRoom(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	// a zone over the whole world, so wherever they spawn they hold it
+	code := ts.createRoom(t, map[string]interface{}{
+		"mode":       ModeHill,
+		"hill":       sim.Circle{X: ts.cfg.WorldWidth / 2, Y: ts.cfg.WorldHeight / 2, Radius: ts.cfg.WorldWidth + ts.cfg.WorldHeight},
+		"hill_score": 3,
+	})
+	c := ts.match(t, "/game?code="+code, 1)[0]
+	id := c.welcome.ID
+	// the first tick of the match has gone by
+	ts.tick(1)
+	h := c.snapshot().Room.Hill
+	if h == nil || h.Holder != id || h.Contested || h.Progress[id] != 2 || h.Score != 3 || h.Radius != ts.cfg.WorldWidth+ts.cfg.WorldHeight {
+		t.Fatalf("hill %+v", h)
+	}
+	ts.tick(1)
+	var over MatchOverEvent
+	c.event(EventMatchOver, &over)
+	if over.Reason != sim.EndHill || over.Winner != id {
+		t.Fatalf("match over %+v", over)
+	}
+	c.phase(PhaseEnded)
+}
+
+func TestColorHint(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	for _, color := range []string{"red", "ff8800", "#ff88", "#gg8800"} {
+		if status := ts.refused(t, "/game?color="+url.QueryEscape(color)); status != http.StatusBadRequest {
+			t.Fatalf("color %q refused with %d, want %d", color, status, http.StatusBadRequest)
+		}
+	}
+	clients := ts.match(t, "/game?color="+url.QueryEscape("#FF8800"), 2)
+	a, b := clients[0], clients[1]
+	// the first to ask gets it, the second a palette color like anyone else
+	if got := a.players[a.welcome.ID].Color; got != "#ff8800" {
+		t.Fatalf("asked for #FF8800, got %s", got)
+	}
+	if got := a.players[b.welcome.ID].Color; got != sim.Palette[0] {
+		t.Fatalf("asked for a taken color, got %s, want %s", got, sim.Palette[0])
+	}
+
+	// and it is kept over a reconnect
+	a.conn.Close()
+	b.event(EventDisconnected, nil)
+	back := ts.dial(t, "/game?token="+a.welcome.Token+"&color="+url.QueryEscape("#123456"))
+	ts.tick(1)
+	back.keyframe()
+	if got := back.me().Color; got != "#ff8800" {
+		t.Fatalf("resumed with %s, want #ff8800", got)
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// ClientMessage is the envelope for everything a client sends
+type ClientMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+const (
+	MessageInput = "input"
+	MessageReady = "ready"
+	MessageKick  = "kick"
+	// asks for a keyframe, after a gap in snapshot seqs
+	MessageResync = "resync"
+	// answered straight away with a pong event
+	MessagePing = "ping"
+	// answered straight away with a time_sync event, see TimeSyncEvent
+	MessageTimeSync = "time_sync"
+	// moves the sender to the other team, see Room.switchTeam
+	MessageSwitchTeam = "switch_team"
+	// freeze and unfreeze the match, host only, see Room.applyPause
+	MessagePause  = "pause"
+	MessageResume = "resume"
+)
+
+// InputMessage is the data of an input message. A client predicting its own
+// movement numbers its inputs from 1 and gets the highest one applied back
+// as last_input_seq in its snapshots. Gamepad and touch clients send Move
+// instead of, or as well as, held directions, and Aim turns the player to
+// face an angle in radians. A client sampling faster than it wants to send
+// can put several frames in Frames instead, oldest first.
+type InputMessage struct {
+	Seq    int          `json:"seq"`
+	Inputs []string     `json:"inputs"`
+	Move   *sim.Vector  `json:"move,omitempty"`
+	Shoot  *sim.Vector  `json:"shoot,omitempty"`
+	Aim    *float64     `json:"aim,omitempty"`
+	Frames []InputFrame `json:"frames,omitempty"`
+}
+
+// InputFrame is one frame of a batched input message, T being the client's
+// clock in ms when it was sampled
+type InputFrame struct {
+	Seq    int         `json:"seq"`
+	T      int64       `json:"t"`
+	Inputs []string    `json:"inputs"`
+	Move   *sim.Vector `json:"move,omitempty"`
+	Shoot  *sim.Vector `json:"shoot,omitempty"`
+	Aim    *float64    `json:"aim,omitempty"`
+}
+
+// KickMessage is the data of a kick message, which only the host may send
+type KickMessage struct {
+	PlayerID string `json:"player_id"`
+}
+
+// PingMessage is the data of a ping message, with the client's clock in ms
+type PingMessage struct {
+	T int64 `json:"t"`
+}
+
+// TimeSyncMessage is the data of a time_sync message, with the client's clock
+// when it was sent
+type TimeSyncMessage struct {
+	ClientTime int64 `json:"client_time"`
+}
+
+// ReadyMessage is the optional data of a ready message; without it the sender
+// is ready
+type ReadyMessage struct {
+	Ready bool `json:"ready"`
+}
+
+// error codes reported back to clients
+const (
+	ErrBadMessage  = "bad_message"
+	ErrUnknownType = "unknown_type"
+	ErrBadInput    = "bad_input"
+	ErrSpectating  = "spectating"
+	ErrNotHost     = "not_host"
+	ErrBadKick     = "bad_kick"
+	ErrRateLimited = "rate_limited"
+	ErrBatchSize   = "batch_too_large"
+	ErrTooLarge    = "too_large"
+	ErrNoTeams     = "no_teams"
+	ErrUnbalanced  = "unbalanced"
+	ErrBadPause    = "bad_pause"
+)
+
+// RouteError is a problem with a client message that is reported back to the
+// client
+type RouteError struct {
+	Code   string
+	Detail string
+}
+
+func (e *RouteError) Error() string {
+	return e.Code + ": " + e.Detail
+}
+
+// Strike reports whether the error counts against the client, meaning it
+// sent something no well behaved client would. The connection is closed
+// once it has MaxStrikes of them; other route errors are only reported.
+func (e *RouteError) Strike() bool {
+	switch e.Code {
+	case ErrBadMessage, ErrUnknownType, ErrBadInput, ErrBatchSize, ErrTooLarge:
+		return true
+	}
+	return false
+}
+
+type MessageHandler func(data json.RawMessage) error
+
+// Router dispatches client messages to a handler by their type
+type Router struct {
+	handlers map[string]MessageHandler
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: map[string]MessageHandler{}}
+}
+
+func (r *Router) Handle(msgType string, h MessageHandler) {
+	r.handlers[msgType] = h
+}
+
+// Dispatch decodes a raw frame and runs the handler for its type. A bare
+// JSON array is the old input format and is treated as an input message.
+func (r *Router) Dispatch(raw []byte) error {
+	var msg ClientMessage
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		// TODO drop the bare array format after the next release
+		data, err := json.Marshal(struct {
+			Inputs json.RawMessage `json:"inputs"`
+		}{trimmed})
+		if err != nil {
+			return &RouteError{ErrBadMessage, err.Error()}
+		}
+		msg = ClientMessage{Type: MessageInput, Data: data}
+	} else if err := json.Unmarshal(raw, &msg); err != nil {
+		return &RouteError{ErrBadMessage, err.Error()}
+	}
+
+	h, ok := r.handlers[msg.Type]
+	if !ok {
+		return &RouteError{ErrUnknownType, fmt.Sprintf("unknown message type %q", msg.Type)}
+	}
+	return h(msg.Data)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// recorder is a router with a handler for every message type that records
+// what it was given
+type recorder struct {
+	*Router
+	typ  string
+	data string
+}
+
+func newRecorder() *recorder {
+	r := &recorder{Router: NewRouter()}
+	for _, typ := range []string{MessageInput, MessageReady, MessageKick, MessageResync, MessagePing, MessageTimeSync, MessageSwitchTeam, MessagePause, MessageResume} {
+		typ := typ
+		r.Handle(typ, func(data json.RawMessage) error {
+			r.typ, r.data = typ, string(data)
+			return nil
+		})
+	}
+	return r
+}
+
+func TestRouterDispatch(t *testing.T) {
+	tests := []struct {
+		raw  string
+		typ  string
+		data string
+	}{
+		{`{"type":"input","data":{"inputs":["up"]}}`, MessageInput, `{"inputs":["up"]}`},
+		{`{"type":"ready"}`, MessageReady, ``},
+		{`{"type":"ready","data":{"ready":false}}`, MessageReady, `{"ready":false}`},
+		{`{"type":"kick","data":{"player_id":"a"}}`, MessageKick, `{"player_id":"a"}`},
+		{`{"type":"resync"}`, MessageResync, ``},
+		{`{"type":"ping","data":{"t":12}}`, MessagePing, `{"t":12}`},
+		{`{"type":"time_sync","data":{"client_time":12}}`, MessageTimeSync, `{"client_time":12}`},
+		{`{"type":"switch_team"}`, MessageSwitchTeam, ``},
+		{`{"type":"pause"}`, MessagePause, ``},
+		{`{"type":"resume"}`, MessageResume, ``},
+		// the old format, a bare array of held directions
+		{`["up","left"]`, MessageInput, `{"inputs":["up","left"]}`},
+		{`  []`, MessageInput, `{"inputs":[]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			r := newRecorder()
+			if err := r.Dispatch([]byte(tt.raw)); err != nil {
+				t.Fatal(err)
+			}
+			if r.typ != tt.typ || r.data != tt.data {
+				t.Fatalf("dispatched %s with %s, want %s with %s", r.typ, r.data, tt.typ, tt.data)
+			}
+		})
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	tests := []struct {
+		raw  string
+		code string
+	}{
+		{`{"type":"chat","data":"hi"}`, ErrUnknownType},
+		{`{}`, ErrUnknownType},
+		{`{"type":`, ErrBadMessage},
+		{``, ErrBadMessage},
+		{`"input"`, ErrBadMessage},
+		{`{"type":5}`, ErrBadMessage},
+		{`["up"`, ErrBadMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			r := newRecorder()
+			var re *RouteError
+			if err := r.Dispatch([]byte(tt.raw)); !errors.As(err, &re) || re.Code != tt.code {
+				t.Fatalf("got %v, want a %s route error", err, tt.code)
+			}
+			if !re.Strike() {
+				t.Fatal("no strike for a malformed message")
+			}
+			if r.typ != "" {
+				t.Fatalf("dispatched to %s", r.typ)
+			}
+		})
+	}
+}
+
+func TestRouterHandlerError(t *testing.T) {
+	r := NewRouter()
+	failed := errors.New("failed")
+	r.Handle(MessagePing, func(json.RawMessage) error { return failed })
+	if err := r.Dispatch([]byte(`{"type":"ping"}`)); err != failed {
+		t.Fatalf("got %v, want the handler's error", err)
+	}
+}
+
+func TestUnknownMessageReported(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	c := ts.dial(t, "/game")
+	c.send("chat", "hi")
+	if e := c.errorMessage(); e.Code != ErrUnknownType {
+		t.Fatalf("got %+v, want %s", e, ErrUnknownType)
+	}
+	c.write("not an envelope")
+	if e := c.errorMessage(); e.Code != ErrBadMessage {
+		t.Fatalf("got %+v, want %s", e, ErrBadMessage)
+	}
+	// still connected
+	c.sync()
+}
+
+func TestGarbageThenMovement(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) { cfg.MaxStrikes = 10 })
+	c := ts.match(t, "/game", 1)[0]
+	for _, tt := range []struct {
+		frame []byte
+		code  string
+	}{
+		{[]byte("{not json"), ErrBadMessage},
+		{[]byte(`{"type":"chat","data":"hi"}`), ErrUnknownType},
+		{[]byte(`{"type":"input","data":{"inputs":"right"}}`), ErrBadInput},
+		{[]byte(`{"type":"input","data":{"seq":-1}}`), ErrBadInput},
+		{bytes.Repeat([]byte(" "), ts.cfg.MaxMessageSize+1), ErrTooLarge},
+	} {
+		if err := c.conn.WriteMessage(websocket.TextMessage, tt.frame); err != nil {
+			t.Fatal(err)
+		}
+		if e := c.errorMessage(); e.Code != tt.code || e.Detail == "" {
+			t.Fatalf("%.20q: got %+v, want %s", tt.frame, e, tt.code)
+		}
+	}
+	// still in the game
+	x := c.me().X
+	c.input("right")
+	c.sync()
+	ts.tick(1)
+	c.snapshot()
+	if c.me().X <= x {
+		t.Fatal("didn't move after the bad messages")
+	}
+}
+
+func TestStrikesClose(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) { cfg.MaxStrikes = 3 })
+	c := ts.match(t, "/game", 1)[0]
+	// refusals that aren't the client's fault don't count
+	for i := 0; i < 5; i++ {
+		c.send(MessageKick, KickMessage{PlayerID: c.welcome.ID})
+		if e := c.errorMessage(); e.Code != ErrBadKick {
+			t.Fatalf("got %+v, want %s", e, ErrBadKick)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		c.send("chat", "hi")
+		if e := c.errorMessage(); e.Code != ErrUnknownType {
+			t.Fatalf("got %+v, want %s", e, ErrUnknownType)
+		}
+	}
+	if code := c.closeCode(); code != CloseTooManyStrikes {
+		t.Fatalf("closed with %d, want %d", code, CloseTooManyStrikes)
+	}
+}
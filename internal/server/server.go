@@ -0,0 +1,951 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/broker"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/clock"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/registry"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+	"github.com/stevenwhitehead/multiplayer-backend/internal/store"
+)
+
+// the most rooms a single GET /rooms returns
+const maxListedRooms = 100
+
+// largest POST /rooms body accepted
+const maxSettingsBody = 4096
+
+// matchmaking requests are held open, so MatchMaxWait has to fit inside this
+const httpWriteTimeout = 10 * time.Second
+
+// Counters are running totals of events worth keeping an eye on
+type Counters struct {
+	// inputs dropped because their player id is missing or no longer in gamestate
+	UnknownPlayerInputs uint64
+	// inputs coalesced or dropped because the event queue was full
+	DroppedInputs uint64
+	// payloads on the input channel that could not be decoded
+	MalformedInputs uint64
+	// inputs that could not be published to the broker
+	PublishFailures uint64
+	// number of times the broker subscription had to be re-established
+	PubsubReconnects uint64
+	// ticks that panicked and were recovered
+	TickPanics uint64
+	// ticks whose broadcast dispatch took longer than the tick interval
+	SlowBroadcasts uint64
+	// player saves dropped because the store fell behind
+	DroppedSaves uint64
+	// ticks of leaderboard points dropped because the leaderboard fell behind
+	DroppedScores uint64
+	// room checkpoints dropped because the checkpoint store fell behind
+	DroppedCheckpoints uint64
+	// match records dropped because the match history fell behind
+	DroppedMatches uint64
+}
+
+// Server hosts the game rooms: it accepts websocket players, fans their inputs
+// out through the broker and each room broadcasts its simulated state every
+// tick.
+type Server struct {
+	// updated atomically, kept first for alignment
+	counters Counters
+
+	cfg      Config
+	broker   broker.Broker
+	registry registry.Registry
+
+	upgrader websocket.Upgrader
+
+	// live public rooms by name and private rooms by join code; roomCtx is
+	// nil while the server isn't serving
+	roomsLock sync.Mutex
+	rooms     map[string]*Room
+	private   map[string]*Room
+	roomCtx   context.Context
+
+	matchmaker Matchmaker
+
+	// running game handlers, waited on during shutdown
+	handlers sync.WaitGroup
+
+	// fatal errors from background goroutines; the first one stops Serve
+	errs chan error
+
+	// player saves waiting for cfg.Players, nil without one, and closed
+	// once runSaves has written the last of them
+	saves     chan playerSave
+	savesDone chan struct{}
+	// the same for score batches waiting for cfg.Leaderboard
+	scores     chan scoreBatch
+	scoresDone chan struct{}
+	// and for room checkpoints waiting for cfg.Checkpoints
+	checkpoints     chan checkpointSave
+	checkpointsDone chan struct{}
+	// and for match records waiting for cfg.Matches
+	matches     chan MatchRecord
+	matchesDone chan struct{}
+}
+
+// NewServer creates a server fanning inputs out through broker. A nil broker
+// runs in local single-process mode. With a registry, public rooms are hosted
+// by whichever instance claims them first and players asking another
+// instance are redirected; without one every instance hosts its own.
+func NewServer(cfg Config, b broker.Broker, reg registry.Registry) *Server {
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real()
+	}
+	if cfg.Seed == nil {
+		cfg.Seed = func(string) int64 { return time.Now().UnixNano() }
+	}
+	s := &Server{
+		cfg:      cfg,
+		broker:   b,
+		registry: reg,
+		upgrader: websocket.Upgrader{
+			Subprotocols:      []string{MsgpackProtocol, ProtobufProtocol},
+			EnableCompression: cfg.CompressionLevel != flate.NoCompression,
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		rooms:   map[string]*Room{},
+		private: map[string]*Room{},
+		errs:    make(chan error, 1),
+	}
+	if cfg.Players != nil {
+		s.saves = make(chan playerSave, maxPendingSaves)
+		s.savesDone = make(chan struct{})
+	}
+	if cfg.Leaderboard != nil {
+		s.scores = make(chan scoreBatch, maxPendingScores)
+		s.scoresDone = make(chan struct{})
+	}
+	// without a registry instances may host the same room side by side
+	if cfg.Checkpoints != nil && cfg.CheckpointTicks > 0 && reg != nil {
+		s.checkpoints = make(chan checkpointSave, maxPendingCheckpoints)
+		s.checkpointsDone = make(chan struct{})
+	}
+	if cfg.Matches != nil {
+		s.matches = make(chan MatchRecord, maxPendingMatches)
+		s.matchesDone = make(chan struct{})
+	}
+	s.matchmaker = newLocalMatchmaker(cfg.MatchSize, cfg.MatchMaxWait, cfg.Clock, func() (string, error) {
+		room, err := s.createPrivateRoom(s.cfg.RoomSettings())
+		if err != nil {
+			return "", err
+		}
+		return room.code, nil
+	})
+	return s
+}
+
+// Counters returns a copy of the server's counters
+func (s *Server) Counters() Counters {
+	return Counters{
+		UnknownPlayerInputs: atomic.LoadUint64(&s.counters.UnknownPlayerInputs),
+		DroppedInputs:       atomic.LoadUint64(&s.counters.DroppedInputs),
+		MalformedInputs:     atomic.LoadUint64(&s.counters.MalformedInputs),
+		PublishFailures:     atomic.LoadUint64(&s.counters.PublishFailures),
+		PubsubReconnects:    atomic.LoadUint64(&s.counters.PubsubReconnects),
+		TickPanics:          atomic.LoadUint64(&s.counters.TickPanics),
+		SlowBroadcasts:      atomic.LoadUint64(&s.counters.SlowBroadcasts),
+		DroppedSaves:        atomic.LoadUint64(&s.counters.DroppedSaves),
+		DroppedScores:       atomic.LoadUint64(&s.counters.DroppedScores),
+		DroppedCheckpoints:  atomic.LoadUint64(&s.counters.DroppedCheckpoints),
+		DroppedMatches:      atomic.LoadUint64(&s.counters.DroppedMatches),
+	}
+}
+
+// Handler returns the http handler serving the health check, /game, /rooms
+// and /matchmake
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleHome)
+	mux.HandleFunc("/game", s.handleGame)
+	mux.HandleFunc("/rooms", s.handleRooms)
+	mux.HandleFunc("/rooms/", s.handleRoomStats)
+	mux.HandleFunc("/matchmake", s.handleMatchmake)
+	mux.HandleFunc("/maps", s.handleMaps)
+	mux.HandleFunc("/leaderboard", s.handleLeaderboard)
+	mux.HandleFunc("/leaderboard/", s.handleLeaderboard)
+	mux.HandleFunc("/matches", s.handleMatches)
+	mux.HandleFunc("/matches/", s.handleMatches)
+	return mux
+}
+
+// Run listens on the configured address and serves until ctx is canceled
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", s.cfg.ListenAddr, err)
+	}
+	log.Println("listening on", ln.Addr())
+	return s.Serve(ctx, ln)
+}
+
+// Serve runs the game on ln until ctx is canceled, then shuts down
+// gracefully. It returns once every goroutine it started, including the
+// per-connection ones, has stopped.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	// canceling ctx stops every room and its broker subscription straight
+	// away; a join racing with that is turned away
+	loopCtx, stopLoops := context.WithCancel(ctx)
+	defer stopLoops()
+	s.roomsLock.Lock()
+	s.roomCtx = loopCtx
+	s.roomsLock.Unlock()
+
+	switch s.broker.(type) {
+	case nil:
+		log.Println("broker mode: local, inputs are applied in-process")
+	case *broker.StreamBroker:
+		log.Println("broker mode: streams")
+	default:
+		log.Println("broker mode: pub/sub")
+	}
+
+	if s.saves != nil {
+		go s.runSaves()
+	}
+	if s.scores != nil {
+		go s.runScores()
+	}
+	if s.checkpoints != nil {
+		go s.runCheckpoints()
+	}
+	if s.matches != nil {
+		go s.runMatches()
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+	case err := <-serveErr:
+		s.shutdown(srv, stopLoops)
+		return fmt.Errorf("serving http: %w", err)
+	case err := <-s.errs:
+		log.Println("shutting down:", err)
+		s.shutdown(srv, stopLoops)
+		return err
+	}
+	s.shutdown(srv, stopLoops)
+	return nil
+}
+
+// shutdown stops accepting connections, halts every room's tick loop and
+// broker subscription, then sends every client its room's final snapshot and
+// a close frame.
+// Clients that haven't been closed within the drain timeout are disconnected
+// forcibly.
+func (s *Server) shutdown(srv *http.Server, stopLoops func()) {
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), s.cfg.DrainTimeout)
+	defer cancelDrain()
+
+	// stop the rooms first so held matchmaking requests give up rather than
+	// keep srv.Shutdown waiting
+	stopLoops()
+	err := srv.Shutdown(drainCtx)
+	if err != nil {
+		log.Println("http shutdown error:", err)
+	}
+
+	s.roomsLock.Lock()
+	rooms := make([]*Room, 0, len(s.rooms)+len(s.private))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	for _, room := range s.private {
+		rooms = append(rooms, room)
+	}
+	s.rooms = map[string]*Room{}
+	s.private = map[string]*Room{}
+	s.roomCtx = nil
+	s.roomsLock.Unlock()
+
+	// the room goroutines have exited, so their state is ours now
+	clients := []*client{}
+	for _, room := range rooms {
+		<-room.done
+		room.broadcast()
+		for _, c := range room.clients {
+			clients = append(clients, c)
+			if c.resume != "" {
+				room.savePlayer(c.resume, c.id)
+			}
+		}
+		// so whichever instance gets the players back picks up the match
+		room.saveCheckpoint()
+	}
+	if s.saves != nil {
+		close(s.saves)
+		<-s.savesDone
+	}
+	if s.scores != nil {
+		close(s.scores)
+		<-s.scoresDone
+	}
+	if s.checkpoints != nil {
+		close(s.checkpoints)
+		<-s.checkpointsDone
+	}
+	if s.matches != nil {
+		close(s.matches)
+		<-s.matchesDone
+	}
+	for _, c := range clients {
+		c.close(CloseShutdown)
+	}
+	drained := make(chan struct{})
+	go func() {
+		for _, c := range clients {
+			<-c.exited
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-drainCtx.Done():
+		log.Println("drain timeout, dropping remaining connections")
+		for _, c := range clients {
+			c.conn.Close()
+		}
+	}
+	s.handlers.Wait()
+	log.Println("shutdown complete")
+}
+
+func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// handleRooms lists the live public rooms by name, at most maxListedRooms at
+// a time; ?offset= pages through the rest. A POST creates a private room
+// instead.
+func (s *Server) handleRooms(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		s.handleCreateRoom(w, r)
+		return
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	rooms := s.listRooms()
+	if offset > len(rooms) {
+		offset = len(rooms)
+	}
+	rooms = rooms[offset:]
+	if len(rooms) > maxListedRooms {
+		rooms = rooms[:maxListedRooms]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms)
+}
+
+// handleCreateRoom starts a private room and replies with its join code and
+// settings. The body may hold RoomSettings; anything left out keeps the
+// default of the map it picks, or of the server.
+func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSettingsBody))
+	if err != nil {
+		http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the map first, since the rest of the body overrides its defaults;
+	// a body that doesn't parse fails the decode below instead
+	settings := s.cfg.RoomSettings()
+	var pick struct {
+		Map *string `json:"map"`
+	}
+	if json.Unmarshal(body, &pick) == nil && pick.Map != nil {
+		settings, err = s.cfg.MapSettings(*pick.Map)
+		if err != nil {
+			http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&settings)
+	if err != nil && err != io.EOF {
+		http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = settings.Validate(s.cfg)
+	if err != nil {
+		http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	room, err := s.createPrivateRoom(settings)
+	if err == errServerStopped {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println("create room:", err)
+		http.Error(w, "cannot create room", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Code     string       `json:"code"`
+		Settings RoomSettings `json:"settings"`
+	}{room.code, room.settings})
+}
+
+// handleMatchmake holds the request open until the caller has been matched,
+// then replies with the join code of its room. Hanging up leaves the queue.
+func (s *Server) handleMatchmake(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.roomsLock.Lock()
+	roomCtx := s.roomCtx
+	s.roomsLock.Unlock()
+	if roomCtx == nil {
+		http.Error(w, errServerStopped.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-roomCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	code, err := s.matchmaker.Wait(ctx)
+	if r.Context().Err() != nil {
+		return
+	}
+	if err == errServerStopped || roomCtx.Err() != nil {
+		http.Error(w, errServerStopped.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println("matchmake:", err)
+		http.Error(w, "cannot create room", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Code string `json:"code"`
+	}{code})
+}
+
+// MapInfo is a map as GET /maps lists it, its size filled in
+type MapInfo struct {
+	Name string `json:"name"`
+	Map
+}
+
+// handleMaps lists the maps private rooms may pick, by name
+func (s *Server) handleMaps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	maps := make([]MapInfo, 0, len(s.cfg.Maps))
+	for _, name := range s.cfg.mapNames() {
+		m := s.cfg.Maps[name]
+		m.Width, m.Height = m.size(s.cfg.WorldWidth, s.cfg.WorldHeight)
+		maps = append(maps, MapInfo{name, m})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maps)
+}
+
+// listRooms returns every live room sorted by name
+func (s *Server) listRooms() []RoomInfo {
+	s.roomsLock.Lock()
+	rooms := make([]RoomInfo, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room.info())
+	}
+	s.roomsLock.Unlock()
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms
+}
+
+func (s *Server) handleGame(w http.ResponseWriter, r *http.Request) {
+	s.handlers.Add(1)
+	defer s.handlers.Done()
+
+	log.Println("user connected:", r.URL.User)
+	// rooms are looked up again after the upgrade since a private one may
+	// expire in between
+	var lookup func() (*Room, error)
+	name := r.URL.Query().Get("room")
+	code := r.URL.Query().Get("code")
+	switch {
+	case code != "" && name != "":
+		http.Error(w, "give either a room or a code, not both", http.StatusBadRequest)
+		return
+	case code != "":
+		_, err := s.privateRoom(code)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		lookup = func() (*Room, error) { return s.privateRoom(code) }
+	default:
+		if name == "" {
+			name = DefaultRoom
+		}
+		if !ValidRoomName(name) {
+			http.Error(w, "invalid room name", http.StatusBadRequest)
+			return
+		}
+		lookup = func() (*Room, error) { return s.room(name) }
+	}
+	spectate := false
+	switch r.URL.Query().Get("mode") {
+	case "", "player":
+	case "spectator":
+		spectate = true
+	default:
+		http.Error(w, "mode must be player or spectator", http.StatusBadRequest)
+		return
+	}
+	color := r.URL.Query().Get("color")
+	if color != "" && !sim.ValidColor(color) {
+		http.Error(w, "color must be a hex color like #ff8800", http.StatusBadRequest)
+		return
+	}
+	encoding := r.URL.Query().Get("encoding")
+	switch encoding {
+	case "":
+		encoding = EncodingJSON
+	case EncodingJSON, EncodingBinary, EncodingMsgpack, EncodingProtobuf:
+	default:
+		http.Error(w, "encoding must be json, binary, msgpack or protobuf", http.StatusBadRequest)
+		return
+	}
+	declared := r.URL.Query().Get("protocol")
+	protocol, supported := negotiateProtocol(declared)
+	// the room is claimed last, so a request turned away doesn't hold it
+	claimed := code == "" && supported
+	if claimed && s.redirectElsewhere(w, r, name) {
+		return
+	}
+
+	c, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("upgrade:", err)
+		if claimed {
+			s.releaseUnhosted(name)
+		}
+		return
+	}
+	defer c.Close()
+	log.Println("websocket upgrade:", c.LocalAddr().String())
+	// a no-op unless the client negotiated compression
+	if err := c.SetCompressionLevel(s.cfg.CompressionLevel); err != nil {
+		log.Println("compression level:", err)
+	}
+
+	cl := newClient(s, c)
+	cl.spectator = spectate
+	cl.resume = r.URL.Query().Get("token")
+	if cl.resume != "" && s.cfg.Players != nil {
+		// read here, so the room goroutine never waits on the store
+		saved, ok, err := s.cfg.Players.Load(r.Context(), cl.resume)
+		cl.rotated = errors.Is(err, store.ErrRotated)
+		if err != nil && !cl.rotated {
+			log.Println("player load:", err)
+		}
+		if ok {
+			cl.saved = &saved
+		}
+		cl.unknown = err == nil && !ok
+	}
+	cl.color = color
+	cl.name = r.URL.Query().Get("name")
+	cl.legacy = r.URL.Query().Get("format") == "bare"
+	cl.encoding = encoding
+	switch c.Subprotocol() {
+	case MsgpackProtocol:
+		cl.encoding = EncodingMsgpack
+	case ProtobufProtocol:
+		cl.encoding = EncodingProtobuf
+	}
+	if !supported {
+		cl.reject(CloseUnsupportedProtocol, ErrUnsupportedProtocol, unsupportedProtocol(declared))
+		return
+	}
+	cl.protocol = protocol
+	id, room, err := s.join(lookup, cl)
+	if err != nil {
+		cl.abort(closeCode(err))
+		return
+	}
+	log.Println("player", id, "joined room", room.name)
+	cl.keepalive()
+	go cl.writePump()
+	// why the connection ended, once the read loop below has returned
+	reason := LeaveDisconnect
+	// and the close code to send, if nothing else closed it first
+	closeWith := websocket.CloseNormalClosure
+	defer func() {
+		room.leave(cl, reason)
+		cl.close(closeWith)
+		<-cl.exited
+	}()
+
+	router := NewRouter()
+	router.Handle(MessageInput, func(data json.RawMessage) error {
+		if cl.spectator {
+			return &RouteError{ErrSpectating, "spectators can't move"}
+		}
+		var msg InputMessage
+		err := json.Unmarshal(data, &msg)
+		if err != nil {
+			return &RouteError{ErrBadInput, err.Error()}
+		}
+		batch, err := s.inputBatch(id, msg)
+		if err != nil {
+			return err
+		}
+		return s.publishInput(r.Context(), room, batch)
+	})
+
+	router.Handle(MessageReady, func(data json.RawMessage) error {
+		if cl.spectator {
+			return &RouteError{ErrSpectating, "spectators can't ready up"}
+		}
+		msg := ReadyMessage{Ready: true}
+		if len(data) > 0 {
+			err := json.Unmarshal(data, &msg)
+			if err != nil {
+				return &RouteError{ErrBadMessage, err.Error()}
+			}
+		}
+		room.setReady(cl, msg.Ready)
+		return nil
+	})
+
+	router.Handle(MessageResync, func(json.RawMessage) error {
+		now := s.cfg.Clock.Now()
+		if now.Sub(cl.lastResync) < minResyncInterval {
+			return &RouteError{ErrRateLimited, "resync asked for too often"}
+		}
+		cl.lastResync = now
+		room.requestResync(cl)
+		return nil
+	})
+
+	router.Handle(MessagePing, func(data json.RawMessage) error {
+		received := s.cfg.Clock.Now().UnixNano() / int64(time.Millisecond)
+		var msg PingMessage
+		err := json.Unmarshal(data, &msg)
+		if err != nil {
+			return &RouteError{ErrBadMessage, err.Error()}
+		}
+		cl.deliver(encode(MessageEvent, PongEvent{Kind: EventPong, T: msg.T, ServerTimeMS: received}))
+		return nil
+	})
+
+	// answered here on the read goroutine, never queued for the room
+	router.Handle(MessageTimeSync, func(data json.RawMessage) error {
+		received := s.cfg.Clock.Now().UnixNano() / int64(time.Millisecond)
+		var msg TimeSyncMessage
+		err := json.Unmarshal(data, &msg)
+		if err != nil {
+			return &RouteError{ErrBadMessage, err.Error()}
+		}
+		cl.deliver(encode(MessageEvent, TimeSyncEvent{
+			Kind:            EventTimeSync,
+			ClientTime:      msg.ClientTime,
+			ServerReceiveMS: received,
+			ServerSendMS:    s.cfg.Clock.Now().UnixNano() / int64(time.Millisecond),
+		}))
+		return nil
+	})
+
+	router.Handle(MessageKick, func(data json.RawMessage) error {
+		var msg KickMessage
+		err := json.Unmarshal(data, &msg)
+		if err != nil {
+			return &RouteError{ErrBadMessage, err.Error()}
+		}
+		return room.kick(cl, msg.PlayerID)
+	})
+
+	router.Handle(MessagePause, func(json.RawMessage) error {
+		return room.setPaused(cl, true)
+	})
+
+	router.Handle(MessageResume, func(json.RawMessage) error {
+		return room.setPaused(cl, false)
+	})
+
+	router.Handle(MessageSwitchTeam, func(json.RawMessage) error {
+		if cl.spectator {
+			return &RouteError{ErrSpectating, "spectators aren't on a team"}
+		}
+		return room.switchTeam(cl)
+	})
+
+	strikes := 0
+	for {
+		message, err := s.readMessage(c)
+		if err != nil && !errors.Is(err, errTooLarge) {
+			log.Println("read:", err)
+			// the read deadline only runs out when pongs stop coming
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				reason = LeaveIdle
+				closeWith = CloseIdle
+			}
+			return
+		}
+		switch {
+		case err != nil:
+		case cl.encoding == EncodingMsgpack:
+			message, err = unpack(message)
+		case cl.encoding == EncodingProtobuf:
+			message, err = clientMessageFromProto(message)
+		}
+		switch {
+		case errors.Is(err, errTooLarge):
+			err = &RouteError{ErrTooLarge, fmt.Sprintf("messages may be at most %d bytes", s.cfg.MaxMessageSize)}
+		case err != nil:
+			err = &RouteError{ErrBadMessage, err.Error()}
+		default:
+			err = router.Dispatch(message)
+		}
+		var re *RouteError
+		if errors.As(err, &re) {
+			cl.sendError(re.Code, re.Detail)
+			if re.Strike() {
+				strikes++
+			}
+			if strikes >= s.cfg.MaxStrikes {
+				log.Println("too many bad messages from player", id+", last:", err)
+				closeWith = CloseTooManyStrikes
+				return
+			}
+			continue
+		}
+		if errors.Is(err, errRoomClosed) {
+			// the room shut down under a host or team action
+			closeWith = CloseShutdown
+			return
+		}
+		if err != nil {
+			log.Printf("err: %s", err.Error())
+			closeWith = CloseInternalError
+			return
+		}
+	}
+}
+
+var errTooLarge = errors.New("message too large")
+
+// readMessage reads the next message from c. One longer than MaxMessageSize
+// is read to the end and thrown away, returning errTooLarge, so the
+// connection stays usable.
+func (s *Server) readMessage(c *websocket.Conn) ([]byte, error) {
+	_, r, err := c.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	message, err := ioutil.ReadAll(io.LimitReader(r, int64(s.cfg.MaxMessageSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(message) > s.cfg.MaxMessageSize {
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return nil, err
+		}
+		return nil, errTooLarge
+	}
+	return message, nil
+}
+
+// fail hands a fatal error to Serve. Only the first one is kept.
+func (s *Server) fail(err error) {
+	select {
+	case s.errs <- err:
+	default:
+		log.Println("dropping error, already shutting down:", err)
+	}
+}
+
+// join adds c to the room returned by lookup. A room that closes between
+// lookup and join is looked up again, which starts a fresh public room or
+// reports an expired join code.
+func (s *Server) join(lookup func() (*Room, error), c *client) (string, *Room, error) {
+	for {
+		room, err := lookup()
+		if err != nil {
+			return "", nil, err
+		}
+		id, err := room.join(c)
+		if err == errRoomClosed {
+			continue
+		}
+		return id, room, err
+	}
+}
+
+// room returns the named room, starting it if needed
+func (s *Server) room(name string) (*Room, error) {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+	if !s.serving() {
+		return nil, errServerStopped
+	}
+	room, ok := s.rooms[name]
+	if ok {
+		// empty rooms leave the map before closing, so this one was stopped
+		// by a fatal error and the server is on its way down
+		select {
+		case <-room.done:
+			return nil, errServerStopped
+		default:
+		}
+	} else {
+		room = newRoom(s, name, s.cfg.RoomSettings())
+		s.rooms[name] = room
+		room.start(s.roomCtx)
+		log.Println("room created:", name)
+	}
+	return room, nil
+}
+
+// privateRoom returns the private room with the given join code
+func (s *Server) privateRoom(code string) (*Room, error) {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+	if !s.serving() {
+		return nil, errServerStopped
+	}
+	room, ok := s.private[code]
+	if !ok {
+		return nil, errUnknownCode
+	}
+	select {
+	case <-room.done:
+		return nil, errServerStopped
+	default:
+	}
+	return room, nil
+}
+
+// createPrivateRoom starts a private room under a fresh join code
+func (s *Server) createPrivateRoom(settings RoomSettings) (*Room, error) {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+	if !s.serving() {
+		return nil, errServerStopped
+	}
+	for {
+		code, err := newJoinCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, taken := s.private[code]; taken {
+			continue
+		}
+		room := newPrivateRoom(s, code, settings)
+		s.private[code] = room
+		room.start(s.roomCtx)
+		log.Println("private room created:", code)
+		return room, nil
+	}
+}
+
+// serving reports whether rooms may be started. roomsLock must be held.
+func (s *Server) serving() bool {
+	return s.roomCtx != nil && s.roomCtx.Err() == nil
+}
+
+// closeRoom forgets an empty room so the next join starts a fresh one, or for
+// a private room expires its join code. A join already waiting on the old
+// room fails with errRoomClosed and looks it up again.
+func (s *Server) closeRoom(r *Room) {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+	rooms := s.rooms
+	key := r.name
+	if r.code != "" {
+		rooms = s.private
+		key = r.code
+	}
+	if rooms[key] == r {
+		delete(rooms, key)
+		log.Println("room closed:", r.name)
+	}
+}
+
+// publishInput sends an input to every instance through the room's broker
+// channel, or straight into its event queue when running without one. Only
+// encoding errors are returned; publish failures are logged and counted.
+func (s *Server) publishInput(ctx context.Context, room *Room, input inputBatch) error {
+	if s.broker == nil {
+		room.enqueueInputs(input.frames())
+		return nil
+	}
+	payload, err := s.encodeInput(input)
+	if err != nil {
+		return err
+	}
+	err = s.broker.Publish(ctx, room.channel, payload)
+	if err != nil {
+		atomic.AddUint64(&s.counters.PublishFailures, 1)
+		log.Println("publish error for player", input.PlayerID+":", err)
+	}
+	return nil
+}
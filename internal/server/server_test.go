@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownClosesClients(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := []*testClient{ts.dial(t, "/game"), ts.dial(t, "/game?mode=spectator")}
+	if err := ts.stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients {
+		// everything has been sent by the time stop returns
+		var last envelope
+		for m := range c.in {
+			json.Unmarshal(m.data, &last)
+		}
+		if last.Type != MessageSnapshot {
+			t.Fatalf("last message before closing was a %s, want the final snapshot", last.Type)
+		}
+		var ce *websocket.CloseError
+		if !errors.As(c.err, &ce) || ce.Code != CloseShutdown {
+			t.Fatalf("closed with %v, want %d", c.err, CloseShutdown)
+		}
+	}
+}
+
+func TestTwoServersInOneProcess(t *testing.T) {
+	brokers := []*fakeBroker{newFakeBroker(), newFakeBroker()}
+	servers := []*testServer{startServer(t, brokers[0], nil), startServer(t, brokers[1], nil)}
+	var clients []*testClient
+	for _, ts := range servers {
+		clients = append(clients, ts.match(t, "/game", 1)[0])
+	}
+	still := clients[1].me()
+
+	clients[0].input("right")
+	if !moves(servers[0], clients[0], clients[0].welcome.ID) {
+		t.Fatal("player didn't move")
+	}
+	servers[1].tick(1)
+	clients[1].snapshot()
+	if p := clients[1].me(); p.X != still.X || p.Y != still.Y {
+		t.Fatalf("the other server's player moved to %v,%v", p.X, p.Y)
+	}
+	if n := len(brokers[1].inputs(t)); n != 0 {
+		t.Fatalf("%d inputs published on the other server's broker", n)
+	}
+}
+
+func TestRestartLeaksNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 2; i++ {
+		b := newFakeBroker()
+		ts := startServer(t, b, nil)
+		clients := ts.match(t, "/game", 2)
+		clients = append(clients, ts.dial(t, "/game?mode=spectator"))
+		clients[0].input("right")
+		if !moves(ts, clients[0], clients[0].welcome.ID) {
+			t.Fatal("player didn't move")
+		}
+		if err := ts.stop(); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range clients {
+			for range c.in {
+			}
+			c.conn.Close()
+		}
+	}
+	var now int
+	for i := 0; i < 100; i++ {
+		if now = runtime.NumGoroutine(); now <= before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<16)
+	t.Fatalf("%d goroutines before, %d after stopping twice:\n%s", before, now, buf[:runtime.Stack(buf, true)])
+}
+
+// listed is the name, players, spectators and started flag of each room in
+// GET path
+func listed(t *testing.T, ts *testServer, path string) []string {
+	t.Helper()
+	var rooms []RoomInfo
+	ts.get(t, path, &rooms)
+	out := make([]string, len(rooms))
+	for i, r := range rooms {
+		out[i] = fmt.Sprintf("%s %d/%d %d %v", r.Name, r.Players, r.Max, r.Spectators, r.Started)
+	}
+	return out
+}
+
+func TestRoomList(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.ReconnectGrace = 0
+		cfg.EmptyRoomGrace = 3 * cfg.Tick
+	})
+	ts.match(t, "/game?room=playing", 2)
+	ts.dial(t, "/game?room=lobby")
+	ts.dial(t, "/game?room=lobby&mode=spectator")
+	ts.dial(t, "/game?room=watched&mode=spectator")
+	gone := ts.dial(t, "/game?room=gone")
+	ts.createRoom(t, nil)
+
+	want := []string{"gone 1/64 0 false", "lobby 1/64 1 false", "playing 2/64 0 true", "watched 0/64 1 false"}
+	if got := listed(t, ts, "/rooms"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("listed %v, want %v", got, want)
+	}
+	if got := listed(t, ts, "/rooms?offset=2"); !reflect.DeepEqual(got, want[2:]) {
+		t.Fatalf("listed %v from offset 2, want %v", got, want[2:])
+	}
+	if got := listed(t, ts, "/rooms?offset=10"); len(got) != 0 {
+		t.Fatalf("listed %v past the end", got)
+	}
+	for _, offset := range []string{"-1", "two"} {
+		if status, _ := ts.request(t, http.MethodGet, "/rooms?offset="+offset, nil); status != http.StatusBadRequest {
+			t.Fatalf("offset %s: %d, want %d", offset, status, http.StatusBadRequest)
+		}
+	}
+
+	// a room that was cleaned up is gone from the list
+	gone.conn.Close()
+	eventually(t, "the empty room to close", func() bool {
+		ts.tick(1)
+		return len(listed(t, ts, "/rooms")) == len(want)-1
+	})
+	if got := listed(t, ts, "/rooms"); !reflect.DeepEqual(got, want[1:]) {
+		t.Fatalf("listed %v, want %v", got, want[1:])
+	}
+}
+
+func TestRoomListCapped(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	// serving once it answers
+	ts.dial(t, "/game?room=room000")
+	for i := 0; i < maxListedRooms+5; i++ {
+		if _, err := ts.room(fmt.Sprintf("room%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop := ticking(ts)
+	defer stop()
+	// listing is safe while the rooms tick
+	for i := 0; i < 5; i++ {
+		if n := len(listed(t, ts, "/rooms")); n != maxListedRooms {
+			t.Fatalf("listed %d rooms, want %d", n, maxListedRooms)
+		}
+	}
+	if got := listed(t, ts, fmt.Sprintf("/rooms?offset=%d", maxListedRooms)); len(got) != 5 || got[0][:7] != fmt.Sprintf("room%03d", maxListedRooms) {
+		t.Fatalf("listed %v on the second page", got)
+	}
+}
+
+func TestPrivateRoom(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	code := ts.createRoom(t, nil)
+	if len(code) != joinCodeLength || strings.Trim(code, joinCodeAlphabet) != "" {
+		t.Fatalf("join code %q", code)
+	}
+	a := ts.dial(t, "/game?code="+code)
+	b := ts.dial(t, "/game?code="+code)
+	a.send(MessageReady, nil)
+	b.play()
+	ts.tick(1)
+	if s := b.snapshot(); s.Room.Name != code {
+		t.Fatalf("joined room %q", s.Room.Name)
+	}
+	if got := listed(t, ts, "/rooms"); len(got) != 0 {
+		t.Fatalf("private room listed: %v", got)
+	}
+
+	for path, want := range map[string]int{
+		"/game?code=" + strings.ToLower(code): http.StatusNotFound,
+		"/game?code=ZZZZZZ":                   http.StatusNotFound,
+		"/game?code=" + code + "&room=a":      http.StatusBadRequest,
+	} {
+		if status := ts.refused(t, path); status != want {
+			t.Fatalf("%s refused with %d, want %d", path, status, want)
+		}
+	}
+	// no code at all is the public default room
+	if name := ts.dial(t, "/game").snapshot().Room.Name; name != DefaultRoom {
+		t.Fatalf("joined %q without a code", name)
+	}
+}
+
+func TestPrivateRoomExpires(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.ReconnectGrace = 0
+		cfg.PrivateRoomTTL = 5 * cfg.Tick
+		cfg.EmptyRoomGrace = 3 * cfg.Tick
+	})
+	// nobody ever joins this one
+	unused := ts.createRoom(t, nil)
+	eventually(t, "the unused code to expire", func() bool {
+		ts.tick(1)
+		_, err := ts.privateRoom(unused)
+		return err == errUnknownCode
+	})
+	if status := ts.refused(t, "/game?code="+unused); status != http.StatusNotFound {
+		t.Fatalf("expired code refused with %d, want %d", status, http.StatusNotFound)
+	}
+
+	// this one empties after being played in
+	code := ts.createRoom(t, nil)
+	c := ts.dial(t, "/game?code="+code)
+	ts.tick(10)
+	c.snapshot()
+	c.conn.Close()
+	eventually(t, "the code to expire once the room is empty", func() bool {
+		ts.tick(1)
+		_, err := ts.privateRoom(code)
+		return err == errUnknownCode
+	})
+	if status := ts.refused(t, "/game?code="+code); status != http.StatusNotFound {
+		t.Fatalf("expired code refused with %d, want %d", status, http.StatusNotFound)
+	}
+}
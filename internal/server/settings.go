@@ -0,0 +1,388 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// bounds for settings supplied by clients
+const (
+	minWorldSize       = 100
+	maxWorldSize       = 10000
+	maxSpeed           = 2000
+	maxAccel           = 20000
+	maxRadius          = 100
+	maxSprint          = 400
+	maxStamina         = 10000
+	maxLockoutMS       = 10000
+	maxDash            = 1000
+	maxCooldownMS      = 60000
+	maxProjectileSpeed = 5000
+	maxHP              = 10000
+	maxCoins           = 100
+	maxHillScore       = 1000000
+	maxWinScore        = 1000000
+	maxMatchMS         = 3600000
+	maxPrecision       = 3
+)
+
+// RoomSettings are the rules a room is created with. Public rooms use the
+// server defaults, private ones may pick their own.
+type RoomSettings struct {
+	WorldWidth  int `json:"world_width"`
+	WorldHeight int `json:"world_height"`
+	// whether leaving by an edge comes back in by the opposite one
+	Wrap         bool `json:"wrap"`
+	PlayerSpeed  int  `json:"player_speed"`
+	Acceleration int  `json:"acceleration"`
+	Friction     int  `json:"friction"`
+	PlayerRadius int  `json:"player_radius"`
+	// sprint speed in percent of player_speed, stamina and its rates per
+	// second
+	SprintSpeed     int `json:"sprint_speed"`
+	Stamina         int `json:"stamina"`
+	StaminaDrain    int `json:"stamina_drain"`
+	StaminaRegen    int `json:"stamina_regen"`
+	SprintLockoutMS int `json:"sprint_lockout_ms"`
+	DashDistance    int `json:"dash_distance"`
+	DashCooldownMS  int `json:"dash_cooldown_ms"`
+	// projectile speed per second and lifetime, and the time between shots
+	ProjectileSpeed int `json:"projectile_speed"`
+	ProjectileTTLMS int `json:"projectile_ttl_ms"`
+	FireCooldownMS  int `json:"fire_cooldown_ms"`
+	// health, damage per hit and the wait to respawn after dying
+	MaxHP            int `json:"max_hp"`
+	ProjectileDamage int `json:"projectile_damage"`
+	RespawnDelayMS   int `json:"respawn_delay_ms"`
+	// knockback per second from hits and from bumping into players, and
+	// the percent of control kept while it wears off
+	Knockback        int `json:"knockback"`
+	BumpKnockback    int `json:"bump_knockback"`
+	KnockbackControl int `json:"knockback_control"`
+	// how long players can't be hurt after spawning, and whether shooting
+	// ends it
+	SpawnProtectionMS  int  `json:"spawn_protection_ms"`
+	ShotEndsProtection bool `json:"shot_ends_protection"`
+	// coins at once, their pickup radius and worth, and the wait for a
+	// collected one to be replaced
+	Coins         int `json:"coins"`
+	CoinRadius    int `json:"coin_radius"`
+	CoinPoints    int `json:"coin_points"`
+	CoinRespawnMS int `json:"coin_respawn_ms"`
+	// power-ups at most, how often and for how long one is put down, and
+	// the speed boost in percent and how long it lasts
+	PowerUps          int `json:"power_ups"`
+	PowerUpIntervalMS int `json:"power_up_interval_ms"`
+	PowerUpTTLMS      int `json:"power_up_ttl_ms"`
+	SpeedBoost        int `json:"speed_boost"`
+	BoostDurationMS   int `json:"boost_duration_ms"`
+	// ModeFreeForAll, ModeTag, ModeCTF or ModeHill, and how long after
+	// tagging someone a player can't be tagged back and being it takes to
+	// cost a point
+	Mode          string `json:"mode"`
+	TagImmunityMS int    `json:"tag_immunity_ms"`
+	TagCostMS     int    `json:"tag_cost_ms"`
+	// the king of the hill zone, the map's unless picked, and the ticks of
+	// holding it that win
+	Hill      *sim.Circle `json:"hill,omitempty"`
+	HillScore int         `json:"hill_score"`
+	// whether players are split into teams, always so in capture the flag,
+	// how many players one may be ahead of another after a switch, and
+	// whether projectiles hurt teammates
+	Teams        bool `json:"teams"`
+	TeamDelta    int  `json:"team_delta"`
+	FriendlyFire bool `json:"friendly_fire"`
+	// how far apart players spawn when the map has no spawn points
+	SpawnDistance int `json:"spawn_distance"`
+	MaxPlayers    int `json:"max_players"`
+	// players the server plays, on top of MaxPlayers
+	Bots int `json:"bots"`
+	// decimal places positions are sent with
+	Precision int `json:"precision"`
+	// MidMatchSpawn or MidMatchSpectate
+	MidMatchJoin string `json:"mid_match_join"`
+	// match length, 0 for no limit, how long results are shown and
+	// AfterMatchLobby or AfterMatchRestart
+	MatchDurationMS int    `json:"match_duration_ms"`
+	IntermissionMS  int    `json:"intermission_ms"`
+	AfterMatch      string `json:"after_match"`
+	// the score that wins, 0 for none, and whether the dead stay out until
+	// one player or team is left alive
+	WinScore  int  `json:"win_score"`
+	LastAlive bool `json:"last_alive"`
+	// the layout rooms are on, from the server's maps, and what it puts
+	// in the world; clients pick the map, not what is on it
+	Map       string      `json:"map,omitempty"`
+	Obstacles []sim.Rect  `json:"-"`
+	Spawns    []sim.Point `json:"-"`
+	Bases     []sim.Point `json:"-"`
+}
+
+// RoomSettings returns the settings rooms get unless told otherwise
+func (cfg Config) RoomSettings() RoomSettings {
+	rs := RoomSettings{
+		WorldWidth:         cfg.WorldWidth,
+		WorldHeight:        cfg.WorldHeight,
+		Wrap:               cfg.Wrap,
+		PlayerSpeed:        cfg.PlayerSpeed,
+		Acceleration:       cfg.Acceleration,
+		Friction:           cfg.Friction,
+		PlayerRadius:       cfg.PlayerRadius,
+		SprintSpeed:        cfg.SprintSpeed,
+		Stamina:            cfg.Stamina,
+		StaminaDrain:       cfg.StaminaDrain,
+		StaminaRegen:       cfg.StaminaRegen,
+		SprintLockoutMS:    int(cfg.SprintLockout.Milliseconds()),
+		DashDistance:       cfg.DashDistance,
+		DashCooldownMS:     int(cfg.DashCooldown.Milliseconds()),
+		ProjectileSpeed:    cfg.ProjectileSpeed,
+		ProjectileTTLMS:    int(cfg.ProjectileTTL.Milliseconds()),
+		FireCooldownMS:     int(cfg.FireCooldown.Milliseconds()),
+		MaxHP:              cfg.MaxHP,
+		ProjectileDamage:   cfg.ProjectileDamage,
+		Knockback:          cfg.Knockback,
+		BumpKnockback:      cfg.BumpKnockback,
+		KnockbackControl:   cfg.KnockbackControl,
+		RespawnDelayMS:     int(cfg.RespawnDelay.Milliseconds()),
+		SpawnProtectionMS:  int(cfg.SpawnProtection.Milliseconds()),
+		ShotEndsProtection: cfg.ShotEndsProtection,
+		Coins:              cfg.Coins,
+		CoinRadius:         cfg.CoinRadius,
+		CoinPoints:         cfg.CoinPoints,
+		CoinRespawnMS:      int(cfg.CoinRespawn.Milliseconds()),
+		PowerUps:           cfg.PowerUps,
+		PowerUpIntervalMS:  int(cfg.PowerUpInterval.Milliseconds()),
+		PowerUpTTLMS:       int(cfg.PowerUpTTL.Milliseconds()),
+		SpeedBoost:         cfg.SpeedBoost,
+		BoostDurationMS:    int(cfg.BoostDuration.Milliseconds()),
+		Mode:               cfg.Mode,
+		TagImmunityMS:      int(cfg.TagImmunity.Milliseconds()),
+		TagCostMS:          int(cfg.TagCost.Milliseconds()),
+		Hill:               cfg.Hill,
+		HillScore:          cfg.HillScore,
+		Teams:              cfg.Teams,
+		TeamDelta:          cfg.TeamDelta,
+		FriendlyFire:       cfg.FriendlyFire,
+		SpawnDistance:      cfg.SpawnDistance,
+		MaxPlayers:         cfg.MaxPlayers,
+		Bots:               cfg.Bots,
+		Precision:          cfg.PositionPrecision,
+		MidMatchJoin:       cfg.MidMatchJoin,
+		MatchDurationMS:    int(cfg.MatchDuration.Milliseconds()),
+		IntermissionMS:     int(cfg.Intermission.Milliseconds()),
+		AfterMatch:         cfg.AfterMatch,
+		WinScore:           cfg.WinScore,
+		LastAlive:          cfg.LastAlive,
+		Obstacles:          cfg.Obstacles,
+		Spawns:             cfg.Spawns,
+		Bases:              cfg.Bases,
+	}
+	// a copy, so decoding a client's hill into it leaves the server's be
+	if cfg.Hill != nil {
+		hill := *cfg.Hill
+		rs.Hill = &hill
+	}
+	if m, ok := cfg.Maps[cfg.Map]; ok && cfg.Map != "" {
+		rs = cfg.onMap(rs, cfg.Map, m)
+	}
+	return rs
+}
+
+// MapSettings is RoomSettings for a room on the map called name
+func (cfg Config) MapSettings(name string) (RoomSettings, error) {
+	rs := cfg.RoomSettings()
+	if name == rs.Map {
+		return rs, nil
+	}
+	m, ok := cfg.Maps[name]
+	if !ok {
+		return rs, fmt.Errorf("map must be one of %s, got %q", quoted(cfg.mapNames()), name)
+	}
+	return cfg.onMap(rs, name, m), nil
+}
+
+// onMap lays rs out as m, which is called name
+func (cfg Config) onMap(rs RoomSettings, name string, m Map) RoomSettings {
+	rs.Map = name
+	rs.WorldWidth, rs.WorldHeight = m.size(cfg.WorldWidth, cfg.WorldHeight)
+	rs.Obstacles, rs.Spawns, rs.Bases = m.Obstacles, m.Spawns, m.Bases
+	rs.Hill = nil
+	if m.Hill != nil {
+		hill := *m.Hill
+		rs.Hill = &hill
+	}
+	return rs
+}
+
+// Validate checks client supplied settings against sane bounds. A room may
+// not hold more players than the server allows or fewer than a match needs.
+func (rs RoomSettings) Validate(cfg Config) error {
+	ints := []struct {
+		name     string
+		v        int
+		min, max int
+	}{
+		{"world_width", rs.WorldWidth, minWorldSize, maxWorldSize},
+		{"world_height", rs.WorldHeight, minWorldSize, maxWorldSize},
+		{"player_speed", rs.PlayerSpeed, 1, maxSpeed},
+		{"acceleration", rs.Acceleration, 1, maxAccel},
+		{"friction", rs.Friction, 0, maxAccel},
+		{"player_radius", rs.PlayerRadius, 0, maxRadius},
+		{"sprint_speed", rs.SprintSpeed, 100, maxSprint},
+		{"stamina", rs.Stamina, 1, maxStamina},
+		{"stamina_drain", rs.StaminaDrain, 1, maxStamina},
+		{"stamina_regen", rs.StaminaRegen, 0, maxStamina},
+		{"sprint_lockout_ms", rs.SprintLockoutMS, 0, maxLockoutMS},
+		{"dash_distance", rs.DashDistance, 0, maxDash},
+		{"dash_cooldown_ms", rs.DashCooldownMS, 0, maxCooldownMS},
+		{"projectile_speed", rs.ProjectileSpeed, 1, maxProjectileSpeed},
+		{"projectile_ttl_ms", rs.ProjectileTTLMS, 1, maxCooldownMS},
+		{"fire_cooldown_ms", rs.FireCooldownMS, 0, maxCooldownMS},
+		{"max_hp", rs.MaxHP, 1, maxHP},
+		{"projectile_damage", rs.ProjectileDamage, 0, maxHP},
+		{"knockback", rs.Knockback, 0, maxProjectileSpeed},
+		{"bump_knockback", rs.BumpKnockback, 0, maxProjectileSpeed},
+		{"knockback_control", rs.KnockbackControl, 0, 100},
+		{"respawn_delay_ms", rs.RespawnDelayMS, 0, maxCooldownMS},
+		{"spawn_protection_ms", rs.SpawnProtectionMS, 0, maxCooldownMS},
+		{"coins", rs.Coins, 0, maxCoins},
+		{"coin_radius", rs.CoinRadius, 0, maxRadius},
+		{"coin_points", rs.CoinPoints, 0, maxHP},
+		{"coin_respawn_ms", rs.CoinRespawnMS, 0, maxCooldownMS},
+		{"power_ups", rs.PowerUps, 0, maxCoins},
+		{"power_up_interval_ms", rs.PowerUpIntervalMS, 0, maxCooldownMS},
+		{"power_up_ttl_ms", rs.PowerUpTTLMS, 1, maxCooldownMS},
+		{"speed_boost", rs.SpeedBoost, 100, maxSprint},
+		{"boost_duration_ms", rs.BoostDurationMS, 0, maxCooldownMS},
+		{"tag_immunity_ms", rs.TagImmunityMS, 0, maxCooldownMS},
+		{"tag_cost_ms", rs.TagCostMS, 1, maxCooldownMS},
+		{"hill_score", rs.HillScore, 1, maxHillScore},
+		{"team_delta", rs.TeamDelta, 1, cfg.MaxPlayers},
+		{"spawn_distance", rs.SpawnDistance, 0, maxWorldSize},
+		{"max_players", rs.MaxPlayers, cfg.MinPlayers, cfg.MaxPlayers},
+		{"bots", rs.Bots, 0, maxBots},
+		{"precision", rs.Precision, 0, maxPrecision},
+		{"match_duration_ms", rs.MatchDurationMS, 0, maxMatchMS},
+		{"intermission_ms", rs.IntermissionMS, 0, maxCooldownMS},
+		{"win_score", rs.WinScore, 0, maxWinScore},
+	}
+	for _, f := range ints {
+		if f.v < f.min || f.v > f.max {
+			return fmt.Errorf("%s must be between %d and %d, got %d", f.name, f.min, f.max, f.v)
+		}
+	}
+	if _, ok := modes[rs.Mode]; !ok {
+		return fmt.Errorf("mode must be one of %s, got %q", modeNames(), rs.Mode)
+	}
+	if rs.Hill != nil && (rs.Hill.Radius < 1 || rs.Hill.Radius > maxWorldSize || outsideCircle(rs.Hill, rs.WorldWidth, rs.WorldHeight)) {
+		return fmt.Errorf("hill must have a radius between 1 and %d and its centre in the world", maxWorldSize)
+	}
+	if rs.MidMatchJoin != MidMatchSpawn && rs.MidMatchJoin != MidMatchSpectate {
+		return fmt.Errorf("mid_match_join must be %q or %q, got %q", MidMatchSpawn, MidMatchSpectate, rs.MidMatchJoin)
+	}
+	if rs.AfterMatch != AfterMatchLobby && rs.AfterMatch != AfterMatchRestart {
+		return fmt.Errorf("after_match must be %q or %q, got %q", AfterMatchLobby, AfterMatchRestart, rs.AfterMatch)
+	}
+	if outside(rs.Obstacles, rs.WorldWidth, rs.WorldHeight) >= 0 || outsidePoint(rs.Spawns, rs.WorldWidth, rs.WorldHeight) >= 0 ||
+		outsidePoint(rs.Bases, rs.WorldWidth, rs.WorldHeight) >= 0 {
+		return fmt.Errorf("world of %dx%d is too small for the map", rs.WorldWidth, rs.WorldHeight)
+	}
+	return nil
+}
+
+// quantize rounds p's position to the precision it is sent with, and their
+// facing to hundredths of a radian. Every form of a snapshot is built from
+// the rounded values, and deltas compare them rather than the exact ones,
+// so no client sees a player move or turn by rounding alone.
+func (rs RoomSettings) quantize(p sim.Player) sim.Player {
+	scale := math.Pow10(rs.Precision)
+	p.X = math.Round(p.X*scale) / scale
+	p.Y = math.Round(p.Y*scale) / scale
+	p.Facing = float64(facingUnits(p.Facing)) / facingScale
+	return p
+}
+
+// facingScale is the units of a radian facing is sent in
+const facingScale = 100
+
+// facingUnits is a facing angle, already quantized or not, in hundredths of
+// a radian
+func facingUnits(a float64) int {
+	return int(math.Round(a * facingScale))
+}
+
+// quantizeProjectile is quantize for a projectile, velocity included
+func (rs RoomSettings) quantizeProjectile(pr sim.Projectile) sim.Projectile {
+	scale := math.Pow10(rs.Precision)
+	pr.X = math.Round(pr.X*scale) / scale
+	pr.Y = math.Round(pr.Y*scale) / scale
+	pr.Vel.X = math.Round(pr.Vel.X*scale) / scale
+	pr.Vel.Y = math.Round(pr.Vel.Y*scale) / scale
+	return pr
+}
+
+// fixed is v, already quantized, as an integer count of 10^-Precision units
+// for the binary and protobuf snapshots
+func (rs RoomSettings) fixed(v float64) int64 {
+	return int64(math.Round(v * math.Pow10(rs.Precision)))
+}
+
+// Rules returns the simulation parameters for a room with these settings
+// ticking every tick
+func (rs RoomSettings) Rules(tick time.Duration) sim.Rules {
+	return sim.Rules{
+		Width:    rs.WorldWidth,
+		Height:   rs.WorldHeight,
+		Wrap:     rs.Wrap,
+		Tick:     tick,
+		MaxSpeed: rs.PlayerSpeed,
+		Accel:    rs.Acceleration,
+		Friction: rs.Friction,
+		Radius:   rs.PlayerRadius,
+		// rates stay per second, the simulation scales them by the tick
+		SprintSpeed:        rs.SprintSpeed,
+		Stamina:            rs.Stamina,
+		StaminaDrain:       rs.StaminaDrain,
+		StaminaRegen:       rs.StaminaRegen,
+		SprintLockout:      time.Duration(rs.SprintLockoutMS) * time.Millisecond,
+		DashDistance:       rs.DashDistance,
+		DashCooldown:       time.Duration(rs.DashCooldownMS) * time.Millisecond,
+		ProjectileSpeed:    rs.ProjectileSpeed,
+		ProjectileTTL:      time.Duration(rs.ProjectileTTLMS) * time.Millisecond,
+		FireCooldown:       time.Duration(rs.FireCooldownMS) * time.Millisecond,
+		MaxHP:              rs.MaxHP,
+		ProjectileDamage:   rs.ProjectileDamage,
+		Knockback:          rs.Knockback,
+		BumpKnockback:      rs.BumpKnockback,
+		KnockbackControl:   rs.KnockbackControl,
+		RespawnDelay:       time.Duration(rs.RespawnDelayMS) * time.Millisecond,
+		SpawnProtection:    time.Duration(rs.SpawnProtectionMS) * time.Millisecond,
+		ShotEndsProtection: rs.ShotEndsProtection,
+		Coins:              rs.Coins,
+		CoinRadius:         rs.CoinRadius,
+		CoinPoints:         rs.CoinPoints,
+		CoinRespawn:        time.Duration(rs.CoinRespawnMS) * time.Millisecond,
+		PowerUps:           rs.PowerUps,
+		PowerUpInterval:    time.Duration(rs.PowerUpIntervalMS) * time.Millisecond,
+		PowerUpTTL:         time.Duration(rs.PowerUpTTLMS) * time.Millisecond,
+		SpeedBoost:         rs.SpeedBoost,
+		BoostDuration:      time.Duration(rs.BoostDurationMS) * time.Millisecond,
+		Mode:               modes[rs.Mode],
+		TagImmunity:        time.Duration(rs.TagImmunityMS) * time.Millisecond,
+		TagCost:            time.Duration(rs.TagCostMS) * time.Millisecond,
+		// rooms only read the map, never change it
+		Obstacles:     rs.Obstacles,
+		Spawns:        rs.Spawns,
+		Bases:         rs.Bases,
+		Teams:         rs.Teams || rs.Mode == ModeCTF,
+		FriendlyFire:  rs.FriendlyFire,
+		Hill:          rs.Hill,
+		HillScore:     rs.HillScore,
+		SpawnDistance: rs.SpawnDistance,
+		WinScore:      rs.WinScore,
+		LastAlive:     rs.LastAlive,
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+func TestRoomSettingsClampDiffer(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	for _, width := range []int{200, 1000} {
+		code := ts.createRoom(t, map[string]int{"world_width": width, "world_height": 300, "player_speed": 2000})
+		c := ts.match(t, "/game?code="+code, 1)[0]
+		for i := 0; i < 40; i++ {
+			c.input("right")
+			c.sync()
+			ts.tick(1)
+			c.snapshot()
+		}
+		if x := c.me().X; x != float64(width) {
+			t.Fatalf("stopped at %v in a world %d wide", x, width)
+		}
+	}
+}
+
+func TestRoomSettingsEchoed(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	status, body := ts.request(t, http.MethodPost, "/rooms", map[string]interface{}{"world_width": 500, "max_players": 4, "mid_match_join": MidMatchSpectate})
+	if status != http.StatusCreated {
+		t.Fatalf("POST /rooms: %d %s", status, body)
+	}
+	var created struct {
+		Settings RoomSettings `json:"settings"`
+	}
+	json.Unmarshal(body, &created)
+	want := ts.cfg.RoomSettings()
+	want.WorldWidth, want.MaxPlayers, want.MidMatchJoin = 500, 4, MidMatchSpectate
+	if created.Settings.WorldWidth != 500 || created.Settings.MaxPlayers != 4 || created.Settings.MidMatchJoin != MidMatchSpectate ||
+		created.Settings.WorldHeight != want.WorldHeight || created.Settings.PlayerSpeed != want.PlayerSpeed {
+		t.Fatalf("created with %+v", created.Settings)
+	}
+
+	ts.dial(t, "/game?room=public")
+	var rooms []RoomInfo
+	ts.get(t, "/rooms", &rooms)
+	if len(rooms) != 1 || rooms[0].Settings.WorldWidth != ts.cfg.WorldWidth || rooms[0].Settings.PlayerSpeed != ts.cfg.PlayerSpeed {
+		t.Fatalf("listed %+v", rooms)
+	}
+}
+
+func TestRoomSettingsInvalid(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"world_width":50}`, "world_width must be between"},
+		{`{"world_height":100000}`, "world_height must be between"},
+		{`{"player_speed":0}`, "player_speed must be between"},
+		{`{"max_players":1000}`, "max_players must be between"},
+		{`{"mode":"racing"}`, "mode must be one of"},
+		{`{"knockback_control":150}`, "knockback_control must be between"},
+		{`{"mid_match_join":"never"}`, "mid_match_join must be"},
+		{`{"gravity":9}`, "unknown field"},
+		{`{"world_width":"wide"}`, "invalid settings"},
+		{`{`, "invalid settings"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://"+ts.addr+"/rooms", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			msg, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(msg), tt.want) {
+				t.Fatalf("%d %q, want 400 mentioning %q", resp.StatusCode, msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuantizedPositions(t *testing.T) {
+	for precision := 0; precision <= maxPrecision; precision++ {
+		t.Run(fmt.Sprint(precision), func(t *testing.T) {
+			r := benchRoom(t, 2)
+			r.settings.Precision = precision
+			r.srv.cfg.KeyframeInterval = 10
+			scale := math.Pow10(precision)
+			var ids []string
+			for id := range r.gamestate.Players {
+				ids = append(ids, id)
+			}
+			moving, still := r.gamestate.Players[ids[0]], r.gamestate.Players[ids[1]]
+			base := still.X
+			// what a client puts together from what it was sent
+			c := &testClient{t: t, players: map[string]sim.Player{}}
+			for i := 0; i < 40; i++ {
+				moving.X += 1.2345678
+				moving.Y -= 0.0321
+				// jitter well under the precision
+				still.X = base + 0.01/scale*float64(i%3-1)
+
+				s := r.snapshot()
+				// the JSON form, as every client gets it
+				var sent Snapshot
+				if err := json.Unmarshal(encode(MessageSnapshot, s).msg, &ServerMessage{Data: &sent}); err != nil {
+					t.Fatal(err)
+				}
+				data, _ := json.Marshal(sent)
+				c.apply(data)
+				p := c.players[ids[0]]
+				for _, v := range []struct{ sent, internal float64 }{{p.X, moving.X}, {p.Y, moving.Y}} {
+					if units := v.sent * scale; math.Abs(units-math.Round(units)) > 1e-6 {
+						t.Fatalf("tick %d: sent %v at precision %d", i, v.sent, precision)
+					}
+					if math.Abs(v.sent-v.internal) > 0.5/scale+1e-9 {
+						t.Fatalf("tick %d: sent %v for %v", i, v.sent, v.internal)
+					}
+				}
+				// keyframes and deltas round alike
+				if want := r.settings.quantize(*moving); p.X != want.X || p.Y != want.Y {
+					t.Fatalf("tick %d (keyframe %v): sent %v,%v, want %v,%v", i, s.Keyframe, p.X, p.Y, want.X, want.Y)
+				}
+				if _, ok := s.Update[ids[1]]; ok && i > 0 {
+					t.Fatalf("tick %d: the still player moved by rounding alone", i)
+				}
+			}
+		})
+	}
+}
+
+func TestTagModeRoom(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	code := ts.createRoom(t, map[string]interface{}{"mode": ModeTag})
+	clients := ts.match(t, "/game?code="+code, 2)
+	ts.tick(1)
+	for _, c := range clients {
+		c.snapshot()
+		it := 0
+		for _, p := range c.players {
+			if p.It {
+				it++
+			}
+		}
+		if it != 1 {
+			t.Fatalf("%d players it in %v", it, c.players)
+		}
+	}
+	// and a room in the default mode has nobody it
+	c := ts.match(t, "/game", 1)[0]
+	ts.tick(1)
+	c.snapshot()
+	if c.me().It {
+		t.Fatal("it in free for all")
+	}
+}
+
+func TestQuantizedFacing(t *testing.T) {
+	var rs RoomSettings
+	// quantizing again changes nothing, so keyframes and deltas agree
+	for a := 0.0; a < 2*math.Pi; a += 0.0007 {
+		once := rs.quantize(sim.Player{Facing: a}).Facing
+		if twice := rs.quantize(sim.Player{Facing: once}).Facing; twice != once || math.Abs(once-a) > 0.005+1e-9 {
+			t.Fatalf("%v quantized to %v, then %v", a, once, twice)
+		}
+	}
+
+	r := benchRoom(t, 1)
+	r.srv.cfg.KeyframeInterval = 1000
+	var id string
+	var p *sim.Player
+	for id, p = range r.gamestate.Players {
+	}
+	p.Facing = 1.234567
+	if _, s := sent(t, r.snapshot()); s.Players[id].Facing != 1.23 {
+		t.Fatalf("sent facing %v, want 1.23", s.Players[id].Facing)
+	}
+	// turning by less than a hundredth sends nothing
+	for _, tt := range []struct {
+		facing float64
+		sent   bool
+	}{
+		{1.2341, false},
+		{1.2349, false},
+		{1.2351, true},
+		{1.2352, false},
+	} {
+		p.Facing = tt.facing
+		_, s := sent(t, r.snapshot())
+		if s.Keyframe {
+			t.Fatal("keyframe")
+		}
+		if _, ok := s.Update[id]; ok != tt.sent {
+			t.Fatalf("facing %v: update %+v", tt.facing, s.Update)
+		}
+	}
+}
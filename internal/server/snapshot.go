@@ -0,0 +1,389 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// SnapshotVersion is the version of the Snapshot format, bumped whenever it
+// changes. Version 1 was the bare players map, which ?format=bare still
+// gets.
+const SnapshotVersion = 2
+
+// Snapshot is the data of the snapshot message broadcast every tick. A
+// keyframe carries every player in Players. Any other snapshot is a delta
+// against the one before it: players in Add are new, players in Update
+// have moved, been hurt, scored, been tagged, changed team or gained or
+// lost protection or a boost and players in Remove are gone. Projectiles
+// are short lived and always move, so every snapshot lists all of them.
+// Coins, power-ups, flags and the leaderboard go in every snapshot too.
+type Snapshot struct {
+	Version int `json:"version"`
+	// goes up by one every tick, so a client that sees a gap has missed a
+	// delta and should send a resync message for a keyframe of its own
+	Seq uint64 `json:"seq"`
+	// the simulation tick the snapshot shows, the room clock time in ms that
+	// tick started and how long a tick is, for clients to interpolate with
+	Tick         uint64 `json:"tick"`
+	ServerTimeMS int64  `json:"server_time_ms"`
+	TickMS       int64  `json:"tick_ms"`
+	// decimal places positions are rounded to
+	Precision int       `json:"precision"`
+	Keyframe  bool      `json:"keyframe"`
+	Room      RoomState `json:"room"`
+	// the size of the world, only on keyframes
+	World   *World                `json:"world,omitempty"`
+	Players map[string]sim.Player `json:"players,omitempty"`
+	Add     map[string]sim.Player `json:"add,omitempty"`
+	Update  map[string]sim.Player `json:"update,omitempty"`
+	Remove  []string              `json:"remove,omitempty"`
+	// left out when there are none
+	Projectiles []sim.Projectile `json:"projectiles,omitempty"`
+	Coins       []sim.Coin       `json:"coins,omitempty"`
+	PowerUps    []sim.PowerUp    `json:"power_ups,omitempty"`
+	Flags       []sim.Flag       `json:"flags,omitempty"`
+	// the LeaderboardSize highest scoring players, best first, ties going
+	// to whoever joined first
+	Leaderboard []sim.Standing `json:"leaderboard,omitempty"`
+	// the highest input seq applied for the receiving player, left out for
+	// spectators and players that don't number their inputs
+	LastInputSeq int `json:"last_input_seq,omitempty"`
+	// the receiving player's own state, left out for spectators
+	Self *Self `json:"self,omitempty"`
+
+	// binary indices of the players in Remove, which they no longer hold
+	removed []uint16
+}
+
+// Self is what a snapshot tells only the player receiving it about
+// themselves
+type Self struct {
+	// rounded up, so it is only 0 once they have run dry
+	Stamina   int  `json:"stamina"`
+	Exhausted bool `json:"exhausted"`
+	// until they can dash again, 0 when they can now
+	DashCooldownMS int64 `json:"dash_cooldown_ms"`
+}
+
+func (r *Room) selfOf(p *sim.Player) *Self {
+	return &Self{
+		Stamina:        int(math.Ceil(p.Stamina)),
+		Exhausted:      p.Exhausted(),
+		DashCooldownMS: int64(p.DashCooldown()) * r.srv.cfg.Tick.Milliseconds(),
+	}
+}
+
+// World is the size of a room's world in pixels and the obstacles in it.
+// Positions run from 0 to Width and Height, or up to just short of them
+// when the world wraps around.
+type World struct {
+	Width     int        `json:"width"`
+	Height    int        `json:"height"`
+	Wrap      bool       `json:"wrap,omitempty"`
+	Obstacles []sim.Rect `json:"obstacles,omitempty"`
+}
+
+func (r *Room) world() *World {
+	return &World{
+		Width:     r.settings.WorldWidth,
+		Height:    r.settings.WorldHeight,
+		Wrap:      r.settings.Wrap,
+		Obstacles: r.settings.Obstacles,
+	}
+}
+
+// RoomState is the room metadata sent with every snapshot
+type RoomState struct {
+	Name       string `json:"name"`
+	Mode       string `json:"mode"`
+	Phase      string `json:"phase"`
+	Players    int    `json:"players"`
+	Spectators int    `json:"spectators"`
+	Host       string `json:"host"`
+	// time since the match started, zero before that
+	ElapsedMS int64 `json:"elapsed_ms"`
+	// time left of a match with a time limit, or of the intermission after
+	// one
+	RemainingMS int64 `json:"remaining_ms,omitempty"`
+	// captures of team 1 and 2 in capture the flag
+	TeamScores []int `json:"team_scores,omitempty"`
+	// the zone and who is winning it in king of the hill
+	Hill *Hill `json:"hill,omitempty"`
+	// whether the host has frozen the match
+	Paused bool `json:"paused,omitempty"`
+}
+
+// Hill is the state of king of the hill. Holders are player ids, or team
+// numbers when there are teams.
+type Hill struct {
+	sim.Circle
+	// who alone holds the zone, if anyone, and whether it is being fought
+	// over
+	Holder    string `json:"holder,omitempty"`
+	Contested bool   `json:"contested"`
+	// ticks held by each holder so far, out of Score
+	Progress map[string]int `json:"progress"`
+	Score    int            `json:"score"`
+}
+
+func (r *Room) hill() *Hill {
+	if r.settings.Mode != ModeHill {
+		return nil
+	}
+	h := &Hill{
+		Circle:    r.settings.Rules(r.srv.cfg.Tick).HillZone(),
+		Holder:    r.gamestate.HillHolder,
+		Contested: r.gamestate.HillContested,
+		Progress:  make(map[string]int, len(r.gamestate.HillProgress)),
+		Score:     r.settings.HillScore,
+	}
+	for k, v := range r.gamestate.HillProgress {
+		h.Progress[k] = v
+	}
+	return h
+}
+
+func (r *Room) roomState() RoomState {
+	return RoomState{
+		Name:        r.name,
+		Mode:        r.settings.Mode,
+		Phase:       r.phase,
+		Players:     r.humans(),
+		Spectators:  r.spectatorCount(),
+		Host:        r.host,
+		ElapsedMS:   r.elapsed.Milliseconds(),
+		RemainingMS: int64(r.remaining) * r.srv.cfg.Tick.Milliseconds(),
+		// copied, as the world keeps counting while this waits to be sent
+		TeamScores: append([]int(nil), r.gamestate.TeamScores...),
+		Hill:       r.hill(),
+		Paused:     r.paused > 0,
+	}
+}
+
+// snapshot builds this tick's snapshot, a keyframe every KeyframeInterval
+// ticks and a delta otherwise, and remembers what it sent
+func (r *Room) snapshot() Snapshot {
+	r.seq++
+	r.sentTick = r.ticks
+	r.sentAt = r.tickAt
+	s := Snapshot{
+		Version:      SnapshotVersion,
+		Seq:          r.seq,
+		Tick:         r.sentTick,
+		ServerTimeMS: r.sentAt,
+		TickMS:       r.srv.cfg.Tick.Milliseconds(),
+		Precision:    r.settings.Precision,
+		Room:         r.roomState(),
+	}
+	// a new slice every time, as the last one may still be queued to send
+	r.shots = nil
+	for _, pr := range r.gamestate.Projectiles {
+		r.shots = append(r.shots, r.settings.quantizeProjectile(*pr))
+	}
+	s.Projectiles = r.shots
+	r.coins = nil
+	for _, c := range r.gamestate.Coins {
+		r.coins = append(r.coins, *c)
+	}
+	s.Coins = r.coins
+	r.powerUps = nil
+	for _, pu := range r.gamestate.PowerUps {
+		r.powerUps = append(r.powerUps, *pu)
+	}
+	s.PowerUps = r.powerUps
+	r.flags = nil
+	for _, f := range r.gamestate.Flags {
+		r.flags = append(r.flags, *f)
+	}
+	s.Flags = r.flags
+	r.board = r.gamestate.Leaderboard(r.srv.cfg.LeaderboardSize)
+	s.Leaderboard = r.board
+	if (r.seq-1)%uint64(r.srv.cfg.KeyframeInterval) == 0 {
+		for id := range r.sent {
+			if _, ok := r.gamestate.Players[id]; !ok {
+				r.releaseIndex(id)
+			}
+		}
+		r.sent = make(map[string]sim.Player, len(r.gamestate.Players))
+		for id, p := range r.gamestate.Players {
+			r.sent[id] = r.settings.quantize(*p)
+			r.assignIndex(id)
+		}
+		s.Keyframe = true
+		s.World = r.world()
+		s.Players = r.sent
+	} else {
+		for id, gp := range r.gamestate.Players {
+			p := r.settings.quantize(*gp)
+			old, ok := r.sent[id]
+			switch {
+			case !ok:
+				if s.Add == nil {
+					s.Add = map[string]sim.Player{}
+				}
+				s.Add[id] = p
+				r.assignIndex(id)
+			case changed(old, p):
+				if s.Update == nil {
+					s.Update = map[string]sim.Player{}
+				}
+				s.Update[id] = p
+			default:
+				continue
+			}
+			r.sent[id] = p
+		}
+		for id := range r.sent {
+			if _, ok := r.gamestate.Players[id]; !ok {
+				s.Remove = append(s.Remove, id)
+				delete(r.sent, id)
+			}
+		}
+		sort.Strings(s.Remove)
+		for _, id := range s.Remove {
+			s.removed = append(s.removed, r.index[id])
+			r.releaseIndex(id)
+		}
+	}
+	return s
+}
+
+// changed reports whether p needs to go in a delta against old. Spawn
+// protection and boosts counting down a tick at a time are left for clients
+// to follow, so only their start and end are sent.
+func changed(old, p sim.Player) bool {
+	return old.X != p.X || old.Y != p.Y || old.HP != p.HP || old.Dead != p.Dead || old.Score != p.Score || old.It != p.It || old.Team != p.Team || old.Facing != p.Facing ||
+		restarted(old.Invulnerable, p.Invulnerable) || restarted(old.Boost, p.Boost)
+}
+
+// restarted reports whether a countdown went from old to v other than by
+// ticking down
+func restarted(old, v int) bool {
+	return v > old || (v == 0) != (old == 0)
+}
+
+// requestResync queues a keyframe for c alone
+func (r *Room) requestResync(c *client) {
+	select {
+	case r.resyncs <- c:
+	case <-r.done:
+	}
+}
+
+// resync is a keyframe of the last snapshot for a new connection or one that
+// lost track, so the deltas everyone else gets next apply to it too
+func (r *Room) resync() outbound {
+	s := Snapshot{
+		Version:      SnapshotVersion,
+		Seq:          r.seq,
+		Tick:         r.sentTick,
+		ServerTimeMS: r.sentAt,
+		TickMS:       r.srv.cfg.Tick.Milliseconds(),
+		Precision:    r.settings.Precision,
+		Keyframe:     true,
+		World:        r.world(),
+		Room:         r.roomState(),
+		Players:      r.sent,
+		Projectiles:  r.shots,
+		Coins:        r.coins,
+		PowerUps:     r.powerUps,
+		Flags:        r.flags,
+		Leaderboard:  r.board,
+	}
+	o := encode(MessageSnapshot, s)
+	o.binary = r.encodeBinary(s)
+	return o
+}
+
+// broadcast sends the current gamestate to every connection
+func (r *Room) broadcast() {
+	// marshal once and hand the same bytes to every writer
+	s := r.snapshot()
+	o := r.packFor(encode(MessageSnapshot, s), true)
+	for _, c := range r.clients {
+		if c.encoding == EncodingBinary {
+			o.binary = r.encodeBinary(s)
+			break
+		}
+	}
+	for _, c := range r.clients {
+		if c.legacy {
+			quantized := make(map[string]sim.Player, len(r.gamestate.Players))
+			for id, p := range r.gamestate.Players {
+				quantized[id] = r.settings.quantize(*p)
+			}
+			bare, err := json.Marshal(quantized)
+			if err != nil {
+				log.Println("marshal error:", err)
+			}
+			o.legacy = bare
+			break
+		}
+	}
+	var slow []*client
+	for _, c := range r.clients {
+		if !c.deliver(r.withSelf(o, c, r.gamestate.Players[c.id])) {
+			slow = append(slow, c)
+		}
+	}
+	r.dropSlow(slow)
+}
+
+// withSelf adds p's last_input_seq and own state to the form of a snapshot c
+// gets. The snapshot is marshaled once for the whole room and these are the
+// last fields of its data, so they can be spliced in before the closing
+// braces instead of marshaling again per player. The binary encoding has a
+// fixed place for the ack and the rest at the end; only msgpack and protobuf
+// are encoded again.
+func (r *Room) withSelf(o outbound, c *client, p *sim.Player) outbound {
+	if p == nil || len(o.msg) < 2 {
+		return o
+	}
+	self := r.selfOf(p)
+	switch c.encoding {
+	case EncodingBinary:
+		if o.binary != nil {
+			o.binary = binaryWithSelf(o.binary, p.LastInputSeq, self)
+		}
+		return o
+	case EncodingMsgpack:
+		s, ok := o.value.Data.(Snapshot)
+		if ok {
+			s.LastInputSeq = p.LastInputSeq
+			s.Self = self
+			o.packed = pack(&ServerMessage{Type: MessageSnapshot, Data: s})
+		}
+		return o
+	case EncodingProtobuf:
+		s, ok := o.value.Data.(Snapshot)
+		if ok {
+			s.LastInputSeq = p.LastInputSeq
+			s.Self = self
+			o.protobuf = marshalProto(&ServerMessage{Type: MessageSnapshot, Data: s})
+		}
+		return o
+	}
+	own, err := json.Marshal(self)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return o
+	}
+	end := len(o.msg) - 2
+	msg := make([]byte, 0, len(o.msg)+len(own)+32)
+	msg = append(msg, o.msg[:end]...)
+	if p.LastInputSeq != 0 {
+		msg = append(msg, `,"last_input_seq":`...)
+		msg = strconv.AppendInt(msg, int64(p.LastInputSeq), 10)
+	}
+	msg = append(msg, `,"self":`...)
+	msg = append(msg, own...)
+	msg = append(msg, o.msg[end:]...)
+	o.msg = msg
+	o.prepared = nil
+	return o
+}
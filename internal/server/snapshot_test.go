@@ -0,0 +1,512 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// benchRoom is a playing room of n players on connections that only exist as
+// their send buffers
+func benchRoom(b testing.TB, n int) *Room {
+	b.Helper()
+	cfg := testConfig()
+	cfg.MaxPlayers = n
+	// everyone spawns in the middle rather than each searching the world
+	// for a free spot
+	cfg.SpawnDistance = 0
+	s := NewServer(cfg, nil, nil)
+	r := newRoom(s, "bench", cfg.RoomSettings())
+	for i := 0; i < n; i++ {
+		if err := r.admit(newClient(s, nil)); err != nil {
+			b.Fatal(err)
+		}
+		drainAll(r)
+	}
+	r.phase = PhasePlaying
+	return r
+}
+
+// drainAll empties the send buffer of every connection in r, like their
+// writers would
+func drainAll(r *Room) {
+	for _, c := range r.clients {
+		for len(c.send) > 0 {
+			<-c.send
+		}
+	}
+}
+
+// BenchmarkBroadcast times what the tick loop spends handing one snapshot to
+// every connection, which is queueing only and no socket writes
+func BenchmarkBroadcast(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			r := benchRoom(b, n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.broadcast()
+				b.StopTimer()
+				drainAll(r)
+				b.StartTimer()
+			}
+			b.StopTimer()
+			if len(r.clients) != n {
+				b.Fatalf("%d of %d connections dropped", n-len(r.clients), n)
+			}
+		})
+	}
+}
+
+func TestSnapshotRoomState(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.ReconnectGrace = 0
+	})
+	a := ts.dial(t, "/game?room=alpha")
+	ts.tick(1)
+	s := a.snapshot()
+	if s.Version != SnapshotVersion {
+		t.Fatalf("version %d, want %d", s.Version, SnapshotVersion)
+	}
+	want := RoomState{Name: "alpha", Mode: s.Room.Mode, Phase: PhaseLobby, Players: 1, Host: a.welcome.ID}
+	if s.Room.Name != want.Name || s.Room.Phase != want.Phase || s.Room.Players != want.Players || s.Room.Host != want.Host || s.Room.ElapsedMS != 0 {
+		t.Fatalf("room %+v, want %+v", s.Room, want)
+	}
+
+	// joining shows up in the next one
+	b := ts.dial(t, "/game?room=alpha")
+	var ev PlayerEvent
+	for ev.PlayerID != b.welcome.ID {
+		a.event(EventJoin, &ev)
+	}
+	ts.tick(1)
+	if s := a.snapshot(); s.Room.Players != 2 || s.Room.Host != a.welcome.ID {
+		t.Fatalf("room %+v, want 2 players", s.Room)
+	}
+
+	// and so does the phase, with the time played
+	a.send(MessageReady, nil)
+	b.play()
+	a.phase(PhasePlaying)
+	var elapsed int64
+	for i := 0; i < 3; i++ {
+		ts.tick(1)
+		s := a.snapshot()
+		if s.Room.Phase != PhasePlaying || s.Room.ElapsedMS <= elapsed {
+			t.Fatalf("room %+v, want playing for more than %dms", s.Room, elapsed)
+		}
+		elapsed = s.Room.ElapsedMS
+	}
+
+	b.conn.Close()
+	a.event(EventLeave, nil)
+	ts.tick(1)
+	if s := a.snapshot(); s.Room.Players != 1 {
+		t.Fatalf("room %+v, want 1 player left", s.Room)
+	}
+}
+
+// sent is the size of s as sent, and s as a client decodes it
+func sent(t *testing.T, s Snapshot) (int, Snapshot) {
+	t.Helper()
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Snapshot
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	return len(data), got
+}
+
+func TestDeltaBandwidth(t *testing.T) {
+	const players, ticks = 50, 60
+	delta := benchRoom(t, players)
+	full := benchRoom(t, players)
+	// every snapshot of full is a keyframe
+	full.srv.cfg.KeyframeInterval = 1
+	var deltaBytes, fullBytes int
+	for i := 0; i < ticks; i++ {
+		// two players walk about, the rest stand still
+		for _, r := range []*Room{delta, full} {
+			n := 0
+			for _, p := range r.gamestate.Players {
+				if n == 2 {
+					break
+				}
+				p.X++
+				n++
+			}
+		}
+		n, _ := sent(t, delta.snapshot())
+		deltaBytes += n
+		n, _ = sent(t, full.snapshot())
+		fullBytes += n
+	}
+	t.Logf("%d bytes of deltas against %d of keyframes", deltaBytes, fullBytes)
+	if deltaBytes*5 > fullBytes {
+		t.Fatalf("deltas %d bytes, keyframes %d, want a fifth or less", deltaBytes, fullBytes)
+	}
+}
+
+func TestDeltasReplay(t *testing.T) {
+	r := benchRoom(t, 10)
+	rng := rand.New(rand.NewSource(1))
+	// what a client following the deltas has
+	var players map[string]sim.Player
+	next := 0
+	for i := 0; i < 200; i++ {
+		for id, p := range r.gamestate.Players {
+			switch rng.Intn(10) {
+			case 0:
+				delete(r.gamestate.Players, id)
+			case 1, 2, 3:
+				p.X += float64(rng.Intn(5))
+				p.HP = rng.Intn(100)
+			}
+		}
+		for j := rng.Intn(3); j > 0; j-- {
+			next++
+			r.gamestate.Players[fmt.Sprint("added-", next)] = &sim.Player{X: float64(rng.Intn(800)), Y: float64(rng.Intn(600)), HP: 100}
+		}
+
+		_, s := sent(t, r.snapshot())
+		if s.Keyframe {
+			players = s.Players
+			continue
+		}
+		if players == nil {
+			t.Fatal("delta before the first keyframe")
+		}
+		for _, id := range s.Remove {
+			if _, ok := players[id]; !ok {
+				t.Fatalf("tick %d: removing %s, which isn't there", i, id)
+			}
+			delete(players, id)
+		}
+		for id, p := range s.Add {
+			if _, ok := players[id]; ok {
+				t.Fatalf("tick %d: adding %s, which is already there", i, id)
+			}
+			players[id] = p
+		}
+		for id, p := range s.Update {
+			if _, ok := players[id]; !ok {
+				t.Fatalf("tick %d: updating %s, which isn't there", i, id)
+			}
+			players[id] = p
+		}
+		// a keyframe of the same tick, as a resync gets
+		var keyframe Snapshot
+		if err := json.Unmarshal(r.resync().msg, &ServerMessage{Data: &keyframe}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(players, keyframe.Players) {
+			t.Fatalf("tick %d: replayed %v, keyframe has %v", i, players, keyframe.Players)
+		}
+	}
+}
+
+func TestSnapshotSeq(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 3)
+	var last Snapshot
+	for i := 0; i < 100; i++ {
+		ts.tick(1)
+		var s Snapshot
+		for j, c := range clients {
+			got := c.snapshot()
+			if j == 0 {
+				s = got
+				continue
+			}
+			if got.Seq != s.Seq || got.Tick != s.Tick || got.ServerTimeMS != s.ServerTimeMS {
+				t.Fatalf("client %d got seq %d tick %d at %d, client 0 seq %d tick %d at %d", j, got.Seq, got.Tick, got.ServerTimeMS, s.Seq, s.Tick, s.ServerTimeMS)
+			}
+		}
+		if i > 0 {
+			if s.Seq != last.Seq+1 {
+				t.Fatalf("seq %d after %d", s.Seq, last.Seq)
+			}
+			if d := s.ServerTimeMS - last.ServerTimeMS; d != ts.cfg.Tick.Milliseconds() {
+				t.Fatalf("server time moved %dms in a tick", d)
+			}
+		}
+		// keyframes count in the same sequence as deltas
+		if s.Keyframe != ((s.Seq-1)%uint64(ts.cfg.KeyframeInterval) == 0) {
+			t.Fatalf("seq %d keyframe %v", s.Seq, s.Keyframe)
+		}
+		last = s
+	}
+}
+
+func TestSnapshotTiming(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	c := ts.match(t, "/game", 1)[0]
+	var last Snapshot
+	for i := 0; i < 40; i++ {
+		ts.tick(1)
+		s := c.snapshot()
+		if now := ts.clock.Now().UnixNano() / int64(time.Millisecond); s.ServerTimeMS != now {
+			t.Fatalf("server time %d, want the clock's %d", s.ServerTimeMS, now)
+		}
+		if s.TickMS != ts.cfg.Tick.Milliseconds() {
+			t.Fatalf("tick_ms %d, want %d", s.TickMS, ts.cfg.Tick.Milliseconds())
+		}
+		if i > 0 && (s.Tick != last.Tick+1 || s.ServerTimeMS-last.ServerTimeMS != s.TickMS) {
+			t.Fatalf("tick %d at %d after tick %d at %d", s.Tick, s.ServerTimeMS, last.Tick, last.ServerTimeMS)
+		}
+		last = s
+	}
+	// a keyframe asked for between ticks shows the same tick as the delta
+	// before it
+	c.send(MessageResync, nil)
+	s := c.keyframe()
+	if s.Tick != last.Tick || s.ServerTimeMS != last.ServerTimeMS || s.Seq != last.Seq {
+		t.Fatalf("resync at tick %d, %d, seq %d, want tick %d, %d, seq %d", s.Tick, s.ServerTimeMS, s.Seq, last.Tick, last.ServerTimeMS, last.Seq)
+	}
+}
+
+func TestJoinMidMatchKeyframe(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 2)
+	clients[0].input("right")
+	clients[1].input("down")
+	for i := 0; i < 10; i++ {
+		ts.tick(1)
+		for _, c := range clients {
+			c.snapshot()
+		}
+	}
+	first := clients[0]
+
+	// the first snapshot is a keyframe, whenever the next scheduled one is
+	late := ts.dial(t, "/game")
+	if s := late.snapshot(); !s.Keyframe {
+		t.Fatalf("joined with a delta %+v", s)
+	}
+	// and from then on what it has put together matches an old hand's view
+	for i := 0; i < 10; i++ {
+		ts.tick(1)
+		want := first.snapshot()
+		got := late.snapshot()
+		if got.Keyframe || got.Seq != want.Seq {
+			t.Fatalf("tick %d: got seq %d keyframe %v, want delta %d", i, got.Seq, got.Keyframe, want.Seq)
+		}
+		if !reflect.DeepEqual(late.players, first.players) {
+			t.Fatalf("tick %d: rebuilt %v, want %v", i, late.players, first.players)
+		}
+	}
+}
+
+func TestResyncRequest(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		// so that every keyframe here is a resync
+		cfg.KeyframeInterval = 1 << 20
+	})
+	c := ts.match(t, "/game", 1)[0]
+	ts.tick(1)
+	last := c.snapshot()
+
+	// a keyframe comes before any further delta, without waiting for a tick
+	c.send(MessageResync, nil)
+	s := c.snapshot()
+	if !s.Keyframe || s.Seq != last.Seq {
+		t.Fatalf("resynced with seq %d keyframe %v, want a keyframe of %d", s.Seq, s.Keyframe, last.Seq)
+	}
+	ts.tick(1)
+	if s := c.snapshot(); s.Keyframe || s.Seq != last.Seq+1 {
+		t.Fatalf("then seq %d keyframe %v, want delta %d", s.Seq, s.Keyframe, last.Seq+1)
+	}
+
+	// not again so soon
+	c.send(MessageResync, nil)
+	if e := c.errorMessage(); e.Code != ErrRateLimited {
+		t.Fatalf("got %+v, want %s", e, ErrRateLimited)
+	}
+	ts.clock.Advance(minResyncInterval)
+	c.send(MessageResync, nil)
+	for {
+		env := c.message()
+		if env.Type == MessageError {
+			t.Fatalf("resync after %v: %s", minResyncInterval, env.Data)
+		}
+		if env.Type != MessageSnapshot {
+			continue
+		}
+		var s Snapshot
+		c.decode(env.Data, &s)
+		if s.Keyframe {
+			break
+		}
+	}
+}
+
+func TestSelfStamina(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 2)
+	runner, walker := clients[0], clients[1]
+	// 50 a second at 24ms a tick drains 1.2 a tick
+	var last Self
+	for i := 0; i < 10; i++ {
+		runner.input("right", "sprint")
+		runner.sync()
+		ts.tick(1)
+		env := runner.skipTo(MessageSnapshot, nil)
+		var s Snapshot
+		runner.decode(env, &s)
+		if s.Self == nil {
+			t.Fatal("no state of its own")
+		}
+		last = *s.Self
+		// others only get it about themselves
+		if w := walker.snapshot(); w.Self == nil || w.Self.Stamina != 100 {
+			t.Fatalf("walker's own state %+v", w.Self)
+		}
+		if n := strings.Count(string(env), `"stamina"`); n != 1 {
+			t.Fatalf("stamina %d times in %s, want once for self", n, env)
+		}
+	}
+	if last.Stamina != 88 || last.Exhausted {
+		t.Fatalf("after 10 ticks sprinting %+v, want 88 stamina", last)
+	}
+}
+
+func TestSelfDashCooldown(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) { cfg.DashCooldown = 240 * time.Millisecond })
+	c := ts.match(t, "/game", 1)[0]
+	c.input("dash")
+	c.sync()
+	ts.tick(1)
+	// counting down a tick at a time until they can dash again
+	for _, want := range []int64{240, 216, 192, 168, 144, 120, 96, 72, 48, 24, 0, 0} {
+		s := c.snapshot()
+		if s.Self == nil || s.Self.DashCooldownMS != want {
+			t.Fatalf("own state %+v, want %dms of cooldown", s.Self, want)
+		}
+		ts.tick(1)
+	}
+}
+
+func TestProjectilesInSnapshot(t *testing.T) {
+	ts := startServer(t, nil, nil)
+	clients := ts.match(t, "/game", 2)
+	shooter := clients[0]
+	shooter.send(MessageInput, InputMessage{Shoot: &sim.Vector{X: 0, Y: -1}})
+	shooter.sync()
+	ts.tick(1)
+	for _, c := range clients {
+		s := c.snapshot()
+		if len(s.Projectiles) != 1 || s.Projectiles[0].Owner != shooter.welcome.ID || s.Projectiles[0].Vel.Y >= 0 {
+			t.Fatalf("projectiles %+v, want one shot upwards by %s", s.Projectiles, shooter.welcome.ID)
+		}
+	}
+}
+
+func TestProtectionInSnapshot(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) { cfg.SpawnProtection = 120 * time.Millisecond })
+	c := ts.match(t, "/game", 1)[0]
+	// five ticks from joining, one already gone by the first snapshot.
+	// Clients count it down themselves; deltas only say when it is over.
+	for i, want := range []int{4, 4, 4, 4, 0} {
+		if p := c.me(); p.Invulnerable != want {
+			t.Fatalf("tick %d: %d protected ticks, want %d", i, p.Invulnerable, want)
+		}
+		ts.tick(1)
+		c.snapshot()
+	}
+}
+
+func TestLeaderboardSerialized(t *testing.T) {
+	r := benchRoom(t, 4)
+	r.srv.cfg.LeaderboardSize = 3
+	// ids in the order they joined
+	ids := make([]string, 0, 4)
+	for _, st := range r.gamestate.Leaderboard(4) {
+		ids = append(ids, st.PlayerID)
+	}
+	for i, score := range []int{1, 3, 1, 0} {
+		r.gamestate.Players[ids[i]].Score = score
+	}
+	var s Snapshot
+	if err := json.Unmarshal(encode(MessageSnapshot, r.snapshot()).msg, &ServerMessage{Data: &s}); err != nil {
+		t.Fatal(err)
+	}
+	want := []sim.Standing{{PlayerID: ids[1], Score: 3}, {PlayerID: ids[0], Score: 1}, {PlayerID: ids[2], Score: 1}}
+	if !reflect.DeepEqual(s.Leaderboard, want) {
+		t.Fatalf("leaderboard %+v, want %+v", s.Leaderboard, want)
+	}
+}
+
+func TestBoostInSnapshot(t *testing.T) {
+	r := benchRoom(t, 1)
+	var id string
+	for id = range r.gamestate.Players {
+	}
+	r.gamestate.Players[id].Boost = 7
+	r.gamestate.PowerUps = []*sim.PowerUp{{ID: 2, Kind: sim.PowerSpeed, X: 10, Y: 20, TTL: 5}}
+	var s Snapshot
+	if err := json.Unmarshal(encode(MessageSnapshot, r.snapshot()).msg, &ServerMessage{Data: &s}); err != nil {
+		t.Fatal(err)
+	}
+	if p := s.Players[id]; p.Boost != 7 {
+		t.Fatalf("player %+v, want 7 boosted ticks", p)
+	}
+	// how long a power-up has left is the server's business
+	if want := []sim.PowerUp{{ID: 2, Kind: sim.PowerSpeed, X: 10, Y: 20}}; !reflect.DeepEqual(s.PowerUps, want) {
+		t.Fatalf("power-ups %+v, want %+v", s.PowerUps, want)
+	}
+}
+
+func TestFlagsInSnapshot(t *testing.T) {
+	r := benchRoom(t, 2)
+	r.settings.Mode = ModeCTF
+	var ids []string
+	for id := range r.gamestate.Players {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	a, b := r.gamestate.Players[ids[0]], r.gamestate.Players[ids[1]]
+	a.Team, b.Team = 1, 2
+	rules := r.settings.Rules(r.srv.cfg.Tick)
+	home, enemy := rules.Base(1), rules.Base(2)
+	b.X, b.Y = float64(home.X), float64(home.Y+100)
+
+	// tick puts a at x, y, runs a tick and returns what the room then
+	// sends
+	tick := func(x, y int) Snapshot {
+		a.X, a.Y = float64(x), float64(y)
+		r.tick(r.srv.cfg.Clock.Now())
+		drainAll(r)
+		_, s := sent(t, r.snapshot())
+		return s
+	}
+	s := tick(enemy.X, enemy.Y)
+	if len(s.Flags) != 2 || s.Flags[1].Carrier != ids[0] {
+		t.Fatalf("flags %+v", s.Flags)
+	}
+	if !reflect.DeepEqual(s.Room.TeamScores, []int{0, 0}) {
+		t.Fatalf("team scores %v", s.Room.TeamScores)
+	}
+	// the flag is where its carrier is
+	s = tick(enemy.X-200, enemy.Y+50)
+	if f := s.Flags[1]; f.X != enemy.X-200 || f.Y != enemy.Y+50 {
+		t.Fatalf("flag %+v", f)
+	}
+	s = tick(home.X, home.Y)
+	if f := s.Flags[1]; f.Carrier != "" || f.X != enemy.X || f.Y != enemy.Y {
+		t.Fatalf("captured flag %+v", f)
+	}
+	if !reflect.DeepEqual(s.Room.TeamScores, []int{1, 0}) {
+		t.Fatalf("team scores %v, want [1 0]", s.Room.TeamScores)
+	}
+}
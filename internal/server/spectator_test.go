@@ -0,0 +1,78 @@
+package server
+
+import "testing"
+
+func TestSpectatorWatches(t *testing.T) {
+	b := newFakeBroker()
+	ts := startServer(t, b, nil)
+	player := ts.match(t, "/game", 1)[0]
+	spec := ts.dial(t, "/game?mode=spectator")
+	if !spec.welcome.Spectator {
+		t.Fatal("welcomed as a player")
+	}
+	ts.tick(1)
+	if s := spec.snapshot(); s.Room.Spectators != 1 || s.Room.Players != 1 {
+		t.Fatalf("room %+v, want 1 player and 1 spectator", s.Room)
+	}
+	if _, ok := spec.players[player.welcome.ID]; !ok {
+		t.Fatal("spectator doesn't see the player")
+	}
+
+	// the spectator sees the player move
+	player.input("right")
+	if !moves(ts, spec, player.welcome.ID) {
+		t.Fatal("spectator never saw the player move")
+	}
+	sent := len(b.inputs(t))
+
+	// but can't move anything itself
+	spec.input("left")
+	if e := spec.errorMessage(); e.Code != ErrSpectating {
+		t.Fatalf("got %+v, want %s", e, ErrSpectating)
+	}
+	if n := len(b.inputs(t)); n != sent {
+		t.Fatalf("%d inputs published for a spectator", n-sent)
+	}
+	still := spec.players[player.welcome.ID]
+	ts.tick(3)
+	for i := 0; i < 3; i++ {
+		spec.snapshot()
+	}
+	if p := spec.players[player.welcome.ID]; p.X != still.X || p.Y != still.Y {
+		t.Fatalf("player moved from %v,%v to %v,%v", still.X, still.Y, p.X, p.Y)
+	}
+
+	// and isn't in anyone's snapshots
+	player.until(func() bool { return len(player.players) == 1 })
+	if _, ok := player.players[spec.welcome.ID]; ok {
+		t.Fatal("spectator in the player's snapshot")
+	}
+	if _, ok := spec.players[spec.welcome.ID]; ok || len(spec.players) != 1 {
+		t.Fatalf("spectator sees %d players, want only the player", len(spec.players))
+	}
+}
+
+func TestSpectatorCap(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.MaxPlayers = 1
+		cfg.MaxSpectators = 2
+	})
+	ts.dial(t, "/game")
+	// spectators don't take player slots
+	for i := 0; i < 2; i++ {
+		if c := ts.dial(t, "/game?mode=spectator"); !c.welcome.Spectator {
+			t.Fatal("welcomed as a player")
+		}
+	}
+	// but have their own cap
+	if code := ts.connect(t, "/game?mode=spectator", nil).closeCode(); code != CloseRoomFull {
+		t.Fatalf("closed with %d, want %d", code, CloseRoomFull)
+	}
+	if code := ts.connect(t, "/game", nil).closeCode(); code != CloseRoomFull {
+		t.Fatalf("closed with %d, want %d", code, CloseRoomFull)
+	}
+	rooms := ts.listRooms()
+	if len(rooms) != 1 || rooms[0].Players != 1 || rooms[0].Spectators != 2 {
+		t.Fatalf("rooms %+v, want 1 player and 2 spectators", rooms)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// PlayerStats are a player's sim.Stats as the match_over event and GET
+// /rooms/{room}/stats report them, distance in whole pixels
+type PlayerStats struct {
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+	Distance int    `json:"distance"`
+	Inputs   int    `json:"inputs"`
+	Kills    int    `json:"kills"`
+	Deaths   int    `json:"deaths"`
+	Coins    int    `json:"coins"`
+	ItMS     int64  `json:"it_ms"`
+}
+
+// stats lists every player's stats for the round so far, by id
+func (r *Room) stats() []PlayerStats {
+	out := make([]PlayerStats, 0, len(r.gamestate.Players))
+	for id, p := range r.gamestate.Players {
+		st := p.Stats
+		out = append(out, PlayerStats{
+			PlayerID: id,
+			Name:     p.Name,
+			Distance: int(math.Round(st.Distance)),
+			Inputs:   st.Inputs,
+			Kills:    st.Kills,
+			Deaths:   st.Deaths,
+			Coins:    st.Coins,
+			ItMS:     int64(st.ItTicks) * r.srv.cfg.Tick.Milliseconds(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].PlayerID < out[j].PlayerID
+	})
+	return out
+}
+
+// liveStats asks the room for its stats, since only the room goroutine may
+// read the world
+func (r *Room) liveStats() ([]PlayerStats, error) {
+	reply := make(chan []PlayerStats, 1)
+	select {
+	case r.statsRequests <- reply:
+	case <-r.done:
+		return nil, errRoomClosed
+	}
+	return <-reply, nil
+}
+
+// handleRoomStats serves GET /rooms/{room}/stats, room being the name of a
+// public room or the join code of a private one
+func (s *Server) handleRoomStats(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "stats" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.roomsLock.Lock()
+	room, ok := s.rooms[parts[0]]
+	if !ok {
+		room, ok = s.private[parts[0]]
+	}
+	s.roomsLock.Unlock()
+	if !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+	stats, err := room.liveStats()
+	if err != nil {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestRoomStats(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.MatchDuration = 20 * cfg.Tick
+		cfg.Intermission = 2 * cfg.Tick
+		cfg.AfterMatch = AfterMatchRestart
+	})
+	c := ts.match(t, "/game", 1)[0]
+	start := c.me()
+	for i := 0; i < 10; i++ {
+		c.input("right")
+		c.sync()
+		ts.tick(1)
+		c.snapshot()
+	}
+	moved := c.me().X - start.X
+
+	var stats []PlayerStats
+	ts.get(t, "/rooms/lobby/stats", &stats)
+	if len(stats) != 1 || stats[0].PlayerID != c.welcome.ID || stats[0].Name != start.Name || stats[0].Inputs != 10 {
+		t.Fatalf("stats %+v, want the 10 inputs of %s", stats, c.welcome.ID)
+	}
+	if math.Abs(float64(stats[0].Distance)-moved) > 1 {
+		t.Fatalf("went %d, want %v", stats[0].Distance, moved)
+	}
+
+	// the results have them as they were at the end
+	c.input()
+	c.sync()
+	ts.tick(9)
+	var over MatchOverEvent
+	c.event(EventMatchOver, &over)
+	if len(over.Stats) != 1 || over.Stats[0].Distance < stats[0].Distance || over.Stats[0].Inputs != 11 {
+		t.Fatalf("results %+v after %+v", over.Stats, stats)
+	}
+
+	// and the next round starts them over
+	ts.tick(2)
+	c.phase(PhasePlaying)
+	ts.get(t, "/rooms/lobby/stats", &stats)
+	if len(stats) != 1 || stats[0].Distance != 0 || stats[0].Inputs != 0 {
+		t.Fatalf("stats %+v in a new round", stats)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/rooms/nowhere/stats", http.StatusNotFound},
+		{http.MethodGet, "/rooms/lobby/scores", http.StatusNotFound},
+		{http.MethodPost, "/rooms/lobby/stats", http.StatusMethodNotAllowed},
+	} {
+		if status, body := ts.request(t, tt.method, tt.path, nil); status != tt.want {
+			t.Fatalf("%s %s: %d %s, want %d", tt.method, tt.path, status, body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+type teamSwitch struct {
+	c     *client
+	reply chan error
+}
+
+// switchTeam asks the room to move c's player to the other team
+func (r *Room) switchTeam(c *client) error {
+	req := teamSwitch{c: c, reply: make(chan error, 1)}
+	select {
+	case r.switches <- req:
+	case <-r.done:
+		return errRoomClosed
+	}
+	return <-req.reply
+}
+
+// applySwitch runs on the room goroutine, so the balance check can't race
+// joins or other switches
+func (r *Room) applySwitch(req teamSwitch) error {
+	if r.clients[req.c.id] != req.c {
+		return errRoomClosed
+	}
+	if !r.settings.Rules(r.srv.cfg.Tick).Teams {
+		return &RouteError{ErrNoTeams, "this room has no teams"}
+	}
+	if !r.gamestate.SwitchTeam(req.c.id, r.settings.TeamDelta) {
+		return &RouteError{ErrUnbalanced, "switching would unbalance the teams"}
+	}
+	return nil
+}
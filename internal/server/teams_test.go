@@ -0,0 +1,101 @@
+package server
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// teamsOf is how many players c last saw on each team
+func teamsOf(c *testClient) map[int]int {
+	teams := map[int]int{}
+	for _, p := range c.players {
+		teams[p.Team]++
+	}
+	return teams
+}
+
+func TestTeamsUnderConcurrentJoins(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.Teams = true
+		cfg.MaxPlayers = 20
+	})
+	const n = 15
+	var wg sync.WaitGroup
+	conns := make(chan *websocket.Conn, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := ts.open("/game", nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			conns <- conn
+		}()
+	}
+	wg.Wait()
+	close(conns)
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for conn := range conns {
+		defer conn.Close()
+	}
+	c := ts.dial(t, "/game")
+	for len(c.players) != n+1 {
+		ts.tick(1)
+		c.snapshot()
+	}
+	if teams := teamsOf(c); teams[1] != (n+1)/2 || teams[2] != (n+1)/2 {
+		t.Fatalf("teams %v", teams)
+	}
+}
+
+func TestSwitchTeamBalance(t *testing.T) {
+	ts := startServer(t, nil, func(cfg *Config) { cfg.Teams = true })
+	clients := ts.match(t, "/game", 3)
+	team := func(c *testClient) int {
+		return clients[0].players[c.welcome.ID].Team
+	}
+	var on1, on2 []*testClient
+	for _, c := range clients {
+		if team(c) == 1 {
+			on1 = append(on1, c)
+		} else {
+			on2 = append(on2, c)
+		}
+	}
+	if len(on1) != 2 || len(on2) != 1 {
+		t.Fatalf("teams %v", teamsOf(clients[0]))
+	}
+
+	// two against one can become one against two
+	on1[0].send(MessageSwitchTeam, nil)
+	on1[0].sync()
+	ts.tick(1)
+	clients[0].snapshot()
+	if team(on1[0]) != 2 {
+		t.Fatalf("still on team %d", team(on1[0]))
+	}
+	// but not none against three
+	on1[1].send(MessageSwitchTeam, nil)
+	if e := on1[1].errorMessage(); e.Code != ErrUnbalanced {
+		t.Fatalf("got %+v, want %s", e, ErrUnbalanced)
+	}
+	ts.tick(1)
+	clients[0].snapshot()
+	if teams := teamsOf(clients[0]); teams[1] != 1 || teams[2] != 2 {
+		t.Fatalf("teams %v", teams)
+	}
+
+	solo := startServer(t, nil, nil).dial(t, "/game")
+	solo.send(MessageSwitchTeam, nil)
+	if e := solo.errorMessage(); e.Code != ErrNoTeams {
+		t.Fatalf("got %+v, want %s", e, ErrNoTeams)
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+// Map is a layout loaded from MapFile or MapDir
+type Map struct {
+	// the size of the world, the server's when left out
+	Width     int        `json:"width,omitempty"`
+	Height    int        `json:"height,omitempty"`
+	Obstacles []sim.Rect `json:"obstacles"`
+	// where players start, anywhere free when empty
+	Spawns []sim.Point `json:"spawns"`
+	// where team 1's and team 2's flags stand in capture the flag, near
+	// the left and right edges when left out
+	Bases []sim.Point `json:"bases"`
+	// the zone of king of the hill, in the middle when left out
+	Hill *sim.Circle `json:"hill"`
+}
+
+// LoadMap reads a map file. Fields it doesn't know are an error so a typo
+// doesn't quietly drop an obstacle.
+func LoadMap(path string) (Map, error) {
+	var m Map
+	f, err := os.Open(path)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return m, err
+	}
+	if len(m.Bases) != 0 && len(m.Bases) != sim.Teams {
+		return m, fmt.Errorf("need a base for each of the %d teams, got %d", sim.Teams, len(m.Bases))
+	}
+	if m.Width < 0 || m.Height < 0 {
+		return m, fmt.Errorf("size must not be negative, got %dx%d", m.Width, m.Height)
+	}
+	if m.Hill != nil && m.Hill.Radius <= 0 {
+		return m, fmt.Errorf("hill must have a positive radius, got %d", m.Hill.Radius)
+	}
+	for i, o := range m.Obstacles {
+		if o.Width <= 0 || o.Height <= 0 {
+			return m, fmt.Errorf("obstacle %d must have a positive size, got %dx%d", i, o.Width, o.Height)
+		}
+	}
+	return m, nil
+}
+
+// LoadMaps reads every .json file in dir as a map named after the file
+func LoadMaps(dir string) (map[string]Map, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no maps in %s", dir)
+	}
+	maps := make(map[string]Map, len(paths))
+	for _, path := range paths {
+		m, err := LoadMap(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath.Base(path), err)
+		}
+		maps[strings.TrimSuffix(filepath.Base(path), ".json")] = m
+	}
+	return maps, nil
+}
+
+// size is how big a world on m is when the server's default is width by
+// height
+func (m Map) size(width, height int) (int, int) {
+	if m.Width > 0 {
+		width = m.Width
+	}
+	if m.Height > 0 {
+		height = m.Height
+	}
+	return width, height
+}
+
+// mapNames lists the maps of cfg in order, for errors and GET /maps
+func (cfg Config) mapNames() []string {
+	names := make([]string, 0, len(cfg.Maps))
+	for name := range cfg.Maps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fits checks that everything on m lies inside a world of width by height
+func (m Map) fits(width, height int) error {
+	if width < minWorldSize || width > maxWorldSize || height < minWorldSize || height > maxWorldSize {
+		return fmt.Errorf("size must be between %d and %d, got %dx%d", minWorldSize, maxWorldSize, width, height)
+	}
+	if i := outside(m.Obstacles, width, height); i >= 0 {
+		return fmt.Errorf("obstacle %d lies outside the %dx%d world", i, width, height)
+	}
+	if i := outsidePoint(m.Spawns, width, height); i >= 0 {
+		return fmt.Errorf("spawn point %d lies outside the %dx%d world", i, width, height)
+	}
+	if i := outsidePoint(m.Bases, width, height); i >= 0 {
+		return fmt.Errorf("base %d lies outside the %dx%d world", i, width, height)
+	}
+	if outsideCircle(m.Hill, width, height) {
+		return fmt.Errorf("hill lies outside the %dx%d world", width, height)
+	}
+	return nil
+}
+
+// outside returns the index of the first obstacle not inside a world of
+// width by height, or -1
+func outside(obstacles []sim.Rect, width, height int) int {
+	for i, o := range obstacles {
+		if o.X < 0 || o.Y < 0 || o.X+o.Width > width || o.Y+o.Height > height {
+			return i
+		}
+	}
+	return -1
+}
+
+// outsidePoint is outside for spawn points
+func outsidePoint(points []sim.Point, width, height int) int {
+	for i, p := range points {
+		if p.X < 0 || p.Y < 0 || p.X > width || p.Y > height {
+			return i
+		}
+	}
+	return -1
+}
+
+// outsideCircle reports whether c is set and its centre is not inside a
+// world of width by height
+func outsideCircle(c *sim.Circle, width, height int) bool {
+	return c != nil && outsidePoint([]sim.Point{{X: c.X, Y: c.Y}}, width, height) >= 0
+}
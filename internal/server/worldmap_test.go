@@ -0,0 +1,176 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stevenwhitehead/multiplayer-backend/internal/sim"
+)
+
+func TestLoadMap(t *testing.T) {
+	m, err := LoadMap("testdata/arena.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Obstacles) != 5 || len(m.Spawns) != 6 || m.Obstacles[4] != (sim.Rect{X: 380, Y: 240, Width: 40, Height: 120}) {
+		t.Fatalf("loaded %+v", m)
+	}
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		json, want string
+	}{
+		{`{"obstacles":[{"x":1,"y":1,"w":5,"h":5}]}`, "unknown field"},
+		{`{"obstacles":[{"x":1,"y":1,"width":0,"height":5}]}`, "positive size"},
+		{`{"obstacles":[`, "unexpected EOF"},
+	} {
+		path := filepath.Join(dir, "bad.json")
+		if err := ioutil.WriteFile(path, []byte(tt.json), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadMap(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error mentioning %q", tt.json, err, tt.want)
+		}
+	}
+}
+
+func TestMapFileConfig(t *testing.T) {
+	setenv(t, "MAP_FILE", "testdata/arena.json")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MapFile != "testdata/arena.json" || len(cfg.Obstacles) != 5 || len(cfg.Spawns) != 6 {
+		t.Fatalf("map not loaded: %+v", cfg)
+	}
+	// the arena doesn't fit a smaller world
+	setenv(t, "WORLD_WIDTH", "500")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "lies outside") {
+		t.Fatalf("got %v, want the obstacles outside the world", err)
+	}
+	setenv(t, "MAP_FILE", "testdata/nowhere.json")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "MAP_FILE") {
+		t.Fatalf("got %v, want MAP_FILE", err)
+	}
+}
+
+func TestObstaclesInKeyframe(t *testing.T) {
+	m, err := LoadMap("testdata/arena.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.Obstacles = m.Obstacles
+	})
+	clients := ts.match(t, "/game", 3)
+	c := clients[0]
+	ts.tick(ts.cfg.KeyframeInterval)
+	s := c.keyframe()
+	if s.World == nil || !reflect.DeepEqual(s.World.Obstacles, m.Obstacles) {
+		t.Fatalf("keyframe world %+v, want the arena's obstacles", s.World)
+	}
+	// and nobody started inside one
+	rules := ts.cfg.RoomSettings().Rules(ts.cfg.Tick)
+	rules.Obstacles = m.Obstacles
+	for id, p := range c.players {
+		if !rules.Free(p.X, p.Y) {
+			t.Fatalf("%s at %v,%v", id, p.X, p.Y)
+		}
+	}
+}
+
+func TestLoadMaps(t *testing.T) {
+	maps, err := LoadMaps("testdata/maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arena, pillars := maps["arena"], maps["pillars"]
+	if len(maps) != 2 || len(arena.Obstacles) != 5 || len(pillars.Obstacles) != 6 || pillars.Hill == nil {
+		t.Fatalf("loaded %+v", maps)
+	}
+	if _, err := LoadMaps(t.TempDir()); err == nil || !strings.Contains(err.Error(), "no maps") {
+		t.Fatalf("got %v, want no maps", err)
+	}
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte(`{"width":-1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadMaps(dir); err == nil || !strings.Contains(err.Error(), "bad.json") {
+		t.Fatalf("got %v, want bad.json named", err)
+	}
+}
+
+func TestMapDirConfig(t *testing.T) {
+	setenv(t, "MAP_DIR", "testdata/maps")
+	setenv(t, "MAP", "pillars")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// public rooms are on MAP
+	if rs := cfg.RoomSettings(); rs.Map != "pillars" || rs.WorldWidth != 1200 || rs.WorldHeight != 800 || len(rs.Obstacles) != 6 {
+		t.Fatalf("room settings %+v, want pillars", rs)
+	}
+	setenv(t, "MAP", "maze")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), `unknown map "maze"`) {
+		t.Fatalf("got %v, want the unknown map", err)
+	}
+	setenv(t, "MAP_DIR", "testdata/nowhere")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "MAP_DIR") {
+		t.Fatalf("got %v, want MAP_DIR", err)
+	}
+}
+
+func TestRoomsOnMaps(t *testing.T) {
+	maps, err := LoadMaps("testdata/maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startServer(t, nil, func(cfg *Config) {
+		cfg.MapDir = "testdata/maps"
+		cfg.Maps = maps
+	})
+	var listed []MapInfo
+	ts.get(t, "/maps", &listed)
+	if len(listed) != 2 || listed[0].Name != "arena" || listed[1].Name != "pillars" || listed[1].Width != 1200 {
+		t.Fatalf("GET /maps %+v", listed)
+	}
+
+	for _, tt := range []struct {
+		name          string
+		width, height int
+	}{
+		{"arena", 800, 600},
+		{"pillars", 1200, 800},
+	} {
+		code := ts.createRoom(t, map[string]interface{}{"map": tt.name})
+		c := ts.dial(t, "/game?code="+code)
+		s := c.snapshot()
+		if !s.Keyframe || s.World == nil {
+			t.Fatalf("%s: first snapshot %+v, want a keyframe", tt.name, s)
+		}
+		if s.World.Width != tt.width || s.World.Height != tt.height || !reflect.DeepEqual(s.World.Obstacles, maps[tt.name].Obstacles) {
+			t.Fatalf("%s: keyframe world %+v", tt.name, s.World)
+		}
+		// and players start where the map has them
+		c.play()
+		ts.tick(1)
+		c.joined()
+		me := c.me()
+		spawned := false
+		for _, sp := range maps[tt.name].Spawns {
+			spawned = spawned || me.X == float64(sp.X) && me.Y == float64(sp.Y)
+		}
+		if !spawned {
+			t.Fatalf("%s: spawned at %v,%v", tt.name, me.X, me.Y)
+		}
+	}
+
+	status, body := ts.request(t, http.MethodPost, "/rooms", map[string]interface{}{"map": "maze"})
+	if status != http.StatusBadRequest || !strings.Contains(string(body), `map must be one of "arena", "pillars", got "maze"`) {
+		t.Fatalf("%d %s, want the unknown map", status, body)
+	}
+}
@@ -0,0 +1,110 @@
+package sim
+
+import "sort"
+
+// Checkpoint is what a world can be brought back from when the process
+// running it goes away: who was in it, where and with what score. What only
+// lasts a moment, like velocities, cooldowns and shots in flight, is left
+// out, and coins, power-ups and flags come back as they would in a new
+// world.
+type Checkpoint struct {
+	// in the order they joined
+	Players      []PlayerCheckpoint `json:"players"`
+	TeamScores   []int              `json:"team_scores,omitempty"`
+	HillProgress map[string]int     `json:"hill_progress,omitempty"`
+}
+
+// PlayerCheckpoint is a player as kept in a Checkpoint
+type PlayerCheckpoint struct {
+	ID    string  `json:"id"`
+	Name  string  `json:"name"`
+	Color string  `json:"color"`
+	Team  int     `json:"team,omitempty"`
+	Bot   bool    `json:"bot,omitempty"`
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	HP    int     `json:"hp"`
+	Dead  bool    `json:"dead,omitempty"`
+	It    bool    `json:"it,omitempty"`
+	Score int     `json:"score"`
+	Stats Stats   `json:"stats"`
+	// kept so inputs sent before the checkpoint aren't applied again
+	LastInputSeq int `json:"last_input_seq,omitempty"`
+}
+
+// Checkpoint returns what w would be restored from. It shares nothing with
+// w, so it can be kept while w goes on stepping.
+func (w *World) Checkpoint() Checkpoint {
+	ids := make([]string, 0, len(w.Players))
+	for id := range w.Players {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return w.Players[ids[i]].joined < w.Players[ids[j]].joined
+	})
+	c := Checkpoint{Players: make([]PlayerCheckpoint, len(ids))}
+	for i, id := range ids {
+		p := w.Players[id]
+		c.Players[i] = PlayerCheckpoint{
+			ID:           id,
+			Name:         p.Name,
+			Color:        p.Color,
+			Team:         p.Team,
+			Bot:          p.Bot,
+			X:            p.X,
+			Y:            p.Y,
+			HP:           p.HP,
+			Dead:         p.Dead,
+			It:           p.It,
+			Score:        p.Score,
+			Stats:        p.Stats,
+			LastInputSeq: p.LastInputSeq,
+		}
+	}
+	c.TeamScores = append([]int(nil), w.TeamScores...)
+	if len(w.HillProgress) > 0 {
+		c.HillProgress = make(map[string]int, len(w.HillProgress))
+		for k, v := range w.HillProgress {
+			c.HillProgress[k] = v
+		}
+	}
+	return c
+}
+
+// Restore puts the players of c into w, which should have nobody in it yet,
+// each where they were with their score. A player who was dead, or whose
+// spot the rules no longer leave free, starts over at a spawn point instead,
+// and only with Teams do players keep their team.
+func (w *World) Restore(c Checkpoint, rules Rules) {
+	for _, pc := range c.Players {
+		p := w.Join(pc.ID, rules)
+		p.Name = pc.Name
+		p.Bot = pc.Bot
+		if pc.Color != "" {
+			p.Color = pc.Color
+		}
+		if rules.Teams && pc.Team != 0 {
+			p.Team = pc.Team
+		}
+		if !pc.Dead && rules.Free(pc.X, pc.Y) {
+			p.X, p.Y = pc.X, pc.Y
+			if pc.HP > 0 && pc.HP <= rules.MaxHP {
+				p.HP = pc.HP
+			}
+		}
+		p.fromX, p.fromY = p.X, p.Y
+		p.It = pc.It
+		p.Score = pc.Score
+		p.Stats = pc.Stats
+		p.LastInputSeq = pc.LastInputSeq
+	}
+	if rules.Teams && len(c.TeamScores) == Teams {
+		w.TeamScores = append([]int(nil), c.TeamScores...)
+	}
+	if len(c.HillProgress) > 0 {
+		w.HillProgress = make(map[string]int, len(c.HillProgress))
+		for k, v := range c.HillProgress {
+			w.HillProgress[k] = v
+		}
+	}
+}
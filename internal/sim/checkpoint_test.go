@@ -0,0 +1,80 @@
+package sim
+
+import "testing"
+
+func TestCheckpointRestore(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	a := place(w, "a", 200, 300, rules)
+	a.Name, a.Color, a.HP, a.Score = "Ann", "#e6194b", 50, 4
+	a.Stats = Stats{Distance: 120, Inputs: 9, Kills: 2}
+	a.LastInputSeq = 17
+	b := place(w, "b", 400, 300, rules)
+	b.Bot, b.Dead, b.Score = true, true, 1
+	c := w.Checkpoint()
+	// it shares nothing with the world
+	a.X, a.Score = 10, 99
+	if len(c.Players) != 2 || c.Players[0].ID != "a" || c.Players[1].ID != "b" {
+		t.Fatalf("players %+v, want a then b as they joined", c.Players)
+	}
+
+	r := NewWorld(1)
+	r.Restore(c, rules)
+	ra, rb := r.Players["a"], r.Players["b"]
+	if ra.X != 200 || ra.Y != 300 || ra.HP != 50 || ra.Score != 4 || ra.Name != "Ann" || ra.Color != "#e6194b" {
+		t.Fatalf("a restored as %+v", ra)
+	}
+	if ra.Stats != c.Players[0].Stats || ra.LastInputSeq != 17 || ra.vel != (Vector{}) {
+		t.Fatalf("a restored with %+v, seq %d, going %+v", ra.Stats, ra.LastInputSeq, ra.vel)
+	}
+	// the dead start over at a spawn point, with full health but their score
+	if !rb.Bot || rb.Dead || rb.HP != rules.MaxHP || rb.Score != 1 {
+		t.Fatalf("b restored as %+v", rb)
+	}
+	// and stepping it doesn't move anyone who isn't pressing anything
+	Step(r, nil, rules)
+	if ra.X != 200 || ra.Y != 300 {
+		t.Fatalf("a drifted to %v,%v", ra.X, ra.Y)
+	}
+}
+
+func TestRestoreIntoWall(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	place(w, "a", 250, 300, rules).HP = 50
+	c := w.Checkpoint()
+
+	// the map changed and a's spot is inside a wall now
+	rules.Obstacles = []Rect{{X: 200, Y: 250, Width: 100, Height: 100}}
+	r := NewWorld(1)
+	r.Restore(c, rules)
+	a := r.Players["a"]
+	if !rules.Free(a.X, a.Y) || (a.X == 250 && a.Y == 300) || a.HP != rules.MaxHP {
+		t.Fatalf("restored at %v,%v with %d hp, want a free spawn point", a.X, a.Y, a.HP)
+	}
+}
+
+func TestRestoreTeams(t *testing.T) {
+	rules := testRules()
+	rules.Teams = true
+	w := NewWorld(1)
+	place(w, "a", 200, 300, rules)
+	place(w, "b", 400, 300, rules)
+	w.TeamScores = []int{3, 5}
+	c := w.Checkpoint()
+	c.Players[0].Team, c.Players[1].Team = 2, 2
+
+	r := NewWorld(1)
+	r.Restore(c, rules)
+	if r.Players["a"].Team != 2 || r.Players["b"].Team != 2 || len(r.TeamScores) != 2 || r.TeamScores[0] != 3 || r.TeamScores[1] != 5 {
+		t.Fatalf("teams %d and %d scoring %v", r.Players["a"].Team, r.Players["b"].Team, r.TeamScores)
+	}
+
+	// and without them nobody is on one
+	rules.Teams = false
+	r = NewWorld(1)
+	r.Restore(c, rules)
+	if r.Players["a"].Team != 0 || r.Players["b"].Team != 0 || r.TeamScores != nil {
+		t.Fatalf("teams %d and %d scoring %v without Teams", r.Players["a"].Team, r.Players["b"].Team, r.TeamScores)
+	}
+}
@@ -0,0 +1,91 @@
+package sim
+
+import "math"
+
+// placeTries is how many random places are tried for a coin or power-up
+// each tick before leaving it for the next one
+const placeTries = 16
+
+// Coin is worth CoinPoints to the first player to reach it. It sits at
+// whole pixels.
+type Coin struct {
+	ID uint32 `json:"id"`
+	X  int    `json:"x"`
+	Y  int    `json:"y"`
+}
+
+// Pickup is a coin or power-up a player collected, whichever is set
+type Pickup struct {
+	PlayerID string `json:"player_id"`
+	Coin     uint32 `json:"coin,omitempty"`
+	PowerUp  uint32 `json:"power_up,omitempty"`
+}
+
+// coins gives the coins living players have reached to them and puts new
+// ones down, keeping Coins of them in the world once each collected one's
+// CoinRespawn is up
+func (w *World) coins(rules Rules) {
+	waits := w.coinWaits[:0]
+	for _, t := range w.coinWaits {
+		if t > 1 {
+			waits = append(waits, t-1)
+		}
+	}
+	w.coinWaits = waits
+
+	kept := w.Coins[:0]
+	for _, c := range w.Coins {
+		id := w.collector(c.X, c.Y, rules)
+		if id == "" {
+			kept = append(kept, c)
+			continue
+		}
+		w.Pickups = append(w.Pickups, Pickup{PlayerID: id, Coin: c.ID})
+		w.Players[id].Stats.Coins++
+		w.award(id, rules.CoinPoints)
+		if t := rules.ticks(rules.CoinRespawn); t > 0 {
+			w.coinWaits = append(w.coinWaits, t)
+		}
+	}
+	w.Coins = kept
+
+	for len(w.Coins)+len(w.coinWaits) < rules.Coins {
+		x, y, ok := w.randomFree(rules)
+		if !ok {
+			return
+		}
+		w.lastCoin++
+		w.Coins = append(w.Coins, &Coin{ID: w.lastCoin, X: x, Y: y})
+	}
+}
+
+// collector is the living player nearest x, y within CoinRadius of it, the
+// lower id on a tie, or "" if nobody reached it
+func (w *World) collector(x, y int, rules Rules) string {
+	best, bestD := "", math.Inf(1)
+	for id, p := range w.Players {
+		if p.Dead {
+			continue
+		}
+		d := rules.dist(p.X, p.Y, float64(x), float64(y))
+		if d > float64(rules.CoinRadius) {
+			continue
+		}
+		if d < bestD || d == bestD && id < best {
+			best, bestD = id, d
+		}
+	}
+	return best
+}
+
+// randomFree picks a random place a player could stand, for something to
+// be put down there
+func (w *World) randomFree(rules Rules) (int, int, bool) {
+	for i := 0; i < placeTries; i++ {
+		x, y := w.rand.Intn(rules.Width+1), w.rand.Intn(rules.Height+1)
+		if rules.Free(float64(x), float64(y)) {
+			return x, y, true
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,97 @@
+package sim
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// coinAt is a world with no coins of its own and coin 1 at 400,300
+func coinAt() *World {
+	w := NewWorld(1)
+	w.Coins = []*Coin{{ID: 1, X: 400, Y: 300}}
+	w.lastCoin = 1
+	return w
+}
+
+func TestCoinPickupRadius(t *testing.T) {
+	rules := testRules()
+	rules.Coins = 1
+	// CoinRadius is 20
+	for _, tt := range []struct {
+		x         float64
+		collected bool
+	}{
+		{400, true},
+		{420, true},
+		{421, false},
+	} {
+		w := coinAt()
+		p := place(w, "a", tt.x, 300, rules)
+		Step(w, nil, rules)
+		got := len(w.Pickups) == 1 && w.Pickups[0] == (Pickup{PlayerID: "a", Coin: 1})
+		if got != tt.collected || (p.Score == rules.CoinPoints) != tt.collected {
+			t.Fatalf("%v from the coin: pickups %+v, score %d", tt.x-400, w.Pickups, p.Score)
+		}
+	}
+}
+
+func TestCoinSameTick(t *testing.T) {
+	rules := testRules()
+	w := coinAt()
+	b := place(w, "b", 390, 300, rules)
+	a := place(w, "a", 410, 300, rules)
+	Step(w, nil, rules)
+	// equally near, so the lower id has it
+	if len(w.Pickups) != 1 || w.Pickups[0].PlayerID != "a" || a.Score != 1 || b.Score != 0 {
+		t.Fatalf("pickups %+v", w.Pickups)
+	}
+}
+
+func TestCoinRespawnDelay(t *testing.T) {
+	rules := testRules()
+	rules.Coins = 1
+	rules.CoinRespawn = 500 * time.Millisecond
+	w := coinAt()
+	place(w, "a", 400, 300, rules)
+	Step(w, nil, rules)
+	if len(w.Pickups) != 1 || len(w.Coins) != 0 {
+		t.Fatalf("pickups %+v, coins %+v", w.Pickups, w.Coins)
+	}
+	// out of the way of wherever the next one lands
+	w.Players["a"].Dead = true
+	n := 0
+	for len(w.Coins) == 0 {
+		Step(w, nil, rules)
+		n++
+	}
+	// CoinRespawn is 5 ticks
+	if n != 5 || w.Coins[0].ID != 2 {
+		t.Fatalf("coin %d back %d ticks after the pickup, want coin 2 in 5", w.Coins[0].ID, n)
+	}
+}
+
+func TestCoinsSeeded(t *testing.T) {
+	rules := testRules()
+	rules.Coins = 5
+	places := func(seed int64) []Coin {
+		w := NewWorld(seed)
+		Step(w, nil, rules)
+		var out []Coin
+		for _, c := range w.Coins {
+			out = append(out, *c)
+		}
+		return out
+	}
+	if a := places(1); len(a) != 5 || !reflect.DeepEqual(a, places(1)) {
+		t.Fatalf("seed 1 put down %+v, then %+v", a, places(1))
+	}
+	if reflect.DeepEqual(places(1), places(2)) {
+		t.Fatal("seeds 1 and 2 put the coins in the same places")
+	}
+	for _, c := range places(3) {
+		if !rules.Free(float64(c.X), float64(c.Y)) {
+			t.Fatalf("coin at %d,%d", c.X, c.Y)
+		}
+	}
+}
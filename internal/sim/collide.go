@@ -0,0 +1,78 @@
+package sim
+
+import (
+	"math"
+	"sort"
+)
+
+// collisionPasses bounds how many times overlaps are resolved per tick. A
+// push can cause another overlap in a crowd, so one pass isn't always enough.
+const collisionPasses = 4
+
+// collide pushes overlapping players apart along the line between their
+// centres, each taking half of the correction, or all of it when the other
+// is against the edge of the world. Dead players are left alone. Pairs are
+// visited in id order so the result only depends on the state.
+func collide(state map[string]*Player, rules Rules) {
+	if rules.Radius <= 0 || len(state) < 2 {
+		return
+	}
+	ids := make([]string, 0, len(state))
+	for id, p := range state {
+		if !p.Dead {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	min := 2 * float64(rules.Radius)
+	for pass := 0; pass < collisionPasses; pass++ {
+		moved := false
+		for i, ia := range ids {
+			a := state[ia]
+			for _, ib := range ids[i+1:] {
+				b := state[ib]
+				dx, dy := rules.offset(a.X, b.X, rules.Width), rules.offset(a.Y, b.Y, rules.Height)
+				dist := math.Hypot(dx, dy)
+				if dist >= min {
+					continue
+				}
+				// on top of each other, so split them along x
+				nx, ny := 1.0, 0.0
+				if dist > 0 {
+					nx, ny = dx/dist, dy/dist
+				}
+				if pass == 0 {
+					a.knock(b.X, b.Y, Vector{X: -nx, Y: -ny}, rules.BumpKnockback, rules)
+					b.knock(a.X, a.Y, Vector{X: nx, Y: ny}, rules.BumpKnockback, rules)
+				}
+				overlap := min - dist
+				done := push(a, -nx, -ny, overlap/2, rules)
+				done += push(b, nx, ny, overlap-done, rules)
+				push(a, -nx, -ny, overlap-done, rules)
+				moved = true
+			}
+		}
+		if !moved {
+			return
+		}
+	}
+}
+
+// push moves p by d along (nx, ny) as far as the world allows and returns
+// how far it got along that direction
+func push(p *Player, nx, ny, d float64, rules Rules) float64 {
+	if d <= 0 {
+		return 0
+	}
+	if rules.Wrap {
+		p.X = wrapAxis(p.X+nx*d, float64(rules.Width))
+		p.Y = wrapAxis(p.Y+ny*d, float64(rules.Height))
+		return d
+	}
+	x := clamp(p.X+nx*d, 0, float64(rules.Width))
+	y := clamp(p.Y+ny*d, 0, float64(rules.Height))
+	got := (x-p.X)*nx + (y-p.Y)*ny
+	p.X, p.Y = x, y
+	return got
+}
@@ -0,0 +1,91 @@
+package sim
+
+import (
+	"math"
+	"testing"
+)
+
+// apart fails unless every two players in w are at least two radii apart
+func apart(t *testing.T, w *World, rules Rules) {
+	t.Helper()
+	for ia, a := range w.Players {
+		for ib, b := range w.Players {
+			if ia < ib && math.Hypot(a.X-b.X, a.Y-b.Y) < 2*float64(rules.Radius)-1e-6 {
+				t.Fatalf("%s at %v,%v and %s at %v,%v overlap", ia, a.X, a.Y, ib, b.X, b.Y)
+			}
+		}
+	}
+}
+
+func TestCollideHeadOn(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	a := place(w, "a", 370, 300, rules)
+	b := place(w, "b", 430, 300, rules)
+	steps(w, 10, rules, hold("a", "right"), hold("b", "left"))
+	// they meet in the middle and neither gets past
+	assertAt(t, a, 390, 300)
+	assertAt(t, b, 410, 300)
+}
+
+func TestCollidePile(t *testing.T) {
+	rules := testRules()
+	pile := func() *World {
+		w := NewWorld(1)
+		for _, id := range []string{"c", "a", "b"} {
+			place(w, id, 400, 300, rules)
+		}
+		return steps(w, 5, rules)
+	}
+	w := pile()
+	apart(t, w, rules)
+	// the same every time, however the map iterates
+	for i := 0; i < 10; i++ {
+		again := pile()
+		for id, p := range w.Players {
+			if q := again.Players[id]; q.X != p.X || q.Y != p.Y {
+				t.Fatalf("%s at %v,%v, then %v,%v", id, p.X, p.Y, q.X, q.Y)
+			}
+		}
+	}
+}
+
+func TestCollideAtEdge(t *testing.T) {
+	rules := testRules()
+	tests := []struct {
+		name     string
+		ax, ay   float64
+		bx, by   float64
+		input    string
+		awx, awy float64
+		bwx, bwy float64
+	}{
+		{"left", 0, 300, 35, 300, "left", 0, 300, 20, 300},
+		{"right", 800, 300, 765, 300, "right", 800, 300, 780, 300},
+		{"top", 400, 0, 400, 35, "up", 400, 0, 400, 20},
+		{"bottom", 400, 600, 400, 565, "down", 400, 600, 400, 580},
+		// walked into the edge with the other close behind
+		{"both walking", 25, 300, 60, 300, "left", 0, 300, 20, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWorld(1)
+			a := place(w, "a", tt.ax, tt.ay, rules)
+			b := place(w, "b", tt.bx, tt.by, rules)
+			steps(w, 10, rules, hold("a", tt.input), hold("b", tt.input))
+			assertAt(t, a, tt.awx, tt.awy)
+			assertAt(t, b, tt.bwx, tt.bwy)
+		})
+	}
+}
+
+func TestCollidePushedIntoEdge(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	// a stands still by the edge and b walks into them
+	a := place(w, "a", 5, 300, rules)
+	b := place(w, "b", 60, 300, rules)
+	steps(w, 10, rules, hold("b", "left"))
+	assertAt(t, a, 0, 300)
+	assertAt(t, b, 20, 300)
+}
@@ -0,0 +1,55 @@
+package sim
+
+import "strings"
+
+// Palette is the colors players are given, in the order they are handed out
+var Palette = []string{
+	"#e6194b", "#3cb44b", "#ffe119", "#4363d8", "#f58231", "#911eb4",
+	"#46f0f0", "#f032e6", "#bcf60c", "#008080", "#9a6324", "#800000",
+}
+
+// nextColor is the first palette color the fewest players have, so colors
+// are only shared once every one of them is taken
+func (w *World) nextColor() string {
+	uses := map[string]int{}
+	for _, p := range w.Players {
+		uses[p.Color]++
+	}
+	best := Palette[0]
+	for _, c := range Palette[1:] {
+		if uses[c] < uses[best] {
+			best = c
+		}
+	}
+	return best
+}
+
+// ValidColor reports whether c is a hex color like #ff8800
+func ValidColor(c string) bool {
+	if len(c) != 7 || c[0] != '#' {
+		return false
+	}
+	for _, r := range c[1:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Paint gives player id color c, which must be valid, unless another player
+// has it already, and reports whether it did
+func (w *World) Paint(id, c string) bool {
+	p, ok := w.Players[id]
+	if !ok {
+		return false
+	}
+	c = strings.ToLower(c)
+	for other, q := range w.Players {
+		if other != id && q.Color == c {
+			return false
+		}
+	}
+	p.Color = c
+	return true
+}
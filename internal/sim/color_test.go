@@ -0,0 +1,83 @@
+package sim
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestColorsDistinct(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	seen := map[string]string{}
+	for i := range Palette {
+		id := fmt.Sprint(i)
+		p := w.Join(id, rules)
+		if p.Color != Palette[i] {
+			t.Fatalf("player %d got %s, want %s", i, p.Color, Palette[i])
+		}
+		if other, ok := seen[p.Color]; ok {
+			t.Fatalf("%s shared by %s and %s", p.Color, other, id)
+		}
+		seen[p.Color] = id
+	}
+	// once every color is taken they go round again
+	if p := w.Join("extra", rules); p.Color != Palette[0] {
+		t.Fatalf("one more than the palette got %s, want %s", p.Color, Palette[0])
+	}
+}
+
+func TestColorReused(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	for i := 0; i < 4; i++ {
+		w.Join(fmt.Sprint(i), rules)
+	}
+	w.Remove("1")
+	if p := w.Join("new", rules); p.Color != Palette[1] {
+		t.Fatalf("got %s, want %s left by the player who went", p.Color, Palette[1])
+	}
+	if p := w.Join("next", rules); p.Color != Palette[4] {
+		t.Fatalf("got %s, want %s", p.Color, Palette[4])
+	}
+}
+
+func TestValidColor(t *testing.T) {
+	for c, want := range map[string]bool{
+		"#ff8800":  true,
+		"#FF8800":  true,
+		"#0a0B0c":  true,
+		"ff8800":   false,
+		"#ff880":   false,
+		"#ff88000": false,
+		"#gg8800":  false,
+		"red":      false,
+		"":         false,
+		"#ff 800":  false,
+	} {
+		if got := ValidColor(c); got != want {
+			t.Fatalf("ValidColor(%q) = %v, want %v", c, got, want)
+		}
+	}
+}
+
+func TestPaint(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	a := w.Join("a", rules)
+	b := w.Join("b", rules)
+	if !w.Paint("a", "#ABCDEF") || a.Color != "#abcdef" {
+		t.Fatalf("painted %s", a.Color)
+	}
+	// taken, whatever the case
+	if w.Paint("b", "#abcdef") || b.Color != Palette[1] {
+		t.Fatalf("painted a taken color, now %s", b.Color)
+	}
+	// a player may keep their own
+	if !w.Paint("a", "#abcdef") || w.Paint("nobody", "#123456") {
+		t.Fatal("paint")
+	}
+	// and one freed up is handed out again
+	if p := w.Join("c", rules); p.Color != Palette[0] {
+		t.Fatalf("got %s, want %s a gave up", p.Color, Palette[0])
+	}
+}
@@ -0,0 +1,107 @@
+package sim
+
+import (
+	"math"
+	"sort"
+)
+
+// Flag is a team's flag, at its base unless someone from the other team is
+// carrying it, in which case it is where they are
+type Flag struct {
+	Team    int    `json:"team"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Carrier string `json:"carrier,omitempty"`
+}
+
+// Capture is a flag brought home
+type Capture struct {
+	PlayerID string `json:"player_id"`
+	Team     int    `json:"team"`
+}
+
+// CaptureTheFlag is the mode where each team has a flag at its base. A
+// living player reaching the other team's flag within CoinRadius picks it
+// up, and bringing it within CoinRadius of their own base scores a capture
+// for their team and a point for them. A flag whose carrier dies, leaves or
+// switches to its team goes back to its base, and so does a captured one.
+type CaptureTheFlag struct{}
+
+func (CaptureTheFlag) Step(w *World, rules Rules) {
+	if len(w.Flags) == 0 {
+		// a restored world has its team scores but no flags yet
+		if len(w.TeamScores) != Teams {
+			w.TeamScores = make([]int, Teams)
+		}
+		for t := 1; t <= Teams; t++ {
+			f := &Flag{Team: t}
+			f.reset(rules)
+			w.Flags = append(w.Flags, f)
+		}
+	}
+	ids := make([]string, 0, len(w.Players))
+	for id := range w.Players {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, f := range w.Flags {
+		if f.Carrier == "" {
+			f.Carrier = w.grabber(f, ids, rules)
+		}
+		if f.Carrier == "" {
+			continue
+		}
+		p, ok := w.Players[f.Carrier]
+		if !ok || p.Dead || p.Team == f.Team {
+			f.reset(rules)
+			continue
+		}
+		f.X, f.Y = int(math.Round(p.X)), int(math.Round(p.Y))
+		home := rules.Base(p.Team)
+		if rules.dist(p.X, p.Y, float64(home.X), float64(home.Y)) <= float64(rules.CoinRadius) {
+			w.TeamScores[p.Team-1]++
+			w.Captures = append(w.Captures, Capture{PlayerID: f.Carrier, Team: p.Team})
+			w.award(f.Carrier, capturePoints)
+			f.reset(rules)
+		}
+	}
+}
+
+// capturePoints is what a player scores for bringing a flag home
+const capturePoints = 1
+
+// reset puts f back at its base
+func (f *Flag) reset(rules Rules) {
+	base := rules.Base(f.Team)
+	f.X, f.Y, f.Carrier = base.X, base.Y, ""
+}
+
+// grabber is the living player of another team nearest f within CoinRadius
+// of it, the lower id on a tie, or "" if nobody reached it
+func (w *World) grabber(f *Flag, ids []string, rules Rules) string {
+	best, bestD := "", math.Inf(1)
+	for _, id := range ids {
+		p := w.Players[id]
+		if p.Dead || p.Team == 0 || p.Team == f.Team {
+			continue
+		}
+		if d := rules.dist(p.X, p.Y, float64(f.X), float64(f.Y)); d <= float64(rules.CoinRadius) && d < bestD {
+			best, bestD = id, d
+		}
+	}
+	return best
+}
+
+// Base is where team's flag stands, from Bases when set and otherwise an
+// eighth of the way in from the left or right edge, halfway down
+func (rules Rules) Base(team int) Point {
+	if team >= 1 && team <= len(rules.Bases) {
+		return rules.Bases[team-1]
+	}
+	x := rules.Width / 8
+	if team == 2 {
+		x = rules.Width - x
+	}
+	return Point{X: x, Y: rules.Height / 2}
+}
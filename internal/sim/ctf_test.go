@@ -0,0 +1,103 @@
+package sim
+
+import "testing"
+
+// ctf is a capture the flag world with a of team 1 and b of team 2 in the
+// middle. The bases are at 100,300 and 700,300.
+func ctf() (*World, Rules, *Player, *Player) {
+	rules := testRules()
+	rules.Teams = true
+	rules.Mode = CaptureTheFlag{}
+	w := NewWorld(1)
+	a := place(w, "a", 400, 200, rules)
+	b := place(w, "b", 400, 400, rules)
+	a.Team, b.Team = 1, 2
+	Step(w, nil, rules)
+	return w, rules, a, b
+}
+
+func TestFlagPickup(t *testing.T) {
+	w, rules, a, _ := ctf()
+	if len(w.Flags) != 2 || *w.Flags[0] != (Flag{Team: 1, X: 100, Y: 300}) || *w.Flags[1] != (Flag{Team: 2, X: 700, Y: 300}) {
+		t.Fatalf("flags %+v %+v", w.Flags[0], w.Flags[1])
+	}
+	if len(w.TeamScores) != Teams {
+		t.Fatalf("team scores %v", w.TeamScores)
+	}
+	// CoinRadius is 20
+	a.X, a.Y = 680, 300
+	Step(w, nil, rules)
+	if f := w.Flags[1]; f.Carrier != "a" || f.X != 680 || f.Y != 300 {
+		t.Fatalf("flag %+v", f)
+	}
+	// it goes where they go
+	steps(w, 3, rules, hold("a", "left"))
+	if f := w.Flags[1]; f.Carrier != "a" || f.X != int(a.X) || f.Y != 300 || a.X >= 680 {
+		t.Fatalf("flag %+v, a at %v,%v", f, a.X, a.Y)
+	}
+}
+
+func TestOwnFlagStays(t *testing.T) {
+	w, rules, a, b := ctf()
+	a.X, a.Y = 100, 300
+	b.X, b.Y = 700, 300
+	steps(w, 3, rules)
+	for _, f := range w.Flags {
+		if f.Carrier != "" {
+			t.Fatalf("flag %+v picked up by its own team", f)
+		}
+	}
+	if w.TeamScores[0] != 0 || w.TeamScores[1] != 0 {
+		t.Fatalf("team scores %v", w.TeamScores)
+	}
+}
+
+func TestFlagCapture(t *testing.T) {
+	w, rules, a, b := ctf()
+	a.X, a.Y = 700, 300
+	Step(w, nil, rules)
+	a.X, a.Y = 115, 300
+	Step(w, nil, rules)
+	if w.TeamScores[0] != 1 || w.TeamScores[1] != 0 || a.Score != 1 || b.Score != 0 {
+		t.Fatalf("team scores %v, scores %d and %d", w.TeamScores, a.Score, b.Score)
+	}
+	if len(w.Captures) != 1 || w.Captures[0] != (Capture{PlayerID: "a", Team: 1}) {
+		t.Fatalf("captures %+v", w.Captures)
+	}
+	if f := w.Flags[1]; *f != (Flag{Team: 2, X: 700, Y: 300}) {
+		t.Fatalf("captured flag %+v, want it back at its base", f)
+	}
+	// home without the flag is nothing
+	Step(w, nil, rules)
+	if w.TeamScores[0] != 1 || len(w.Captures) != 0 {
+		t.Fatalf("team scores %v, captures %+v", w.TeamScores, w.Captures)
+	}
+}
+
+func TestFlagReset(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		lose func(w *World, a *Player)
+	}{
+		{"left", func(w *World, a *Player) { w.Remove("a") }},
+		{"died", func(w *World, a *Player) {
+			a.Dead = true
+			a.respawn = 10
+		}},
+		{"switched", func(w *World, a *Player) { a.Team = 2 }},
+	} {
+		w, rules, a, _ := ctf()
+		a.X, a.Y = 700, 300
+		Step(w, nil, rules)
+		a.X, a.Y = 400, 100
+		Step(w, nil, rules)
+		if w.Flags[1].Carrier != "a" {
+			t.Fatalf("%s: flag %+v", tt.name, w.Flags[1])
+		}
+		tt.lose(w, a)
+		Step(w, nil, rules)
+		if f := w.Flags[1]; *f != (Flag{Team: 2, X: 700, Y: 300}) {
+			t.Fatalf("%s: flag %+v, want it back at its base", tt.name, f)
+		}
+	}
+}
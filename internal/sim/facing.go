@@ -0,0 +1,21 @@
+package sim
+
+import "math"
+
+// NormalizeAngle wraps a, in radians, into [0, 2π)
+func NormalizeAngle(a float64) float64 {
+	a = math.Mod(a, 2*math.Pi)
+	if a < 0 {
+		a += 2 * math.Pi
+	}
+	// adding 2π to a tiny negative angle can round up to 2π itself
+	if a >= 2*math.Pi {
+		a = 0
+	}
+	return a
+}
+
+// facingVector is the unit vector along the way p faces
+func (p *Player) facingVector() Vector {
+	return Vector{X: math.Cos(p.Facing), Y: math.Sin(p.Facing)}
+}
@@ -0,0 +1,79 @@
+package sim
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalizeAngle(t *testing.T) {
+	for _, tt := range []struct{ in, want float64 }{
+		{0, 0},
+		{1, 1},
+		{2 * math.Pi, 0},
+		{-math.Pi / 2, 3 * math.Pi / 2},
+		{5 * math.Pi, math.Pi},
+		{-4 * math.Pi, 0},
+		{-7 * math.Pi / 2, math.Pi / 2},
+		// so close under 2π it would round up to it
+		{-1e-17, 0},
+	} {
+		got := NormalizeAngle(tt.in)
+		if !near(got, tt.want) || got < 0 || got >= 2*math.Pi {
+			t.Fatalf("NormalizeAngle(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFacingFromMovement(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	p := place(w, "a", 400, 300, rules)
+	for _, tt := range []struct {
+		inputs []string
+		want   float64
+	}{
+		{[]string{"right"}, 0},
+		{[]string{"down"}, math.Pi / 2},
+		{[]string{"up", "left"}, 5 * math.Pi / 4},
+		{[]string{"up"}, 3 * math.Pi / 2},
+		// standing still keeps the last way they went
+		{nil, 3 * math.Pi / 2},
+	} {
+		Step(w, []InputEvent{hold("a", tt.inputs...)}, rules)
+		if !near(p.Facing, tt.want) {
+			t.Fatalf("%v: facing %v, want %v", tt.inputs, p.Facing, tt.want)
+		}
+	}
+	// an analog stick turns them too
+	Step(w, []InputEvent{{PlayerID: "a", Move: &Vector{X: -0.5, Y: 0.5}}}, rules)
+	if !near(p.Facing, 3*math.Pi/4) {
+		t.Fatalf("facing %v, want %v", p.Facing, 3*math.Pi/4)
+	}
+}
+
+func TestAimedFacing(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	p := place(w, "a", 400, 300, rules)
+	aim := -math.Pi / 2
+	Step(w, []InputEvent{{PlayerID: "a", Aim: &aim}}, rules)
+	if !near(p.Facing, 3*math.Pi/2) {
+		t.Fatalf("facing %v, want %v", p.Facing, 3*math.Pi/2)
+	}
+	// once they aim, moving doesn't turn them
+	steps(w, 3, rules, hold("a", "right"))
+	if !near(p.Facing, 3*math.Pi/2) {
+		t.Fatalf("facing %v after moving, want %v", p.Facing, 3*math.Pi/2)
+	}
+
+	// shooting and dashing without a direction go the way they face
+	Step(w, []InputEvent{hold("a", "shoot")}, rules)
+	if len(w.Projectiles) != 1 || !near(w.Projectiles[0].Vel.X, 0) || !near(w.Projectiles[0].Vel.Y, -400) {
+		t.Fatalf("projectiles %+v", w.Projectiles)
+	}
+	x, y := p.X, p.Y
+	Step(w, []InputEvent{hold("a", "dash")}, rules)
+	if !near(p.X, x) || !near(p.Y, y-80) {
+		t.Fatalf("dashed from %v,%v to %v,%v, want 80 up", x, y, p.X, p.Y)
+	}
+}
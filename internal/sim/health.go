@@ -0,0 +1,91 @@
+package sim
+
+import (
+	"math"
+	"sort"
+)
+
+// hit takes a projectile's damage off p, killing them when it runs out
+func (w *World) hit(p *Player, id string, pr *Projectile, rules Rules) {
+	p.HP -= rules.ProjectileDamage
+	if p.HP > 0 {
+		return
+	}
+	p.HP = 0
+	p.Dead = true
+	p.vel = Vector{}
+	p.knocked = false
+	p.Boost = 0
+	p.respawn = rules.ticks(rules.RespawnDelay)
+	w.Deaths = append(w.Deaths, Death{Killer: pr.Owner, Victim: id})
+	p.Stats.Deaths++
+	if killer, ok := w.Players[pr.Owner]; ok {
+		killer.Stats.Kills++
+	}
+	w.award(pr.Owner, killPoints)
+}
+
+// respawn counts down spawn protection and brings back the dead players
+// whose delay is up, at a spawn point with full health and stamina and
+// protected again. Players are visited in id order so two coming back at
+// once always end up in the same places. With LastAlive nobody comes back
+// until the next round.
+func (w *World) respawn(rules Rules) {
+	var back []string
+	for id, p := range w.Players {
+		if p.Invulnerable > 0 {
+			p.Invulnerable--
+		}
+		if !p.Dead || rules.LastAlive {
+			continue
+		}
+		if p.respawn > 0 {
+			p.respawn--
+		}
+		if p.respawn == 0 {
+			back = append(back, id)
+		}
+	}
+	sort.Strings(back)
+	for _, id := range back {
+		p := w.Players[id]
+		p.X, p.Y = w.Spawn(rules)
+		p.HP = rules.MaxHP
+		p.Invulnerable = rules.ticks(rules.SpawnProtection)
+		p.Dead = false
+		p.Stamina = float64(rules.Stamina)
+		p.lockout = 0
+	}
+}
+
+// struck returns the id of the first living, unprotected player other than
+// its owner that pr passes through on its way from x, y to where it is now,
+// or "" if it hits nobody. Players are hit within Radius of their centre, or a pixel
+// when they don't collide; ties go to the lower id.
+func (w *World) struck(pr *Projectile, x, y float64, rules Rules) string {
+	r := math.Max(float64(rules.Radius), 1)
+	dx, dy := pr.X-x, pr.Y-y
+	l2 := dx*dx + dy*dy
+	best, bestT := "", math.Inf(1)
+	for id, p := range w.Players {
+		if p.Dead || p.Invulnerable > 0 || id == pr.Owner {
+			continue
+		}
+		if !rules.FriendlyFire && pr.team != 0 && p.Team == pr.team {
+			continue
+		}
+		// where p is seen from x, y, across the seam if that is nearer
+		px, py := x+rules.offset(x, p.X, rules.Width), y+rules.offset(y, p.Y, rules.Height)
+		t := 0.0
+		if l2 > 0 {
+			t = clamp(((px-x)*dx+(py-y)*dy)/l2, 0, 1)
+		}
+		if math.Hypot(x+t*dx-px, y+t*dy-py) > r {
+			continue
+		}
+		if t < bestT || t == bestT && id < best {
+			best, bestT = id, t
+		}
+	}
+	return best
+}
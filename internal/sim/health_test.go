@@ -0,0 +1,128 @@
+package sim
+
+import (
+	"testing"
+	"time"
+)
+
+// duel puts a at 100,300 and b 50 pixels to their right, a shot's travel
+// in a tick and a bit
+func duel(rules Rules) (*World, *Player, *Player) {
+	w := NewWorld(1)
+	a := place(w, "a", 100, 300, rules)
+	b := place(w, "b", 150, 300, rules)
+	return w, a, b
+}
+
+func TestHit(t *testing.T) {
+	rules := testRules()
+	w, a, b := duel(rules)
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	if b.HP != 75 || b.Dead || a.HP != 100 {
+		t.Fatalf("b has %d hp, a %d", b.HP, a.HP)
+	}
+	// the shot is spent
+	if len(w.Projectiles) != 0 || len(w.Deaths) != 0 {
+		t.Fatalf("projectiles %+v, deaths %+v", w.Projectiles, w.Deaths)
+	}
+}
+
+func TestKillAndRespawn(t *testing.T) {
+	rules := testRules()
+	w, _, b := duel(rules)
+	b.HP = 25
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	if !b.Dead || b.HP != 0 {
+		t.Fatalf("b alive with %d hp", b.HP)
+	}
+	if len(w.Deaths) != 1 || w.Deaths[0] != (Death{Killer: "a", Victim: "b"}) {
+		t.Fatalf("deaths %+v", w.Deaths)
+	}
+	x, y := b.X, b.Y
+	// RespawnDelay is 10 ticks, spent dead whatever they press
+	for i := 1; i < 10; i++ {
+		Step(w, []InputEvent{hold("b", "up", "dash")}, rules)
+		if !b.Dead {
+			t.Fatalf("back %d ticks after dying", i)
+		}
+		if b.X != x || b.Y != y {
+			t.Fatalf("moved to %v,%v while dead", b.X, b.Y)
+		}
+		if len(w.Deaths) != 0 {
+			t.Fatalf("died again: %+v", w.Deaths)
+		}
+	}
+	Step(w, nil, rules)
+	if b.Dead || b.HP != rules.MaxHP {
+		t.Fatalf("after 10 ticks dead %v with %d hp", b.Dead, b.HP)
+	}
+}
+
+func TestOwnShotIgnored(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	a := place(w, "a", 100, 300, rules)
+	// fired from inside them, then followed
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	steps(w, 5, rules, hold("a", "right"))
+	if a.HP != 100 || len(w.Projectiles) != 1 {
+		t.Fatalf("%d hp and %d projectiles after their own shot", a.HP, len(w.Projectiles))
+	}
+}
+
+func TestSpawnProtection(t *testing.T) {
+	rules := testRules()
+	rules.SpawnProtection = 500 * time.Millisecond
+	rules.FireCooldown = 0
+	w, a, b := duel(rules)
+	if b.Invulnerable != 5 {
+		t.Fatalf("joined with %d protected ticks, want 5", b.Invulnerable)
+	}
+	hitAt := -1
+	for i := 0; i < 10 && hitAt < 0; i++ {
+		Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+		if b.HP < 100 {
+			hitAt = i
+			if b.Invulnerable > 0 {
+				t.Fatalf("tick %d: hit with %d protected ticks left", i, b.Invulnerable)
+			}
+		}
+	}
+	// shots pass through for the first four ticks, and the one on its way
+	// lands as protection runs out in the fifth
+	if hitAt != 4 {
+		t.Fatalf("first hit in tick %d, want 4", hitAt)
+	}
+	if a.HP != 100 {
+		t.Fatalf("a has %d hp", a.HP)
+	}
+}
+
+func TestShotEndsProtection(t *testing.T) {
+	for _, ends := range []bool{false, true} {
+		rules := testRules()
+		rules.SpawnProtection = 500 * time.Millisecond
+		rules.ShotEndsProtection = ends
+		w, _, b := duel(rules)
+		// b fires away from a as a fires at b
+		Step(w, []InputEvent{shootAt("a", 1, 0), shootAt("b", 1, 0)}, rules)
+		Step(w, nil, rules)
+		if hit := b.HP < 100; hit != ends {
+			t.Fatalf("ShotEndsProtection %v: hit %v", ends, hit)
+		}
+	}
+}
+
+func TestRespawnProtected(t *testing.T) {
+	rules := testRules()
+	rules.SpawnProtection = 500 * time.Millisecond
+	w, _, b := duel(rules)
+	b.Invulnerable = 0
+	b.Dead, b.HP, b.respawn = true, 0, 1
+	Step(w, nil, rules)
+	if b.Dead || b.Invulnerable != 5 {
+		t.Fatalf("back %v with %d protected ticks, want 5", !b.Dead, b.Invulnerable)
+	}
+}
@@ -0,0 +1,62 @@
+package sim
+
+import "strconv"
+
+// Circle is a round area in whole pixels
+type Circle struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Radius int `json:"radius"`
+}
+
+// KingOfTheHill is the mode with a zone to hold. Every tick it is held by
+// one player, or with teams by players of one team only, they gain a
+// point of progress, and the first to HillScore wins. A player is in the
+// zone while their centre is, and dead players don't count. Once someone
+// wins, progress starts over.
+type KingOfTheHill struct{}
+
+func (KingOfTheHill) Step(w *World, rules Rules) {
+	zone := rules.HillZone()
+	holder, contested := "", false
+	for id, p := range w.Players {
+		if p.Dead || rules.dist(p.X, p.Y, float64(zone.X), float64(zone.Y)) > float64(zone.Radius) {
+			continue
+		}
+		key := id
+		if p.Team != 0 {
+			key = strconv.Itoa(p.Team)
+		}
+		if holder != "" && holder != key {
+			contested = true
+		}
+		holder = key
+	}
+	w.HillContested = contested
+	w.HillHolder = ""
+	if holder == "" || contested {
+		return
+	}
+	w.HillHolder = holder
+	if w.HillProgress == nil {
+		w.HillProgress = map[string]int{}
+	}
+	w.HillProgress[holder]++
+	if w.HillProgress[holder] >= rules.HillScore {
+		w.win(holder, EndHill)
+		w.HillProgress = nil
+	}
+}
+
+// HillZone is Hill, or when it isn't set a circle in the middle of the
+// world an eighth as wide as its shorter side
+func (rules Rules) HillZone() Circle {
+	if rules.Hill != nil {
+		return *rules.Hill
+	}
+	r := rules.Width
+	if rules.Height < r {
+		r = rules.Height
+	}
+	return Circle{X: rules.Width / 2, Y: rules.Height / 2, Radius: r / 8}
+}
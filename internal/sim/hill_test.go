@@ -0,0 +1,108 @@
+package sim
+
+import (
+	"reflect"
+	"testing"
+)
+
+// hillRules have the zone at 400,300 with a radius of 75
+func hillRules() Rules {
+	rules := testRules()
+	rules.Mode = KingOfTheHill{}
+	rules.HillScore = 5
+	return rules
+}
+
+func TestHillHeldAlone(t *testing.T) {
+	rules := hillRules()
+	w := NewWorld(1)
+	place(w, "a", 400, 300, rules)
+	place(w, "b", 100, 100, rules)
+	steps(w, 3, rules)
+	if w.HillHolder != "a" || w.HillContested || !reflect.DeepEqual(w.HillProgress, map[string]int{"a": 3}) {
+		t.Fatalf("holder %q, contested %v, progress %v", w.HillHolder, w.HillContested, w.HillProgress)
+	}
+	// progress is kept while away
+	w.Players["a"].X = 100
+	steps(w, 2, rules)
+	if w.HillHolder != "" || w.HillProgress["a"] != 3 {
+		t.Fatalf("holder %q, progress %v", w.HillHolder, w.HillProgress)
+	}
+	// and the dead hold nothing
+	w.Players["a"].X = 400
+	w.Players["a"].Dead = true
+	w.Players["a"].respawn = 10
+	Step(w, nil, rules)
+	if w.HillHolder != "" || w.HillProgress["a"] != 3 {
+		t.Fatalf("dead: holder %q, progress %v", w.HillHolder, w.HillProgress)
+	}
+}
+
+func TestHillContested(t *testing.T) {
+	rules := hillRules()
+	w := NewWorld(1)
+	place(w, "a", 380, 300, rules)
+	place(w, "b", 420, 300, rules)
+	steps(w, 3, rules)
+	if w.HillHolder != "" || !w.HillContested || len(w.HillProgress) != 0 {
+		t.Fatalf("holder %q, contested %v, progress %v", w.HillHolder, w.HillContested, w.HillProgress)
+	}
+
+	// teammates hold it together
+	rules.Teams = true
+	w = NewWorld(1)
+	place(w, "a", 380, 300, rules).Team = 1
+	place(w, "b", 420, 300, rules).Team = 1
+	place(w, "c", 100, 100, rules).Team = 2
+	steps(w, 2, rules)
+	if w.HillHolder != "1" || w.HillContested || !reflect.DeepEqual(w.HillProgress, map[string]int{"1": 2}) {
+		t.Fatalf("holder %q, contested %v, progress %v", w.HillHolder, w.HillContested, w.HillProgress)
+	}
+	w.Players["c"].X, w.Players["c"].Y = 400, 340
+	Step(w, nil, rules)
+	if w.HillHolder != "" || !w.HillContested || w.HillProgress["1"] != 2 {
+		t.Fatalf("holder %q, contested %v, progress %v", w.HillHolder, w.HillContested, w.HillProgress)
+	}
+}
+
+func TestHillEdge(t *testing.T) {
+	rules := hillRules()
+	// in while the centre is, however much of them hangs over the edge
+	for _, tt := range []struct {
+		x, y float64
+		in   bool
+	}{
+		{475, 300, true},
+		{400, 225, true},
+		{476, 300, false},
+		{400 + 53, 300 + 53, true},
+		{400 + 54, 300 + 54, false},
+	} {
+		w := NewWorld(1)
+		place(w, "a", tt.x, tt.y, rules)
+		Step(w, nil, rules)
+		if in := w.HillHolder == "a"; in != tt.in {
+			t.Fatalf("at %v,%v: holder %q, want in %v", tt.x, tt.y, w.HillHolder, tt.in)
+		}
+	}
+}
+
+func TestHillWin(t *testing.T) {
+	rules := hillRules()
+	w := NewWorld(1)
+	place(w, "a", 400, 300, rules)
+	for i := 1; i <= 5; i++ {
+		Step(w, nil, rules)
+		if ended := w.Ended != ""; ended != (i == 5) {
+			t.Fatalf("tick %d: ended %q", i, w.Ended)
+		}
+	}
+	if w.Ended != EndHill || w.Winner != "a" || w.HillProgress != nil {
+		t.Fatalf("ended %q, winner %q, progress %v", w.Ended, w.Winner, w.HillProgress)
+	}
+	// and starts over
+	Step(w, nil, rules)
+	if w.Ended != "" || w.HillProgress["a"] != 1 {
+		t.Fatalf("ended %q, progress %v", w.Ended, w.HillProgress)
+	}
+}
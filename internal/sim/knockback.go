@@ -0,0 +1,25 @@
+package sim
+
+import "math"
+
+// knock adds an impulse of strength pixels per second to p's velocity,
+// away from x, y or along dir when p is right on top of it. Until friction
+// has brought them back down to the speed they steer for, they only get
+// KnockbackControl percent of their acceleration.
+func (p *Player) knock(x, y float64, dir Vector, strength int, rules Rules) {
+	if strength <= 0 || p.Dead {
+		return
+	}
+	dx, dy := rules.offset(x, p.X, rules.Width), rules.offset(y, p.Y, rules.Height)
+	l := math.Hypot(dx, dy)
+	if l == 0 {
+		dx, dy = dir.X, dir.Y
+		l = math.Hypot(dx, dy)
+	}
+	if l == 0 {
+		return
+	}
+	p.vel.X += dx / l * float64(strength)
+	p.vel.Y += dy / l * float64(strength)
+	p.knocked = true
+}
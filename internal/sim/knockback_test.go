@@ -0,0 +1,138 @@
+package sim
+
+import (
+	"math"
+	"testing"
+)
+
+func knockRules() Rules {
+	rules := testRules()
+	rules.Knockback = 300
+	return rules
+}
+
+func TestKnockbackImpulse(t *testing.T) {
+	rules := knockRules()
+	for _, aim := range []Vector{{X: 1}, {X: -1}, {Y: 1}, {X: 3, Y: -4}} {
+		w := NewWorld(1)
+		place(w, "a", 400, 300, rules)
+		// 50 pixels along the aim, where the shot gets in a tick and a bit
+		l := math.Hypot(aim.X, aim.Y)
+		b := place(w, "b", 400+aim.X/l*50, 300+aim.Y/l*50, rules)
+		Step(w, []InputEvent{shootAt("a", aim.X, aim.Y)}, rules)
+		Step(w, nil, rules)
+		if b.HP != 75 {
+			t.Fatalf("aiming %v: b has %d hp, want hit", aim, b.HP)
+		}
+		// Knockback per second, straight away from where the shot came from
+		if !near(b.vel.X, aim.X/l*300) || !near(b.vel.Y, aim.Y/l*300) || !b.knocked {
+			t.Fatalf("aiming %v: b going %+v, want %v along it", aim, b.vel, 300)
+		}
+	}
+
+	// none without Knockback
+	rules = testRules()
+	w, _, b := duel(rules)
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	if b.vel != (Vector{}) || b.knocked {
+		t.Fatalf("b going %+v without knockback", b.vel)
+	}
+}
+
+func TestKnockbackDecays(t *testing.T) {
+	rules := knockRules()
+	w, _, b := duel(rules)
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	// Friction takes 100 off a tick, so 300 is gone in three
+	for i, want := range []struct{ speed, x float64 }{{200, 170}, {100, 180}, {0, 180}, {0, 180}} {
+		Step(w, nil, rules)
+		if !near(b.vel.X, want.speed) || !near(b.X, want.x) {
+			t.Fatalf("tick %d: at %v going %v, want %v going %v", i+1, b.X, b.vel.X, want.x, want.speed)
+		}
+	}
+	if b.knocked {
+		t.Fatal("still knocked back once stopped")
+	}
+}
+
+func TestKnockbackControl(t *testing.T) {
+	// steering up while knocked right, at full and at half control
+	for _, control := range []int{100, 50} {
+		rules := knockRules()
+		rules.KnockbackControl = control
+		w, _, b := duel(rules)
+		Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+		Step(w, nil, rules)
+		Step(w, []InputEvent{hold("b", "up")}, rules)
+		// Accel gives 100 a tick, then friction slows the lot from 300 to 200
+		up := float64(control)
+		want := -up * 200 / math.Hypot(300, up)
+		if !near(b.vel.Y, want) {
+			t.Fatalf("control %d: going %v up, want %v", control, b.vel.Y, want)
+		}
+	}
+
+	// and full control back once it has worn off
+	rules := knockRules()
+	rules.KnockbackControl = 0
+	w, _, b := duel(rules)
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	// down to 200, then to 100, where it steers again
+	steps(w, 2, rules, hold("b", "up"))
+	if b.vel.Y != 0 || b.knocked {
+		t.Fatalf("steered %v with no control", b.vel.Y)
+	}
+	Step(w, []InputEvent{hold("b", "up")}, rules)
+	if want := -100 / math.Sqrt2; !near(b.vel.Y, want) {
+		t.Fatalf("going %v up after the knockback, want %v", b.vel.Y, want)
+	}
+}
+
+func TestKnockbackStopsAtEdges(t *testing.T) {
+	rules := knockRules()
+	rules.Knockback = 2000
+	w := NewWorld(1)
+	place(w, "a", 740, 300, rules)
+	b := place(w, "b", 790, 300, rules)
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	Step(w, nil, rules)
+	if b.X != 800 || b.vel.X != 0 {
+		t.Fatalf("at %v going %v, want stopped at the edge", b.X, b.vel.X)
+	}
+
+	rules.Obstacles = []Rect{{X: 200, Y: 250, Width: 100, Height: 100}}
+	w, _, b = duel(rules)
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	Step(w, nil, rules)
+	if !near(b.X, 190) || b.vel.X != 0 {
+		t.Fatalf("at %v going %v, want stopped against the wall at 190", b.X, b.vel.X)
+	}
+}
+
+func TestBumpKnockback(t *testing.T) {
+	rules := testRules()
+	rules.BumpKnockback = 200
+	w := NewWorld(1)
+	a := place(w, "a", 390, 300, rules)
+	b := place(w, "b", 405, 300, rules)
+	Step(w, nil, rules)
+	if !near(a.vel.X, -200) || !near(b.vel.X, 200) || a.vel.Y != 0 || b.vel.Y != 0 {
+		t.Fatalf("a going %+v, b %+v, want 200 apart", a.vel, b.vel)
+	}
+	apart(t, w, rules)
+
+	// only when it's on
+	rules = testRules()
+	w = NewWorld(1)
+	a = place(w, "a", 390, 300, rules)
+	place(w, "b", 405, 300, rules)
+	Step(w, nil, rules)
+	if a.vel != (Vector{}) || a.knocked {
+		t.Fatalf("a going %+v without bump knockback", a.vel)
+	}
+}
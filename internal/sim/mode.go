@@ -0,0 +1,20 @@
+package sim
+
+// Mode is a game mode's own rules, run at the end of every Step after
+// everything every mode shares
+type Mode interface {
+	Step(w *World, rules Rules)
+}
+
+// FreeForAll is the mode with no rules of its own
+type FreeForAll struct{}
+
+func (FreeForAll) Step(w *World, rules Rules) {}
+
+// mode is the room's mode, free for all when none is set
+func (rules Rules) mode() Mode {
+	if rules.Mode == nil {
+		return FreeForAll{}
+	}
+	return rules.Mode
+}
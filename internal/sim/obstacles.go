@@ -0,0 +1,107 @@
+package sim
+
+import "math"
+
+// Rect is an axis-aligned obstacle. Players can't enter it; for this a
+// player is the square around their centre with sides twice Radius.
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// overlaps reports whether the square of half size r centred on x, y is
+// inside o. Touching an edge doesn't count.
+func (o Rect) overlaps(x, y, r float64) bool {
+	return x+r > float64(o.X) && x-r < float64(o.X+o.Width) &&
+		y+r > float64(o.Y) && y-r < float64(o.Y+o.Height)
+}
+
+// moveX moves p along x to x, stopping at the first obstacle in the way.
+// Being stopped on one axis leaves the other free, so a player steering
+// diagonally into a wall slides along it.
+func moveX(p *Player, x float64, rules Rules) {
+	r := float64(rules.Radius)
+	for _, o := range rules.Obstacles {
+		if !(p.Y+r > float64(o.Y) && p.Y-r < float64(o.Y+o.Height)) {
+			continue
+		}
+		if left := float64(o.X) - r; p.X <= left && x > left {
+			x = left
+			p.vel.X = 0
+		}
+		if right := float64(o.X+o.Width) + r; p.X >= right && x < right {
+			x = right
+			p.vel.X = 0
+		}
+	}
+	p.X = x
+}
+
+// moveY is moveX along y
+func moveY(p *Player, y float64, rules Rules) {
+	r := float64(rules.Radius)
+	for _, o := range rules.Obstacles {
+		if !(p.X+r > float64(o.X) && p.X-r < float64(o.X+o.Width)) {
+			continue
+		}
+		if top := float64(o.Y) - r; p.Y <= top && y > top {
+			y = top
+			p.vel.Y = 0
+		}
+		if bottom := float64(o.Y+o.Height) + r; p.Y >= bottom && y < bottom {
+			y = bottom
+			p.vel.Y = 0
+		}
+	}
+	p.Y = y
+}
+
+// unblock moves p out of any obstacle it was pushed into, by the shortest
+// way out of each that keeps them in the world. Where there is none, as in
+// a gap narrower than a player between an obstacle and the edge, the world
+// wins and p may be left overlapping.
+func unblock(p *Player, rules Rules) {
+	r := float64(rules.Radius)
+	w, h := float64(rules.Width), float64(rules.Height)
+	for _, o := range rules.Obstacles {
+		if !o.overlaps(p.X, p.Y, r) {
+			continue
+		}
+		exits := []struct{ dx, dy float64 }{
+			{-(p.X + r - float64(o.X)), 0},
+			{float64(o.X+o.Width) - (p.X - r), 0},
+			{0, -(p.Y + r - float64(o.Y))},
+			{0, float64(o.Y+o.Height) - (p.Y - r)},
+		}
+		best, bestD := -1, math.Inf(1)
+		for i, e := range exits {
+			x, y := p.X+e.dx, p.Y+e.dy
+			inside := rules.Wrap || x >= 0 && x <= w && y >= 0 && y <= h
+			if d := math.Abs(e.dx + e.dy); inside && d < bestD {
+				best, bestD = i, d
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		p.X, _ = rules.bound(p.X+exits[best].dx, 0, rules.Width)
+		p.Y, _ = rules.bound(p.Y+exits[best].dy, 0, rules.Height)
+	}
+}
+
+// Free reports whether a player centred on x, y would be inside the world
+// and clear of every obstacle
+func (rules Rules) Free(x, y float64) bool {
+	r := float64(rules.Radius)
+	if x-r < 0 || y-r < 0 || x+r > float64(rules.Width) || y+r > float64(rules.Height) {
+		return false
+	}
+	for _, o := range rules.Obstacles {
+		if o.overlaps(x, y, r) {
+			return false
+		}
+	}
+	return true
+}
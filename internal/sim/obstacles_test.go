@@ -0,0 +1,91 @@
+package sim
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestObstacleStopsEachSide(t *testing.T) {
+	rules := testRules()
+	rules.Obstacles = []Rect{{X: 300, Y: 300, Width: 100, Height: 100}}
+	tests := []struct {
+		name   string
+		x, y   float64
+		input  string
+		wx, wy float64
+	}{
+		{"from the left", 250, 350, "right", 290, 350},
+		{"from the right", 450, 350, "left", 410, 350},
+		{"from above", 350, 250, "down", 350, 290},
+		{"from below", 350, 450, "up", 350, 410},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWorld(1)
+			p := place(w, "a", tt.x, tt.y, rules)
+			steps(w, 20, rules, hold("a", tt.input))
+			assertAt(t, p, tt.wx, tt.wy)
+		})
+	}
+}
+
+func TestObstacleSlide(t *testing.T) {
+	rules := testRules()
+	rules.Obstacles = []Rect{{X: 300, Y: 100, Width: 100, Height: 400}}
+	w := NewWorld(1)
+	p := place(w, "a", 250, 250, rules)
+	steps(w, 10, rules, hold("a", "right", "down"))
+	if !near(p.X, 290) {
+		t.Fatalf("x = %v, want against the wall at 290", p.X)
+	}
+	if p.Y <= 300 {
+		t.Fatalf("y = %v, want well past 250 after sliding down the wall", p.Y)
+	}
+}
+
+func TestUnblockStaysInWorld(t *testing.T) {
+	rules := testRules()
+	// the shortest way out of this wall is through the world's left edge
+	rules.Obstacles = []Rect{{X: 0, Y: 100, Width: 30, Height: 100}}
+	p := &Player{X: 5, Y: 150}
+	unblock(p, rules)
+	assertAt(t, p, 40, 150)
+	if !rules.Free(p.X, p.Y) {
+		t.Fatal("left inside the wall")
+	}
+
+	rules.Obstacles = []Rect{{X: 770, Y: 100, Width: 30, Height: 100}}
+	p = &Player{X: 795, Y: 150}
+	unblock(p, rules)
+	assertAt(t, p, 760, 150)
+}
+
+func TestUnblockWraps(t *testing.T) {
+	rules := testRules()
+	rules.Wrap = true
+	rules.Obstacles = []Rect{{X: 0, Y: 100, Width: 30, Height: 100}}
+	p := &Player{X: 5, Y: 150}
+	unblock(p, rules)
+	// out through the left edge, back in at the right
+	assertAt(t, p, 790, 150)
+}
+
+func TestSpawnAvoidsObstacles(t *testing.T) {
+	rules := testRules()
+	// over the middle, where a spawn is tried first
+	rules.Obstacles = []Rect{{X: 300, Y: 200, Width: 200, Height: 200}}
+	w := NewWorld(1)
+	for i := 0; i < 10; i++ {
+		x, y := w.Spawn(rules)
+		if !rules.Free(x, y) {
+			t.Fatalf("spawned at %v,%v", x, y)
+		}
+		place(w, fmt.Sprint(i), x, y, rules)
+	}
+
+	// a spawn point an obstacle covers is never used
+	rules.Spawns = []Point{{X: 400, Y: 300}, {X: 50, Y: 50}}
+	if x, y := NewWorld(1).Spawn(rules); x != 50 || y != 50 {
+		t.Fatalf("spawned at %v,%v, want the free point 50,50", x, y)
+	}
+}
@@ -0,0 +1,59 @@
+package sim
+
+// PowerSpeed is the power-up that makes a player faster for a while
+const PowerSpeed = "speed"
+
+// PowerUp is a pickup that gives the player reaching it an effect. It sits
+// at whole pixels and is gone once its TTL runs out.
+type PowerUp struct {
+	ID   uint32 `json:"id"`
+	Kind string `json:"kind"`
+	X    int    `json:"x"`
+	Y    int    `json:"y"`
+	// ticks left before it despawns
+	TTL int `json:"-"`
+}
+
+// powerUps despawns the power-ups nobody collected in time, gives the ones
+// living players reached to them and puts a new one down every
+// PowerUpInterval while there are fewer than PowerUps. Picking up speed
+// while already boosted starts the boost over rather than adding to it.
+func (w *World) powerUps(rules Rules) {
+	kept := w.PowerUps[:0]
+	for _, pu := range w.PowerUps {
+		pu.TTL--
+		if pu.TTL <= 0 {
+			continue
+		}
+		id := w.collector(pu.X, pu.Y, rules)
+		if id == "" {
+			kept = append(kept, pu)
+			continue
+		}
+		w.Pickups = append(w.Pickups, Pickup{PlayerID: id, PowerUp: pu.ID})
+		w.Players[id].Boost = rules.ticks(rules.BoostDuration)
+	}
+	w.PowerUps = kept
+
+	if len(w.PowerUps) >= rules.PowerUps {
+		w.powerUpTimer = 0
+		return
+	}
+	w.powerUpTimer++
+	if w.powerUpTimer < rules.ticks(rules.PowerUpInterval) {
+		return
+	}
+	x, y, ok := w.randomFree(rules)
+	if !ok {
+		return
+	}
+	w.powerUpTimer = 0
+	w.lastPowerUp++
+	w.PowerUps = append(w.PowerUps, &PowerUp{
+		ID:   w.lastPowerUp,
+		Kind: PowerSpeed,
+		X:    x,
+		Y:    y,
+		TTL:  rules.ticks(rules.PowerUpTTL),
+	})
+}
@@ -0,0 +1,115 @@
+package sim
+
+import (
+	"testing"
+	"time"
+)
+
+// boostRules reach top speed within a tick and boost for 10 ticks
+func boostRules() Rules {
+	rules := testRules()
+	rules.Accel = 10000
+	rules.Friction = 10000
+	rules.BoostDuration = time.Second
+	rules.PowerUpTTL = 2 * time.Second
+	return rules
+}
+
+// drop puts a speed power-up at x, y
+func drop(w *World, x, y int, rules Rules) {
+	w.lastPowerUp++
+	w.PowerUps = append(w.PowerUps, &PowerUp{ID: w.lastPowerUp, Kind: PowerSpeed, X: x, Y: y, TTL: rules.ticks(rules.PowerUpTTL)})
+}
+
+func TestSpeedBoost(t *testing.T) {
+	rules := boostRules()
+	w := NewWorld(1)
+	a := place(w, "a", 100, 100, rules)
+	b := place(w, "b", 100, 300, rules)
+	drop(w, 100, 100, rules)
+	Step(w, nil, rules)
+	if len(w.Pickups) != 1 || w.Pickups[0] != (Pickup{PlayerID: "a", PowerUp: 1}) || len(w.PowerUps) != 0 {
+		t.Fatalf("pickups %+v, power-ups %+v", w.Pickups, w.PowerUps)
+	}
+	if a.Boost != 10 || b.Boost != 0 {
+		t.Fatalf("boost %d and %d, want 10 and 0", a.Boost, b.Boost)
+	}
+	// SpeedBoost is 150 percent of 100 px/s for 10 ticks, then back to 100
+	for i := 0; i < 12; i++ {
+		ax, bx := a.X, b.X
+		Step(w, []InputEvent{hold("a", "right"), hold("b", "right")}, rules)
+		wantA := 15.0
+		if i >= 10 {
+			wantA = 10
+		}
+		if !near(a.X-ax, wantA) || !near(b.X-bx, 10) {
+			t.Fatalf("tick %d: went %v and %v, want %v and 10", i, a.X-ax, b.X-bx, wantA)
+		}
+		left := 9 - i
+		if left < 0 {
+			left = 0
+		}
+		if a.Boost != left {
+			t.Fatalf("tick %d: %d boosted ticks left", i, a.Boost)
+		}
+	}
+}
+
+func TestSpeedBoostRefreshed(t *testing.T) {
+	rules := boostRules()
+	w := NewWorld(1)
+	a := place(w, "a", 100, 100, rules)
+	drop(w, 100, 100, rules)
+	steps(w, 5, rules)
+	if a.Boost != 6 {
+		t.Fatalf("%d boosted ticks left, want 6", a.Boost)
+	}
+	// a second one starts it over rather than adding to it
+	drop(w, 100, 100, rules)
+	Step(w, nil, rules)
+	if len(w.Pickups) != 1 || a.Boost != 10 {
+		t.Fatalf("pickups %+v, %d boosted ticks, want 10", w.Pickups, a.Boost)
+	}
+}
+
+func TestPowerUpDespawns(t *testing.T) {
+	rules := boostRules()
+	w := NewWorld(1)
+	a := place(w, "a", 100, 100, rules)
+	drop(w, 700, 500, rules)
+	// PowerUpTTL is 20 ticks
+	for i := 1; i <= 20; i++ {
+		Step(w, nil, rules)
+		if gone := len(w.PowerUps) == 0; gone != (i == 20) {
+			t.Fatalf("tick %d: power-ups %+v", i, w.PowerUps)
+		}
+	}
+	// and what is gone can't be picked up
+	a.X, a.Y = 700, 500
+	Step(w, nil, rules)
+	if len(w.Pickups) != 0 || a.Boost != 0 {
+		t.Fatalf("pickups %+v, boost %d", w.Pickups, a.Boost)
+	}
+}
+
+func TestPowerUpInterval(t *testing.T) {
+	rules := boostRules()
+	rules.PowerUps = 1
+	rules.PowerUpInterval = 500 * time.Millisecond
+	w := NewWorld(1)
+	for i := 1; i <= 5; i++ {
+		Step(w, nil, rules)
+		if got := len(w.PowerUps) == 1; got != (i == 5) {
+			t.Fatalf("tick %d: power-ups %+v", i, w.PowerUps)
+		}
+	}
+	pu := w.PowerUps[0]
+	if pu.Kind != PowerSpeed || !rules.Free(float64(pu.X), float64(pu.Y)) {
+		t.Fatalf("power-up %+v", pu)
+	}
+	// no more than PowerUps at once
+	steps(w, 10, rules)
+	if len(w.PowerUps) != 1 || w.PowerUps[0] != pu {
+		t.Fatalf("power-ups %+v", w.PowerUps)
+	}
+}
@@ -0,0 +1,73 @@
+package sim
+
+import (
+	"math"
+	"sort"
+)
+
+// moveProjectiles advances every projectile by a tick, dropping the ones
+// that hit someone, expire or leave the world. In a world that wraps they
+// come back in by the opposite edge instead.
+func (w *World) moveProjectiles(rules Rules) {
+	dt := rules.Tick.Seconds()
+	kept := w.Projectiles[:0]
+	for _, pr := range w.Projectiles {
+		x, y := pr.X, pr.Y
+		pr.TTL--
+		pr.X += pr.Vel.X * dt
+		pr.Y += pr.Vel.Y * dt
+		if id := w.struck(pr, x, y, rules); id != "" {
+			p := w.Players[id]
+			w.hit(p, id, pr, rules)
+			p.knock(x, y, pr.Vel, rules.Knockback, rules)
+			continue
+		}
+		if rules.Wrap {
+			pr.X = wrapAxis(pr.X, float64(rules.Width))
+			pr.Y = wrapAxis(pr.Y, float64(rules.Height))
+		}
+		if pr.TTL <= 0 || pr.X < 0 || pr.Y < 0 || pr.X > float64(rules.Width) || pr.Y > float64(rules.Height) {
+			continue
+		}
+		kept = append(kept, pr)
+	}
+	w.Projectiles = kept
+}
+
+// fire spawns the shots players aimed this tick. Players are visited in id
+// order so projectile ids only depend on the world.
+func (w *World) fire(rules Rules) {
+	ids := make([]string, 0, len(w.Players))
+	for id, p := range w.Players {
+		if p.reload > 0 {
+			p.reload--
+		}
+		if p.shoot == nil && p.trigger {
+			f := p.facingVector()
+			p.shoot = &f
+		}
+		if p.shoot != nil && p.reload == 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		p := w.Players[id]
+		p.reload = rules.ticks(rules.FireCooldown)
+		if rules.ShotEndsProtection {
+			p.Invulnerable = 0
+		}
+		l := math.Hypot(p.shoot.X, p.shoot.Y)
+		speed := float64(rules.ProjectileSpeed)
+		w.lastProjectile++
+		w.Projectiles = append(w.Projectiles, &Projectile{
+			ID:    w.lastProjectile,
+			Owner: id,
+			X:     p.X,
+			Y:     p.Y,
+			Vel:   Vector{X: p.shoot.X / l * speed, Y: p.shoot.Y / l * speed},
+			TTL:   rules.ticks(rules.ProjectileTTL),
+			team:  p.Team,
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package sim
+
+import "testing"
+
+// shootAt is an input from id shooting along x, y
+func shootAt(id string, x, y float64) InputEvent {
+	return InputEvent{PlayerID: id, Shoot: &Vector{X: x, Y: y}}
+}
+
+func TestProjectileSpawnAndTravel(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	place(w, "a", 400, 300, rules)
+	Step(w, []InputEvent{shootAt("a", 3, -4)}, rules)
+	if len(w.Projectiles) != 1 {
+		t.Fatalf("%d projectiles, want 1", len(w.Projectiles))
+	}
+	pr := w.Projectiles[0]
+	// from the shooter, at ProjectileSpeed whatever the aim's length
+	if pr.ID != 1 || pr.Owner != "a" || pr.X != 400 || pr.Y != 300 || !near(pr.Vel.X, 240) || !near(pr.Vel.Y, -320) || pr.TTL != 10 {
+		t.Fatalf("spawned %+v", pr)
+	}
+	steps(w, 3, rules)
+	if !near(pr.X, 400+3*24) || !near(pr.Y, 300-3*32) || pr.TTL != 7 {
+		t.Fatalf("after 3 ticks %+v", pr)
+	}
+}
+
+func TestProjectileExpires(t *testing.T) {
+	rules := testRules()
+	rules.Width, rules.Height = 10000, 10000
+	w := NewWorld(1)
+	place(w, "a", 100, 100, rules)
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	// ProjectileTTL is 10 ticks
+	steps(w, 9, rules)
+	if len(w.Projectiles) != 1 {
+		t.Fatal("gone before its time")
+	}
+	steps(w, 1, rules)
+	if len(w.Projectiles) != 0 {
+		t.Fatalf("still flying after its TTL: %+v", w.Projectiles[0])
+	}
+}
+
+func TestProjectileLeavesWorld(t *testing.T) {
+	rules := testRules()
+	for _, aim := range []Vector{{X: 1}, {X: -1}, {Y: 1}, {Y: -1}} {
+		w := NewWorld(1)
+		place(w, "a", 20, 20, rules)
+		place(w, "b", 780, 580, rules)
+		Step(w, []InputEvent{shootAt("a", aim.X, aim.Y), shootAt("b", aim.X, aim.Y)}, rules)
+		steps(w, 1, rules)
+		// one of the two is out after a tick either way, 40 pixels on
+		if len(w.Projectiles) != 1 {
+			t.Fatalf("aiming %v: %d projectiles left, want 1", aim, len(w.Projectiles))
+		}
+	}
+}
+
+func TestFireRate(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	place(w, "a", 400, 300, rules)
+	var fired []int
+	for i := 0; i < 12; i++ {
+		before := w.lastProjectile
+		Step(w, []InputEvent{shootAt("a", 0, 1)}, rules)
+		if w.lastProjectile != before {
+			fired = append(fired, i)
+		}
+	}
+	// FireCooldown is 5 ticks
+	if len(fired) != 3 || fired[0] != 0 || fired[1] != 5 || fired[2] != 10 {
+		t.Fatalf("fired in ticks %v, want 0, 5 and 10", fired)
+	}
+}
@@ -0,0 +1,54 @@
+package sim
+
+import "sort"
+
+// killPoints is what a player scores for each player they kill
+const killPoints = 1
+
+// Standing is a player's place on the leaderboard
+type Standing struct {
+	PlayerID string `json:"player_id"`
+	Score    int    `json:"score"`
+}
+
+// ScoreChange is points a player scored in a step, and their score after
+type ScoreChange struct {
+	PlayerID string `json:"player_id"`
+	Points   int    `json:"points"`
+	Score    int    `json:"score"`
+}
+
+// award gives points to the player id, if they are still in the world
+func (w *World) award(id string, points int) {
+	p, ok := w.Players[id]
+	if !ok || points == 0 {
+		return
+	}
+	p.Score += points
+	w.Scores = append(w.Scores, ScoreChange{PlayerID: id, Points: points, Score: p.Score})
+}
+
+// Leaderboard is the n highest scoring players, best first. On a tie the
+// one that joined first goes ahead, so the order never depends on map
+// iteration.
+func (w *World) Leaderboard(n int) []Standing {
+	ids := make([]string, 0, len(w.Players))
+	for id := range w.Players {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := w.Players[ids[i]], w.Players[ids[j]]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.joined < b.joined
+	})
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	out := make([]Standing, len(ids))
+	for i, id := range ids {
+		out[i] = Standing{PlayerID: id, Score: w.Players[id].Score}
+	}
+	return out
+}
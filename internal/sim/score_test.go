@@ -0,0 +1,45 @@
+package sim
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLeaderboard(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	// joined in this order, which isn't the ids' order
+	for _, id := range []string{"z", "a", "m", "b"} {
+		w.Join(id, rules)
+	}
+	w.award("m", 1)
+	w.award("a", 2)
+	w.award("z", 1)
+	w.award("a", 1)
+	w.award("gone", 5)
+	want := []ScoreChange{{"m", 1, 1}, {"a", 2, 2}, {"z", 1, 1}, {"a", 1, 3}}
+	if !reflect.DeepEqual(w.Scores, want) {
+		t.Fatalf("score changes %+v, want %+v", w.Scores, want)
+	}
+	// z and m tie, and z joined first
+	if got := w.Leaderboard(3); !reflect.DeepEqual(got, []Standing{{"a", 3}, {"z", 1}, {"m", 1}}) {
+		t.Fatalf("leaderboard %+v", got)
+	}
+	if got := w.Leaderboard(10); len(got) != 4 || got[3] != (Standing{"b", 0}) {
+		t.Fatalf("whole leaderboard %+v", got)
+	}
+}
+
+func TestKillScores(t *testing.T) {
+	rules := testRules()
+	w, a, b := duel(rules)
+	b.HP = 25
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	if a.Score != killPoints || b.Score != 0 {
+		t.Fatalf("scores %d and %d after a kill", a.Score, b.Score)
+	}
+	if len(w.Scores) != 1 || w.Scores[0] != (ScoreChange{"a", killPoints, killPoints}) {
+		t.Fatalf("score changes %+v", w.Scores)
+	}
+}
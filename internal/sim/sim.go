@@ -0,0 +1,552 @@
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// InputEvent is one frame of inputs from a player. It is also the wire format
+// of a single frame published on the broker channel. Seq is the client's
+// number for the frame, zero if it doesn't number them, and T its clock in
+// ms when the frame was sampled, zero if not sent. Inputs are held
+// directions, "sprint", "dash" or "shoot", and Move an analog stick; a frame
+// may carry both, and they add up. Shoot fires a projectile the way it
+// points, and Aim turns the player to face an angle in radians.
+type InputEvent struct {
+	PlayerID string   `json:"player_id"`
+	Seq      int      `json:"seq"`
+	T        int64    `json:"t,omitempty"`
+	Inputs   []string `json:"inputs"`
+	Move     *Vector  `json:"move,omitempty"`
+	Shoot    *Vector  `json:"shoot,omitempty"`
+	Aim      *float64 `json:"aim,omitempty"`
+}
+
+// Vector is a movement direction, each axis in [-1, 1]. Y grows downwards.
+type Vector struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Clamp returns v with each axis limited to [-1, 1]
+func (v Vector) Clamp() Vector {
+	return Vector{X: clampf(v.X), Y: clampf(v.Y)}
+}
+
+// vector translates held directions into the movement they stand for. Two
+// axes held at once make a diagonal of length 1, no faster than one axis.
+func vector(inputs []string) Vector {
+	var v Vector
+	for _, str := range inputs {
+		switch str {
+		case "left":
+			v.X = -1
+		case "right":
+			v.X = 1
+		case "up":
+			v.Y = -1
+		case "down":
+			v.Y = 1
+		}
+	}
+	if v.X != 0 && v.Y != 0 {
+		v.X *= math.Sqrt2 / 2
+		v.Y *= math.Sqrt2 / 2
+	}
+	return v
+}
+
+// Rules are the parameters of the simulation. Speeds are in pixels per
+// second and accelerations in pixels per second squared, so changing Tick
+// doesn't change how fast anything moves.
+type Rules struct {
+	Width  int
+	Height int
+	Tick   time.Duration
+	// top speed at full stick, in any direction
+	MaxSpeed int
+	// how fast a player speeds up towards where they are steering, and
+	// slows down when they let go or ease off the stick
+	Accel    int
+	Friction int
+	// every player is a circle this big that others can't walk into, zero
+	// letting them pass through each other
+	Radius int
+	// where nobody can go
+	Obstacles []Rect
+	// where players may start, and how close to others they may start
+	// when none are set
+	Spawns        []Point
+	SpawnDistance int
+	// top speed while sprinting, as a percent of MaxSpeed. Sprinting drains
+	// Stamina by StaminaDrain a second, anything else refills it by
+	// StaminaRegen a second, and running dry rules out sprinting and
+	// refilling for SprintLockout.
+	SprintSpeed   int
+	Stamina       int
+	StaminaDrain  int
+	StaminaRegen  int
+	SprintLockout time.Duration
+	// how far a dash takes a player, and how long until they can dash
+	// again
+	DashDistance int
+	DashCooldown time.Duration
+	// how fast projectiles fly in pixels per second, how long they last
+	// and how long a player waits between shots
+	ProjectileSpeed int
+	ProjectileTTL   time.Duration
+	FireCooldown    time.Duration
+	// health players start with, what a hit takes off and how long a
+	// killed player waits to come back
+	MaxHP            int
+	ProjectileDamage int
+	RespawnDelay     time.Duration
+	// the impulse in pixels per second a hit gives, and two players
+	// bumping into each other give both, 0 for none, and the percent of
+	// their acceleration players keep while it wears off
+	Knockback        int
+	BumpKnockback    int
+	KnockbackControl int
+	// how long a player that just spawned can't be hit, cut short by them
+	// firing if ShotEndsProtection is set
+	SpawnProtection    time.Duration
+	ShotEndsProtection bool
+	// how many coins lie around at once, how close a player must come to
+	// one to collect it, what it is worth and how long a collected one
+	// takes to be replaced
+	Coins       int
+	CoinRadius  int
+	CoinPoints  int
+	CoinRespawn time.Duration
+	// how many power-ups can lie around at once, how often a new one is put
+	// down while there are fewer and how long it lies there, and for how
+	// long speed picked up multiplies top speed by SpeedBoost percent. They
+	// are collected within CoinRadius like coins.
+	PowerUps        int
+	PowerUpInterval time.Duration
+	PowerUpTTL      time.Duration
+	SpeedBoost      int
+	BoostDuration   time.Duration
+	// the game mode, free for all when nil, and for tag how long a player
+	// that just passed on it can't be tagged back and how long being it
+	// costs a point
+	Mode        Mode
+	TagImmunity time.Duration
+	TagCost     time.Duration
+	// whether joining players are put on the smaller of the teams, and
+	// where each team's flag stands in capture the flag
+	Teams bool
+	Bases []Point
+	// whether projectiles hit players on their owner's team
+	FriendlyFire bool
+	// the zone to hold in king of the hill and the progress that wins it
+	Hill      *Circle
+	HillScore int
+	// whether leaving the world by one edge comes back in by the opposite
+	// one, rather than stopping at it
+	Wrap bool
+	// the score that wins the match, 0 for none, and whether the dead stay
+	// dead until the last player or team standing has won
+	WinScore  int
+	LastAlive bool
+}
+
+// ticks is d in ticks, rounded up
+func (rules Rules) ticks(d time.Duration) int {
+	return int((d + rules.Tick - 1) / rules.Tick)
+}
+
+// World is everything the simulation moves
+type World struct {
+	Players     map[string]*Player
+	Projectiles []*Projectile
+	Coins       []*Coin
+	PowerUps    []*PowerUp
+	// in capture the flag, one flag per team and their captures
+	Flags      []*Flag
+	TeamScores []int
+	// in king of the hill, progress towards HillScore by player id, or by
+	// team number with teams, who alone holds the zone, and whether more
+	// than one are fighting over it
+	HillProgress  map[string]int
+	HillHolder    string
+	HillContested bool
+	// how the match ended in the last step, one of the End reasons or
+	// empty if it goes on, and who won it, a player id or a team number,
+	// or nobody for a draw
+	Ended  string
+	Winner string
+	// players killed in the last step
+	Deaths []Death
+	// points scored in the last step, in the order they were scored
+	Scores []ScoreChange
+	// coins and power-ups collected in the last step, and flags captured
+	Pickups  []Pickup
+	Captures []Capture
+	// id of the last projectile fired, coin placed and power-up placed
+	lastProjectile uint32
+	lastCoin       uint32
+	lastPowerUp    uint32
+	// ticks until each collected coin is replaced, and since there was
+	// last room for a power-up or one was put down
+	coinWaits    []int
+	powerUpTimer int
+	// where coins go
+	rand *rand.Rand
+	// players that ever joined, for their join order
+	joins uint64
+}
+
+// Death is a player killed by another's projectile
+type Death struct {
+	Killer string `json:"killer"`
+	Victim string `json:"victim"`
+}
+
+// NewWorld returns a world with nobody in it. Everything random in it comes
+// from seed, so a world made with the same seed and given the same inputs
+// plays out the same way.
+func NewWorld(seed int64) *World {
+	return &World{
+		Players: map[string]*Player{},
+		rand:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Remove takes a player out of the world along with their projectiles
+func (w *World) Remove(id string) {
+	delete(w.Players, id)
+	kept := w.Projectiles[:0]
+	for _, pr := range w.Projectiles {
+		if pr.Owner != id {
+			kept = append(kept, pr)
+		}
+	}
+	w.Projectiles = kept
+}
+
+// Projectile is a shot in flight, fired by Owner
+type Projectile struct {
+	ID    uint32  `json:"id"`
+	Owner string  `json:"owner"`
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	// in pixels per second
+	Vel Vector `json:"vel"`
+	// ticks left before it expires
+	TTL int `json:"-"`
+	// the owner's team when it was fired, 0 without teams
+	team int
+}
+
+type Player struct {
+	// movement asked for this tick, and the velocity in pixels per second
+	move Vector
+	vel  Vector
+	// whether sprint was held this tick, and the ticks left until a player
+	// that ran out of stamina may sprint again
+	sprint  bool
+	lockout int
+	// whether dash was pressed this tick, and the ticks until it works again
+	dash     bool
+	cooldown int
+	// where they aimed a shot this tick, nil if they didn't, and the ticks
+	// until they can fire again
+	shoot  *Vector
+	reload int
+	// whether shoot was held this tick, which fires the way they face
+	// unless a Shoot direction came too
+	trigger bool
+	// whether they ever aimed; until then they face the way they last moved
+	aimed bool
+	// whether a knockback is still slowing them down
+	knocked bool
+	// ticks until a dead player respawns
+	respawn int
+	// where they were once the step had respawned them, for
+	// Stats.Distance
+	fromX, fromY float64
+	// when they joined the world, counting joins, for breaking leaderboard
+	// ties
+	joined uint64
+	// in tag, the ticks they have been it for, and the ticks left before
+	// they can be tagged again
+	itTicks   int
+	tagImmune int
+	// left for sprinting, only told to the player itself
+	Stamina float64 `json:"-"`
+	// kept exact here and rounded only when sent
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	// health, 0 while dead
+	HP   int  `json:"hp"`
+	Dead bool `json:"dead,omitempty"`
+	// ticks left in which projectiles pass through them after spawning
+	Invulnerable int `json:"invulnerable,omitempty"`
+	// ticks left of a speed power-up
+	Boost int `json:"boost,omitempty"`
+	// whether they are it in tag
+	It bool `json:"it,omitempty"`
+	// the way they face in radians, in [0, 2π) and clockwise from the x
+	// axis as y grows downwards
+	Facing float64 `json:"facing"`
+	// 1 or 2 when there are teams
+	Team int `json:"team,omitempty"`
+	// like #ff8800, from Palette unless the player asked for another
+	Color string `json:"color"`
+	// unique within the room, picked by the server
+	Name string `json:"name"`
+	// whether the server plays them
+	Bot bool `json:"bot,omitempty"`
+	// points from kills and coins
+	Score int `json:"score"`
+	// sent on their own, when the match is over and in GET
+	// /rooms/{room}/stats
+	Stats Stats `json:"-"`
+	// highest input seq applied, only told to the player itself
+	LastInputSeq int `json:"-"`
+	// smoothed round trip time to the player's connection, filled in by the
+	// server
+	LatencyMS int `json:"latency_ms"`
+}
+
+// Exhausted reports whether p ran out of stamina and is waiting for the
+// lockout to end
+func (p *Player) Exhausted() bool {
+	return p.lockout > 0
+}
+
+// DashCooldown is the number of ticks before p can dash again
+func (p *Player) DashCooldown() int {
+	return p.cooldown
+}
+
+// Step advances the world by one tick given the inputs received since the
+// last one. It mutates and returns w and does no I/O, so the same world and
+// inputs always produce the same result. A step goes like this:
+//
+// First, players whose RespawnDelay is up come back at a spawn point. Then
+// the inputs are applied: those for unknown players are ignored, and so are
+// numbered inputs no newer than one already applied and inputs from the
+// dead. A player's inputs in a tick are added up, each axis clamped to
+// [-1, 1], and capped to a length of 1 so no mix of inputs is faster than a
+// single direction.
+//
+// Next every living player moves. A dash first takes them DashDistance at
+// once in the direction they steer, or the way they face without one. Their
+// input then accelerates them in its direction up to MaxSpeed times its
+// length, or SprintSpeed percent of that while they sprint; without input,
+// or above that speed, friction slows them down. Players face the way they
+// last aimed, or the way they last moved if they never aimed. Touching the
+// edge of the world or an obstacle stops them along that axis, unless the
+// world wraps, in which case leaving by one edge brings them back in by the
+// opposite one. Players that end up overlapping are then pushed apart and
+// knocked back by BumpKnockback, and out of any obstacle that pushed them
+// into.
+//
+// Then projectiles already in flight move on, and are gone once they leave
+// the world, their TTL runs out or they hit a player other than the one who
+// fired them; they pass through players within SpawnProtection of
+// spawning. A hit knocks its player back by Knockback, and a player whose
+// health a hit takes to zero is dead, listed in w.Deaths, while their
+// killer scores a point, listed in w.Scores.
+// After that come the shots fired this tick, starting where their player
+// is, one per FireCooldown at most, the way they face when shoot is held
+// without a direction.
+//
+// Coins and power-ups within CoinRadius of a living player go to the
+// nearest one and are listed in w.Pickups, and new ones are put down at
+// random free places. A speed power-up multiplies its player's top speed by
+// SpeedBoost percent for BoostDuration. The rules of the game mode come
+// next, then the match ends if someone reached WinScore or, with LastAlive,
+// only one player or team is left alive; see checkWin. Finally how far
+// everyone went this tick is added to their Stats.
+func Step(w *World, inputs []InputEvent, rules Rules) *World {
+	state := w.Players
+	w.Deaths = nil
+	w.Scores = nil
+	w.Pickups = nil
+	w.Captures = nil
+	w.Winner = ""
+	w.Ended = ""
+	w.respawn(rules)
+	for _, p := range state {
+		p.move = Vector{}
+		p.sprint = false
+		p.dash = false
+		p.shoot = nil
+		p.trigger = false
+		p.fromX, p.fromY = p.X, p.Y
+	}
+
+	for _, input := range inputs {
+		p, ok := state[input.PlayerID]
+		if !ok {
+			continue
+		}
+		if input.Seq != 0 {
+			if input.Seq <= p.LastInputSeq {
+				continue
+			}
+			p.LastInputSeq = input.Seq
+		}
+		p.Stats.Inputs++
+		if p.Dead {
+			continue
+		}
+		v := vector(input.Inputs)
+		for _, str := range input.Inputs {
+			switch str {
+			case "sprint":
+				p.sprint = true
+			case "dash":
+				p.dash = true
+			case "shoot":
+				p.trigger = true
+			}
+		}
+		if input.Move != nil {
+			m := input.Move.Clamp()
+			v.X += m.X
+			v.Y += m.Y
+		}
+		p.move = Vector{X: p.move.X + v.X, Y: p.move.Y + v.Y}.Clamp()
+		if s := input.Shoot; s != nil && (s.X != 0 || s.Y != 0) {
+			aim := *s
+			p.shoot = &aim
+		}
+		if input.Aim != nil {
+			p.Facing = NormalizeAngle(*input.Aim)
+			p.aimed = true
+		}
+	}
+
+	dt := rules.Tick.Seconds()
+	for _, p := range state {
+		if p.Dead {
+			continue
+		}
+		d := p.move
+		l := math.Hypot(d.X, d.Y)
+		if l > 1 {
+			d.X /= l
+			d.Y /= l
+			l = 1
+		}
+		if l > 0 && !p.aimed {
+			p.Facing = NormalizeAngle(math.Atan2(d.Y, d.X))
+		}
+		dash(p, d, l, rules)
+		before := math.Hypot(p.vel.X, p.vel.Y)
+		accel := float64(rules.Accel) * dt
+		if p.knocked {
+			accel = accel * float64(rules.KnockbackControl) / 100
+		}
+		p.vel.X += d.X * accel
+		p.vel.Y += d.Y * accel
+		top := float64(rules.MaxSpeed) * l
+		if stamina(p, l > 0, rules) {
+			top = top * float64(rules.SprintSpeed) / 100
+		}
+		if p.Boost > 0 {
+			top = top * float64(rules.SpeedBoost) / 100
+			p.Boost--
+		}
+		if speed := math.Hypot(p.vel.X, p.vel.Y); speed > top {
+			// friction brings them down towards top, not past it
+			slowed := math.Min(speed, math.Max(top, before-float64(rules.Friction)*dt))
+			p.vel.X *= slowed / speed
+			p.vel.Y *= slowed / speed
+		}
+		if p.knocked && math.Hypot(p.vel.X, p.vel.Y) <= top {
+			p.knocked = false
+		}
+
+		moveX(p, p.X+p.vel.X*dt, rules)
+		p.X, p.vel.X = rules.bound(p.X, p.vel.X, rules.Width)
+		moveY(p, p.Y+p.vel.Y*dt, rules)
+		p.Y, p.vel.Y = rules.bound(p.Y, p.vel.Y, rules.Height)
+	}
+	collide(state, rules)
+	if len(rules.Obstacles) > 0 {
+		for _, p := range state {
+			unblock(p, rules)
+		}
+	}
+	w.moveProjectiles(rules)
+	w.fire(rules)
+	w.coins(rules)
+	w.powerUps(rules)
+	rules.mode().Step(w, rules)
+	w.checkWin(rules)
+	w.travelled(rules)
+	return w
+}
+
+// stamina drains or refills p's stamina for a tick and reports whether
+// they sprint in it. Sprint only counts while moving.
+func stamina(p *Player, moving bool, rules Rules) bool {
+	dt := rules.Tick.Seconds()
+	switch {
+	case p.lockout > 0:
+		p.lockout--
+		return false
+	case p.sprint && moving && p.Stamina > 0:
+		p.Stamina -= float64(rules.StaminaDrain) * dt
+		if p.Stamina <= 0 {
+			p.Stamina = 0
+			p.lockout = rules.ticks(rules.SprintLockout)
+		}
+		return true
+	}
+	p.Stamina = math.Min(float64(rules.Stamina), p.Stamina+float64(rules.StaminaRegen)*dt)
+	return false
+}
+
+// dash moves p DashDistance along d, of length l, or the way they face
+// when l is 0, if they pressed dash and it isn't cooling down. The distance
+// is covered in steps no longer than a player is wide, so a dash can't skip
+// over an obstacle.
+func dash(p *Player, d Vector, l float64, rules Rules) {
+	if p.cooldown > 0 {
+		p.cooldown--
+	}
+	if !p.dash || p.cooldown > 0 || rules.DashDistance == 0 {
+		return
+	}
+	if l == 0 {
+		d, l = p.facingVector(), 1
+	}
+	p.cooldown = rules.ticks(rules.DashCooldown)
+	step := math.Max(float64(2*rules.Radius), 1)
+	n := math.Ceil(float64(rules.DashDistance) / step)
+	dx := d.X / l * float64(rules.DashDistance) / n
+	dy := d.Y / l * float64(rules.DashDistance) / n
+	for i := 0; i < int(n); i++ {
+		moveX(p, p.X+dx, rules)
+		p.X, p.vel.X = rules.bound(p.X, p.vel.X, rules.Width)
+		moveY(p, p.Y+dy, rules)
+		p.Y, p.vel.Y = rules.bound(p.Y, p.vel.Y, rules.Height)
+	}
+}
+
+func clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func clampf(v float64) float64 {
+	if v < -1 {
+		return -1
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,458 @@
+package sim
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// testRules is a plain free for all: no coins, power-ups or spawn
+// protection, and players reaching top speed within a tick
+func testRules() Rules {
+	return Rules{
+		Width:            800,
+		Height:           600,
+		Tick:             100 * time.Millisecond,
+		MaxSpeed:         100,
+		Accel:            1000,
+		Friction:         1000,
+		Radius:           10,
+		SprintSpeed:      200,
+		Stamina:          100,
+		StaminaDrain:     50,
+		StaminaRegen:     25,
+		SprintLockout:    time.Second,
+		DashDistance:     80,
+		DashCooldown:     time.Second,
+		ProjectileSpeed:  400,
+		ProjectileTTL:    time.Second,
+		FireCooldown:     500 * time.Millisecond,
+		MaxHP:            100,
+		ProjectileDamage: 25,
+		RespawnDelay:     time.Second,
+		KnockbackControl: 100,
+		CoinRadius:       20,
+		CoinPoints:       1,
+		SpeedBoost:       150,
+	}
+}
+
+// place puts a new player id at x, y
+func place(w *World, id string, x, y float64, rules Rules) *Player {
+	p := w.Join(id, rules)
+	p.X, p.Y = x, y
+	return p
+}
+
+// hold is an input of held directions for id
+func hold(id string, inputs ...string) InputEvent {
+	return InputEvent{PlayerID: id, Inputs: inputs}
+}
+
+// steps runs n steps, each with the same inputs
+func steps(w *World, n int, rules Rules, inputs ...InputEvent) *World {
+	for i := 0; i < n; i++ {
+		w = Step(w, inputs, rules)
+	}
+	return w
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func assertAt(t *testing.T, p *Player, x, y float64) {
+	t.Helper()
+	if !near(p.X, x) || !near(p.Y, y) {
+		t.Fatalf("player at %v, %v, want %v, %v", p.X, p.Y, x, y)
+	}
+}
+
+func TestStepClampsToWorld(t *testing.T) {
+	rules := testRules()
+	tests := []struct {
+		name   string
+		x, y   float64
+		inputs []string
+		wx, wy float64
+	}{
+		{"left edge", 5, 300, []string{"left"}, 0, 300},
+		{"right edge", 795, 300, []string{"right"}, 800, 300},
+		{"top edge", 400, 5, []string{"up"}, 400, 0},
+		{"bottom edge", 400, 595, []string{"down"}, 400, 600},
+		{"corner", 795, 595, []string{"right", "down"}, 800, 600},
+		{"along an edge", 400, 600, []string{"right"}, 450, 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWorld(1)
+			p := place(w, "a", tt.x, tt.y, rules)
+			steps(w, 5, rules, hold("a", tt.inputs...))
+			assertAt(t, p, tt.wx, tt.wy)
+		})
+	}
+}
+
+func TestStepLeavesEdgeAtOnce(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	p := place(w, "a", 795, 300, rules)
+	steps(w, 5, rules, hold("a", "right"))
+	// pressing against the edge built up no speed to overcome
+	steps(w, 1, rules, hold("a", "left"))
+	assertAt(t, p, 790, 300)
+}
+
+func TestStepOpposingInputs(t *testing.T) {
+	rules := testRules()
+	tests := []struct {
+		name   string
+		inputs []InputEvent
+		wx, wy float64
+	}{
+		{"left and right", []InputEvent{hold("a", "left"), hold("a", "right")}, 400, 300},
+		{"up and down", []InputEvent{hold("a", "up"), hold("a", "down")}, 400, 300},
+		{"all four", []InputEvent{hold("a", "up", "left"), hold("a", "down", "right")}, 400, 300},
+		{"one cancelled out", []InputEvent{hold("a", "left"), hold("a", "right"), hold("a", "down")}, 400, 310},
+		{"twice the same way", []InputEvent{hold("a", "right"), hold("a", "right")}, 410, 300},
+		{"diagonal", []InputEvent{hold("a", "right"), hold("a", "down")}, 400 + 10*math.Sqrt2/2, 300 + 10*math.Sqrt2/2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWorld(1)
+			p := place(w, "a", 400, 300, rules)
+			Step(w, tt.inputs, rules)
+			assertAt(t, p, tt.wx, tt.wy)
+		})
+	}
+}
+
+func TestStepMultiplePlayers(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	a := place(w, "a", 100, 100, rules)
+	b := place(w, "b", 400, 300, rules)
+	c := place(w, "c", 700, 500, rules)
+	steps(w, 3, rules, hold("a", "right"), hold("b", "up"), hold("gone", "left"))
+	assertAt(t, a, 130, 100)
+	assertAt(t, b, 400, 270)
+	assertAt(t, c, 700, 500)
+	if len(w.Players) != 3 {
+		t.Fatalf("%d players, want 3", len(w.Players))
+	}
+}
+
+func TestStepDeterministic(t *testing.T) {
+	rules := testRules()
+	run := func() *World {
+		w := NewWorld(7)
+		for _, id := range []string{"a", "b", "c"} {
+			w.Join(id, rules)
+		}
+		for i := 0; i < 50; i++ {
+			w = Step(w, []InputEvent{hold("a", "right"), hold("b", "up", "left"), hold("c", []string{"down", "left", "right"}[i%3])}, rules)
+		}
+		return w
+	}
+	first, second := run(), run()
+	for id, p := range first.Players {
+		q := second.Players[id]
+		if p.X != q.X || p.Y != q.Y {
+			t.Fatalf("%s at %v, %v and %v, %v in the same game", id, p.X, p.Y, q.X, q.Y)
+		}
+	}
+}
+
+func TestStepInputSeq(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	p := place(w, "a", 400, 300, rules)
+	// 3 is lost on the way, then turns up late after 5, which comes twice
+	tests := []struct {
+		seq   int
+		moves bool
+		ack   int
+	}{
+		{1, true, 1},
+		{2, true, 2},
+		{4, true, 4},
+		{5, true, 5},
+		{3, false, 5},
+		{5, false, 5},
+		{6, true, 6},
+	}
+	for _, tt := range tests {
+		x := p.X
+		w = Step(w, []InputEvent{{PlayerID: "a", Seq: tt.seq, Inputs: []string{"right"}}}, rules)
+		p = w.Players["a"]
+		if moved := p.X != x; moved != tt.moves {
+			t.Fatalf("seq %d moved %v, want %v", tt.seq, moved, tt.moves)
+		}
+		if p.LastInputSeq != tt.ack {
+			t.Fatalf("after seq %d acked %d, want %d", tt.seq, p.LastInputSeq, tt.ack)
+		}
+		// stop again, so each input's movement shows on its own
+		w = steps(w, 5, rules)
+		p = w.Players["a"]
+	}
+	// unnumbered inputs always apply and leave the ack alone
+	x := p.X
+	w = Step(w, []InputEvent{hold("a", "right")}, rules)
+	if p = w.Players["a"]; p.X == x || p.LastInputSeq != 6 {
+		t.Fatalf("unnumbered input: at %v acked %d", p.X, p.LastInputSeq)
+	}
+}
+
+func TestStepAnalogMove(t *testing.T) {
+	rules := testRules()
+	move := func(x, y float64) InputEvent {
+		return InputEvent{PlayerID: "a", Move: &Vector{X: x, Y: y}}
+	}
+	tests := []struct {
+		name   string
+		input  InputEvent
+		wx, wy float64
+	}{
+		{"half right", move(0.5, 0), 405, 300},
+		{"full length", move(0.6, 0.8), 406, 308},
+		{"half length", move(0.3, 0.4), 403, 304},
+		{"zero", move(0, 0), 400, 300},
+		{"out of range", move(5, 0), 410, 300},
+		{"out of range both ways", move(-3, 4), 400 - 10*math.Sqrt2/2, 300 + 10*math.Sqrt2/2},
+		// the same as a held direction
+		{"held right", hold("a", "right"), 410, 300},
+		{"held and moved", InputEvent{PlayerID: "a", Inputs: []string{"right"}, Move: &Vector{X: -0.5}}, 405, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWorld(1)
+			p := place(w, "a", 400, 300, rules)
+			Step(w, []InputEvent{tt.input}, rules)
+			assertAt(t, p, tt.wx, tt.wy)
+		})
+	}
+}
+
+func TestStepAcceleration(t *testing.T) {
+	rules := testRules()
+	rules.Accel = 200
+	rules.Friction = 500
+	// 20 faster a tick up to 100 while held, then 50 slower a tick
+	held := 7
+	want := []float64{20, 40, 60, 80, 100, 100, 100, 50, 0, 0}
+	for _, tt := range []struct {
+		dir    string
+		dx, dy float64
+	}{
+		{"left", -1, 0},
+		{"right", 1, 0},
+		{"up", 0, -1},
+		{"down", 0, 1},
+	} {
+		t.Run(tt.dir, func(t *testing.T) {
+			w := NewWorld(1)
+			p := place(w, "a", 400, 300, rules)
+			travelled := 0.0
+			for i, speed := range want {
+				var inputs []InputEvent
+				if i < held {
+					inputs = []InputEvent{hold("a", tt.dir)}
+				}
+				Step(w, inputs, rules)
+				if got := math.Hypot(p.vel.X, p.vel.Y); !near(got, speed) {
+					t.Fatalf("tick %d: speed %v, want %v", i, got, speed)
+				}
+				if !near(p.vel.X, tt.dx*speed) || !near(p.vel.Y, tt.dy*speed) {
+					t.Fatalf("tick %d: velocity %v, want along %v,%v", i, p.vel, tt.dx, tt.dy)
+				}
+				travelled += speed * rules.Tick.Seconds()
+			}
+			assertAt(t, p, 400+tt.dx*travelled, 300+tt.dy*travelled)
+		})
+	}
+}
+
+func TestStepTickIndependent(t *testing.T) {
+	for _, tick := range []time.Duration{10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond} {
+		rules := testRules()
+		rules.Tick = tick
+		rules.Accel = 200
+		w := NewWorld(1)
+		p := place(w, "a", 0, 300, rules)
+		// top speed half a second in, whatever the tick
+		n := int(500 * time.Millisecond / tick)
+		steps(w, n-1, rules, hold("a", "right"))
+		if p.vel.X >= float64(rules.MaxSpeed) {
+			t.Fatalf("tick %v: at top speed after %d ticks", tick, n-1)
+		}
+		steps(w, 1, rules, hold("a", "right"))
+		if !near(p.vel.X, float64(rules.MaxSpeed)) {
+			t.Fatalf("tick %v: speed %v after %d ticks", tick, p.vel.X, n)
+		}
+		// and then MaxSpeed a second
+		x := p.X
+		steps(w, int(time.Second/tick), rules, hold("a", "right"))
+		if !near(p.X-x, float64(rules.MaxSpeed)) {
+			t.Fatalf("tick %v: %v in a second at top speed", tick, p.X-x)
+		}
+	}
+}
+
+func TestStepWallStopsVelocity(t *testing.T) {
+	rules := testRules()
+	rules.Accel = 200
+	w := NewWorld(1)
+	p := place(w, "a", 780, 595, rules)
+	steps(w, 5, rules, hold("a", "right", "down"))
+	if p.vel.X != 0 || p.vel.Y != 0 {
+		t.Fatalf("velocity %v against the corner", p.vel)
+	}
+	assertAt(t, p, 800, 600)
+}
+
+func TestDiagonalSpeed(t *testing.T) {
+	rules := testRules()
+	rules.Width, rules.Height = 100000, 100000
+	rules.Accel = 200
+	distance := func(inputs ...string) float64 {
+		w := NewWorld(1)
+		p := place(w, "a", 50000, 50000, rules)
+		steps(w, 100, rules, hold("a", inputs...))
+		return math.Hypot(p.X-50000, p.Y-50000)
+	}
+	straight := distance("right")
+	for _, inputs := range [][]string{{"left", "up"}, {"right", "up"}, {"left", "down"}, {"right", "down"}} {
+		if d := distance(inputs...); !near(d, straight) {
+			t.Errorf("%v covered %v in 100 ticks, straight %v", inputs, d, straight)
+		}
+	}
+	// and a held pair isn't faster than the analog stick all the way over
+	if d := vector([]string{"right", "down"}); !near(math.Hypot(d.X, d.Y), 1) {
+		t.Errorf("diagonal vector %v", d)
+	}
+}
+
+func TestStepSmallWorld(t *testing.T) {
+	rules := testRules()
+	rules.Width, rules.Height = 200, 200
+	for _, tt := range []struct {
+		inputs []string
+		wx, wy float64
+	}{
+		{[]string{"left"}, 0, 100},
+		{[]string{"right"}, 200, 100},
+		{[]string{"up"}, 100, 0},
+		{[]string{"down"}, 100, 200},
+		{[]string{"right", "down"}, 200, 200},
+	} {
+		w := NewWorld(1)
+		p := place(w, "a", 100, 100, rules)
+		// 200 pixels, well past the edges of this world
+		steps(w, 20, rules, hold("a", tt.inputs...))
+		assertAt(t, p, tt.wx, tt.wy)
+	}
+}
+
+func TestSprintStamina(t *testing.T) {
+	// 5 stamina a tick sprinting, 2.5 back walking, a 10 tick lockout
+	rules := testRules()
+	// at sprinting speed within a tick, and back to walking within one
+	rules.Accel, rules.Friction = 10000, 10000
+	w := NewWorld(1)
+	p := place(w, "a", 10, 300, rules)
+	sprint := hold("a", "right", "sprint")
+
+	// twice as fast until it runs out, 20 ticks in
+	for i := 1; i <= 20; i++ {
+		x := p.X
+		Step(w, []InputEvent{sprint}, rules)
+		if !near(p.X-x, 20) {
+			t.Fatalf("tick %d: sprinted %v", i, p.X-x)
+		}
+		if want := 100 - 5*float64(i); !near(p.Stamina, want) {
+			t.Fatalf("tick %d: stamina %v, want %v", i, p.Stamina, want)
+		}
+	}
+	if !p.Exhausted() {
+		t.Fatal("not exhausted at 0 stamina")
+	}
+
+	// locked out: walking speed and no refill, sprint held or not
+	for i := 1; i <= 10; i++ {
+		x := p.X
+		Step(w, []InputEvent{sprint}, rules)
+		if !near(p.X-x, 10) || p.Stamina != 0 {
+			t.Fatalf("lockout tick %d: moved %v with %v stamina", i, p.X-x, p.Stamina)
+		}
+	}
+	if p.Exhausted() {
+		t.Fatal("still exhausted after the lockout")
+	}
+
+	// then it comes back walking, up to the cap
+	for i := 1; i <= 40; i++ {
+		Step(w, []InputEvent{hold("a", "down")}, rules)
+		if want := 2.5 * float64(i); !near(p.Stamina, want) {
+			t.Fatalf("regen tick %d: stamina %v, want %v", i, p.Stamina, want)
+		}
+	}
+	steps(w, 10, rules)
+	if p.Stamina != 100 {
+		t.Fatalf("stamina %v, want it capped at 100", p.Stamina)
+	}
+
+	// sprinting in place costs nothing
+	steps(w, 5, rules, hold("a", "sprint"))
+	if p.Stamina != 100 {
+		t.Fatalf("stamina %v after sprinting without moving", p.Stamina)
+	}
+}
+
+func TestDash(t *testing.T) {
+	rules := testRules()
+	rules.Obstacles = []Rect{{X: 500, Y: 250, Width: 20, Height: 100}}
+	tests := []struct {
+		name   string
+		x, y   float64
+		inputs []string
+		wx, wy float64
+	}{
+		// DashDistance along the way they move, on top of the move itself
+		{"moving", 100, 100, []string{"right", "dash"}, 190, 100},
+		{"diagonal", 100, 100, []string{"down", "left", "dash"}, 100 - 90*math.Sqrt2/2, 100 + 90*math.Sqrt2/2},
+		// standing still they dash the way they face, right to begin with
+		{"standing", 100, 100, []string{"dash"}, 180, 100},
+		{"into the edge", 750, 100, []string{"right", "dash"}, 800, 100},
+		// stops at the wall rather than coming out the other side
+		{"into a wall", 450, 300, []string{"right", "dash"}, 490, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWorld(1)
+			p := place(w, "a", tt.x, tt.y, rules)
+			Step(w, []InputEvent{hold("a", tt.inputs...)}, rules)
+			assertAt(t, p, tt.wx, tt.wy)
+		})
+	}
+}
+
+func TestDashCooldown(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	p := place(w, "a", 10, 300, rules)
+	var dashed []int
+	for i := 0; i < 25; i++ {
+		x := p.X
+		Step(w, []InputEvent{hold("a", "dash")}, rules)
+		if p.X-x > 0 {
+			dashed = append(dashed, i)
+		}
+		if i == 0 && p.DashCooldown() != 10 {
+			t.Fatalf("cooldown %d ticks after dashing, want 10", p.DashCooldown())
+		}
+	}
+	// a second's worth of ticks apart
+	if len(dashed) != 3 || dashed[0] != 0 || dashed[1] != 10 || dashed[2] != 20 {
+		t.Fatalf("dashed in ticks %v, want 0, 10 and 20", dashed)
+	}
+}
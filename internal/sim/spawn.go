@@ -0,0 +1,141 @@
+package sim
+
+import (
+	"math"
+	"sort"
+)
+
+// spawnStep is the least distance between the points Spawn tries, so a
+// search with collisions off doesn't try every pixel
+const spawnStep = 8
+
+// Point is a position in whole pixels
+type Point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Join adds a player with full health and stamina at a spawn point,
+// protected for SpawnProtection, in the next free palette color and on the
+// team with fewer players if there are teams
+func (w *World) Join(id string, rules Rules) *Player {
+	p := w.fresh(rules)
+	w.joins++
+	p.joined = w.joins
+	p.Color = w.nextColor()
+	if rules.Teams {
+		p.Team = w.smallestTeam()
+	}
+	w.Players[id] = p
+	return p
+}
+
+// fresh is a player as they start out, at a spawn point
+func (w *World) fresh(rules Rules) *Player {
+	x, y := w.Spawn(rules)
+	return &Player{
+		X:            x,
+		Y:            y,
+		HP:           rules.MaxHP,
+		Invulnerable: rules.ticks(rules.SpawnProtection),
+		Stamina:      float64(rules.Stamina),
+	}
+}
+
+// NewRound puts the world back as it was before anyone scored, with every
+// player starting over at a spawn point with their name and color and on
+// the team they were on. Players are placed in id order, so the same world
+// always starts the same way. Projectiles, coins, power-ups and flags are
+// cleared and come back as they would in a new world.
+func (w *World) NewRound(rules Rules) {
+	ids := make([]string, 0, len(w.Players))
+	for id := range w.Players {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	old := w.Players
+	*w = World{
+		Players:        make(map[string]*Player, len(old)),
+		lastProjectile: w.lastProjectile,
+		lastCoin:       w.lastCoin,
+		lastPowerUp:    w.lastPowerUp,
+		joins:          w.joins,
+		rand:           w.rand,
+	}
+	for _, id := range ids {
+		o := old[id]
+		p := w.fresh(rules)
+		p.joined = o.joined
+		p.Team = o.Team
+		p.Color = o.Color
+		p.Name = o.Name
+		p.Bot = o.Bot
+		p.LastInputSeq = o.LastInputSeq
+		p.LatencyMS = o.LatencyMS
+		w.Players[id] = p
+	}
+}
+
+// Spawn returns where a player starts or respawns. With Spawns set it is the
+// one farthest from every living player, ignoring any an obstacle covers.
+// Otherwise points on rings around the centre of the world are tried,
+// nearest first, and the first free one at least SpawnDistance from every
+// living player is taken, or failing that the free one farthest from them.
+func (w *World) Spawn(rules Rules) (float64, float64) {
+	if len(rules.Spawns) > 0 {
+		bx, by, best := 0.0, 0.0, -1.0
+		for _, s := range rules.Spawns {
+			x, y := float64(s.X), float64(s.Y)
+			if !rules.Free(x, y) {
+				continue
+			}
+			if d := w.clearance(x, y, rules); d > best {
+				bx, by, best = x, y, d
+			}
+		}
+		if best >= 0 {
+			return bx, by
+		}
+	}
+
+	cx, cy := float64(rules.Width/2), float64(rules.Height/2)
+	bx, by, best := cx, cy, -1.0
+	try := func(x, y float64) bool {
+		if !rules.Free(x, y) {
+			return false
+		}
+		d := w.clearance(x, y, rules)
+		if d > best {
+			bx, by, best = x, y, d
+		}
+		return d >= float64(rules.SpawnDistance)
+	}
+	if try(cx, cy) {
+		return cx, cy
+	}
+	step := math.Max(float64(2*rules.Radius), spawnStep)
+	limit := math.Max(float64(rules.Width), float64(rules.Height))
+	for ring := step; ring < limit; ring += step {
+		// points on the ring about step apart, starting from the right
+		n := int(2 * math.Pi * ring / step)
+		for i := 0; i < n; i++ {
+			a := 2 * math.Pi * float64(i) / float64(n)
+			x, y := cx+ring*math.Cos(a), cy+ring*math.Sin(a)
+			if try(x, y) {
+				return x, y
+			}
+		}
+	}
+	return bx, by
+}
+
+// clearance is the distance from x, y to the nearest living player
+func (w *World) clearance(x, y float64, rules Rules) float64 {
+	d := math.Inf(1)
+	for _, p := range w.Players {
+		if !p.Dead {
+			d = math.Min(d, rules.dist(p.X, p.Y, x, y))
+		}
+	}
+	return d
+}
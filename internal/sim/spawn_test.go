@@ -0,0 +1,68 @@
+package sim
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// spread fails unless every two living players in w are at least d apart
+func spread(t *testing.T, w *World, d float64) {
+	t.Helper()
+	for ia, a := range w.Players {
+		for ib, b := range w.Players {
+			if ia < ib && !a.Dead && !b.Dead && math.Hypot(a.X-b.X, a.Y-b.Y) < d {
+				t.Fatalf("%s at %v,%v and %s at %v,%v are closer than %v", ia, a.X, a.Y, ib, b.X, b.Y, d)
+			}
+		}
+	}
+}
+
+func TestSpawnSpreadsPlayers(t *testing.T) {
+	rules := testRules()
+	rules.SpawnDistance = 100
+	w := NewWorld(1)
+	for i := 0; i < 10; i++ {
+		w.Join(fmt.Sprint(i), rules)
+	}
+	spread(t, w, 100)
+}
+
+func TestSpawnPointsFarthestFirst(t *testing.T) {
+	rules := testRules()
+	rules.Spawns = []Point{{X: 100, Y: 100}, {X: 700, Y: 500}, {X: 400, Y: 300}}
+	w := NewWorld(1)
+	place(w, "a", 650, 450, rules)
+	if x, y := w.Spawn(rules); x != 100 || y != 100 {
+		t.Fatalf("spawned at %v,%v, want the point farthest from a", x, y)
+	}
+}
+
+func TestRespawnSpreads(t *testing.T) {
+	rules := testRules()
+	rules.SpawnDistance = 100
+	w := NewWorld(1)
+	for i := 0; i < 10; i++ {
+		w.Join(fmt.Sprint(i), rules)
+	}
+	// one dies, and the rest gather in a row across the middle where
+	// spawns are tried first
+	p := w.Players["3"]
+	p.Dead, p.HP, p.respawn = true, 0, 1
+	x := 220.0
+	for _, other := range w.Players {
+		if other != p {
+			other.X, other.Y = x, 300
+			x += 40
+		}
+	}
+	steps(w, 1, rules)
+	if p.Dead {
+		t.Fatal("not back")
+	}
+	for id, other := range w.Players {
+		if other != p && math.Hypot(other.X-p.X, other.Y-p.Y) < 100 {
+			t.Fatalf("back at %v,%v next to %s at %v,%v", p.X, p.Y, id, other.X, other.Y)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package sim
+
+// Stats are what a player has done so far in the round. They live on the
+// player and are counted as the world steps, so keeping them allocates
+// nothing, and they start over along with everything else in NewRound.
+type Stats struct {
+	// pixels moved, the short way round when the world wraps; respawning
+	// doesn't count
+	Distance float64 `json:"distance"`
+	// input frames applied
+	Inputs int `json:"inputs"`
+	Kills  int `json:"kills"`
+	Deaths int `json:"deaths"`
+	Coins  int `json:"coins"`
+	// ticks spent it in tag
+	ItTicks int `json:"it_ticks"`
+}
+
+// travelled adds how far every player got since the start of the step to
+// their distance
+func (w *World) travelled(rules Rules) {
+	for _, p := range w.Players {
+		p.Stats.Distance += rules.dist(p.fromX, p.fromY, p.X, p.Y)
+	}
+}
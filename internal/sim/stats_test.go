@@ -0,0 +1,75 @@
+package sim
+
+import "testing"
+
+func TestStatsShortMatch(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	w.Coins = []*Coin{{ID: 1, X: 150, Y: 300}, {ID: 2, X: 250, Y: 300}}
+	w.lastCoin = 2
+	a := place(w, "a", 100, 300, rules)
+	b := place(w, "b", 400, 500, rules)
+	// 10 pixels a tick from the first, through both coins
+	steps(w, 20, rules, hold("a", "right"))
+	if !near(a.Stats.Distance, 200) || a.Stats.Coins != 2 || a.Stats.Inputs != 20 {
+		t.Fatalf("a's stats %+v, want 200 pixels, 2 coins and 20 inputs", a.Stats)
+	}
+	if b.Stats != (Stats{}) {
+		t.Fatalf("b's stats %+v standing still", b.Stats)
+	}
+
+	// a diagonal counts its length, not its two sides
+	steps(w, 10, rules, hold("b", "up", "right"))
+	if !near(b.Stats.Distance, 100) || b.Stats.Inputs != 10 {
+		t.Fatalf("b's stats %+v, want 100 pixels in 10 inputs", b.Stats)
+	}
+}
+
+func TestStatsKillsAndDeaths(t *testing.T) {
+	rules := testRules()
+	w, a, b := duel(rules)
+	b.HP = 25
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	if a.Stats.Kills != 1 || a.Stats.Deaths != 0 || b.Stats.Kills != 0 || b.Stats.Deaths != 1 {
+		t.Fatalf("a's stats %+v, b's %+v", a.Stats, b.Stats)
+	}
+	// respawning somewhere else isn't travelling
+	before := b.Stats.Distance
+	steps(w, 10, rules)
+	if b.Dead || b.Stats.Distance != before {
+		t.Fatalf("b dead %v, went %v respawning", b.Dead, b.Stats.Distance-before)
+	}
+}
+
+func TestStatsWrap(t *testing.T) {
+	rules := wrapRules()
+	w := NewWorld(1)
+	p := place(w, "a", 795, 300, rules)
+	Step(w, []InputEvent{hold("a", "right")}, rules)
+	if !near(p.Stats.Distance, 10) {
+		t.Fatalf("went %v through the seam, want 10", p.Stats.Distance)
+	}
+}
+
+func TestStatsNewRound(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	place(w, "a", 100, 300, rules)
+	steps(w, 5, rules, hold("a", "right"))
+	w.NewRound(rules)
+	if p := w.Players["a"]; p.Stats != (Stats{}) {
+		t.Fatalf("stats %+v in a new round", p.Stats)
+	}
+}
+
+func TestStatsDontAllocate(t *testing.T) {
+	rules := testRules()
+	w := NewWorld(1)
+	for _, id := range []string{"a", "b", "c"} {
+		place(w, id, 100, 100, rules)
+	}
+	if n := testing.AllocsPerRun(100, func() { w.travelled(rules) }); n != 0 {
+		t.Fatalf("%v allocations a tick", n)
+	}
+}
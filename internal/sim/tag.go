@@ -0,0 +1,76 @@
+package sim
+
+import (
+	"math"
+	"sort"
+)
+
+// tagReach is how far apart two players may be and still touch, so players
+// collide pushes to exactly touching still count
+const tagReach = 1
+
+// Tag is the mode where one player is it. Whoever is it passes that on by
+// touching another living player, who can't tag them straight back for
+// TagImmunity, and loses a point for every TagCost they stay it.
+type Tag struct{}
+
+func (Tag) Step(w *World, rules Rules) {
+	ids := make([]string, 0, len(w.Players))
+	it := ""
+	for id, p := range w.Players {
+		ids = append(ids, id)
+		if p.It {
+			it = id
+		}
+		if p.tagImmune > 0 {
+			p.tagImmune--
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	sort.Strings(ids)
+	if it == "" {
+		// at the start, or once whoever was it has left
+		it = ids[w.rand.Intn(len(ids))]
+		w.Players[it].It = true
+		w.Players[it].itTicks = 0
+	}
+	p := w.Players[it]
+
+	if next := w.tagged(it, ids, rules); next != "" {
+		p.It = false
+		p.tagImmune = rules.ticks(rules.TagImmunity)
+		q := w.Players[next]
+		q.It = true
+		q.itTicks = 0
+		return
+	}
+	p.itTicks++
+	p.Stats.ItTicks++
+	if cost := rules.ticks(rules.TagCost); cost > 0 && p.itTicks%cost == 0 {
+		w.award(it, -1)
+	}
+}
+
+// tagged is the player it touches that can be tagged, the nearest with the
+// lower id on a tie, or "" if there is none. Dead players neither tag nor
+// get tagged.
+func (w *World) tagged(it string, ids []string, rules Rules) string {
+	p := w.Players[it]
+	if p.Dead {
+		return ""
+	}
+	reach := 2*float64(rules.Radius) + tagReach
+	best, bestD := "", math.Inf(1)
+	for _, id := range ids {
+		q := w.Players[id]
+		if id == it || q.Dead || q.tagImmune > 0 {
+			continue
+		}
+		if d := rules.dist(p.X, p.Y, q.X, q.Y); d <= reach && d < bestD {
+			best, bestD = id, d
+		}
+	}
+	return best
+}
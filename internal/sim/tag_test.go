@@ -0,0 +1,154 @@
+package sim
+
+import (
+	"testing"
+	"time"
+)
+
+func tagRules() Rules {
+	rules := testRules()
+	rules.Mode = Tag{}
+	rules.TagImmunity = 500 * time.Millisecond
+	rules.TagCost = 300 * time.Millisecond
+	return rules
+}
+
+// it is who is it, "" for nobody and "many" for more than one
+func it(w *World) string {
+	found := ""
+	for id, p := range w.Players {
+		if p.It {
+			if found != "" {
+				return "many"
+			}
+			found = id
+		}
+	}
+	return found
+}
+
+// row puts ids well apart along the middle of the world
+func row(w *World, rules Rules, ids ...string) {
+	for i, id := range ids {
+		place(w, id, float64(100+200*i), 300, rules)
+	}
+}
+
+func TestTagFirstIt(t *testing.T) {
+	rules := tagRules()
+	picked := map[string]bool{}
+	for seed := int64(1); seed <= 20; seed++ {
+		w := NewWorld(seed)
+		row(w, rules, "a", "b", "c")
+		Step(w, nil, rules)
+		first := it(w)
+		if first == "" || first == "many" {
+			t.Fatalf("seed %d: it is %q", seed, first)
+		}
+		// and it stays them while nobody touches anyone
+		steps(w, 5, rules)
+		if got := it(w); got != first {
+			t.Fatalf("seed %d: it went from %s to %s", seed, first, got)
+		}
+		picked[first] = true
+	}
+	if len(picked) < 2 {
+		t.Fatalf("20 seeds all picked %v", picked)
+	}
+
+	// whoever leaves while it hands it on
+	w := NewWorld(1)
+	row(w, rules, "a", "b", "c")
+	Step(w, nil, rules)
+	w.Remove(it(w))
+	Step(w, nil, rules)
+	if got := it(w); got == "" || got == "many" {
+		t.Fatalf("after it left it is %q", got)
+	}
+}
+
+func TestTagTransfer(t *testing.T) {
+	rules := tagRules()
+	w := NewWorld(1)
+	a := place(w, "a", 100, 300, rules)
+	b := place(w, "b", 500, 300, rules)
+	c := place(w, "c", 540, 300, rules)
+	a.It = true
+	// b is nearer than c, both in reach
+	a.X = 480
+	Step(w, nil, rules)
+	if a.It || !b.It || c.It {
+		t.Fatalf("it is %s, want b", it(w))
+	}
+	if a.tagImmune != 5 {
+		t.Fatalf("%d ticks of immunity, want 5", a.tagImmune)
+	}
+
+	// the dead neither tag nor get tagged
+	w = NewWorld(1)
+	a = place(w, "a", 100, 300, rules)
+	b = place(w, "b", 119, 300, rules)
+	a.It = true
+	b.Dead = true
+	Step(w, nil, rules)
+	if got := it(w); got != "a" {
+		t.Fatalf("tagged the dead: it is %s", got)
+	}
+}
+
+func TestTagImmunity(t *testing.T) {
+	rules := tagRules()
+	w := NewWorld(1)
+	a := place(w, "a", 100, 300, rules)
+	place(w, "b", 120, 300, rules)
+	a.It = true
+	Step(w, nil, rules)
+	if got := it(w); got != "b" {
+		t.Fatalf("it is %s, want b", got)
+	}
+	// still touching, but a can't be tagged back for TagImmunity, 5 ticks
+	for i := 1; i <= 5; i++ {
+		Step(w, nil, rules)
+		want := "b"
+		if i == 5 {
+			want = "a"
+		}
+		if got := it(w); got != want {
+			t.Fatalf("tick %d: it is %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestTagScoring(t *testing.T) {
+	rules := tagRules()
+	w := NewWorld(1)
+	a := place(w, "a", 100, 300, rules)
+	b := place(w, "b", 500, 300, rules)
+	a.It = true
+	// TagCost is 3 ticks
+	for i := 1; i <= 9; i++ {
+		Step(w, nil, rules)
+		if want := -(i / 3); a.Score != want || b.Score != 0 {
+			t.Fatalf("tick %d: scores %d and %d, want %d and 0", i, a.Score, b.Score, want)
+		}
+	}
+	if a.Stats.ItTicks != 9 || b.Stats.ItTicks != 0 {
+		t.Fatalf("ticks it %d and %d", a.Stats.ItTicks, b.Stats.ItTicks)
+	}
+	if len(w.Scores) != 1 || w.Scores[0].PlayerID != "a" {
+		t.Fatalf("score events %+v", w.Scores)
+	}
+
+	// being tagged starts the count over
+	b.X = 120
+	Step(w, nil, rules)
+	b.X = 500
+	steps(w, 2, rules)
+	if b.Score != 0 {
+		t.Fatalf("b lost %d after two ticks it", -b.Score)
+	}
+	Step(w, nil, rules)
+	if b.Score != -1 || a.Score != -3 {
+		t.Fatalf("scores %d and %d, want -3 and -1", a.Score, b.Score)
+	}
+}
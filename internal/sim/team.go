@@ -0,0 +1,52 @@
+package sim
+
+// Teams is how many teams there are when players are split into them
+const Teams = 2
+
+// teamCounts is how many players each team has, indexed by team
+func (w *World) teamCounts() [Teams + 1]int {
+	var counts [Teams + 1]int
+	for _, p := range w.Players {
+		counts[p.Team]++
+	}
+	return counts
+}
+
+// smallestTeam is the team with the fewest players, the lower one on a tie
+func (w *World) smallestTeam() int {
+	counts := w.teamCounts()
+	best := 1
+	for t := 2; t <= Teams; t++ {
+		if counts[t] < counts[best] {
+			best = t
+		}
+	}
+	return best
+}
+
+// SwitchTeam moves player id to the next team, unless that would leave one
+// team more than delta players ahead of another, and reports whether it did
+func (w *World) SwitchTeam(id string, delta int) bool {
+	p, ok := w.Players[id]
+	if !ok || p.Team == 0 {
+		return false
+	}
+	to := p.Team%Teams + 1
+	counts := w.teamCounts()
+	counts[p.Team]--
+	counts[to]++
+	least, most := counts[1], counts[1]
+	for t := 2; t <= Teams; t++ {
+		if counts[t] < least {
+			least = counts[t]
+		}
+		if counts[t] > most {
+			most = counts[t]
+		}
+	}
+	if most-least > delta {
+		return false
+	}
+	p.Team = to
+	return true
+}
@@ -0,0 +1,93 @@
+package sim
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTeamsAlternate(t *testing.T) {
+	rules := testRules()
+	rules.Teams = true
+	w := NewWorld(1)
+	for i := 0; i < 6; i++ {
+		p := place(w, fmt.Sprint(i), float64(100+100*i), 300, rules)
+		if want := i%2 + 1; p.Team != want {
+			t.Fatalf("player %d on team %d, want %d", i, p.Team, want)
+		}
+	}
+	// a gap left by someone leaving is filled first
+	w.Remove("0")
+	w.Remove("2")
+	if p := place(w, "6", 100, 500, rules); p.Team != 1 {
+		t.Fatalf("joined team %d, want the smaller team 1", p.Team)
+	}
+	// and without teams nobody is on one
+	rules.Teams = false
+	if p := place(w, "7", 300, 500, rules); p.Team != 0 {
+		t.Fatalf("joined team %d without teams", p.Team)
+	}
+}
+
+func TestSwitchTeam(t *testing.T) {
+	rules := testRules()
+	rules.Teams = true
+	for _, tt := range []struct {
+		name  string
+		teams []int
+		delta int
+		ok    bool
+	}{
+		{"to the smaller team", []int{1, 1, 2}, 1, true},
+		{"one each", []int{1, 2}, 1, false},
+		{"evens to two ahead", []int{1, 1, 2, 2}, 1, false},
+		{"evens to two ahead allowed", []int{1, 1, 2, 2}, 2, true},
+		{"to the bigger team", []int{1, 2, 2}, 1, false},
+		{"alone", []int{1}, 1, true},
+		{"alone, no slack", []int{1}, 0, false},
+	} {
+		w := NewWorld(1)
+		for i, team := range tt.teams {
+			place(w, fmt.Sprint(i), float64(100+100*i), 300, rules).Team = team
+		}
+		p := w.Players["0"]
+		from := p.Team
+		if ok := w.SwitchTeam("0", tt.delta); ok != tt.ok {
+			t.Fatalf("%s: switched %v, want %v", tt.name, ok, tt.ok)
+		}
+		if moved := p.Team != from; moved != tt.ok {
+			t.Fatalf("%s: on team %d after starting on %d", tt.name, p.Team, from)
+		}
+	}
+
+	w := NewWorld(1)
+	place(w, "a", 100, 300, testRules())
+	if w.SwitchTeam("a", 5) || w.SwitchTeam("nobody", 5) {
+		t.Fatal("switched without a team")
+	}
+}
+
+func TestFriendlyFire(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		friendly bool
+		bTeam    int
+		bHP, cHP int
+	}{
+		// the shot goes through a teammate to the enemy behind them
+		{"teammate", false, 1, 100, 75},
+		{"teammate, friendly fire", true, 1, 75, 100},
+		{"enemy", false, 2, 75, 100},
+	} {
+		rules := testRules()
+		rules.Teams = true
+		rules.FriendlyFire = tt.friendly
+		w, a, b := duel(rules)
+		c := place(w, "c", 200, 300, rules)
+		a.Team, b.Team, c.Team = 1, tt.bTeam, 2
+		Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+		steps(w, 3, rules)
+		if b.HP != tt.bHP || c.HP != tt.cHP {
+			t.Fatalf("%s: b has %d hp and c %d, want %d and %d", tt.name, b.HP, c.HP, tt.bHP, tt.cHP)
+		}
+	}
+}
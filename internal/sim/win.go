@@ -0,0 +1,98 @@
+package sim
+
+import "strconv"
+
+// how a match was won, in World.Ended
+const (
+	// someone reached WinScore
+	EndScore = "score"
+	// everyone else is dead, with LastAlive
+	EndLastAlive = "last_alive"
+	// someone held the hill for HillScore, in king of the hill
+	EndHill = "hill"
+)
+
+// win ends the match in the step, won by winner for reason
+func (w *World) win(winner, reason string) {
+	w.Winner, w.Ended = winner, reason
+}
+
+// checkWin ends the match once a player, or with teams a team, has
+// WinScore points, counting captures in capture the flag, or with
+// LastAlive once at most one of two or more has anyone left alive. Ties
+// go to the lower id or team, and nobody left alive at all is a draw.
+func (w *World) checkWin(rules Rules) {
+	if w.Ended != "" {
+		return
+	}
+	if rules.WinScore > 0 {
+		winner := ""
+		if rules.Teams {
+			for t := Teams; t >= 1; t-- {
+				if w.teamScore(t) >= rules.WinScore {
+					winner = strconv.Itoa(t)
+				}
+			}
+		} else {
+			for id, p := range w.Players {
+				if p.Score >= rules.WinScore && (winner == "" || id < winner) {
+					winner = id
+				}
+			}
+		}
+		if winner != "" {
+			w.win(winner, EndScore)
+			return
+		}
+	}
+	if !rules.LastAlive {
+		return
+	}
+	// how many players or teams are in the match, how many have anyone
+	// alive and the last of those
+	sides, left, last := 0, 0, ""
+	if rules.Teams {
+		var total, living [Teams + 1]int
+		for _, p := range w.Players {
+			total[p.Team]++
+			if !p.Dead {
+				living[p.Team]++
+			}
+		}
+		for t := 1; t <= Teams; t++ {
+			if total[t] > 0 {
+				sides++
+			}
+			if living[t] > 0 {
+				left++
+				last = strconv.Itoa(t)
+			}
+		}
+	} else {
+		sides = len(w.Players)
+		for id, p := range w.Players {
+			if !p.Dead {
+				left++
+				last = id
+			}
+		}
+	}
+	if sides >= 2 && left <= 1 {
+		w.win(last, EndLastAlive)
+	}
+}
+
+// teamScore is team t's captures when the mode keeps them, and otherwise
+// what its players scored between them
+func (w *World) teamScore(t int) int {
+	if len(w.TeamScores) == Teams {
+		return w.TeamScores[t-1]
+	}
+	score := 0
+	for _, p := range w.Players {
+		if p.Team == t {
+			score += p.Score
+		}
+	}
+	return score
+}
@@ -0,0 +1,159 @@
+package sim
+
+import "testing"
+
+func TestWinScore(t *testing.T) {
+	rules := testRules()
+	rules.WinScore = 3
+	w := NewWorld(1)
+	a := place(w, "a", 100, 100, rules)
+	b := place(w, "b", 300, 100, rules)
+	c := place(w, "c", 500, 100, rules)
+	a.Score, b.Score, c.Score = 2, 2, 2
+	Step(w, nil, rules)
+	if w.Ended != "" {
+		t.Fatalf("ended by %s short of the score", w.Ended)
+	}
+	// ties go to the lower id
+	c.Score, b.Score = 3, 4
+	Step(w, nil, rules)
+	if w.Ended != EndScore || w.Winner != "b" {
+		t.Fatalf("ended by %q won by %q, want b by score", w.Ended, w.Winner)
+	}
+	// and only the step it happened in says so
+	rules.WinScore = 0
+	Step(w, nil, rules)
+	if w.Ended != "" || w.Winner != "" {
+		t.Fatalf("ended by %q won by %q without a win score", w.Ended, w.Winner)
+	}
+
+	// a kill can be the point that wins it
+	rules = testRules()
+	rules.WinScore = 1
+	w, _, _ = duel(rules)
+	w.Players["b"].HP = 25
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	if w.Ended != EndScore || w.Winner != "a" {
+		t.Fatalf("ended by %q won by %q, want a by score", w.Ended, w.Winner)
+	}
+}
+
+func TestWinScoreTeams(t *testing.T) {
+	rules := testRules()
+	rules.Teams = true
+	rules.WinScore = 4
+	w := NewWorld(1)
+	// teams 1, 2, 1, 2
+	ps := []*Player{
+		place(w, "a", 100, 100, rules),
+		place(w, "b", 300, 100, rules),
+		place(w, "c", 500, 100, rules),
+		place(w, "d", 700, 100, rules),
+	}
+	ps[0].Score, ps[1].Score, ps[2].Score, ps[3].Score = 3, 2, 0, 1
+	Step(w, nil, rules)
+	if w.Ended != "" {
+		t.Fatalf("ended by %s short of the score", w.Ended)
+	}
+	ps[3].Score = 2
+	Step(w, nil, rules)
+	if w.Ended != EndScore || w.Winner != "2" {
+		t.Fatalf("ended by %q won by %q, want team 2 by score", w.Ended, w.Winner)
+	}
+}
+
+func TestWinLastAlive(t *testing.T) {
+	rules := testRules()
+	rules.LastAlive = true
+	w := NewWorld(1)
+	place(w, "a", 100, 300, rules)
+	b := place(w, "b", 150, 300, rules)
+	c := place(w, "c", 600, 300, rules)
+	b.HP, c.HP = 25, 25
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	Step(w, nil, rules)
+	if !b.Dead || w.Ended != "" {
+		t.Fatalf("b dead %v, ended by %q with two alive", b.Dead, w.Ended)
+	}
+	// the dead stay dead well past RespawnDelay
+	steps(w, 20, rules)
+	if !b.Dead || w.Ended != "" {
+		t.Fatalf("b dead %v, ended by %q", b.Dead, w.Ended)
+	}
+	c.Dead = true
+	Step(w, nil, rules)
+	if w.Ended != EndLastAlive || w.Winner != "a" {
+		t.Fatalf("ended by %q won by %q, want a as the last alive", w.Ended, w.Winner)
+	}
+	// nobody left at all is a draw
+	w.Players["a"].Dead = true
+	Step(w, nil, rules)
+	if w.Ended != EndLastAlive || w.Winner != "" {
+		t.Fatalf("ended by %q won by %q, want a draw", w.Ended, w.Winner)
+	}
+
+	// and one player alone hasn't won anything
+	w = NewWorld(1)
+	place(w, "a", 100, 300, rules)
+	Step(w, nil, rules)
+	if w.Ended != "" {
+		t.Fatalf("ended by %q alone", w.Ended)
+	}
+}
+
+func TestWinLastAliveTeams(t *testing.T) {
+	rules := testRules()
+	rules.Teams = true
+	rules.LastAlive = true
+	w := NewWorld(1)
+	a := place(w, "a", 100, 100, rules)
+	b := place(w, "b", 300, 100, rules)
+	place(w, "c", 500, 100, rules)
+	d := place(w, "d", 700, 100, rules)
+	a.Dead, b.Dead = true, true
+	Step(w, nil, rules)
+	if w.Ended != "" {
+		t.Fatalf("ended by %q with both teams alive", w.Ended)
+	}
+	d.Dead = true
+	Step(w, nil, rules)
+	if w.Ended != EndLastAlive || w.Winner != "1" {
+		t.Fatalf("ended by %q won by %q, want team 1", w.Ended, w.Winner)
+	}
+}
+
+func TestNewRoundResets(t *testing.T) {
+	rules := testRules()
+	rules.Coins = 3
+	rules.Spawns = []Point{{X: 100, Y: 100}, {X: 700, Y: 500}}
+	w, a, b := duel(rules)
+	a.Score, b.Score = 3, 5
+	b.HP = 25
+	Step(w, []InputEvent{shootAt("a", 1, 0), shootAt("b", 1, 0)}, rules)
+	Step(w, nil, rules)
+	if !b.Dead || len(w.Projectiles) == 0 {
+		t.Fatalf("b dead %v with %d projectiles flying", b.Dead, len(w.Projectiles))
+	}
+	last := w.lastProjectile
+
+	w.NewRound(rules)
+	if len(w.Projectiles) != 0 || len(w.Coins) != 0 || w.Ended != "" || len(w.Deaths) != 0 {
+		t.Fatalf("left over %+v", w)
+	}
+	spawns := map[Point]bool{}
+	for id, p := range w.Players {
+		if p.Score != 0 || p.Dead || p.HP != rules.MaxHP || p.vel != (Vector{}) {
+			t.Fatalf("%s starts over as %+v", id, p)
+		}
+		spawns[Point{X: int(p.X), Y: int(p.Y)}] = true
+	}
+	if len(spawns) != 2 || !spawns[Point{X: 100, Y: 100}] || !spawns[Point{X: 700, Y: 500}] {
+		t.Fatalf("spawned at %v", spawns)
+	}
+	// the next step puts the coins back, and ids carry on
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	if len(w.Coins) != 3 || len(w.Projectiles) != 1 || w.Projectiles[0].ID != last+1 {
+		t.Fatalf("coins %d, projectiles %+v", len(w.Coins), w.Projectiles)
+	}
+}
@@ -0,0 +1,53 @@
+package sim
+
+import "math"
+
+// wrapAxis brings pos back into [0, size) through the opposite edge
+func wrapAxis(pos, size float64) float64 {
+	pos = math.Mod(pos, size)
+	if pos < 0 {
+		pos += size
+	}
+	// adding size to a tiny negative pos can round up to size itself
+	if pos >= size {
+		pos = 0
+	}
+	return pos
+}
+
+// offset is how far b lies from a along an axis of size, the short way
+// round through the seam when the world wraps
+func (rules Rules) offset(a, b float64, size int) float64 {
+	d := b - a
+	if !rules.Wrap || size <= 0 {
+		return d
+	}
+	s := float64(size)
+	d = math.Mod(d, s)
+	if d > s/2 {
+		d -= s
+	} else if d < -s/2 {
+		d += s
+	}
+	return d
+}
+
+// dist is the distance between two points, the short way round when the
+// world wraps
+func (rules Rules) dist(ax, ay, bx, by float64) float64 {
+	return math.Hypot(rules.offset(ax, bx, rules.Width), rules.offset(ay, by, rules.Height))
+}
+
+// bound keeps pos within the world along an axis of size. Without Wrap it
+// stops there, and so does the velocity along it on contact; with Wrap it
+// comes back in through the opposite edge.
+func (rules Rules) bound(pos, vel float64, size int) (float64, float64) {
+	if rules.Wrap {
+		return wrapAxis(pos, float64(size)), vel
+	}
+	max := float64(size)
+	if pos <= 0 && vel < 0 || pos >= max && vel > 0 {
+		vel = 0
+	}
+	return clamp(pos, 0, max), vel
+}
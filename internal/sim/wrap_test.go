@@ -0,0 +1,96 @@
+package sim
+
+import (
+	"math"
+	"testing"
+)
+
+func wrapRules() Rules {
+	rules := testRules()
+	rules.Wrap = true
+	return rules
+}
+
+func TestWrapEdges(t *testing.T) {
+	rules := wrapRules()
+	// 10 px a tick, or 7.07 along each axis on a diagonal
+	d := 10 / math.Sqrt2
+	for _, tt := range []struct {
+		name         string
+		x, y         float64
+		inputs       []string
+		wantX, wantY float64
+	}{
+		{"right", 795, 300, []string{"right"}, 5, 300},
+		{"left", 5, 300, []string{"left"}, 795, 300},
+		{"down", 400, 595, []string{"down"}, 400, 5},
+		{"up", 400, 5, []string{"up"}, 400, 595},
+		{"bottom right", 798, 598, []string{"down", "right"}, 798 + d - 800, 598 + d - 600},
+		{"top left", 2, 2, []string{"up", "left"}, 802 - d, 602 - d},
+		{"top right", 798, 2, []string{"up", "right"}, 798 + d - 800, 602 - d},
+		{"bottom left", 2, 598, []string{"down", "left"}, 802 - d, 598 + d - 600},
+	} {
+		w := NewWorld(1)
+		p := place(w, "a", tt.x, tt.y, rules)
+		Step(w, []InputEvent{hold("a", tt.inputs...)}, rules)
+		if !near(p.X, tt.wantX) || !near(p.Y, tt.wantY) {
+			t.Fatalf("%s: at %v,%v, want %v,%v", tt.name, p.X, p.Y, tt.wantX, tt.wantY)
+		}
+		// and they keep going at the same speed
+		if v := math.Hypot(p.vel.X, p.vel.Y); !near(v, 100) {
+			t.Fatalf("%s: speed %v after wrapping", tt.name, v)
+		}
+	}
+	// without Wrap the edge stops them
+	w := NewWorld(1)
+	p := place(w, "a", 795, 300, testRules())
+	Step(w, []InputEvent{hold("a", "right")}, testRules())
+	if p.X != 800 || p.vel.X != 0 {
+		t.Fatalf("at %v going %v, want stopped at 800", p.X, p.vel.X)
+	}
+}
+
+func TestWrapAxis(t *testing.T) {
+	for _, tt := range []struct{ pos, want float64 }{
+		{0, 0},
+		{799.5, 799.5},
+		{800, 0},
+		{805, 5},
+		{-5, 795},
+		{1605, 5},
+		{-1e-14, 0},
+	} {
+		if got := wrapAxis(tt.pos, 800); !near(got, tt.want) || got < 0 || got >= 800 {
+			t.Fatalf("wrapAxis(%v) = %v, want %v", tt.pos, got, tt.want)
+		}
+	}
+}
+
+func TestWrapSeam(t *testing.T) {
+	rules := wrapRules()
+	if d := rules.dist(795, 300, 5, 300); !near(d, 10) {
+		t.Fatalf("distance across the seam %v, want 10", d)
+	}
+	if d := rules.dist(400, 2, 400, 598); !near(d, 4) {
+		t.Fatalf("distance across the seam %v, want 4", d)
+	}
+
+	// players overlapping across the seam are pushed apart through it
+	w := NewWorld(1)
+	a := place(w, "a", 795, 300, rules)
+	b := place(w, "b", 5, 300, rules)
+	Step(w, nil, rules)
+	if d := rules.dist(a.X, a.Y, b.X, b.Y); d < 20-1e-6 || a.X < 700 || b.X > 100 {
+		t.Fatalf("a at %v and b at %v, %v apart", a.X, b.X, d)
+	}
+
+	// and a shot goes through it to whoever is on the other side
+	w = NewWorld(1)
+	place(w, "a", 780, 300, rules)
+	c := place(w, "c", 30, 300, rules)
+	Step(w, []InputEvent{shootAt("a", 1, 0)}, rules)
+	steps(w, 2, rules)
+	if c.HP != 75 {
+		t.Fatalf("c has %d hp, want hit through the seam", c.HP)
+	}
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Checkpoints keeps the latest checkpoint of each room, already encoded,
+// for a while after it was taken
+type Checkpoints interface {
+	// Save keeps data as room's checkpoint for ttl, in place of any before
+	Save(ctx context.Context, room string, data []byte, ttl time.Duration) error
+	// Load returns room's checkpoint, ok false when there is none or it
+	// expired
+	Load(ctx context.Context, room string) (data []byte, ok bool, err error)
+	// Forget drops room's checkpoint
+	Forget(ctx context.Context, room string) error
+}
+
+// RedisCheckpoints keeps each checkpoint in a plain key that expires
+type RedisCheckpoints struct {
+	rdb    redis.Cmdable
+	prefix string
+}
+
+// NewRedisCheckpoints stores checkpoints as prefix:{<room>}, hash tagged
+// like the room's broker channel
+func NewRedisCheckpoints(rdb redis.Cmdable, prefix string) *RedisCheckpoints {
+	return &RedisCheckpoints{rdb: rdb, prefix: prefix}
+}
+
+func (rc *RedisCheckpoints) key(room string) string {
+	return rc.prefix + ":{" + room + "}"
+}
+
+func (rc *RedisCheckpoints) Save(ctx context.Context, room string, data []byte, ttl time.Duration) error {
+	return rc.rdb.Set(ctx, rc.key(room), data, ttl).Err()
+}
+
+func (rc *RedisCheckpoints) Load(ctx context.Context, room string) ([]byte, bool, error) {
+	data, err := rc.rdb.Get(ctx, rc.key(room)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	return data, err == nil, err
+}
+
+func (rc *RedisCheckpoints) Forget(ctx context.Context, room string) error {
+	return rc.rdb.Del(ctx, rc.key(room)).Err()
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCheckpoints(t *testing.T) {
+	rdb, mr := testRedis(t)
+	cps := NewRedisCheckpoints(rdb, "checkpoint")
+	ctx := context.Background()
+	if _, ok, err := cps.Load(ctx, "lobby"); ok || err != nil {
+		t.Fatalf("loaded a checkpoint never saved: %v, %v", ok, err)
+	}
+	for _, data := range []string{"one", "two"} {
+		if err := cps.Save(ctx, "lobby", []byte(data), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the latest replaces the one before
+	if data, ok, err := cps.Load(ctx, "lobby"); err != nil || !ok || string(data) != "two" {
+		t.Fatalf("got %q, %v, %v, want two", data, ok, err)
+	}
+	// hash tagged like the room's channel
+	if !mr.Exists("checkpoint:{lobby}") {
+		t.Fatalf("keys %v", mr.Keys())
+	}
+	if _, ok, _ := cps.Load(ctx, "other"); ok {
+		t.Fatal("another room has lobby's checkpoint")
+	}
+
+	if err := cps.Forget(ctx, "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := cps.Load(ctx, "lobby"); ok || err != nil {
+		t.Fatalf("loaded a forgotten checkpoint: %v, %v", ok, err)
+	}
+}
+
+func TestCheckpointExpires(t *testing.T) {
+	rdb, mr := testRedis(t)
+	cps := NewRedisCheckpoints(rdb, "checkpoint")
+	ctx := context.Background()
+	if err := cps.Save(ctx, "lobby", []byte("one"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(59 * time.Second)
+	if _, ok, _ := cps.Load(ctx, "lobby"); !ok {
+		t.Fatal("gone before its ttl")
+	}
+	mr.FastForward(time.Second)
+	if _, ok, err := cps.Load(ctx, "lobby"); ok || err != nil {
+		t.Fatalf("loaded after its ttl: %v, %v", ok, err)
+	}
+}
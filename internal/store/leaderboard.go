@@ -0,0 +1,126 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Points is what a player scored, to be added to their all-time score
+type Points struct {
+	Account string
+	Name    string
+	Points  int
+}
+
+// Rank is a player's place on a leaderboard. Players with the same score
+// share a rank, the next one down skipping as many places as shared it.
+type Rank struct {
+	Rank    int
+	Account string
+	Name    string
+	Score   int64
+}
+
+// Leaderboard keeps all-time scores by account, one board per game mode
+type Leaderboard interface {
+	// Add adds points to the mode's board, naming each account by the name
+	// it last scored under
+	Add(ctx context.Context, mode string, points []Points) error
+	// Top returns the n best ranked players of the mode's board, best first
+	Top(ctx context.Context, mode string, n int) ([]Rank, error)
+	// Rank returns where account is on the mode's board, ok false when it
+	// has never scored there
+	Rank(ctx context.Context, mode, account string) (r Rank, ok bool, err error)
+}
+
+// RedisLeaderboard keeps each board in a sorted set and the names of every
+// account in a hash beside them
+type RedisLeaderboard struct {
+	rdb    redis.Cmdable
+	prefix string
+}
+
+// NewRedisLeaderboard keeps boards as prefix:<mode> and names as
+// prefix:names
+func NewRedisLeaderboard(rdb redis.Cmdable, prefix string) *RedisLeaderboard {
+	return &RedisLeaderboard{rdb: rdb, prefix: prefix}
+}
+
+func (rl *RedisLeaderboard) key(mode string) string {
+	return rl.prefix + ":" + mode
+}
+
+func (rl *RedisLeaderboard) names() string {
+	return rl.prefix + ":names"
+}
+
+// Add writes all of points in one round trip
+func (rl *RedisLeaderboard) Add(ctx context.Context, mode string, points []Points) error {
+	if len(points) == 0 {
+		return nil
+	}
+	names := make(map[string]interface{}, len(points))
+	pipe := rl.rdb.Pipeline()
+	for _, p := range points {
+		pipe.ZIncrBy(ctx, rl.key(mode), float64(p.Points), p.Account)
+		names[p.Account] = p.Name
+	}
+	pipe.HSet(ctx, rl.names(), names)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (rl *RedisLeaderboard) Top(ctx context.Context, mode string, n int) ([]Rank, error) {
+	if n <= 0 {
+		return []Rank{}, nil
+	}
+	zs, err := rl.rdb.ZRevRangeWithScores(ctx, rl.key(mode), 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ranks := make([]Rank, len(zs))
+	if len(zs) == 0 {
+		return ranks, nil
+	}
+	accounts := make([]string, len(zs))
+	for i, z := range zs {
+		accounts[i], _ = z.Member.(string)
+	}
+	names, err := rl.rdb.HMGet(ctx, rl.names(), accounts...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, z := range zs {
+		ranks[i] = Rank{Rank: i + 1, Account: accounts[i], Score: int64(z.Score)}
+		ranks[i].Name, _ = names[i].(string)
+		if i > 0 && ranks[i].Score == ranks[i-1].Score {
+			ranks[i].Rank = ranks[i-1].Rank
+		}
+	}
+	return ranks, nil
+}
+
+func (rl *RedisLeaderboard) Rank(ctx context.Context, mode, account string) (Rank, bool, error) {
+	r := Rank{Account: account}
+	score, err := rl.rdb.ZScore(ctx, rl.key(mode), account).Result()
+	if errors.Is(err, redis.Nil) {
+		return r, false, nil
+	}
+	if err != nil {
+		return r, false, err
+	}
+	r.Score = int64(score)
+	above, err := rl.rdb.ZCount(ctx, rl.key(mode), "("+strconv.FormatFloat(score, 'f', -1, 64), "+inf").Result()
+	if err != nil {
+		return r, false, err
+	}
+	r.Rank = int(above) + 1
+	r.Name, err = rl.rdb.HGet(ctx, rl.names(), account).Result()
+	if errors.Is(err, redis.Nil) {
+		err = nil
+	}
+	return r, true, err
+}
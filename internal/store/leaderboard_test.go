@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func testRedis(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return rdb, mr
+}
+
+func TestLeaderboardAdd(t *testing.T) {
+	rdb, mr := testRedis(t)
+	board := NewRedisLeaderboard(rdb, "leaderboard")
+	ctx := context.Background()
+	if err := board.Add(ctx, "ffa", []Points{{Account: "a", Name: "Ann", Points: 2}, {Account: "b", Name: "Bob", Points: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// points add up, and the latest name sticks
+	if err := board.Add(ctx, "ffa", []Points{{Account: "a", Name: "Annie", Points: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := board.Add(ctx, "ffa", nil); err != nil {
+		t.Fatal(err)
+	}
+	r, ok, err := board.Rank(ctx, "ffa", "a")
+	if err != nil || !ok || r != (Rank{Rank: 1, Account: "a", Name: "Annie", Score: 5}) {
+		t.Fatalf("got %+v, %v, %v", r, ok, err)
+	}
+	if score, _ := mr.ZScore("leaderboard:ffa", "a"); score != 5 {
+		t.Fatalf("stored %v", score)
+	}
+
+	// each mode has a board of its own
+	if _, ok, err := board.Rank(ctx, "tag", "a"); ok || err != nil {
+		t.Fatalf("ranked on the tag board: %v, %v", ok, err)
+	}
+	if top, err := board.Top(ctx, "tag", 10); err != nil || top == nil || len(top) != 0 {
+		t.Fatalf("empty board %+v, %v", top, err)
+	}
+	if top, err := board.Top(ctx, "ffa", 0); err != nil || top == nil || len(top) != 0 {
+		t.Fatalf("top 0 %+v, %v", top, err)
+	}
+}
+
+func TestLeaderboardTies(t *testing.T) {
+	rdb, _ := testRedis(t)
+	board := NewRedisLeaderboard(rdb, "leaderboard")
+	ctx := context.Background()
+	err := board.Add(ctx, "ffa", []Points{
+		{Account: "a", Name: "Ann", Points: 5},
+		{Account: "b", Name: "Bob", Points: 9},
+		{Account: "c", Name: "Cat", Points: 5},
+		{Account: "d", Name: "Dan", Points: 5},
+		{Account: "e", Name: "Eve", Points: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := board.Top(ctx, "ffa", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ties share a rank and the next one down skips past them; among
+	// themselves they come in reverse order of account, as redis has it
+	want := []Rank{
+		{1, "b", "Bob", 9},
+		{2, "d", "Dan", 5},
+		{2, "c", "Cat", 5},
+		{2, "a", "Ann", 5},
+		{5, "e", "Eve", 2},
+	}
+	if !reflect.DeepEqual(top, want) {
+		t.Fatalf("top %+v, want %+v", top, want)
+	}
+	// a limit cuts through a tie without changing the rank
+	if top, _ := board.Top(ctx, "ffa", 3); !reflect.DeepEqual(top, want[:3]) {
+		t.Fatalf("top 3 %+v", top)
+	}
+	for _, w := range want {
+		if r, ok, err := board.Rank(ctx, "ffa", w.Account); err != nil || !ok || r != w {
+			t.Fatalf("rank of %s %+v, want %+v", w.Account, r, w)
+		}
+	}
+}
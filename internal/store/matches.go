@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Matches keeps records of finished matches, already encoded, the latest
+// few of each game mode
+type Matches interface {
+	// Add keeps data as match id of mode, dropping the mode's oldest
+	// matches past the ones kept
+	Add(ctx context.Context, mode, id string, data []byte) error
+	// Recent returns up to n of the mode's latest matches, newest first
+	Recent(ctx context.Context, mode string, n int) ([][]byte, error)
+	// Get returns match id, ok false when there is none or it was dropped
+	Get(ctx context.Context, id string) (data []byte, ok bool, err error)
+}
+
+// RedisMatches keeps each record in a key of its own, which expires after
+// ttl when it is set, and the ids of each mode's latest keep matches in a
+// list
+type RedisMatches struct {
+	rdb    redis.Cmdable
+	prefix string
+	keep   int
+	ttl    time.Duration
+}
+
+// NewRedisMatches keeps records as prefix:match:<id> and lists as
+// prefix:<mode>. A ttl of zero keeps records until keep newer ones of their
+// mode push them out.
+func NewRedisMatches(rdb redis.Cmdable, prefix string, keep int, ttl time.Duration) *RedisMatches {
+	return &RedisMatches{rdb: rdb, prefix: prefix, keep: keep, ttl: ttl}
+}
+
+func (rm *RedisMatches) key(id string) string {
+	return rm.prefix + ":match:" + id
+}
+
+func (rm *RedisMatches) list(mode string) string {
+	return rm.prefix + ":" + mode
+}
+
+// Add writes the record and trims the list in one round trip, then deletes
+// the records trimmed off it in another
+func (rm *RedisMatches) Add(ctx context.Context, mode, id string, data []byte) error {
+	pipe := rm.rdb.Pipeline()
+	pipe.Set(ctx, rm.key(id), data, rm.ttl)
+	pipe.LPush(ctx, rm.list(mode), id)
+	trimmed := pipe.LRange(ctx, rm.list(mode), int64(rm.keep), -1)
+	pipe.LTrim(ctx, rm.list(mode), 0, int64(rm.keep-1))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if len(trimmed.Val()) == 0 {
+		return nil
+	}
+	// one key at a time, as they needn't share a cluster slot
+	pipe = rm.rdb.Pipeline()
+	for _, old := range trimmed.Val() {
+		pipe.Del(ctx, rm.key(old))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (rm *RedisMatches) Recent(ctx context.Context, mode string, n int) ([][]byte, error) {
+	if n <= 0 {
+		return [][]byte{}, nil
+	}
+	ids, err := rm.rdb.LRange(ctx, rm.list(mode), 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([][]byte, 0, len(ids))
+	if len(ids) == 0 {
+		return records, nil
+	}
+	pipe := rm.rdb.Pipeline()
+	gets := make([]*redis.StringCmd, len(ids))
+	for i, id := range ids {
+		gets[i] = pipe.Get(ctx, rm.key(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	for _, get := range gets {
+		// expired, or trimmed by an Add racing with this
+		data, err := get.Bytes()
+		if err == nil {
+			records = append(records, data)
+		}
+	}
+	return records, nil
+}
+
+func (rm *RedisMatches) Get(ctx context.Context, id string) ([]byte, bool, error) {
+	data, err := rm.rdb.Get(ctx, rm.key(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	return data, err == nil, err
+}
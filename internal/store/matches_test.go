@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recent is the records Recent returns as strings
+func recent(t *testing.T, matches *RedisMatches, mode string, n int) []string {
+	t.Helper()
+	records, err := matches.Recent(context.Background(), mode, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, data := range records {
+		got = append(got, string(data))
+	}
+	return got
+}
+
+func TestMatches(t *testing.T) {
+	rdb, _ := testRedis(t)
+	matches := NewRedisMatches(rdb, "matches", 10, 0)
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		if err := matches.Add(ctx, "ffa", fmt.Sprint(i), []byte(fmt.Sprint("ffa ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := matches.Add(ctx, "tag", "4", []byte("tag 4")); err != nil {
+		t.Fatal(err)
+	}
+
+	// newest first, one list per mode
+	if got := recent(t, matches, "ffa", 10); !reflect.DeepEqual(got, []string{"ffa 3", "ffa 2", "ffa 1"}) {
+		t.Fatalf("ffa %v", got)
+	}
+	if got := recent(t, matches, "ffa", 2); !reflect.DeepEqual(got, []string{"ffa 3", "ffa 2"}) {
+		t.Fatalf("ffa, 2 of them %v", got)
+	}
+	if got := recent(t, matches, "tag", 10); !reflect.DeepEqual(got, []string{"tag 4"}) {
+		t.Fatalf("tag %v", got)
+	}
+	if got := recent(t, matches, "ctf", 10); len(got) != 0 {
+		t.Fatalf("ctf %v", got)
+	}
+	if got := recent(t, matches, "ffa", 0); len(got) != 0 {
+		t.Fatalf("none asked for, got %v", got)
+	}
+
+	// any of them by id, whatever the mode
+	for id, want := range map[string]string{"1": "ffa 1", "4": "tag 4"} {
+		if data, ok, err := matches.Get(ctx, id); err != nil || !ok || string(data) != want {
+			t.Fatalf("match %s: %q, %v, %v", id, data, ok, err)
+		}
+	}
+	if _, ok, err := matches.Get(ctx, "5"); ok || err != nil {
+		t.Fatalf("match 5: %v, %v", ok, err)
+	}
+}
+
+func TestMatchesExpire(t *testing.T) {
+	rdb, mr := testRedis(t)
+	matches := NewRedisMatches(rdb, "matches", 10, time.Hour)
+	ctx := context.Background()
+	if err := matches.Add(ctx, "ffa", "1", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(30 * time.Minute)
+	if err := matches.Add(ctx, "ffa", "2", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(30 * time.Minute)
+	// the list still has the expired id, which is skipped
+	if got := recent(t, matches, "ffa", 10); !reflect.DeepEqual(got, []string{"new"}) {
+		t.Fatalf("ffa %v", got)
+	}
+	if _, ok, err := matches.Get(ctx, "1"); ok || err != nil {
+		t.Fatalf("expired match: %v, %v", ok, err)
+	}
+}
+
+func TestMatchesKeep(t *testing.T) {
+	rdb, mr := testRedis(t)
+	const keep = 3
+	matches := NewRedisMatches(rdb, "matches", keep, 0)
+	ctx := context.Background()
+	add := func(i int) {
+		t.Helper()
+		if err := matches.Add(ctx, "ffa", fmt.Sprint(i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= keep; i++ {
+		add(i)
+	}
+	// exactly keep of them fit
+	if got := recent(t, matches, "ffa", 10); !reflect.DeepEqual(got, []string{"3", "2", "1"}) {
+		t.Fatalf("at the limit %v", got)
+	}
+
+	// one more pushes the oldest out, list and record both
+	add(keep + 1)
+	if got := recent(t, matches, "ffa", 10); !reflect.DeepEqual(got, []string{"4", "3", "2"}) {
+		t.Fatalf("past the limit %v", got)
+	}
+	if n, _ := rdb.LLen(ctx, "matches:ffa").Result(); n != keep {
+		t.Fatalf("list of %d, want %d", n, keep)
+	}
+	if mr.Exists("matches:match:1") {
+		t.Fatal("the oldest record is still kept")
+	}
+	if _, ok, err := matches.Get(ctx, "1"); ok || err != nil {
+		t.Fatalf("oldest match: %v, %v", ok, err)
+	}
+	if _, ok, _ := matches.Get(ctx, "2"); !ok {
+		t.Fatal("the oldest kept match is gone")
+	}
+	// other modes are trimmed on their own
+	if err := matches.Add(ctx, "tag", "5", []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	if got := recent(t, matches, "ffa", 10); len(got) != keep {
+		t.Fatalf("ffa %v after a tag match", got)
+	}
+}
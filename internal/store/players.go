@@ -0,0 +1,137 @@
+// Package store keeps in redis what has to outlive a connection or the
+// instance it was on.
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrRotated is returned by Load for a token that Rotate replaced
+var ErrRotated = errors.New("resume token was rotated")
+
+// Player is what is kept of a player while they are away, enough to put
+// them back where they were in their room
+type Player struct {
+	ID      string
+	Room    string
+	Account string
+	Name    string
+	Color   string
+	X, Y    float64
+	Score   int
+	// when the token stops being good, set by Save
+	Expires time.Time
+}
+
+// Players keeps players by resume token for a while after they were last
+// saved, so a player can resume on any instance. Tokens are secrets:
+// implementations mustn't log them or keep them where they can be read back.
+type Players interface {
+	// Save keeps p under token for ttl
+	Save(ctx context.Context, token string, p Player, ttl time.Duration) error
+	// Load returns the player kept under token, ok false when there is
+	// none or it expired, and ErrRotated when it was rotated away
+	Load(ctx context.Context, token string) (p Player, ok bool, err error)
+	// Rotate keeps p under token in place of old, which Load tells apart
+	// from a token it never had for ttl
+	Rotate(ctx context.Context, old, token string, p Player, ttl time.Duration) error
+	// Forget drops the player kept under token
+	Forget(ctx context.Context, token string) error
+}
+
+// RedisPlayers keeps each player in a hash of its own, so it can expire on
+// its own. Keys are named by a digest of the token rather than the token,
+// so whoever can list the keys still can't resume as anyone.
+type RedisPlayers struct {
+	rdb    redis.Cmdable
+	prefix string
+}
+
+// NewRedisPlayers stores players as prefix:<sha256 of token>
+func NewRedisPlayers(rdb redis.Cmdable, prefix string) *RedisPlayers {
+	return &RedisPlayers{rdb: rdb, prefix: prefix}
+}
+
+func (rp *RedisPlayers) key(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return rp.prefix + ":" + hex.EncodeToString(sum[:])
+}
+
+func (rp *RedisPlayers) Save(ctx context.Context, token string, p Player, ttl time.Duration) error {
+	pipe := rp.rdb.TxPipeline()
+	rp.save(ctx, pipe, token, p, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Rotate leaves a hash with only a rotated field under old. The two keys
+// needn't share a cluster slot, so they are written one after the other,
+// token first: in between, and for good if the second write fails, old
+// loads as p too. Trying again after an error is safe.
+func (rp *RedisPlayers) Rotate(ctx context.Context, old, token string, p Player, ttl time.Duration) error {
+	if err := rp.Save(ctx, token, p, ttl); err != nil {
+		return err
+	}
+	pipe := rp.rdb.TxPipeline()
+	pipe.Del(ctx, rp.key(old))
+	pipe.HSet(ctx, rp.key(old), "rotated", 1)
+	pipe.PExpire(ctx, rp.key(old), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (rp *RedisPlayers) save(ctx context.Context, pipe redis.Pipeliner, token string, p Player, ttl time.Duration) {
+	key := rp.key(token)
+	pipe.HSet(ctx, key, map[string]interface{}{
+		"id":      p.ID,
+		"room":    p.Room,
+		"account": p.Account,
+		"name":    p.Name,
+		"color":   p.Color,
+		"x":       strconv.FormatFloat(p.X, 'g', -1, 64),
+		"y":       strconv.FormatFloat(p.Y, 'g', -1, 64),
+		"score":   p.Score,
+		"expires": time.Now().Add(ttl).UnixNano() / int64(time.Millisecond),
+	})
+	pipe.PExpire(ctx, key, ttl)
+}
+
+func (rp *RedisPlayers) Load(ctx context.Context, token string) (Player, bool, error) {
+	var p Player
+	fields, err := rp.rdb.HGetAll(ctx, rp.key(token)).Result()
+	if err != nil || len(fields) == 0 {
+		return p, false, err
+	}
+	if fields["rotated"] != "" {
+		return p, false, ErrRotated
+	}
+	p.ID = fields["id"]
+	p.Room = fields["room"]
+	p.Account = fields["account"]
+	p.Name = fields["name"]
+	p.Color = fields["color"]
+	// a field that doesn't parse comes back as zero rather than losing
+	// the player altogether
+	p.X, _ = strconv.ParseFloat(fields["x"], 64)
+	p.Y, _ = strconv.ParseFloat(fields["y"], 64)
+	p.Score, _ = strconv.Atoi(fields["score"])
+	// the key's ttl should have seen to this, but a player outliving it
+	// mustn't resume
+	ms, err := strconv.ParseInt(fields["expires"], 10, 64)
+	if err != nil {
+		return p, false, nil
+	}
+	p.Expires = time.Unix(0, ms*int64(time.Millisecond))
+	return p, p.ID != "" && p.Room != "" && time.Now().Before(p.Expires), nil
+}
+
+func (rp *RedisPlayers) Forget(ctx context.Context, token string) error {
+	return rp.rdb.Del(ctx, rp.key(token)).Err()
+}
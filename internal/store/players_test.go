@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const token = "0123456789abcdef0123456789abcdef"
+
+func TestPlayers(t *testing.T) {
+	rdb, mr := testRedis(t)
+	players := NewRedisPlayers(rdb, "player")
+	ctx := context.Background()
+	want := Player{ID: "a", Room: "lobby", Account: "acct", Name: "Ann", Color: "#e6194b", X: 123.25, Y: 0.5, Score: 7}
+	if err := players.Save(ctx, token, want, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	p, ok, err := players.Load(ctx, token)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if until := time.Until(p.Expires); until <= 0 || until > time.Minute {
+		t.Fatalf("expires in %s, want within a minute", until)
+	}
+	p.Expires = time.Time{}
+	if p != want {
+		t.Fatalf("loaded %+v, want %+v", p, want)
+	}
+
+	// the key is a digest of the token, and nothing stored gives it away
+	keys := mr.Keys()
+	if len(keys) != 1 || !strings.HasPrefix(keys[0], "player:") {
+		t.Fatalf("keys %v", keys)
+	}
+	fields, _ := mr.HKeys(keys[0])
+	for _, f := range append(fields, keys[0]) {
+		if strings.Contains(f, token) || strings.Contains(mr.HGet(keys[0], f), token) {
+			t.Fatalf("%q holds the token", f)
+		}
+	}
+
+	if _, ok, err := players.Load(ctx, "fedcba9876543210"); ok || err != nil {
+		t.Fatalf("loaded another token: %v, %v", ok, err)
+	}
+	if err := players.Forget(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := players.Load(ctx, token); ok || err != nil {
+		t.Fatalf("loaded a forgotten token: %v, %v", ok, err)
+	}
+}
+
+func TestPlayerExpires(t *testing.T) {
+	rdb, mr := testRedis(t)
+	players := NewRedisPlayers(rdb, "player")
+	ctx := context.Background()
+	if err := players.Save(ctx, token, Player{ID: "a", Room: "lobby"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(time.Minute)
+	if _, ok, err := players.Load(ctx, token); ok || err != nil {
+		t.Fatalf("loaded after its ttl: %v, %v", ok, err)
+	}
+
+	// a hash outliving its expiry, say with a ttl set wrong, doesn't load
+	// either
+	if err := players.Save(ctx, token, Player{ID: "a", Room: "lobby"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	key := mr.Keys()[0]
+	mr.SetTTL(key, time.Hour)
+	mr.HSet(key, "expires", "1")
+	if _, ok, err := players.Load(ctx, token); ok || err != nil {
+		t.Fatalf("loaded past its expiry: %v, %v", ok, err)
+	}
+	// and nor does one missing who or where the player is
+	mr.HSet(key, "expires", "99999999999999", "room", "")
+	if _, ok, err := players.Load(ctx, token); ok || err != nil {
+		t.Fatalf("loaded without a room: %v, %v", ok, err)
+	}
+}
+
+func TestPlayerRotate(t *testing.T) {
+	rdb, mr := testRedis(t)
+	players := NewRedisPlayers(rdb, "player")
+	ctx := context.Background()
+	const rotated = "fedcba9876543210fedcba9876543210"
+	p := Player{ID: "a", Room: "lobby", Name: "Ann", Score: 3}
+	if err := players.Save(ctx, token, p, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(8 * time.Second)
+	p.Score = 4
+	if err := players.Rotate(ctx, token, rotated, p, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the spent token stops resolving, and says why
+	if _, ok, err := players.Load(ctx, token); ok || !errors.Is(err, ErrRotated) {
+		t.Fatalf("spent token: %v, %v, want ErrRotated", ok, err)
+	}
+	got, ok, err := players.Load(ctx, rotated)
+	if err != nil || !ok || got.ID != "a" || got.Score != 4 {
+		t.Fatalf("new token: %+v, %v, %v", got, ok, err)
+	}
+	// the new one lasts the ttl it was rotated with, not what the old one
+	// had left
+	if until := time.Until(got.Expires); until <= 8*time.Second {
+		t.Fatalf("new token expires in %s, want the full 10s", until)
+	}
+	if ttl := mr.TTL(players.key(rotated)); ttl != 10*time.Second {
+		t.Fatalf("new token's key lives %s, want 10s", ttl)
+	}
+	mr.FastForward(9 * time.Second)
+	if _, ok, _ := players.Load(ctx, rotated); !ok {
+		t.Fatal("new token gone when the old one would have been")
+	}
+	if _, _, err := players.Load(ctx, token); !errors.Is(err, ErrRotated) {
+		t.Fatalf("spent token resolving again: %v", err)
+	}
+
+	// after the ttl both are gone, the spent one's marker included
+	mr.FastForward(time.Second)
+	if _, ok, err := players.Load(ctx, rotated); ok || err != nil {
+		t.Fatalf("new token after its ttl: %v, %v", ok, err)
+	}
+	if _, ok, err := players.Load(ctx, token); ok || err != nil {
+		t.Fatalf("spent token after the ttl: %v, %v", ok, err)
+	}
+}